@@ -0,0 +1,668 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"greenlight.yp2743.me/internal/data"
+	"greenlight.yp2743.me/internal/validator"
+)
+
+// createUserHandler provisions a user which is activated on creation, bypassing the
+// self-service registration and email activation flow.
+func (app *application) createUserHandler(w http.ResponseWriter, r *http.Request) {
+
+	var input struct {
+		Name             string   `json:"name"`
+		Email            string   `json:"email"`
+		Password         string   `json:"password"`
+		Permissions      []string `json:"permissions"`
+		SkipWelcomeEmail bool     `json:"skip_welcome_email"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := &data.User{
+		Name:      input.Name,
+		Email:     input.Email,
+		Password:  input.Password,
+		Activated: true,
+	}
+
+	v := validator.New()
+
+	data.ValidateUser(v, user)
+	v.Check(len(input.Permissions) <= data.Limits.Permissions, "permissions", fmt.Sprintf("must not contain more than %d permissions", data.Limits.Permissions))
+	v.Check(validator.Unique(input.Permissions), "permissions", "must not contain duplicate values")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if len(input.Permissions) > 0 {
+		unknown, err := app.modelsFor(r).Permissions.GetUnknown(input.Permissions)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if len(unknown) > 0 {
+			v.AddError("permissions", fmt.Sprintf("must only contain existing permissions, unknown: %s", strings.Join(unknown, ", ")))
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+	}
+
+	err = app.modelsFor(r).Transaction(func(tx data.Models) error {
+		err := tx.Users.Insert(user)
+		if err != nil {
+			return err
+		}
+
+		if len(input.Permissions) > 0 {
+			err = tx.Permissions.AddForUser(user.ID, input.Permissions...)
+			if err != nil {
+				return err
+			}
+		}
+
+		if input.SkipWelcomeEmail {
+			return nil
+		}
+
+		return tx.Outbox.Insert(&data.OutboxMessage{
+			Recipient: user.Email,
+			Template:  "user_provisioned.html",
+			Data: map[string]interface{}{
+				"userID": user.ID,
+			},
+		})
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateEmail):
+			v.AddError("email", "a user with this email address already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !input.SkipWelcomeEmail {
+		app.background(app.dispatchOutbox)
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateReadOnlyHandler(w http.ResponseWriter, r *http.Request) {
+
+	var input struct {
+		Enabled *bool `json:"enabled"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if v.Check(input.Enabled != nil, "enabled", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	app.readOnly.Store(*input.Enabled)
+	app.logger.PrintInfo("read-only mode updated", map[string]string{
+		"enabled": strconv.FormatBool(*input.Enabled),
+		"user_id": strconv.FormatInt(app.contextGetUser(r).ID, 10),
+	})
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"read_only": *input.Enabled}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// statsCache holds the most recently computed admin stats, since they change slowly
+// and are relatively expensive to compute.
+type statsCache struct {
+	mu      sync.Mutex
+	stats   *data.Stats
+	expires time.Time
+}
+
+func (app *application) adminStatsHandler(w http.ResponseWriter, r *http.Request) {
+	stats, err := app.cachedStats()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"stats": stats}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) cachedStats() (*data.Stats, error) {
+	app.stats.mu.Lock()
+	defer app.stats.mu.Unlock()
+
+	if app.stats.stats == nil || time.Now().After(app.stats.expires) {
+		stats, err := app.models.Stats.Get()
+		if err != nil {
+			return nil, err
+		}
+		app.stats.stats = stats
+		app.stats.expires = time.Now().Add(app.config.admin.statsCacheTTL)
+	}
+	return app.stats.stats, nil
+}
+
+const (
+	activationResendMaxBatch  = 500
+	activationResendPerSecond = 5
+)
+
+// resendPendingActivationsHandler queues a fresh activation email for each user who
+// hasn't activated their account, for when the original emails were lost. Tokens are
+// only stored hashed, so every user is issued a new token, replacing any they had. The
+// emails are staggered through the outbox so that the mail provider isn't flooded.
+func (app *application) resendPendingActivationsHandler(w http.ResponseWriter, r *http.Request) {
+
+	var input struct {
+		Limit *int `json:"limit"`
+	}
+
+	if r.Body != http.NoBody {
+		err := app.readJSON(w, r, &input)
+		if err != nil {
+			app.badRequestResponse(w, r, err)
+			return
+		}
+	}
+
+	limit := activationResendMaxBatch
+	if input.Limit != nil {
+		limit = *input.Limit
+	}
+
+	v := validator.New()
+	v.Check(limit > 0, "limit", "must be greater than zero")
+	v.Check(limit <= activationResendMaxBatch, "limit", fmt.Sprintf("must be a maximum of %d", activationResendMaxBatch))
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	users, err := app.modelsFor(r).Users.GetUnactivated(limit)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.modelsFor(r).Transaction(func(tx data.Models) error {
+		for i, user := range users {
+			err := tx.Tokens.DeleteAllForUser(data.ScopeActivation, user.ID)
+			if err != nil {
+				return err
+			}
+
+			err = tx.Outbox.Insert(&data.OutboxMessage{
+				Recipient: user.Email,
+				Template:  "user_welcome.html",
+				Data: map[string]interface{}{
+					"userID": user.ID,
+				},
+				Token: &data.OutboxToken{UserID: user.ID, Scope: data.ScopeActivation, Key: "activationToken"},
+				Delay: time.Duration(i) * time.Second / activationResendPerSecond,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.background(app.dispatchOutbox)
+
+	app.logger.PrintInfo("resending pending activations", map[string]string{
+		"admin_id": strconv.FormatInt(app.contextGetUser(r).ID, 10),
+		"queued":   strconv.Itoa(len(users)),
+	})
+
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"queued": len(users)}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// impersonateUserHandler issues a short-lived authentication token which lets the
+// calling admin act as another user. Each impersonation is recorded in the audit log,
+// which is also used to limit how often an admin can impersonate users.
+func (app *application) impersonateUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	admin := app.contextGetUser(r)
+
+	count, err := app.modelsFor(r).Audit.CountForActorSince(admin.ID, data.AuditActionImpersonate, time.Now().Add(-time.Hour))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	} else if count >= app.config.impersonation.hourlyLimit {
+		app.impersonationLimitExceededResponse(w, r)
+		return
+	}
+
+	user, err := app.modelsFor(r).Users.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	permissions, err := app.modelsFor(r).Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	} else if permissions.Include("admin") {
+		app.cannotImpersonateAdminResponse(w, r)
+		return
+	}
+
+	var token *data.Token
+	err = app.modelsFor(r).Transaction(func(tx data.Models) error {
+		var err error
+		token, err = tx.Tokens.NewImpersonation(user.ID, admin.ID, app.config.impersonation.ttl)
+		if err != nil {
+			return err
+		}
+
+		return tx.Audit.Insert(&data.AuditEntry{
+			ActorID:      admin.ID,
+			Action:       data.AuditActionImpersonate,
+			TargetUserID: user.ID,
+			Details: map[string]interface{}{
+				"expiry": token.Expiry,
+			},
+		})
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.logger.PrintInfo("admin impersonating user", map[string]string{
+		"admin_id": strconv.FormatInt(admin.ID, 10),
+		"user_id":  strconv.FormatInt(user.ID, 10),
+	})
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token, "impersonating": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// reactivateUserHandler reactivates an account its user deactivated. Their tokens were
+// deleted on deactivation, so they must log in again. Accounts which were never
+// activated can't be activated this way, as that would skip confirming their email.
+func (app *application) reactivateUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.getUser(w, r)
+	if !ok {
+		return
+	}
+
+	if user.DeactivatedAt == nil {
+		app.notDeactivatedResponse(w, r)
+		return
+	}
+
+	deactivatedAt := *user.DeactivatedAt
+	user.Activated = true
+	user.DeactivatedAt = nil
+
+	err := app.modelsFor(r).Transaction(func(tx data.Models) error {
+		err := tx.Users.Update(user)
+		if err != nil {
+			return err
+		}
+
+		return tx.Audit.Insert(&data.AuditEntry{
+			ActorID:      app.contextGetUser(r).ID,
+			Action:       data.AuditActionReactivate,
+			TargetUserID: user.ID,
+			Details: map[string]interface{}{
+				"deactivated_at": deactivatedAt,
+			},
+		})
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listTokensHandler lists tokens for the admin console, filtered by scope, user,
+// expiry window and whether they have expired. Plaintexts and hashes are never
+// returned.
+func (app *application) listTokensHandler(w http.ResponseWriter, r *http.Request) {
+
+	var input struct {
+		data.TokenFilter
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.TokenFilter.Scope = app.readString(qs, "scope", "")
+	input.TokenFilter.UserID = int64(app.readInt(qs, "user_id", 0, v))
+	input.TokenFilter.Expired = app.readBool(qs, "expired", v)
+	input.TokenFilter.ExpiresAfter = app.readTime(qs, "expires_after", v)
+	input.TokenFilter.ExpiresBefore = app.readTime(qs, "expires_before", v)
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "-created_at")
+	input.Filters.SortSafelist = []string{"created_at", "expiry", "user_id", "-created_at", "-expiry", "-user_id"}
+
+	if input.TokenFilter.Scope != "" {
+		v.Check(validator.In(input.TokenFilter.Scope, data.Scopes()...), "scope", "invalid scope")
+	}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	tokens, metadata, err := app.modelsFor(r).Tokens.GetAll(input.TokenFilter, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	tokensMetadata := make([]data.TokenMetadata, 0, len(tokens))
+	for _, token := range tokens {
+		tokensMetadata = append(tokensMetadata, token.Metadata())
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"tokens": tokensMetadata, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listPermissionsHandler lists permission grants for the admin console, optionally
+// filtered by user and permission code.
+func (app *application) listPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+
+	var input struct {
+		UserID int64
+		Code   string
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.UserID = int64(app.readInt(qs, "user_id", 0, v))
+	input.Code = app.readString(qs, "code", "")
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "user_id")
+	input.Filters.SortSafelist = []string{"user_id", "code", "-user_id", "-code"}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	grants, metadata, err := app.modelsFor(r).Permissions.GetAllGrants(input.UserID, input.Code, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"permissions": grants, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// getUser loads the user identified by the :id route parameter, sending the
+// appropriate error response and returning false if they can't be found.
+func (app *application) getUser(w http.ResponseWriter, r *http.Request) (*data.User, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	user, err := app.modelsFor(r).Users.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+	return user, true
+}
+
+// showUserPermissionsHandler lists the permissions held by a user.
+func (app *application) showUserPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.getUser(w, r)
+	if !ok {
+		return
+	}
+
+	app.writeUserPermissions(w, r, user.ID)
+}
+
+// grantUserPermissionsHandler grants a user the permissions listed in the body, all of
+// which must exist. Permissions the user already holds are left as they are.
+func (app *application) grantUserPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	app.changeUserPermissions(w, r, data.AuditActionGrantPermissions, func(tx data.Models, userID int64, codes []string) error {
+		return tx.Permissions.AddForUser(userID, codes...)
+	})
+}
+
+// revokeUserPermissionsHandler revokes the permissions listed in the body from a user.
+// Permissions the user doesn't hold are ignored, but they must still exist.
+func (app *application) revokeUserPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	app.changeUserPermissions(w, r, data.AuditActionRevokePermissions, func(tx data.Models, userID int64, codes []string) error {
+		return tx.Permissions.RemoveForUser(userID, codes...)
+	})
+}
+
+// changeUserPermissions reads and validates a list of permission codes from the body,
+// applies change to the user identified by the :id parameter, and records it in the
+// audit log as action. It responds with the user's permissions afterwards.
+func (app *application) changeUserPermissions(w http.ResponseWriter, r *http.Request, action string, change func(tx data.Models, userID int64, codes []string) error) {
+	var input struct {
+		Permissions []string `json:"permissions"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(len(input.Permissions) > 0, "permissions", "must contain at least one permission")
+	v.Check(len(input.Permissions) <= data.Limits.Permissions, "permissions", fmt.Sprintf("must not contain more than %d permissions", data.Limits.Permissions))
+	v.Check(validator.Unique(input.Permissions), "permissions", "must not contain duplicate values")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	unknown, err := app.modelsFor(r).Permissions.GetUnknown(input.Permissions)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if len(unknown) > 0 {
+		v.AddError("permissions", fmt.Sprintf("must only contain existing permissions, unknown: %s", strings.Join(unknown, ", ")))
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, ok := app.getUser(w, r)
+	if !ok {
+		return
+	}
+
+	err = app.modelsFor(r).Transaction(func(tx data.Models) error {
+		err := change(tx, user.ID, input.Permissions)
+		if err != nil {
+			return err
+		}
+
+		return tx.Audit.Insert(&data.AuditEntry{
+			ActorID:      app.contextGetUser(r).ID,
+			Action:       action,
+			TargetUserID: user.ID,
+			Details: map[string]interface{}{
+				"permissions": input.Permissions,
+			},
+		})
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.writeUserPermissions(w, r, user.ID)
+}
+
+// listRolesHandler lists the roles which can be assigned to users, with the
+// permissions each one grants.
+func (app *application) listRolesHandler(w http.ResponseWriter, r *http.Request) {
+	roles, err := app.modelsFor(r).Roles.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"roles": roles}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// assignUserRoleHandler grants a user every permission in the role named in the body.
+// The user ends up holding the permissions themselves, so revoking one later works as
+// usual, and changing a role doesn't affect the users it was assigned to. It responds
+// with the user's permissions afterwards.
+func (app *application) assignUserRoleHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Role string `json:"role"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(input.Role != "", "role", "must be provided")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, ok := app.getUser(w, r)
+	if !ok {
+		return
+	}
+
+	err = app.modelsFor(r).Transaction(func(tx data.Models) error {
+		err := tx.Roles.AssignToUser(user.ID, input.Role)
+		if err != nil {
+			return err
+		}
+
+		return tx.Audit.Insert(&data.AuditEntry{
+			ActorID:      app.contextGetUser(r).ID,
+			Action:       data.AuditActionAssignRole,
+			TargetUserID: user.ID,
+			Details: map[string]interface{}{
+				"role": input.Role,
+			},
+		})
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("role", "must be an existing role")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.writeUserPermissions(w, r, user.ID)
+}
+
+func (app *application) writeUserPermissions(w http.ResponseWriter, r *http.Request, userID int64) {
+	permissions, err := app.modelsFor(r).Permissions.GetAllForUser(userID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if permissions == nil {
+		permissions = data.Permissions{}
+	}
+	slices.Sort(permissions)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"permissions": permissions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
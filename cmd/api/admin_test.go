@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"greenlight.yp2743.me/internal/data"
+)
+
+func TestListTokensHandler(t *testing.T) {
+	app := newTestDBApplication(t)
+	admin := newTestUser(t, app, "admin")
+	user := newTestUser(t, app)
+
+	live, err := app.models.Tokens.New(user.ID, time.Hour, data.ScopeAuthentication)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := app.models.Tokens.New(user.ID, -time.Hour, data.ScopeAuthentication)
+	if err != nil {
+		t.Fatal(err)
+	}
+	activation, err := app.models.Tokens.New(user.ID, time.Hour, data.ScopeActivation)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query      string
+		wantExpiry []time.Time
+	}{
+		{"scope=authentication", []time.Time{live.Expiry, expired.Expiry}},
+		{"scope=authentication&expired=true", []time.Time{expired.Expiry}},
+		{"scope=authentication&expired=false", []time.Time{live.Expiry}},
+		{"scope=activation", []time.Time{activation.Expiry}},
+		{"expires_before=" + time.Now().UTC().Format(time.RFC3339), []time.Time{expired.Expiry}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			url := fmt.Sprintf("/v1/admin/tokens?user_id=%d&sort=-expiry&%s", user.ID, tt.query)
+			rr := serveAs(app, app.listTokensHandler, admin, httptest.NewRequest(http.MethodGet, url, nil))
+			if rr.Code != http.StatusOK {
+				t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusOK, rr.Body)
+			}
+
+			var response struct {
+				Tokens []data.TokenMetadata `json:"tokens"`
+			}
+			err := json.Unmarshal(rr.Body.Bytes(), &response)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(response.Tokens) != len(tt.wantExpiry) {
+				t.Fatalf("got %d tokens; want %d: %s", len(response.Tokens), len(tt.wantExpiry), rr.Body)
+			}
+			for i, token := range response.Tokens {
+				if int64(token.UserID) != user.ID || !token.Expiry.Round(time.Millisecond).Equal(tt.wantExpiry[i].Round(time.Millisecond)) {
+					t.Errorf("token %d: got %+v; want expiry %s", i, token, tt.wantExpiry[i])
+				}
+			}
+		})
+	}
+
+	t.Run("no secrets", func(t *testing.T) {
+		url := fmt.Sprintf("/v1/admin/tokens?user_id=%d", user.ID)
+		rr := serveAs(app, app.listTokensHandler, admin, httptest.NewRequest(http.MethodGet, url, nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusOK, rr.Body)
+		}
+
+		body := rr.Body.String()
+		for _, token := range []*data.Token{live, expired, activation} {
+			for _, secret := range []string{token.Plaintext, hex.EncodeToString(token.Hash), base64.StdEncoding.EncodeToString(token.Hash)} {
+				if strings.Contains(body, secret) {
+					t.Errorf("response contains a token secret: %s", body)
+				}
+			}
+		}
+		if strings.Contains(body, `"hash"`) || strings.Contains(body, `"token"`) {
+			t.Errorf("response has a secret field: %s", body)
+		}
+	})
+}
+
+func TestListPermissionsHandler(t *testing.T) {
+	app := newTestDBApplication(t)
+	admin := newTestUser(t, app, "admin")
+	user := newTestUser(t, app, "movies:read", "movies:write")
+
+	tests := []struct {
+		query     string
+		wantCodes []string
+	}{
+		{"", []string{"movies:read", "movies:write"}},
+		{"code=movies:write", []string{"movies:write"}},
+		{"code=admin", []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			url := fmt.Sprintf("/v1/admin/permissions?user_id=%d&sort=code&%s", user.ID, tt.query)
+			rr := serveAs(app, app.listPermissionsHandler, admin, httptest.NewRequest(http.MethodGet, url, nil))
+			if rr.Code != http.StatusOK {
+				t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusOK, rr.Body)
+			}
+
+			var response struct {
+				Permissions []data.PermissionGrant `json:"permissions"`
+			}
+			err := json.Unmarshal(rr.Body.Bytes(), &response)
+			if err != nil {
+				t.Fatal(err)
+			}
+			codes := []string{}
+			for _, grant := range response.Permissions {
+				if int64(grant.UserID) != user.ID || grant.Email != user.Email {
+					t.Errorf("got grant %+v for another user", grant)
+				}
+				codes = append(codes, grant.Code)
+			}
+			if strings.Join(codes, ",") != strings.Join(tt.wantCodes, ",") {
+				t.Errorf("got codes %v; want %v", codes, tt.wantCodes)
+			}
+		})
+	}
+}
+
+func TestGrantUserPermissionsTwice(t *testing.T) {
+	app := newTestDBApplication(t)
+	admin := newTestUser(t, app, "admin:permissions")
+	user := newTestUser(t, app, "movies:read")
+
+	// Granting an already-held permission, directly or through the API, is a no-op.
+	err := app.models.Permissions.AddForUser(user.ID, "movies:read")
+	if err != nil {
+		t.Fatalf("re-granting a held permission: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"permissions": ["movies:read", "movies:write"]}`))
+		rr := serveAs(app, app.grantUserPermissionsHandler, admin, withID(r, user.ID))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("grant %d: got status %d; want %d: %s", i+1, rr.Code, http.StatusOK, rr.Body)
+		}
+	}
+
+	query := `SELECT permissions.code, count(*)
+			FROM users_permissions
+			JOIN permissions ON permissions.id = users_permissions.permission_id
+			WHERE users_permissions.user_id = $1
+			GROUP BY permissions.code`
+	rows, err := app.models.Movies.DB.Query(context.Background(), query, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	counts := map[string]int{}
+	for rows.Next() {
+		var code string
+		var n int
+		err := rows.Scan(&code, &n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[code] = n
+	}
+	if err = rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(counts) != 2 || counts["movies:read"] != 1 || counts["movies:write"] != 1 {
+		t.Errorf("got grants %v; want a single row for each permission", counts)
+	}
+}
+
+func TestResendPendingActivationsHandler(t *testing.T) {
+	app := newTestDBApplication(t)
+	app.mailer = &testMailer{}
+	admin := newTestUser(t, app, "admin")
+
+	activated := newTestUser(t, app)
+	pending := newTestUser(t, app)
+	pending.Activated = false
+	deactivated := newTestUser(t, app)
+	deactivated.Activated = false
+	now := time.Now()
+	deactivated.DeactivatedAt = &now
+	for _, user := range []*data.User{pending, deactivated} {
+		err := app.models.Users.Update(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Activate the pending user afterwards, so that later runs don't resend to them.
+	t.Cleanup(func() {
+		pending.Activated = true
+		app.models.Users.Update(pending)
+	})
+
+	r := httptest.NewRequest(http.MethodPost, "/v1/admin/resend-pending-activations", nil)
+	rr := serveAs(app, app.resendPendingActivationsHandler, admin, r)
+	app.drainBackgroundTasks(5 * time.Second)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusAccepted, rr.Body)
+	}
+
+	var response struct {
+		Queued int `json:"queued"`
+	}
+	err := json.Unmarshal(rr.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Queued < 1 {
+		t.Errorf("got %d queued; want at least 1", response.Queued)
+	}
+
+	for _, tt := range []struct {
+		user *data.User
+		want int
+	}{
+		{activated, 0},
+		{pending, 1},
+		{deactivated, 0},
+		{admin, 0},
+	} {
+		var queued int
+		err := app.models.Movies.DB.QueryRow(context.Background(),
+			`SELECT count(*) FROM outbox WHERE recipient = $1`, tt.user.Email).Scan(&queued)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if queued != tt.want {
+			t.Errorf("%s: got %d emails queued; want %d", tt.user.Email, queued, tt.want)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+const aggregatesBatchSize = 500
+
+// startAggregateRecompute runs recomputeAggregates in the background, unless a run is
+// already in progress, and reports whether it started one.
+func (app *application) startAggregateRecompute() bool {
+	if !app.recomputingAggregates.CompareAndSwap(false, true) {
+		return false
+	}
+
+	app.background(func() {
+		defer app.recomputingAggregates.Store(false)
+		app.recomputeAggregates()
+	})
+	return true
+}
+
+// recomputeAggregates recomputes every movie's average rating and review count from
+// its ratings, correcting those which have drifted. It works through the movies in
+// batches, logging its progress after each one, and stops between batches when the
+// application begins shutting down.
+func (app *application) recomputeAggregates() {
+	var lastID, corrected int64
+	for {
+		next, n, err := app.models.Movies.RecomputeAggregates(lastID, aggregatesBatchSize)
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{
+				"last_movie_id": strconv.FormatInt(lastID, 10),
+				"corrected":     strconv.FormatInt(corrected, 10),
+			})
+			return
+		}
+		if next == 0 {
+			break
+		}
+		lastID, corrected = next, corrected+n
+
+		app.logger.PrintInfo("recomputing aggregates", map[string]string{
+			"last_movie_id": strconv.FormatInt(lastID, 10),
+			"corrected":     strconv.FormatInt(corrected, 10),
+		})
+
+		select {
+		case <-app.shutdown:
+			return
+		default:
+		}
+	}
+
+	app.logger.PrintInfo("recomputed aggregates", map[string]string{
+		"corrected": strconv.FormatInt(corrected, 10),
+	})
+}
+
+// recomputeAggregatesHandler starts a recomputation of the movie aggregates, for when
+// they're known to have drifted, rather than waiting for the next scheduled run.
+func (app *application) recomputeAggregatesHandler(w http.ResponseWriter, r *http.Request) {
+	if !app.startAggregateRecompute() {
+		app.errorResponse(w, r, http.StatusConflict, "the aggregates are already being recomputed")
+		return
+	}
+
+	app.logger.PrintInfo("aggregate recomputation requested", map[string]string{
+		"admin_id": strconv.FormatInt(app.contextGetUser(r).ID, 10),
+	})
+
+	err := app.writeJSON(w, http.StatusAccepted, envelope{"message": "the aggregates are being recomputed"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRecomputeAggregatesHandlerAlreadyRunning(t *testing.T) {
+	app := newTestApplication(t)
+	app.recomputingAggregates.Store(true)
+
+	rr := serveAs(app, app.recomputeAggregatesHandler, nil, httptest.NewRequest(http.MethodPost, "/v1/admin/recompute-aggregates", nil))
+	if rr.Code != http.StatusConflict {
+		t.Errorf("got status %d; want %d", rr.Code, http.StatusConflict)
+	}
+}
+
+func TestRecomputeAggregatesCorrectsDrift(t *testing.T) {
+	app := newTestDBApplication(t)
+	admin := newTestUser(t, app, "admin")
+	movie := newTestMovie(t, app, admin)
+
+	ctx := context.Background()
+	for _, rating := range []struct {
+		stars  int
+		review string
+	}{{5, "Loved it"}, {4, ""}, {2, "Too long"}} {
+		user := newTestUser(t, app)
+		_, err := app.models.Movies.DB.Exec(ctx, `INSERT INTO ratings (movie_id, user_id, rating, review) VALUES ($1, $2, $3, $4)`,
+			movie.ID, user.ID, rating.stars, rating.review)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Corrupt the aggregates, as a missed update would.
+	_, err := app.models.Movies.DB.Exec(ctx, `UPDATE movies SET average_rating = 1.5, review_count = 99 WHERE id = $1`, movie.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := serveAs(app, app.recomputeAggregatesHandler, admin, httptest.NewRequest(http.MethodPost, "/v1/admin/recompute-aggregates", nil))
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusAccepted, rr.Body)
+	}
+	app.drainBackgroundTasks(30 * time.Second)
+
+	var average float64
+	var reviews, version int
+	err = app.models.Movies.DB.QueryRow(ctx, `SELECT average_rating, review_count, version FROM movies WHERE id = $1`, movie.ID).Scan(&average, &reviews, &version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if average != 3.67 || reviews != 2 {
+		t.Errorf("got average rating %v and %d reviews; want 3.67 and 2", average, reviews)
+	}
+	if version != int(movie.Version) {
+		t.Errorf("got version %d; want %d unchanged", version, movie.Version)
+	}
+	if app.recomputingAggregates.Load() {
+		t.Error("recomputation still marked as running")
+	}
+}
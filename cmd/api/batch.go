@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"greenlight.yp2743.me/internal/data"
+)
+
+// Batch policies decide what happens to the rest of a batch when one item fails.
+// With all-or-nothing, any failure rolls back the whole batch; with best-effort, each
+// item is committed on its own.
+const (
+	batchAllOrNothing = "all-or-nothing"
+	batchBestEffort   = "best-effort"
+)
+
+// batchItemError marks an error as the failure of a single batch item, such as a
+// validation error or a conflict, rather than of the whole request. Its payload is
+// reported back in the item's result.
+type batchItemError struct {
+	payload interface{}
+}
+
+func (e batchItemError) Error() string {
+	return fmt.Sprintf("batch item failed: %v", e.payload)
+}
+
+// batchResult is the outcome of one item of a batch, identified by its index in the
+// request. Status is either "ok" or "error".
+type batchResult struct {
+	Index  int         `json:"index"`
+	Status string      `json:"status"`
+	Error  interface{} `json:"error,omitempty"`
+}
+
+type batchSummary struct {
+	OK     int `json:"ok"`
+	Failed int `json:"failed"`
+}
+
+// errBatchItemNotApplied is reported for the items of an all-or-nothing batch which
+// succeeded but were rolled back because others failed.
+const errBatchItemNotApplied = "not applied because another item in the batch failed"
+
+// batchReport accumulates the outcome of a batch as its items run. Only failures are
+// kept, in index order, so that the state kept while a batch runs grows with its
+// failures rather than its size; results expands them into a result for every item.
+type batchReport struct {
+	items      int
+	failures   []batchResult
+	rolledBack bool
+	summary    batchSummary
+}
+
+func (b *batchReport) fail(index int, payload interface{}) {
+	b.failures = append(b.failures, batchResult{Index: index, Status: "error", Error: payload})
+	b.summary.Failed++
+}
+
+// results returns the outcome of every item of the batch, in order.
+func (b *batchReport) results() []batchResult {
+	results := make([]batchResult, 0, b.items)
+	failures := b.failures
+	for i := 0; i < b.items; i++ {
+		if len(failures) > 0 && failures[0].Index == i {
+			results = append(results, failures[0])
+			failures = failures[1:]
+			continue
+		}
+
+		result := batchResult{Index: i, Status: "ok"}
+		if b.rolledBack {
+			result.Status = "error"
+			result.Error = errBatchItemNotApplied
+		}
+		results = append(results, result)
+	}
+
+	// A stop under best-effort is reported against the item that was being read,
+	// which never ran.
+	return append(results, failures...)
+}
+
+// batchStopError stops a batch part way through, for a reason which applies to the
+// rest of the batch rather than to a single item, such as a malformed request body.
+type batchStopError struct {
+	err error
+}
+
+func (e batchStopError) Error() string {
+	return fmt.Sprintf("batch stopped: %s", e.err)
+}
+
+func (e batchStopError) Unwrap() error {
+	return e.err
+}
+
+var errBatchRolledBack = errors.New("batch rolled back")
+
+// runBatch applies fn to the items of a batch under the configured batch policy. The
+// items are read in chunks: next is called with the models the batch runs in, and
+// returns the number of items in the following chunk, or 0 once there are none left.
+// Items are numbered across chunks.
+//
+// Item failures are reported as batchItemErrors; any other error aborts the batch and is
+// returned. Under all-or-nothing, each item runs in a savepoint so that the others are
+// still attempted and their failures reported, before the batch is rolled back.
+//
+// A batchStopError from next also aborts the batch, unless items have already been
+// committed under best-effort. The stop is then reported as the failure of the item
+// being read when it happened, and the results so far are returned.
+//
+// If an all-or-nothing batch is rolled back because of failures, every item is
+// reported as failed.
+func (app *application) runBatch(r *http.Request, next func(models data.Models) (int, error), fn func(tx data.Models, i int) error) (*batchReport, error) {
+	report := &batchReport{}
+
+	runItems := func(models data.Models) error {
+		for {
+			n, err := next(models)
+
+			var stop batchStopError
+			switch {
+			case errors.As(err, &stop) && app.config.batchPolicy == batchBestEffort && report.items > 0:
+				report.fail(report.items, stop.Error())
+				return nil
+			case err != nil:
+				return err
+			case n == 0:
+				return nil
+			}
+
+			for j := 0; j < n; j++ {
+				i := report.items
+				report.items++
+
+				err := models.Transaction(func(tx data.Models) error {
+					return fn(tx, i)
+				})
+
+				var itemErr batchItemError
+				switch {
+				case err == nil:
+					report.summary.OK++
+				case errors.As(err, &itemErr):
+					report.fail(i, itemErr.payload)
+				default:
+					return err
+				}
+			}
+		}
+	}
+
+	if app.config.batchPolicy == batchBestEffort {
+		err := runItems(app.modelsFor(r))
+		return report, err
+	}
+
+	err := app.modelsFor(r).Transaction(func(tx data.Models) error {
+		err := runItems(tx)
+		if err != nil {
+			return err
+		}
+		if report.summary.Failed > 0 {
+			return errBatchRolledBack
+		}
+		return nil
+	})
+	if errors.Is(err, errBatchRolledBack) {
+		report.rolledBack = true
+		report.summary = batchSummary{Failed: report.items}
+		return report, nil
+	}
+	return report, err
+}
+
+// batchStatus is the response status for a batch: 422 if nothing was applied because
+// of failures, and 200 otherwise, with any partial failures described in the results.
+func (app *application) batchStatus(summary batchSummary) int {
+	if summary.Failed > 0 && summary.OK == 0 {
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusOK
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+
+	"greenlight.yp2743.me/internal/data"
+)
+
+// writeMovieArray writes a JSON array of n movies to w, with titles made unique by the
+// prefix, and closes it.
+func writeMovieArray(w *io.PipeWriter, prefix string, n int) {
+	buf := []byte("[")
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		buf = fmt.Appendf(buf, `{"title":"%s %d","year":2000,"runtime_minutes":100,"genres":["drama"]}`, prefix, i)
+		if len(buf) > 32<<10 {
+			if _, err := w.Write(buf); err != nil {
+				return
+			}
+			buf = buf[:0]
+		}
+	}
+	buf = append(buf, ']')
+	w.Write(buf)
+	w.Close()
+}
+
+func heapInUse() uint64 {
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapAlloc
+}
+
+func TestRunBatchLargeArray(t *testing.T) {
+	const (
+		items     = 250_000
+		failEvery = 1_000
+	)
+
+	tests := []struct {
+		policy string
+		want   batchSummary
+	}{
+		{batchAllOrNothing, batchSummary{Failed: items}},
+		{batchBestEffort, batchSummary{OK: items - items/failEvery, Failed: items / failEvery}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			app := newTestApplication(t)
+			app.config.batchPolicy = tt.policy
+
+			pr, pw := io.Pipe()
+			go writeMovieArray(pw, "Large", items)
+
+			r := httptest.NewRequest(http.MethodPost, "/v1/movies/batch", pr)
+			body := app.newJSONArrayReader(httptest.NewRecorder(), r, movieBatchMaxBytes)
+
+			type movieInput struct {
+				Title          string   `json:"title"`
+				Year           int32    `json:"year"`
+				RuntimeMinutes int32    `json:"runtime_minutes"`
+				Genres         []string `json:"genres"`
+			}
+			var chunk []movieInput
+			next := func(models data.Models) (int, error) {
+				chunk = chunk[:0]
+				for len(chunk) < movieBatchChunkSize {
+					var input movieInput
+					more, err := body.next(&input)
+					if err != nil {
+						return 0, err
+					} else if !more {
+						break
+					}
+					chunk = append(chunk, input)
+				}
+				return len(chunk), nil
+			}
+
+			base := heapInUse()
+			var peak uint64
+			report, err := app.runBatch(r, next, func(tx data.Models, i int) error {
+				if i%(items/10) == 0 {
+					peak = max(peak, heapInUse())
+				}
+				if i%failEvery == 0 {
+					return batchItemError{"failed"}
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if report.summary != tt.want {
+				t.Errorf("got summary %+v; want %+v", report.summary, tt.want)
+			}
+			if len(report.failures) != items/failEvery {
+				t.Errorf("got %d failures; want %d", len(report.failures), items/failEvery)
+			}
+			for j, failure := range report.failures {
+				if failure.Index != j*failEvery {
+					t.Fatalf("got failure %d at index %d; want %d", j, failure.Index, j*failEvery)
+				}
+			}
+
+			// The array is over 20MB, so holding on to it or to a result for each
+			// successful item would show up well above this.
+			if peak > base && peak-base > 4<<20 {
+				t.Errorf("heap grew by %d bytes while the batch ran", peak-base)
+			}
+		})
+	}
+}
+
+func TestBatchReportResults(t *testing.T) {
+	tests := []struct {
+		name   string
+		report batchReport
+		want   []batchResult
+	}{
+		{
+			name: "mixed",
+			report: batchReport{items: 3, failures: []batchResult{
+				{Index: 1, Status: "error", Error: "invalid"},
+			}},
+			want: []batchResult{
+				{Index: 0, Status: "ok"},
+				{Index: 1, Status: "error", Error: "invalid"},
+				{Index: 2, Status: "ok"},
+			},
+		},
+		{
+			name: "rolled back",
+			report: batchReport{items: 3, rolledBack: true, failures: []batchResult{
+				{Index: 2, Status: "error", Error: "invalid"},
+			}},
+			want: []batchResult{
+				{Index: 0, Status: "error", Error: errBatchItemNotApplied},
+				{Index: 1, Status: "error", Error: errBatchItemNotApplied},
+				{Index: 2, Status: "error", Error: "invalid"},
+			},
+		},
+		{
+			name: "stopped",
+			report: batchReport{items: 1, failures: []batchResult{
+				{Index: 1, Status: "error", Error: "batch stopped"},
+			}},
+			want: []batchResult{
+				{Index: 0, Status: "ok"},
+				{Index: 1, Status: "error", Error: "batch stopped"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.report.results()
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("got %+v; want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateMoviesBatchHandler(t *testing.T) {
+	app := newTestDBApplication(t)
+	user := newTestUser(t, app, "movies:write")
+
+	const items = 2*movieBatchChunkSize + 50
+	prefix := fmt.Sprintf("Batch %s", user.Email)
+
+	defaultLimit := data.Limits.BatchItems
+	data.Limits.BatchItems = items
+	t.Cleanup(func() { data.Limits.BatchItems = defaultLimit })
+
+	pr, pw := io.Pipe()
+	go writeMovieArray(pw, prefix, items)
+
+	r := httptest.NewRequest(http.MethodPost, "/v1/movies/batch", pr)
+	rr := serveAs(app, app.createMoviesBatchHandler, user, r)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusCreated, rr.Body)
+	}
+
+	var response struct {
+		Movies  []data.Movie  `json:"movies"`
+		Results []batchResult `json:"results"`
+		Summary batchSummary  `json:"summary"`
+	}
+	err := json.NewDecoder(bytes.NewReader(rr.Body.Bytes())).Decode(&response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Summary != (batchSummary{OK: items}) || len(response.Results) != items || len(response.Movies) != items {
+		t.Fatalf("got %+v, %d results and %d movies; want %d created", response.Summary, len(response.Results), len(response.Movies), items)
+	}
+	for i, result := range response.Results {
+		if result.Index != i || result.Status != "ok" {
+			t.Fatalf("got result %+v at %d; want ok", result, i)
+		}
+	}
+	for i, movie := range response.Movies {
+		if movie.ID < 1 || movie.Title != fmt.Sprintf("%s %d", prefix, i) {
+			t.Fatalf("got movie %+v at %d; want %q with its ID", movie, i, fmt.Sprintf("%s %d", prefix, i))
+		}
+	}
+
+	for _, i := range []int{0, movieBatchChunkSize, items - 1} {
+		movie, err := app.models.Movies.GetByTitleYear(fmt.Sprintf("%s %d", prefix, i), 2000)
+		if err != nil {
+			t.Fatalf("movie %d: %v", i, err)
+		}
+		if movie.CreatedByID != user.ID || movie.Runtime != 100 {
+			t.Errorf("movie %d: got %+v", i, movie)
+		}
+	}
+}
+
+func TestCreateMoviesBatchHandlerMixed(t *testing.T) {
+	tests := []struct {
+		policy       string
+		wantStatus   int
+		wantSummary  batchSummary
+		wantStatuses []string
+		wantCreated  bool
+	}{
+		{batchAllOrNothing, http.StatusUnprocessableEntity, batchSummary{Failed: 4}, []string{"error", "error", "error", "error"}, false},
+		{batchBestEffort, http.StatusOK, batchSummary{OK: 2, Failed: 2}, []string{"ok", "error", "error", "ok"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			app := newTestDBApplication(t)
+			app.config.batchPolicy = tt.policy
+			user := newTestUser(t, app, "movies:write")
+
+			// The second item fails validation, and the third duplicates the first.
+			prefix := fmt.Sprintf("Mixed %s", user.Email)
+			body := fmt.Sprintf(`[
+				{"title": "%[1]s A", "year": 2000, "runtime_minutes": 100, "genres": ["drama"]},
+				{"title": "%[1]s X", "year": 0, "runtime_minutes": 100, "genres": ["drama"]},
+				{"title": "%[1]s A", "year": 2000, "runtime_minutes": 100, "genres": ["drama"]},
+				{"title": "%[1]s B", "year": 2000, "runtime_minutes": 100, "genres": ["drama"]}
+			]`, prefix)
+
+			r := httptest.NewRequest(http.MethodPost, "/v1/movies/batch", strings.NewReader(body))
+			rr := serveAs(app, app.createMoviesBatchHandler, user, r)
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("got status %d; want %d: %s", rr.Code, tt.wantStatus, rr.Body)
+			}
+
+			var response struct {
+				Movies  []data.Movie  `json:"movies"`
+				Results []batchResult `json:"results"`
+				Summary batchSummary  `json:"summary"`
+			}
+			err := json.Unmarshal(rr.Body.Bytes(), &response)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response.Summary != tt.wantSummary {
+				t.Errorf("got summary %+v; want %+v", response.Summary, tt.wantSummary)
+			}
+			if len(response.Results) != len(tt.wantStatuses) {
+				t.Fatalf("got results %+v; want %d", response.Results, len(tt.wantStatuses))
+			}
+			for i, result := range response.Results {
+				if result.Index != i || result.Status != tt.wantStatuses[i] {
+					t.Errorf("got result %+v at %d; want status %q", result, i, tt.wantStatuses[i])
+				}
+				if (result.Status == "error") != (result.Error != nil) {
+					t.Errorf("got result %+v at %d; want an error only if it failed", result, i)
+				}
+			}
+			if want := response.Summary.OK; len(response.Movies) != want {
+				t.Errorf("got %d movies; want %d", len(response.Movies), want)
+			}
+
+			for _, title := range []string{prefix + " A", prefix + " B"} {
+				_, err := app.models.Movies.GetByTitleYear(title, 2000)
+				switch {
+				case tt.wantCreated && err != nil:
+					t.Errorf("%q: %v; want it created", title, err)
+				case !tt.wantCreated && !errors.Is(err, data.ErrRecordNotFound):
+					t.Errorf("%q: got error %v; want it rolled back", title, err)
+				}
+			}
+		})
+	}
+}
+
+func TestCreateMoviesBatchHandlerTooMany(t *testing.T) {
+	app := newTestDBApplication(t)
+	user := newTestUser(t, app, "movies:write")
+	prefix := fmt.Sprintf("Too many %s", user.Email)
+
+	pr, pw := io.Pipe()
+	t.Cleanup(func() { pr.Close() })
+	go writeMovieArray(pw, prefix, data.Limits.BatchItems+1)
+
+	r := httptest.NewRequest(http.MethodPost, "/v1/movies/batch", pr)
+	rr := serveAs(app, app.createMoviesBatchHandler, user, r)
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusUnprocessableEntity, rr.Body)
+	}
+
+	_, err := app.models.Movies.GetByTitleYear(prefix+" 0", 2000)
+	if !errors.Is(err, data.ErrRecordNotFound) {
+		t.Errorf("got error %v; want the batch rolled back", err)
+	}
+}
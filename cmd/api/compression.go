@@ -0,0 +1,145 @@
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// negotiateEncoding picks the response encoding from an Accept-Encoding header,
+// preferring Brotli (when enabled) over gzip, and gzip over deflate. It returns "" for
+// identity.
+func negotiateEncoding(acceptEncoding string, brotliEnabled bool) string {
+	accepted := make(map[string]bool)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+
+		q := 1.0
+		if name, value, found := strings.Cut(strings.TrimSpace(params), "="); found && strings.TrimSpace(name) == "q" {
+			if f, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+				q = f
+			}
+		}
+		accepted[coding] = q > 0
+	}
+
+	switch {
+	case brotliEnabled && accepted["br"]:
+		return "br"
+	case accepted["gzip"]:
+		return "gzip"
+	case accepted["deflate"]:
+		return "deflate"
+	default:
+		return ""
+	}
+}
+
+// compressWriter buffers the start of a response until it knows whether the body
+// reaches the minimum size worth compressing, then either compresses it with the
+// negotiated encoding or writes it through unchanged.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	level    int
+	minSize  int
+
+	status  int
+	buf     []byte
+	decided bool
+	encoder io.WriteCloser
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.status == 0 {
+		cw.status = status
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+
+	if cw.decided {
+		if cw.encoder != nil {
+			return cw.encoder.Write(b)
+		}
+		return cw.ResponseWriter.Write(b)
+	}
+
+	cw.buf = append(cw.buf, b...)
+	if len(cw.buf) >= cw.minSize {
+		if err := cw.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// decide sends the header and any buffered body, setting up the encoder if the
+// response should be compressed.
+func (cw *compressWriter) decide(largeEnough bool) error {
+	cw.decided = true
+
+	// A handler which sets Content-Length has promised the client the body's exact
+	// size, so the body is sent as it is.
+	h := cw.Header()
+	if largeEnough && h.Get("Content-Encoding") == "" && h.Get("Content-Length") == "" && isCompressible(h.Get("Content-Type")) {
+		h.Set("Content-Encoding", cw.encoding)
+
+		switch cw.encoding {
+		case "br":
+			cw.encoder = brotli.NewWriterLevel(cw.ResponseWriter, cw.level)
+		case "gzip":
+			gz, err := gzip.NewWriterLevel(cw.ResponseWriter, cw.level)
+			if err != nil {
+				return err
+			}
+			cw.encoder = gz
+		case "deflate":
+			// The deflate content coding is the zlib format, not a raw deflate stream.
+			zw, err := zlib.NewWriterLevel(cw.ResponseWriter, cw.level)
+			if err != nil {
+				return err
+			}
+			cw.encoder = zw
+		}
+	}
+
+	cw.ResponseWriter.WriteHeader(cw.status)
+
+	var err error
+	if cw.encoder != nil {
+		_, err = cw.encoder.Write(cw.buf)
+	} else if len(cw.buf) > 0 {
+		_, err = cw.ResponseWriter.Write(cw.buf)
+	}
+	cw.buf = nil
+	return err
+}
+
+// Close flushes a response which never reached the minimum size, and finishes the
+// compressed stream otherwise.
+func (cw *compressWriter) Close() error {
+	if !cw.decided {
+		if cw.status == 0 {
+			cw.status = http.StatusOK
+		}
+		return cw.decide(false)
+	}
+	if cw.encoder != nil {
+		return cw.encoder.Close()
+	}
+	return nil
+}
+
+func isCompressible(contentType string) bool {
+	return strings.HasPrefix(contentType, "application/json") || strings.HasPrefix(contentType, "text/")
+}
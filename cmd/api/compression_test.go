@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/felixge/httpsnoop"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		brotli         bool
+		want           string
+	}{
+		{"", true, ""},
+		{"identity", true, ""},
+		{"gzip", true, "gzip"},
+		{"deflate", true, "deflate"},
+		{"gzip, deflate, br", true, "br"},
+		{"gzip, deflate, br", false, "gzip"},
+		{"GZIP;q=0.5, deflate", true, "gzip"},
+		{"gzip;q=0, deflate", true, "deflate"},
+		{"br;q=0", true, ""},
+	}
+
+	for _, tt := range tests {
+		got := negotiateEncoding(tt.acceptEncoding, tt.brotli)
+		if got != tt.want {
+			t.Errorf("negotiateEncoding(%q, %t) = %q; want %q", tt.acceptEncoding, tt.brotli, got, tt.want)
+		}
+	}
+}
+
+// decode returns the body of a response with the given Content-Encoding.
+func decode(t *testing.T, encoding string, body []byte) []byte {
+	t.Helper()
+
+	var r io.Reader = bytes.NewReader(body)
+	switch encoding {
+	case "br":
+		r = brotli.NewReader(r)
+	case "gzip":
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = gz
+	case "deflate":
+		zr, err := zlib.NewReader(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = zr
+	}
+
+	decoded, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decoded
+}
+
+func TestCompress(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.compression.enabled = true
+	app.config.compression.level = 6
+	app.config.compression.minSize = 1024
+	app.config.compression.brotli = true
+
+	large := `{"movies": [` + strings.Repeat(`{"title": "Moana", "year": 2016},`, 100) + `{}]}`
+	small := `{"status": "available"}`
+
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		contentType    string
+		contentEnc     string
+		body           string
+		wantEncoding   string
+	}{
+		{"large gzip", "gzip", "application/json", "", large, "gzip"},
+		{"large deflate", "deflate", "application/json", "", large, "deflate"},
+		{"large brotli", "gzip, br", "application/json", "", large, "br"},
+		{"small", "gzip", "application/json", "", small, ""},
+		{"not accepted", "", "application/json", "", large, ""},
+		{"not compressible", "gzip", "image/png", "", large, ""},
+		{"already compressed", "gzip", "application/json", "br", large, "br"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				if tt.contentEnc != "" {
+					w.Header().Set("Content-Encoding", tt.contentEnc)
+				}
+				w.WriteHeader(http.StatusCreated)
+				// Write in pieces, so that the size is only known part way through.
+				for i := 0; i < len(tt.body); i += 100 {
+					w.Write([]byte(tt.body[i:min(i+100, len(tt.body))]))
+				}
+			})
+
+			// The middleware outside compress captures the status through httpsnoop.
+			var captured httpsnoop.Metrics
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				captured = httpsnoop.CaptureMetrics(app.compress(next), w, r)
+			})
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.acceptEncoding != "" {
+				r.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, r)
+
+			if rr.Code != http.StatusCreated || captured.Code != http.StatusCreated {
+				t.Errorf("got status %d, captured as %d; want %d", rr.Code, captured.Code, http.StatusCreated)
+			}
+			if got := rr.Header().Get("Content-Encoding"); got != tt.wantEncoding {
+				t.Errorf("got Content-Encoding %q; want %q", got, tt.wantEncoding)
+			}
+			if got := rr.Header().Get("Vary"); got != "Accept-Encoding" {
+				t.Errorf("got Vary %q; want %q", got, "Accept-Encoding")
+			}
+
+			body := rr.Body.Bytes()
+			if tt.wantEncoding != "" && tt.contentEnc == "" {
+				if len(body) >= len(tt.body) {
+					t.Errorf("compressed body is %d bytes; want fewer than %d", len(body), len(tt.body))
+				}
+				body = decode(t, tt.wantEncoding, body)
+			}
+			if string(body) != tt.body {
+				t.Errorf("got body %.60q...; want %.60q...", body, tt.body)
+			}
+		})
+	}
+}
@@ -9,7 +9,11 @@ import (
 
 type contextKey string
 
-const userContextKey = contextKey("user")
+const (
+	userContextKey       = contextKey("user")
+	userLoaderContextKey = contextKey("userLoader")
+	requestIDContextKey  = contextKey("requestID")
+)
 
 // Returns a new copy of the request with the provided User struct added to the context.
 func (app *application) contextSetUser(r *http.Request, user *data.User) *http.Request {
@@ -24,3 +28,29 @@ func (app *application) contextGetUser(r *http.Request) *data.User {
 	}
 	return user
 }
+
+// Returns a new copy of the request with a fresh UserLoader added to the context.
+func (app *application) contextSetUserLoader(r *http.Request) *http.Request {
+	ctx := context.WithValue(r.Context(), userLoaderContextKey, app.modelsFor(r).Users.NewLoader())
+	return r.WithContext(ctx)
+}
+
+func (app *application) contextGetUserLoader(r *http.Request) *data.UserLoader {
+	loader, ok := r.Context().Value(userLoaderContextKey).(*data.UserLoader)
+	if !ok {
+		panic("missing user loader value in request context")
+	}
+	return loader
+}
+
+func (app *application) contextSetRequestID(r *http.Request, id string) *http.Request {
+	ctx := context.WithValue(r.Context(), requestIDContextKey, id)
+	return r.WithContext(ctx)
+}
+
+// contextGetRequestID returns the request's ID, or an empty string for a request
+// which didn't pass through the requestID middleware.
+func (app *application) contextGetRequestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDContextKey).(string)
+	return id
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// normalizeOrigin checks that origin is a well-formed scheme://host[:port] with no
+// path, query or trailing slash, and returns it with the scheme and host lowercased.
+func normalizeOrigin(origin string) (string, error) {
+	u, err := url.Parse(origin)
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case u.Scheme != "http" && u.Scheme != "https":
+		return "", fmt.Errorf("origin %q must use the http or https scheme", origin)
+	case u.Host == "" || u.Hostname() == "":
+		return "", fmt.Errorf("origin %q must include a host", origin)
+	case u.User != nil:
+		return "", fmt.Errorf("origin %q must not include user info", origin)
+	case u.Path != "" || u.RawQuery != "" || u.Fragment != "" || u.ForceQuery:
+		return "", fmt.Errorf("origin %q must not include a path, query or trailing slash", origin)
+	}
+
+	return u.Scheme + "://" + strings.ToLower(u.Host), nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/felixge/httpsnoop"
+
+	"greenlight.yp2743.me/internal/data"
+)
+
+// A deprecation describes a response field that is scheduled for removal.
+type deprecation struct {
+	field string
+	note  string
+}
+
+// deprecatedFields maps routes to the fields of their responses that are deprecated.
+// Routes listed here are wrapped in the deprecated middleware, so integrators get
+// notice before removal once -deprecation-warnings is on. The v1 runtime field is what
+// clients get by default, so the warnings stay off until its removal is announced.
+var deprecatedFields = map[string][]deprecation{
+	"GET /v1/movies/:id": {
+		{field: "movie.runtime", note: "request application/vnd.greenlight.v2+json and use runtime_minutes instead"},
+	},
+	"GET /v1/movies": {
+		{field: "movies.runtime", note: "request application/vnd.greenlight.v2+json and use runtime_minutes instead"},
+	},
+}
+
+// deprecated adds an RFC 7234 Warning header for each of the route's deprecated fields
+// to its successful responses, while -deprecation-warnings is on. Error responses
+// don't carry the fields, so they're left alone.
+func (app *application) deprecated(route string, next http.HandlerFunc) http.HandlerFunc {
+	var warnings []string
+	for _, d := range deprecatedFields[route] {
+		warnings = append(warnings, fmt.Sprintf(`299 - "field %s is deprecated: %s"`, d.field, d.note))
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !app.config.warnDeprecated {
+			next(w, r)
+			return
+		}
+
+		hooks := httpsnoop.Hooks{
+			WriteHeader: func(writeHeader httpsnoop.WriteHeaderFunc) httpsnoop.WriteHeaderFunc {
+				return func(code int) {
+					if code >= 200 && code < 300 {
+						for _, warning := range warnings {
+							w.Header().Add("Warning", warning)
+						}
+					}
+					writeHeader(code)
+				}
+			},
+		}
+		next(httpsnoop.Wrap(w, hooks), r)
+	}
+}
+
+// A fieldRename maps a request body field from a previous shape of the body to its
+// current name, converting the value too if its representation has changed.
+type fieldRename struct {
+	legacy  string
+	current string
+	convert func(json.RawMessage) (json.RawMessage, error)
+	note    string
+}
+
+// movieRequestRenames adapts the legacy "runtime" field, a string such as
+// "102 mins", to the current integer runtime_minutes field.
+var movieRequestRenames = []fieldRename{
+	{legacy: "runtime", current: "runtime_minutes", convert: legacyRuntime, note: "use runtime_minutes instead"},
+}
+
+// adaptFields rewrites any legacy fields of a decoded request body to their current
+// names in place, returning a Warning header value for each one. A null value, which
+// clears the field in a merge patch, is carried over as it is.
+func adaptFields(fields map[string]json.RawMessage, renames []fieldRename) ([]string, error) {
+	var warnings []string
+	for _, rename := range renames {
+		value, ok := fields[rename.legacy]
+		if !ok {
+			continue
+		}
+		if _, ok := fields[rename.current]; ok {
+			return nil, fmt.Errorf("body must not contain both %q and %q", rename.legacy, rename.current)
+		}
+
+		if rename.convert != nil && string(value) != "null" {
+			var err error
+			value, err = rename.convert(value)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		delete(fields, rename.legacy)
+		fields[rename.current] = value
+		warnings = append(warnings, fmt.Sprintf(`299 - "field %s is deprecated: %s"`, rename.legacy, rename.note))
+	}
+	return warnings, nil
+}
+
+func legacyRuntime(value json.RawMessage) (json.RawMessage, error) {
+	var runtime data.Runtime
+	err := runtime.UnmarshalJSON(value)
+	if err != nil {
+		return nil, invalidRuntimeError("runtime")
+	}
+	return json.Marshal(int32(runtime))
+}
+
+// readAdaptedJSON decodes the request body like readJSON, after first rewriting any
+// legacy fields to their current names. It returns a Warning header value for each
+// legacy field that was rewritten.
+func (app *application) readAdaptedJSON(w http.ResponseWriter, r *http.Request, dst interface{}, renames []fieldRename) ([]string, error) {
+	var fields map[string]json.RawMessage
+	err := app.readJSON(w, r, &fields)
+	if err != nil {
+		return nil, err
+	}
+
+	warnings, err := adaptFields(fields, renames)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	return warnings, app.readJSON(w, r, dst)
+}
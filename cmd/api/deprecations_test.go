@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"greenlight.yp2743.me/internal/data"
+)
+
+func TestDeprecated(t *testing.T) {
+	tests := []struct {
+		name         string
+		route        string
+		status       int
+		enabled      bool
+		wantWarnings int
+	}{
+		{"deprecated route", "GET /v1/movies/:id", http.StatusOK, true, 1},
+		{"warnings off", "GET /v1/movies/:id", http.StatusOK, false, 0},
+		{"error response", "GET /v1/movies/:id", http.StatusNotFound, true, 0},
+		{"route without deprecations", "GET /v1/healthcheck", http.StatusOK, true, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			app.config.warnDeprecated = tt.enabled
+			handler := app.deprecated(tt.route, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+			})
+
+			rr := httptest.NewRecorder()
+			handler(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			warnings := rr.Header().Values("Warning")
+			if len(warnings) != tt.wantWarnings {
+				t.Fatalf("got warnings %q; want %d", warnings, tt.wantWarnings)
+			}
+			for _, warning := range warnings {
+				if !strings.HasPrefix(warning, `299 - "field movie.runtime is deprecated`) {
+					t.Errorf("got warning %q", warning)
+				}
+			}
+		})
+	}
+}
+
+func TestDeprecatedMovieRoute(t *testing.T) {
+	app := newTestDBApplication(t)
+	user := newTestUser(t, app, "movies:read")
+	movie := newTestMovie(t, app, user)
+	token, err := app.models.Tokens.NewForScope(user.ID, data.ScopeAuthentication)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := app.routes()
+
+	tests := []struct {
+		name        string
+		enabled     bool
+		accept      string
+		wantWarning bool
+		wantField   string
+	}{
+		{"warnings off", false, "", false, `"runtime":"100 mins"`},
+		{"v1", true, "", true, `"runtime":"100 mins"`},
+		{"v2", true, "application/vnd.greenlight.v2+json", false, `"runtime_minutes":100`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app.config.warnDeprecated = tt.enabled
+
+			r := httptest.NewRequest(http.MethodGet, "/v1/movies/"+strconv.FormatInt(movie.ID, 10), nil)
+			r.Header.Set("Authorization", "Bearer "+token.Plaintext)
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, r)
+			if rr.Code != http.StatusOK {
+				t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusOK, rr.Body)
+			}
+
+			warnings := rr.Header().Values("Warning")
+			switch {
+			case tt.wantWarning && (len(warnings) != 1 || !strings.HasPrefix(warnings[0], `299 - "field movie.runtime is deprecated`)):
+				t.Errorf("got warnings %q; want one for movie.runtime", warnings)
+			case !tt.wantWarning && len(warnings) != 0:
+				t.Errorf("got warnings %q; want none", warnings)
+			}
+
+			// The warning doesn't change the body: the field is still sent.
+			body := strings.Join(strings.Fields(rr.Body.String()), "")
+			if !strings.Contains(body, tt.wantField) {
+				t.Errorf("body doesn't contain %s: %s", tt.wantField, rr.Body)
+			}
+		})
+	}
+}
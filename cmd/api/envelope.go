@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+
+	"greenlight.yp2743.me/internal/data"
+)
+
+// unwrapEnvelope returns the value written in place of the envelope when
+// -response-envelope is off. An envelope holding a single resource is replaced by the
+// resource itself, with any pagination metadata moved into X-Pagination-* headers and
+// any validation warnings into Warning headers. Envelopes holding several resources,
+// and error responses, are returned unchanged so that nothing is lost and errors keep
+// one shape in both modes.
+func unwrapEnvelope(env envelope, h http.Header) interface{} {
+	if _, ok := env["error"]; ok {
+		return env
+	}
+
+	metadata, hasMetadata := env["metadata"].(data.Metadata)
+	warnings, hasWarnings := env["warnings"].(map[string]string)
+
+	var value interface{}
+	resources := 0
+	for key, v := range env {
+		if (key == "metadata" && hasMetadata) || (key == "warnings" && hasWarnings) {
+			continue
+		}
+		value = v
+		resources++
+	}
+	if resources != 1 {
+		return env
+	}
+
+	if hasMetadata {
+		setPaginationHeaders(h, metadata)
+	}
+	if hasWarnings {
+		setWarningHeaders(h, warnings)
+	}
+	return value
+}
+
+// setWarningHeaders sends validation warnings as Warning headers, for bare responses,
+// in the order of the fields they're about.
+func setWarningHeaders(h http.Header, warnings map[string]string) {
+	keys := make([]string, 0, len(warnings))
+	for key := range warnings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		h.Add("Warning", "299 - "+strconv.Quote(key+": "+warnings[key]))
+	}
+}
+
+// setPaginationHeaders describes a page of results in headers, for bare responses.
+// Fields which are unset in the metadata are left out, as they are from the JSON.
+func setPaginationHeaders(h http.Header, metadata data.Metadata) {
+	fields := []struct {
+		name  string
+		value int
+	}{
+		{"X-Pagination-Total", metadata.TotalRecords},
+		{"X-Pagination-Page", metadata.CurrentPage},
+		{"X-Pagination-Page-Size", metadata.PageSize},
+		{"X-Pagination-First-Page", metadata.FirstPage},
+		{"X-Pagination-Last-Page", metadata.LastPage},
+	}
+	for _, field := range fields {
+		if field.value != 0 {
+			h.Set(field.name, strconv.Itoa(field.value))
+		}
+	}
+	if metadata.NextCursor != "" {
+		h.Set("X-Pagination-Next-Cursor", metadata.NextCursor)
+	}
+}
@@ -1,12 +1,19 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
+
+	"greenlight.yp2743.me/internal/data"
 )
 
 func (app *application) logError(r *http.Request, err error) {
 	app.logger.PrintError(err, map[string]string{
+		"request_id":     app.contextGetRequestID(r),
 		"request_method": r.Method,
 		"request_url":    r.URL.String(),
 	})
@@ -21,8 +28,19 @@ func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, st
 	}
 }
 
+// serverErrorResponse logs and reports an unexpected error and sends a 500. Running
+// out of pooled connections isn't unexpected under load, so that's logged and sent as
+// a 503 with a Retry-After instead.
 func (app *application) serverErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
 	app.logError(r, err)
+	if errors.Is(err, data.ErrAcquireTimeout) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(app.config.overload.retryAfter.Seconds())))
+		message := "the server is too busy to process your request, please try again later"
+		app.errorResponse(w, r, http.StatusServiceUnavailable, message)
+		return
+	}
+
+	app.reportError(r, err)
 	message := "the server encountered a problem and could not process your request"
 	app.errorResponse(w, r, http.StatusInternalServerError, message)
 }
@@ -37,7 +55,15 @@ func (app *application) methodNotAllowedResponse(w http.ResponseWriter, r *http.
 	app.errorResponse(w, r, http.StatusMethodNotAllowed, message)
 }
 
+// badRequestResponse sends a 400 for a malformed request. A fieldError, for a body
+// which was well-formed but held an invalid value, is sent as a 422 validation failure
+// instead, so that every handler draws the line between the two in the same place.
 func (app *application) badRequestResponse(w http.ResponseWriter, r *http.Request, err error) {
+	var fe *fieldError
+	if errors.As(err, &fe) {
+		app.failedValidationResponse(w, r, map[string]string{fe.field: fe.message})
+		return
+	}
 	app.errorResponse(w, r, http.StatusBadRequest, err.Error())
 }
 
@@ -50,11 +76,35 @@ func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Requ
 	app.errorResponse(w, r, http.StatusConflict, message)
 }
 
-func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request) {
+func (app *application) preconditionFailedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the record has been modified since the version given in If-Match"
+	app.errorResponse(w, r, http.StatusPreconditionFailed, message)
+}
+
+func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(max(math.Ceil(retryAfter.Seconds()), 1))))
 	message := "rate limit exceeded"
 	app.errorResponse(w, r, http.StatusTooManyRequests, message)
 }
 
+func (app *application) overloadedResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(app.config.overload.retryAfter.Seconds())))
+	message := "server overloaded"
+	app.errorResponse(w, r, http.StatusServiceUnavailable, message)
+}
+
+func (app *application) dbBusyResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(app.config.overload.retryAfter.Seconds())))
+	message := "too many expensive requests in progress, please try again later"
+	app.errorResponse(w, r, http.StatusServiceUnavailable, message)
+}
+
+func (app *application) quotaExceededResponse(w http.ResponseWriter, r *http.Request) {
+	message := fmt.Sprintf("you may create at most %d movies per %s, please try again later",
+		app.config.quota.movies, app.config.quota.window)
+	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+}
+
 func (app *application) invalidCredentialsResponse(w http.ResponseWriter, r *http.Request) {
 	message := "invalid authentication credentials"
 	app.errorResponse(w, r, http.StatusUnauthorized, message)
@@ -76,7 +126,81 @@ func (app *application) inactiveAccountResponse(w http.ResponseWriter, r *http.R
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
 
+func (app *application) deactivatedAccountResponse(w http.ResponseWriter, r *http.Request) {
+	message := "your user account has been deactivated"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+func (app *application) notDeactivatedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the user account is not deactivated"
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+
+func (app *application) nonceRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this request must carry a nonce from GET /v1/nonce in the X-Nonce header"
+	app.errorResponse(w, r, http.StatusPreconditionRequired, message)
+}
+
+func (app *application) invalidNonceResponse(w http.ResponseWriter, r *http.Request) {
+	message := "invalid, expired or already used nonce"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
 func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Request) {
 	message := "your user account doesn't have the necessary permissions to access this resource"
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
+
+func (app *application) notAcceptableResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the requested API version is not supported"
+	app.errorResponse(w, r, http.StatusNotAcceptable, message)
+}
+
+func (app *application) readOnlyResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the server is in read-only mode, write operations are temporarily unavailable"
+	app.errorResponse(w, r, http.StatusServiceUnavailable, message)
+}
+
+func (app *application) duplicateMovieResponse(w http.ResponseWriter, r *http.Request, existing *data.Movie) {
+	if existing != nil {
+		w.Header().Set("Location", fmt.Sprintf("/v1/movies/%d", existing.ID))
+	}
+	message := "a movie with this title and year already exists"
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+
+func (app *application) duplicateEmailResponse(w http.ResponseWriter, r *http.Request) {
+	message := "a user with this email address already exists"
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+
+func (app *application) impersonationLimitExceededResponse(w http.ResponseWriter, r *http.Request) {
+	message := "impersonation limit exceeded, please try again later"
+	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+}
+
+func (app *application) cannotImpersonateAdminResponse(w http.ResponseWriter, r *http.Request) {
+	message := "admin accounts cannot be impersonated"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+func (app *application) contentTooLargeResponse(w http.ResponseWriter, r *http.Request, limit int64) {
+	message := fmt.Sprintf("body must not be larger than %d bytes", limit)
+	app.errorResponse(w, r, http.StatusRequestEntityTooLarge, message)
+}
+
+func (app *application) uriTooLongResponse(w http.ResponseWriter, r *http.Request, limit int) {
+	message := fmt.Sprintf("request URL must not be longer than %d bytes", limit)
+	app.errorResponse(w, r, http.StatusRequestURITooLong, message)
+}
+
+func (app *application) tokenLifetimeExceededResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this token has reached its maximum lifetime, please authenticate again"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+// tooManyGenresResponse reports a genres list rejected by the database constraint,
+// which can only happen if -max-genres has been raised above what the schema allows.
+func (app *application) tooManyGenresResponse(w http.ResponseWriter, r *http.Request) {
+	app.failedValidationResponse(w, r, map[string]string{"genres": fmt.Sprintf("must not contain more than %d genres", data.MaxGenres)})
+}
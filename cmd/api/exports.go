@@ -0,0 +1,260 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"greenlight.yp2743.me/internal/data"
+)
+
+const (
+	// exportInlineMaxItems is how many records an export may hold before it's
+	// generated in the background and the user is emailed once it's ready.
+	exportInlineMaxItems = 1000
+	// exportTTL is how long a background export can be downloaded for.
+	exportTTL = 7 * 24 * time.Hour
+)
+
+// exportUserDataHandler returns a bundle of all the data held about the caller, for
+// data-subject-access requests. Token hashes and the password hash are never included.
+//
+// Large exports, or any export the client asks for with "Prefer: respond-async", are
+// generated in the background instead: the response is 202 Accepted with a Location
+// to download it from, and the user is emailed when it's ready.
+func (app *application) exportUserDataHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	// A background export has to be stored, which read-only mode doesn't allow.
+	if !app.readOnly.Load() {
+		async := preferAsync(r)
+		if !async {
+			count, err := app.modelsFor(r).Exports.ItemCount(user.ID)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+			async = count > exportInlineMaxItems
+		}
+		if async {
+			app.startUserExport(w, r, user)
+			return
+		}
+	}
+
+	bundle, err := app.userExport(r, user)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"export": bundle}, exportHeaders())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// startUserExport records a pending export and generates it in the background.
+func (app *application) startUserExport(w http.ResponseWriter, r *http.Request, user *data.User) {
+	export, err := app.modelsFor(r).Exports.Insert(user.ID, exportTTL)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.background(func() {
+		app.completeUserExport(r, user, export)
+	})
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/users/me/exports/%d", export.ID))
+
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"export": export}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// completeUserExport generates and stores the bundle for a pending export, then emails
+// the user a link to it. The request is only used to read the caller's identity from,
+// so it's safe to use once the response has been sent.
+func (app *application) completeUserExport(r *http.Request, user *data.User, export *data.Export) {
+	bundle, err := app.userExport(r, user)
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{"export_id": strconv.FormatInt(export.ID, 10)})
+		return
+	}
+
+	// The body is stored exactly as it will be served.
+	js, _, err := app.encodeJSON(envelope{"export": bundle})
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{"export_id": strconv.FormatInt(export.ID, 10)})
+		return
+	}
+
+	err = app.models.Transaction(func(tx data.Models) error {
+		err := tx.Exports.Complete(export.ID, js)
+		if err != nil {
+			return err
+		}
+
+		return tx.Outbox.Insert(&data.OutboxMessage{
+			Recipient: user.Email,
+			Template:  "export_ready.html",
+			Data: map[string]interface{}{
+				"exportID": export.ID,
+				"expiry":   export.ExpiresAt.UTC().Format(time.RFC1123),
+			},
+		})
+	})
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{"export_id": strconv.FormatInt(export.ID, 10)})
+		return
+	}
+
+	app.dispatchOutbox()
+}
+
+// showUserExportHandler serves a background export to the user who requested it. It
+// responds 202 Accepted while the export is still being generated.
+func (app *application) showUserExportHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	export, err := app.modelsFor(r).Exports.Get(id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if export.Bundle == nil {
+		err = app.writeJSON(w, http.StatusAccepted, envelope{"export": export}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	for key, value := range exportHeaders() {
+		w.Header()[key] = value
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(export.Bundle)
+}
+
+// userExport gathers the data held about the user. Sections for data the user has
+// none of are empty rather than missing, and watchlists, which aren't stored yet, are
+// always empty, so that the bundle's shape doesn't change as features are added.
+func (app *application) userExport(r *http.Request, user *data.User) (map[string]interface{}, error) {
+	models := app.modelsFor(r)
+
+	permissions, err := models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens, err := models.Tokens.GetAllForUser("", user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	movies, err := models.Movies.GetAllCreatedBy(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = app.hideRestrictedFields(r, movies)
+	if err != nil {
+		return nil, err
+	}
+
+	ratings, err := models.Ratings.GetAllForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	auditLog, err := models.Audit.GetAllForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	tokensMetadata := make([]data.TokenMetadata, 0, len(tokens))
+	for _, token := range tokens {
+		tokensMetadata = append(tokensMetadata, token.Metadata())
+	}
+
+	if permissions == nil {
+		permissions = data.Permissions{}
+	}
+
+	// Reviews are listed on their own, and left out of the ratings they belong to.
+	scores := make([]data.Rating, 0, len(ratings))
+	reviews := []data.Rating{}
+	for _, rating := range ratings {
+		if rating.Review != "" {
+			reviews = append(reviews, *rating)
+		}
+		rating.Review = ""
+		scores = append(scores, *rating)
+	}
+
+	return map[string]interface{}{
+		"generated_at": time.Now().UTC(),
+		"profile":      user,
+		"permissions":  permissions,
+		"tokens":       tokensMetadata,
+		"movies":       movies,
+		"ratings":      scores,
+		"reviews":      reviews,
+		"watchlist":    []interface{}{},
+		"audit_log":    auditLog,
+	}, nil
+}
+
+// purgeExpiredExports deletes background exports which can no longer be downloaded.
+func (app *application) purgeExpiredExports() {
+	n, err := app.models.Exports.DeleteExpired()
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return
+	}
+
+	if n > 0 {
+		app.logger.PrintInfo("purged expired exports", map[string]string{
+			"purged_exports": strconv.FormatInt(n, 10),
+		})
+	}
+}
+
+func exportHeaders() http.Header {
+	headers := make(http.Header)
+	headers.Set("Content-Disposition", `attachment; filename="greenlight-export.json"`)
+	return headers
+}
+
+// preferAsync reports whether the client asked for the request to be handled
+// asynchronously, as described in RFC 7240.
+func preferAsync(r *http.Request) bool {
+	for _, value := range r.Header.Values("Prefer") {
+		for _, preference := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(preference), "respond-async") {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestPreferAsync(t *testing.T) {
+	tests := []struct {
+		name   string
+		prefer []string
+		want   bool
+	}{
+		{"absent", nil, false},
+		{"respond-async", []string{"respond-async"}, true},
+		{"case-insensitive", []string{"Respond-Async"}, true},
+		{"in a list", []string{"return=minimal, respond-async"}, true},
+		{"in a later header", []string{"return=minimal", "respond-async"}, true},
+		{"other preference", []string{"return=representation"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v1/users/me/export", nil)
+			for _, value := range tt.prefer {
+				r.Header.Add("Prefer", value)
+			}
+			if got := preferAsync(r); got != tt.want {
+				t.Errorf("got %t; want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+// exportSections are the sections every export contains, even when they're empty.
+var exportSections = []string{"profile", "permissions", "tokens", "movies", "ratings", "reviews", "watchlist", "audit_log"}
+
+// checkExportSections decodes an export response body, checks that it has every
+// section, and returns them.
+func checkExportSections(t *testing.T, body []byte) map[string]json.RawMessage {
+	t.Helper()
+
+	var response struct {
+		Export map[string]json.RawMessage `json:"export"`
+	}
+	err := json.Unmarshal(body, &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, section := range exportSections {
+		value, ok := response.Export[section]
+		if !ok || string(value) == "null" {
+			t.Errorf("export has no %q section: %s", section, body)
+		}
+	}
+	return response.Export
+}
+
+func TestExportUserData(t *testing.T) {
+	app := newTestDBApplication(t)
+	user := newTestUser(t, app, "movies:read")
+	movie := newTestMovie(t, app, user)
+	other := newTestMovie(t, app, user)
+
+	ctx := context.Background()
+	for _, rating := range []struct {
+		movieID int64
+		stars   int
+		review  string
+	}{{movie.ID, 4, "Worth a watch"}, {other.ID, 2, ""}} {
+		_, err := app.models.Movies.DB.Exec(ctx, `INSERT INTO ratings (movie_id, user_id, rating, review) VALUES ($1, $2, $3, $4)`,
+			rating.movieID, user.ID, rating.stars, rating.review)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rr := serveAs(app, app.exportUserDataHandler, user, httptest.NewRequest(http.MethodGet, "/v1/users/me/export", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusOK, rr.Body)
+	}
+	export := checkExportSections(t, rr.Body.Bytes())
+
+	var ratings []map[string]interface{}
+	var reviews []map[string]interface{}
+	var watchlist []interface{}
+	for name, section := range map[string]interface{}{"ratings": &ratings, "reviews": &reviews, "watchlist": &watchlist} {
+		err := json.Unmarshal(export[name], section)
+		if err != nil {
+			t.Fatalf("decoding %s: %v", name, err)
+		}
+	}
+
+	if len(ratings) != 2 {
+		t.Errorf("got %d ratings; want 2", len(ratings))
+	}
+	for _, rating := range ratings {
+		if _, ok := rating["review"]; ok {
+			t.Errorf("rating %v includes its review; want it only under reviews", rating)
+		}
+	}
+	if len(reviews) != 1 || reviews[0]["review"] != "Worth a watch" {
+		t.Errorf("got reviews %v; want just the one with text", reviews)
+	}
+	if len(watchlist) != 0 {
+		t.Errorf("got watchlist %v; want it empty", watchlist)
+	}
+}
+
+func TestExportUserDataAsync(t *testing.T) {
+	app := newTestDBApplication(t)
+	mailer := &testMailer{}
+	app.mailer = mailer
+	user := newTestUser(t, app)
+	newTestMovie(t, app, user)
+
+	r := httptest.NewRequest(http.MethodGet, "/v1/users/me/export", nil)
+	r.Header.Set("Prefer", "respond-async")
+	rr := serveAs(app, app.exportUserDataHandler, user, r)
+	app.drainBackgroundTasks(5 * time.Second)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusAccepted, rr.Body)
+	}
+
+	var response struct {
+		Export struct {
+			ID int64 `json:"id"`
+		} `json:"export"`
+	}
+	err := json.Unmarshal(rr.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := response.Export.ID
+	if location := rr.Header().Get("Location"); location != "/v1/users/me/exports/"+strconv.FormatInt(id, 10) {
+		t.Errorf("got Location %q; want the export's URL", location)
+	}
+
+	var emailed bool
+	for _, email := range mailer.sent {
+		if email.recipient == user.Email && email.template == "export_ready.html" && fmt.Sprint(email.data["exportID"]) == strconv.FormatInt(id, 10) {
+			emailed = true
+		}
+	}
+	if !emailed {
+		t.Errorf("got emails %v; want export_ready.html sent to %s for export %d", mailer.sent, user.Email, id)
+	}
+
+	download := httptest.NewRequest(http.MethodGet, "/v1/users/me/exports/"+strconv.FormatInt(id, 10), nil)
+	rr = serveAs(app, app.showUserExportHandler, user, withID(download, id))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusOK, rr.Body)
+	}
+	checkExportSections(t, rr.Body.Bytes())
+
+	// Nobody else can download it.
+	rr = serveAs(app, app.showUserExportHandler, newTestUser(t, app), withID(download, id))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("got status %d for another user; want %d", rr.Code, http.StatusNotFound)
+	}
+}
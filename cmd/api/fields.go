@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+
+	"greenlight.yp2743.me/internal/data"
+)
+
+// fieldPermissions maps the JSON fields of response types to the permission a caller
+// needs to see them. Callers without it get the field zeroed, so restricted fields
+// should be tagged omitempty to drop them from the response altogether.
+var fieldPermissions = map[reflect.Type]map[string]string{
+	reflect.TypeOf(data.Movie{}): {"notes": "movies:notes"},
+}
+
+// hideRestrictedFields zeroes the fields in value which the request's user isn't
+// permitted to see. The value is a pointer to a struct or a slice of them.
+func (app *application) hideRestrictedFields(r *http.Request, value interface{}) error {
+	v := reflect.ValueOf(value)
+
+	var structs []reflect.Value
+	switch v.Kind() {
+	case reflect.Pointer:
+		structs = append(structs, v.Elem())
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			structs = append(structs, v.Index(i).Elem())
+		}
+	}
+
+	var permissions data.Permissions
+	loaded := false
+
+	for _, s := range structs {
+		restricted, ok := fieldPermissions[s.Type()]
+		if !ok {
+			continue
+		}
+
+		// The permissions are only looked up once something restricted is found.
+		if !loaded {
+			user := app.contextGetUser(r)
+			if !user.IsAnonymous() {
+				var err error
+				permissions, err = app.modelsFor(r).Permissions.GetAllForUser(user.ID)
+				if err != nil {
+					return err
+				}
+			}
+			loaded = true
+		}
+
+		for i := 0; i < s.NumField(); i++ {
+			name, _, _ := strings.Cut(s.Type().Field(i).Tag.Get("json"), ",")
+			if code, ok := restricted[name]; ok && !permissions.Include(code) {
+				s.Field(i).SetZero()
+			}
+		}
+	}
+	return nil
+}
+
+// hideRestrictedChanges removes the changes to restricted movie fields from history
+// events, when the request's user isn't permitted to see the fields themselves.
+func (app *application) hideRestrictedChanges(r *http.Request, events []*data.MovieEvent) error {
+	restricted := fieldPermissions[reflect.TypeOf(data.Movie{})]
+
+	permissions, err := app.modelsFor(r).Permissions.GetAllForUser(app.contextGetUser(r).ID)
+	if err != nil {
+		return err
+	}
+
+	for _, event := range events {
+		for name, code := range restricted {
+			if !permissions.Include(code) {
+				delete(event.Changes, name)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"greenlight.yp2743.me/internal/data"
+)
+
+func TestRestrictedFields(t *testing.T) {
+	app := newTestDBApplication(t)
+	app.config.publicReads = true
+	author := newTestUser(t, app, "movies:write")
+	privileged := newTestUser(t, app, "movies:read", "movies:notes")
+	unprivileged := newTestUser(t, app, "movies:read")
+
+	movie := newTestMovie(t, app, author)
+	movie.Notes = "rights expire next year"
+	err := app.models.Movies.Update(movie, "notes")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		user      *data.User
+		wantNotes bool
+	}{
+		{"privileged", privileged, true},
+		{"unprivileged", unprivileged, false},
+		{"anonymous", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := serveAs(app, app.showMovieHandler, tt.user, withID(httptest.NewRequest(http.MethodGet, "/", nil), movie.ID))
+			if rr.Code != http.StatusOK {
+				t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusOK, rr.Body)
+			}
+
+			body := rr.Body.String()
+			hasNotes := strings.Contains(body, `"notes"`)
+			if hasNotes != tt.wantNotes {
+				t.Errorf("got notes field %t; want %t: %s", hasNotes, tt.wantNotes, body)
+			}
+			if !tt.wantNotes && strings.Contains(body, movie.Notes) {
+				t.Errorf("response leaks the notes: %s", body)
+			}
+		})
+	}
+}
@@ -1,11 +1,129 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"net/http"
+	"sync"
+	"time"
 )
 
-func (app *application) healthcheckHandler(w http.ResponseWriter, r *http.Request) {
+const healthCheckTimeout = 2 * time.Second
 
+// healthChecks are the dependency checks which may be enabled with -health-checks. Only
+// db is on by default: a mail outage delays emails, which the outbox retries, rather
+// than making the API unable to serve.
+var healthChecks = map[string]func(*application, context.Context) error{
+	"db": func(app *application, ctx context.Context) error {
+		return app.models.Ping(ctx)
+	},
+	"smtp": func(app *application, ctx context.Context) error {
+		return app.mailer.Ping(ctx)
+	},
+}
+
+// healthState is the overall result of the readiness checks. The states are ordered
+// by severity, so the worst of several is the greatest.
+type healthState int32
+
+const (
+	healthAvailable healthState = iota
+	healthDegraded
+	healthUnavailable
+)
+
+func (s healthState) String() string {
+	switch s {
+	case healthDegraded:
+		return "degraded"
+	case healthUnavailable:
+		return "unavailable"
+	default:
+		return "available"
+	}
+}
+
+// healthCheckResult is the outcome of one check. Status is "pass", "warn" if the check
+// passed but too slowly, or "fail".
+type healthCheckResult struct {
+	Status    string `json:"status"`
+	LatencyMs int64  `json:"latency_ms"`
+	Warning   string `json:"warning,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// degradedLatency is the latency above which a passing check leaves the service
+// degraded, or 0 if it never does. Only a slow database ping is taken as degradation.
+func (app *application) degradedLatency(name string) time.Duration {
+	if name == "db" {
+		return app.config.db.degradedLatency
+	}
+	return 0
+}
+
+// runHealthChecks runs the enabled checks concurrently, and reports the worst state
+// they leave the service in: unavailable if any fail, or degraded if any pass slowly.
+func (app *application) runHealthChecks() (map[string]healthCheckResult, healthState) {
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		results = make(map[string]healthCheckResult, len(app.config.healthChecks))
+		state   = healthAvailable
+	)
+
+	for _, name := range app.config.healthChecks {
+		wg.Add(1)
+		go func(name string, check func(*application, context.Context) error) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+			defer cancel()
+
+			start := time.Now()
+			err := check(app, ctx)
+			latency := time.Since(start)
+
+			result := healthCheckResult{Status: "pass", LatencyMs: latency.Milliseconds()}
+			checkState := healthAvailable
+			if threshold := app.degradedLatency(name); threshold > 0 && latency > threshold {
+				result.Status = "warn"
+				result.Warning = fmt.Sprintf("latency above %s", threshold)
+				checkState = healthDegraded
+			}
+			if err != nil {
+				result.Status = "fail"
+				result.Warning = ""
+				result.Error = err.Error()
+				checkState = healthUnavailable
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			results[name] = result
+			state = max(state, checkState)
+		}(name, healthChecks[name])
+	}
+	wg.Wait()
+
+	app.health.Store(&state)
+	return results, state
+}
+
+// healthGauge reports the state found by the most recent readiness check, along with
+// its level (0 available, 1 degraded, 2 unavailable) for alerting on. The status is
+// "unknown" until the first check has run.
+func (app *application) healthGauge() interface{} {
+	state := app.health.Load()
+	if state == nil {
+		return map[string]interface{}{"status": "unknown"}
+	}
+	return map[string]interface{}{"status": state.String(), "level": int32(*state)}
+}
+
+// livenessHandler reports that the process is up and serving requests. It doesn't
+// check any dependencies, so that an orchestrator only restarts the process when the
+// process itself is stuck.
+func (app *application) livenessHandler(w http.ResponseWriter, r *http.Request) {
 	env := envelope{
 		"status": "available",
 		"system_info": map[string]string{
@@ -19,3 +137,39 @@ func (app *application) healthcheckHandler(w http.ResponseWriter, r *http.Reques
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// readinessHandler runs the dependency checks enabled by -health-checks, responding
+// 503 if any of them fail so that traffic is routed elsewhere until they recover. A
+// database which answers slower than -db-degraded-latency is reported as degraded, but
+// the service stays ready. The database connection pool's usage is reported alongside.
+func (app *application) readinessHandler(w http.ResponseWriter, r *http.Request) {
+	checks, state := app.runHealthChecks()
+
+	code := http.StatusOK
+	if state == healthUnavailable {
+		code = http.StatusServiceUnavailable
+	}
+
+	env := envelope{
+		"status": state.String(),
+		"checks": checks,
+		"system_info": map[string]string{
+			"environment": app.config.env,
+			"version":     version,
+		},
+	}
+
+	if stats := app.models.Stat(); stats != nil {
+		env["database_pool"] = map[string]int32{
+			"in_use": stats.AcquiredConns(),
+			"idle":   stats.IdleConns(),
+			"total":  stats.TotalConns(),
+			"max":    stats.MaxConns(),
+		}
+	}
+
+	err := app.writeJSON(w, code, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+)
+
+func TestReadinessHandlerCheckSet(t *testing.T) {
+	tests := []struct {
+		name       string
+		checks     []string
+		pingErr    error
+		wantStatus int
+		wantChecks map[string]string
+	}{
+		{
+			name:       "no checks",
+			checks:     []string{},
+			wantStatus: http.StatusOK,
+			wantChecks: map[string]string{},
+		},
+		{
+			name:       "smtp passing",
+			checks:     []string{"smtp"},
+			wantStatus: http.StatusOK,
+			wantChecks: map[string]string{"smtp": "pass"},
+		},
+		{
+			name:       "smtp failing",
+			checks:     []string{"smtp"},
+			pingErr:    errors.New("connection refused"),
+			wantStatus: http.StatusServiceUnavailable,
+			wantChecks: map[string]string{"smtp": "fail"},
+		},
+		{
+			// The test application has no database, so its check fails.
+			name:       "db failing, smtp failing but not enabled",
+			checks:     []string{"db"},
+			pingErr:    errors.New("connection refused"),
+			wantStatus: http.StatusServiceUnavailable,
+			wantChecks: map[string]string{"db": "fail"},
+		},
+		{
+			name:       "db and smtp",
+			checks:     []string{"db", "smtp"},
+			wantStatus: http.StatusServiceUnavailable,
+			wantChecks: map[string]string{"db": "fail", "smtp": "pass"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			app.config.healthChecks = tt.checks
+			app.mailer = &testMailer{pingErr: tt.pingErr}
+
+			rr := httptest.NewRecorder()
+			app.readinessHandler(rr, httptest.NewRequest(http.MethodGet, "/v1/healthcheck/ready", nil))
+			if rr.Code != tt.wantStatus {
+				t.Errorf("got status %d; want %d", rr.Code, tt.wantStatus)
+			}
+
+			var response struct {
+				Checks map[string]healthCheckResult `json:"checks"`
+			}
+			err := json.Unmarshal(rr.Body.Bytes(), &response)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := make(map[string]string)
+			for name, result := range response.Checks {
+				got[name] = result.Status
+				if result.Status == "fail" && result.Error == "" {
+					t.Errorf("%s check failed without an error", name)
+				}
+			}
+			if len(got) != len(tt.wantChecks) {
+				t.Errorf("got checks %v; want %v", sortedKeys(got), sortedKeys(tt.wantChecks))
+			}
+			for name, status := range tt.wantChecks {
+				if got[name] != status {
+					t.Errorf("got %s status %q; want %q", name, got[name], status)
+				}
+			}
+		})
+	}
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -1,22 +1,28 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"reflect"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
+	"greenlight.yp2743.me/internal/data"
 	"greenlight.yp2743.me/internal/validator"
 )
 
 func (app *application) readIDParam(r *http.Request) (int64, error) {
 	params := httprouter.ParamsFromContext(r.Context())
-	id, err := strconv.ParseInt(params.ByName("id"), 10, 64)
+	// Accept the ID in its string form ("123") as well, to mirror -stringify-ids.
+	id, err := strconv.ParseInt(strings.Trim(params.ByName("id"), `"`), 10, 64)
 	if err != nil || id < 1 {
 		return 0, errors.New("invalid id parameter")
 	}
@@ -27,16 +33,17 @@ type envelope map[string]interface{}
 
 func (app *application) writeJSON(w http.ResponseWriter, status int, data envelope, headers http.Header) error {
 
-	js, err := json.MarshalIndent(data, "", "\t")
+	js, pagination, err := app.encodeJSON(data)
 	if err != nil {
 		return err
 	}
-	// See easier in the terminal
-	js = append(js, '\n')
 
 	for key, value := range headers {
 		w.Header()[key] = value
 	}
+	for key, value := range pagination {
+		w.Header()[key] = value
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
@@ -44,6 +51,91 @@ func (app *application) writeJSON(w http.ResponseWriter, status int, data envelo
 	return nil
 }
 
+// encodeJSON renders a response body as writeJSON sends it, returning the body and any
+// pagination headers taken out of the envelope.
+func (app *application) encodeJSON(data envelope) ([]byte, http.Header, error) {
+
+	redacted := redact(data)
+	var payload interface{} = redacted
+	pagination := make(http.Header)
+	if !app.config.responseEnvelope {
+		payload = unwrapEnvelope(redacted, pagination)
+	}
+
+	js, err := json.MarshalIndent(payload, "", "\t")
+	if err != nil {
+		return nil, nil, err
+	}
+	// See easier in the terminal
+	js = append(js, '\n')
+	return js, pagination, nil
+}
+
+// deletedResponse completes a delete request given the error returned by the model:
+// 204 No Content on success, and 404 if the resource didn't exist.
+func (app *application) deletedResponse(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusNoContent)
+	case errors.Is(err, data.ErrRecordNotFound):
+		app.notFoundResponse(w, r)
+	default:
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// bodyETag returns a strong entity tag for a response body, derived from a hash of
+// the body itself.
+func bodyETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagMatches reports whether an If-Match or If-None-Match header lists the entity tag
+// or is "*". If-None-Match uses the weak comparison, which ignores a W/ prefix, and
+// If-Match the strong one, which never matches a weak tag.
+func etagMatches(header, etag string, weak bool) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return true
+		}
+		if weak {
+			tag = strings.TrimPrefix(tag, "W/")
+		}
+		if tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModifiedResponse sends a 304 with the validator headers of the representation
+// the client already has, but no body.
+func (app *application) notModifiedResponse(w http.ResponseWriter, headers http.Header) {
+	for key, value := range headers {
+		w.Header()[key] = value
+	}
+	w.WriteHeader(http.StatusNotModified)
+}
+
+// A fieldError is returned when reading a well-formed request body which holds a value
+// a field doesn't accept. That's a validation failure rather than a malformed body, so
+// badRequestResponse answers it with 422 and the usual field-keyed errors.
+type fieldError struct {
+	field   string
+	message string
+}
+
+func (e *fieldError) Error() string {
+	return fmt.Sprintf("%s %s", e.field, e.message)
+}
+
+// invalidRuntimeError reports a runtime which isn't in any of the accepted formats.
+func invalidRuntimeError(field string) error {
+	return &fieldError{field: field, message: `must be a string such as "107 mins" or "1h 47m"`}
+}
+
 func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst interface{}) error {
 
 	maxBytes := 1_048_576
@@ -54,38 +146,37 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst int
 
 	err := dec.Decode(dst)
 	if err != nil {
-		var syntaxError *json.SyntaxError
 		var unmarshalTypeError *json.UnmarshalTypeError
 		var invalidUnmarshalError *json.InvalidUnmarshalError
 		switch {
 
-		case errors.As(err, &syntaxError):
-			return fmt.Errorf("body contains badly-formed JSON (at character %d)", syntaxError.Offset)
-
-		case errors.Is(err, io.ErrUnexpectedEOF):
-			return errors.New("body contains badly-formed JSON")
-
 		case errors.As(err, &unmarshalTypeError):
 			if unmarshalTypeError.Field != "" {
 				return fmt.Errorf("body contains incorrect JSON type for field %q", unmarshalTypeError.Field)
 			}
+			// The whole body is the wrong kind of value, such as an array sent to an
+			// endpoint expecting an object.
+			if unmarshalTypeError.Type == reflect.TypeOf(dst).Elem() {
+				if want := jsonKind(unmarshalTypeError.Type); want != "" {
+					got, _, _ := strings.Cut(unmarshalTypeError.Value, " ")
+					return fmt.Errorf("body must be %s, not %s", want, withArticle(got))
+				}
+			}
 			return fmt.Errorf("body contains incorrect JSON type (at character %d)", unmarshalTypeError.Offset)
 
-		case errors.Is(err, io.EOF):
-			return errors.New("body must not be empty")
+		// Runtime is only ever decoded from a field named runtime.
+		case errors.Is(err, data.ErrInvalidRuntimeFormat):
+			return invalidRuntimeError("runtime")
 
 		case strings.HasPrefix(err.Error(), "json: unknown field "):
 			fieldName := strings.TrimPrefix(err.Error(), "json: unknown field ")
 			return fmt.Errorf("body contains unknown key %s", fieldName)
 
-		case err.Error() == "http: request body too large":
-			return fmt.Errorf("body must not be larger than %d bytes", maxBytes)
-
 		case errors.As(err, &invalidUnmarshalError):
 			panic(err)
 
 		default:
-			return err
+			return jsonBodyError(err, maxBytes)
 		}
 	}
 
@@ -97,6 +188,51 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst int
 	return nil
 }
 
+// jsonBodyError describes an error which stopped a JSON request body from being read
+// at all: a syntax error, a truncated or empty body, or one over maxBytes.
+func jsonBodyError(err error, maxBytes int) error {
+	var syntaxError *json.SyntaxError
+	switch {
+	case errors.As(err, &syntaxError):
+		return fmt.Errorf("body contains badly-formed JSON (at character %d)", syntaxError.Offset)
+
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return errors.New("body contains badly-formed JSON")
+
+	case errors.Is(err, io.EOF):
+		return errors.New("body must not be empty")
+
+	case err.Error() == "http: request body too large":
+		return fmt.Errorf("body must not be larger than %d bytes", maxBytes)
+
+	default:
+		return err
+	}
+}
+
+// jsonKind describes the JSON value expected for a Go type, for types which are
+// decoded from a JSON object or array.
+func jsonKind(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Struct, reflect.Map:
+		return "a single JSON object"
+	case reflect.Slice, reflect.Array:
+		return "a JSON array"
+	default:
+		return ""
+	}
+}
+
+// withArticle prefixes a JSON type name, as reported by encoding/json, with "a" or "an".
+func withArticle(name string) string {
+	switch name {
+	case "array", "object":
+		return "an " + name
+	default:
+		return "a " + name
+	}
+}
+
 func (app *application) readString(qs url.Values, key string, defaultValue string) string {
 	s := qs.Get(key)
 	if s == "" {
@@ -127,11 +263,55 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	return i
 }
 
+// readOptionalInt is like readInt, but returns nil if the key is absent, so that
+// callers can tell an unset filter from zero.
+func (app *application) readOptionalInt(qs url.Values, key string, v *validator.Validator) *int {
+	if qs.Get(key) == "" {
+		return nil
+	}
+
+	i := app.readInt(qs, key, 0, v)
+	return &i
+}
+
+// readBool returns nil if the key is absent, so that callers can tell an unset
+// filter from false.
+func (app *application) readBool(qs url.Values, key string, v *validator.Validator) *bool {
+	s := qs.Get(key)
+	if s == "" {
+		return nil
+	}
+
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		v.AddError(key, "must be a boolean value")
+		return nil
+	}
+	return &b
+}
+
+// readTime parses an RFC 3339 timestamp, returning nil if the key is absent.
+func (app *application) readTime(qs url.Values, key string, v *validator.Validator) *time.Time {
+	s := qs.Get(key)
+	if s == "" {
+		return nil
+	}
+
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		v.AddError(key, "must be an RFC 3339 timestamp")
+		return nil
+	}
+	return &t
+}
+
 func (app *application) background(fn func()) {
 	app.wg.Add(1)
+	app.backgroundTasks.Add(1)
 	go func() {
 		// Decrement the WaitGroup counter before the goroutine returns.
 		defer app.wg.Done()
+		defer app.backgroundTasks.Add(-1)
 		defer func() {
 			if err := recover(); err != nil {
 				app.logger.PrintError(fmt.Errorf("%s", err), nil)
@@ -140,3 +320,28 @@ func (app *application) background(fn func()) {
 		fn()
 	}()
 }
+
+// every runs fn at the given interval in a background goroutine until the application
+// begins shutting down. A panic in fn is logged and doesn't stop later runs.
+func (app *application) every(interval time.Duration, fn func()) {
+	app.background(func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				func() {
+					defer func() {
+						if err := recover(); err != nil {
+							app.logger.PrintError(fmt.Errorf("%s", err), nil)
+						}
+					}()
+					fn()
+				}()
+			case <-app.shutdown:
+				return
+			}
+		}
+	})
+}
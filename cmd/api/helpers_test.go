@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"greenlight.yp2743.me/internal/data"
+)
+
+func TestDeletedResponse(t *testing.T) {
+	tests := []struct {
+		err        error
+		wantStatus int
+	}{
+		{nil, http.StatusNoContent},
+		{data.ErrRecordNotFound, http.StatusNotFound},
+		{fmt.Errorf("deleting: %w", data.ErrRecordNotFound), http.StatusNotFound},
+		{errors.New("connection refused"), http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		app := newTestApplication(t)
+
+		rr := httptest.NewRecorder()
+		app.deletedResponse(rr, httptest.NewRequest(http.MethodDelete, "/v1/movies/1", nil), tt.err)
+		if rr.Code != tt.wantStatus {
+			t.Errorf("%v: got status %d; want %d", tt.err, rr.Code, tt.wantStatus)
+		}
+		if tt.err == nil && rr.Body.Len() != 0 {
+			t.Errorf("got body %q; want none", rr.Body)
+		}
+	}
+}
+
+func TestReadJSONTopLevelType(t *testing.T) {
+	tests := []struct {
+		body    string
+		dst     interface{}
+		wantErr string
+	}{
+		{`[{"title": "Alien"}]`, &struct{ Title string }{}, "body must be a single JSON object, not an array"},
+		{`"Alien"`, &struct{ Title string }{}, "body must be a single JSON object, not a string"},
+		{`42`, &map[string]string{}, "body must be a single JSON object, not a number"},
+		{`{"title": "Alien"}`, &[]string{}, "body must be a JSON array, not an object"},
+		{`{"title": "Alien"}`, &struct{ Title string }{}, ""},
+	}
+
+	for _, tt := range tests {
+		app := newTestApplication(t)
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+
+		err := app.readJSON(httptest.NewRecorder(), r, tt.dst)
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%s: got error %v", tt.body, err)
+		case tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr):
+			t.Errorf("%s: got error %v; want %q", tt.body, err, tt.wantErr)
+		}
+	}
+}
+
+func TestEtagMatches(t *testing.T) {
+	const etag = `"abc123"`
+
+	tests := []struct {
+		header string
+		weak   bool
+		want   bool
+	}{
+		{"", true, false},
+		{"", false, false},
+		{`"abc123"`, true, true},
+		{`"abc123"`, false, true},
+		{`"other"`, true, false},
+		{`"other", "abc123"`, true, true},
+		{`"other","abc123"`, false, true},
+		{`W/"abc123"`, true, true},
+		{`W/"abc123"`, false, false},
+		{"*", true, true},
+		{"*", false, true},
+	}
+
+	for _, tt := range tests {
+		got := etagMatches(tt.header, etag, tt.weak)
+		if got != tt.want {
+			t.Errorf("etagMatches(%q, weak %t) = %t; want %t", tt.header, tt.weak, got, tt.want)
+		}
+	}
+}
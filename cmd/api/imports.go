@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"greenlight.yp2743.me/internal/data"
+	"greenlight.yp2743.me/internal/validator"
+)
+
+const (
+	userImportBatchSize = 100
+	userImportMaxBytes  = 32 << 20
+)
+
+// userImportResult reports the outcome of importing a single CSV row. Status is one
+// of created, skipped, invalid or failed.
+type userImportResult struct {
+	Row    int               `json:"row"`
+	Email  string            `json:"email,omitempty"`
+	Status string            `json:"status"`
+	UserID int64             `json:"user_id,omitempty"`
+	Reason string            `json:"reason,omitempty"`
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+type userImportRow struct {
+	user           *data.User
+	sendActivation bool
+	result         *userImportResult
+}
+
+// importUsersHandler imports users from a CSV upload with a header row naming the
+// columns: name and email are required, password_hash and send_activation optional.
+// Users are imported activated unless send_activation is set, in which case they are
+// sent an activation email instead; a user imported without a password hash can't log
+// in until they set a password. The upload is read row by row, valid rows are inserted
+// in batches, each in its own transaction, and a per-row report is returned.
+func (app *application) importUsersHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, userImportMaxBytes)
+
+	reader := csv.NewReader(r.Body)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		app.badRequestResponse(w, r, errors.New("body must be a CSV file with a header row"))
+		return
+	}
+
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range []string{"name", "email"} {
+		if _, ok := columns[name]; !ok {
+			app.badRequestResponse(w, r, fmt.Errorf("CSV header must include a %q column", name))
+			return
+		}
+	}
+
+	field := func(record []string, name string) string {
+		i, ok := columns[name]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	results := []*userImportResult{}
+	seen := make(map[string]bool)
+	batch := make([]userImportRow, 0, userImportBatchSize)
+	sentEmails := false
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		defer func() { batch = batch[:0] }()
+
+		emails := make([]string, len(batch))
+		for i, row := range batch {
+			emails[i] = row.user.Email
+		}
+
+		existing, err := app.modelsFor(r).Users.GetExistingEmails(emails)
+		if err != nil {
+			return err
+		}
+
+		pending := make([]userImportRow, 0, len(batch))
+		for _, row := range batch {
+			if existing[strings.ToLower(row.user.Email)] {
+				row.result.Status = "skipped"
+				row.result.Reason = "a user with this email address already exists"
+				continue
+			}
+			pending = append(pending, row)
+		}
+
+		err = app.modelsFor(r).Transaction(func(tx data.Models) error {
+			for _, row := range pending {
+				err := app.insertImportedUser(tx, row)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			// A concurrent insert of the same email fails the whole batch rather than
+			// the request, so rows already committed are still reported.
+			if !errors.Is(err, data.ErrDuplicateEmail) {
+				return err
+			}
+			for _, row := range pending {
+				row.result.Status = "failed"
+				row.result.Reason = "batch rolled back because an email address was taken concurrently"
+			}
+			return nil
+		}
+
+		for _, row := range pending {
+			row.result.Status = "created"
+			row.result.UserID = row.user.ID
+			if row.sendActivation {
+				sentEmails = true
+			}
+		}
+		return nil
+	}
+
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			// The reader can't reliably resynchronise after a malformed record or a
+			// truncated upload, so the import stops here.
+			result := &userImportResult{
+				Status: "invalid",
+				Reason: fmt.Sprintf("import stopped: %s", err),
+			}
+			var parseError *csv.ParseError
+			if errors.As(err, &parseError) {
+				result.Row = parseError.StartLine
+			}
+			results = append(results, result)
+			break
+		}
+
+		line, _ := reader.FieldPos(0)
+		result := &userImportResult{Row: line, Email: field(record, "email")}
+		results = append(results, result)
+
+		user := &data.User{
+			Name:         field(record, "name"),
+			Email:        result.Email,
+			PasswordHash: field(record, "password_hash"),
+		}
+
+		v := validator.New()
+		data.ValidateImportedUser(v, user, app.modelsFor(r).Users.Passwords)
+
+		sendActivation := false
+		if value := field(record, "send_activation"); value != "" {
+			sendActivation, err = strconv.ParseBool(value)
+			v.Check(err == nil, "send_activation", "must be a boolean")
+		}
+		v.Check(user.PasswordHash != "" || sendActivation, "password_hash", "must be provided unless send_activation is set")
+
+		if !v.Valid() {
+			result.Status = "invalid"
+			result.Errors = v.Errors
+			continue
+		}
+
+		if seen[strings.ToLower(user.Email)] {
+			result.Status = "skipped"
+			result.Reason = "duplicate email address earlier in the file"
+			continue
+		}
+		seen[strings.ToLower(user.Email)] = true
+
+		user.Activated = !sendActivation
+		batch = append(batch, userImportRow{user: user, sendActivation: sendActivation, result: result})
+
+		if len(batch) == userImportBatchSize {
+			err = flush()
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+		}
+	}
+
+	err = flush()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if sentEmails {
+		app.background(app.dispatchOutbox)
+	}
+
+	summary := map[string]int{"created": 0, "skipped": 0, "invalid": 0, "failed": 0}
+	for _, result := range results {
+		summary[result.Status]++
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"results": results, "summary": summary}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// insertImportedUser inserts a single imported user with the same default permission
+// as a self-registered one, queueing an activation email if requested.
+func (app *application) insertImportedUser(tx data.Models, row userImportRow) error {
+	err := tx.Users.Insert(row.user)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Permissions.AddForUser(row.user.ID, "movies:read")
+	if err != nil {
+		return err
+	}
+
+	if !row.sendActivation {
+		return nil
+	}
+
+	return tx.Outbox.Insert(&data.OutboxMessage{
+		Recipient: row.user.Email,
+		Template:  "user_welcome.html",
+		Data: map[string]interface{}{
+			"userID": row.user.ID,
+		},
+		Token: &data.OutboxToken{UserID: row.user.ID, Scope: data.ScopeActivation, Key: "activationToken"},
+	})
+}
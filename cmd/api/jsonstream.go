@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// A jsonElementError reports an array element which was well-formed JSON but didn't
+// fit the type it was decoded into. The rest of the array can still be read.
+type jsonElementError struct {
+	message string
+}
+
+func (e *jsonElementError) Error() string {
+	return e.message
+}
+
+// jsonArrayReader reads a request body holding a JSON array one element at a time, so
+// that the array is never held in memory as a whole. Unknown keys are rejected, as in
+// readJSON.
+type jsonArrayReader struct {
+	dec      *json.Decoder
+	maxBytes int
+	opened   bool
+}
+
+func (app *application) newJSONArrayReader(w http.ResponseWriter, r *http.Request, maxBytes int) *jsonArrayReader {
+	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
+
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+
+	return &jsonArrayReader{dec: dec, maxBytes: maxBytes}
+}
+
+// next decodes the next element of the array into dst, returning false once the array
+// and the body have been read to the end. An element of the wrong shape is reported as
+// a *jsonElementError; any other error means the body can't be read any further.
+func (a *jsonArrayReader) next(dst interface{}) (bool, error) {
+	if !a.opened {
+		err := a.open()
+		if err != nil {
+			return false, err
+		}
+		a.opened = true
+	}
+
+	if !a.dec.More() {
+		return false, a.close()
+	}
+
+	err := a.dec.Decode(dst)
+	if err != nil {
+		var unmarshalTypeError *json.UnmarshalTypeError
+		switch {
+		case errors.As(err, &unmarshalTypeError):
+			if unmarshalTypeError.Field != "" {
+				return true, &jsonElementError{fmt.Sprintf("contains incorrect JSON type for field %q", unmarshalTypeError.Field)}
+			}
+			got, _, _ := strings.Cut(unmarshalTypeError.Value, " ")
+			return true, &jsonElementError{fmt.Sprintf("must be a JSON object, not %s", withArticle(got))}
+
+		case strings.HasPrefix(err.Error(), "json: unknown field "):
+			fieldName := strings.TrimPrefix(err.Error(), "json: unknown field ")
+			return true, &jsonElementError{fmt.Sprintf("contains unknown key %s", fieldName)}
+
+		// Running out of body part way through the array is a truncated body, not an
+		// empty one.
+		case errors.Is(err, io.EOF):
+			return false, jsonBodyError(io.ErrUnexpectedEOF, a.maxBytes)
+
+		default:
+			return false, jsonBodyError(err, a.maxBytes)
+		}
+	}
+	return true, nil
+}
+
+// open reads the opening bracket of the array.
+func (a *jsonArrayReader) open() error {
+	token, err := a.dec.Token()
+	if err != nil {
+		return jsonBodyError(err, a.maxBytes)
+	}
+
+	var got string
+	switch token := token.(type) {
+	case json.Delim:
+		if token == '[' {
+			return nil
+		}
+		got = "an object"
+	case string:
+		got = "a string"
+	case float64, json.Number:
+		got = "a number"
+	case bool:
+		got = "a bool"
+	default:
+		got = "null"
+	}
+	return fmt.Errorf("body must be a JSON array, not %s", got)
+}
+
+// close reads the closing bracket of the array, and checks nothing follows it.
+func (a *jsonArrayReader) close() error {
+	_, err := a.dec.Token()
+	if err != nil {
+		return jsonBodyError(err, a.maxBytes)
+	}
+
+	err = a.dec.Decode(&struct{}{})
+	if err != io.EOF {
+		return errors.New("body must only contain a single JSON value")
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"greenlight.yp2743.me/internal/data"
+)
+
+func TestJSONArrayReaderTopLevelType(t *testing.T) {
+	tests := []struct {
+		body    string
+		wantErr string
+	}{
+		{`{"title": "Alien"}`, "body must be a JSON array, not an object"},
+		{`"Alien"`, "body must be a JSON array, not a string"},
+		{`42`, "body must be a JSON array, not a number"},
+		{`null`, "body must be a JSON array, not null"},
+		{`[{"title": "Alien"}]`, ""},
+	}
+
+	for _, tt := range tests {
+		app := newTestApplication(t)
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+		body := app.newJSONArrayReader(httptest.NewRecorder(), r, 1024)
+
+		var dst struct {
+			Title string `json:"title"`
+		}
+		_, err := body.next(&dst)
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%s: got error %v", tt.body, err)
+		case tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr):
+			t.Errorf("%s: got error %v; want %q", tt.body, err, tt.wantErr)
+		}
+	}
+}
+
+func TestTopLevelTypeMismatchResponses(t *testing.T) {
+	app := newTestApplication(t)
+	user := &data.User{ID: 1, Name: "Test User", Activated: true}
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		body    string
+		want    string
+	}{
+		{"array to an object endpoint", app.createMovieHandler, `[{"title": "Alien"}]`, "body must be a single JSON object, not an array"},
+		{"object to a batch endpoint", app.createMoviesBatchHandler, `{"title": "Alien"}`, "body must be a JSON array, not an object"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := serveAs(app, tt.handler, user, httptest.NewRequest(http.MethodPost, "/v1/movies", strings.NewReader(tt.body)))
+			if rr.Code != http.StatusBadRequest {
+				t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusBadRequest, rr.Body)
+			}
+			if !strings.Contains(rr.Body.String(), tt.want) {
+				t.Errorf("got %s; want the error %q", rr.Body, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"greenlight.yp2743.me/internal/data"
+	"greenlight.yp2743.me/internal/jsonlog"
+)
+
+// testDBConfig returns a configuration for the database named by the
+// GREENLIGHT_TEST_DSN environment variable, skipping the test if it isn't set.
+//
+// These tests run against an existing, migrated server rather than one started with
+// testcontainers, which the module doesn't depend on.
+func testDBConfig(t *testing.T) config {
+	t.Helper()
+
+	dsn := os.Getenv("GREENLIGHT_TEST_DSN")
+	if dsn == "" {
+		t.Skip("GREENLIGHT_TEST_DSN is not set")
+	}
+
+	var cfg config
+	cfg.db.dsn = dsn
+	cfg.db.maxOpenConns = "4"
+	cfg.db.maxIdleTime = "1m"
+	cfg.db.connectBackoff = 10 * time.Millisecond
+	return cfg
+}
+
+func TestOpenDBStatementTimeout(t *testing.T) {
+	cfg := testDBConfig(t)
+	cfg.db.statementTimeout = 100 * time.Millisecond
+
+	db, err := openDB(cfg, jsonlog.New(io.Discard, jsonlog.LevelOff))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.pool.Close()
+
+	// No deadline on the Go side: only the server can stop the query.
+	start := time.Now()
+	_, err = db.pool.Exec(context.Background(), "SELECT pg_sleep(5)")
+
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) || pgErr.Code != "57014" {
+		t.Fatalf("got error %v; want a query_canceled error from the server", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("query ran for %s before it was cancelled", elapsed)
+	}
+
+	// Every connection gets the timeout, not just the first.
+	conns := make([]*pgxpool.Conn, 0, 2)
+	defer func() {
+		for _, conn := range conns {
+			conn.Release()
+		}
+	}()
+	for i := 0; i < 2; i++ {
+		conn, err := db.pool.Acquire(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+
+		var timeout string
+		err = conn.QueryRow(context.Background(), "SHOW statement_timeout").Scan(&timeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if timeout != "100ms" {
+			t.Errorf("connection %d: got statement_timeout %q; want 100ms", i, timeout)
+		}
+	}
+}
+
+func TestWarmUpDB(t *testing.T) {
+	cfg := testDBConfig(t)
+
+	db, err := openDB(cfg, jsonlog.New(io.Discard, jsonlog.LevelOff))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.pool.Close()
+
+	err = warmUpDB(db.pool, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The connections are left established and idle, ready for the first requests.
+	stat := db.pool.Stat()
+	if stat.TotalConns() != 3 || stat.IdleConns() != 3 {
+		t.Errorf("got %d connections, %d idle; want 3 established and idle", stat.TotalConns(), stat.IdleConns())
+	}
+}
+
+func TestOpenDBTwice(t *testing.T) {
+	cfg := testDBConfig(t)
+	logger := jsonlog.New(io.Discard, jsonlog.LevelOff)
+
+	first, err := openDB(cfg, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.pool.Close()
+
+	second, err := openDB(cfg, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.pool.Close()
+
+	if first == second || first.pool == second.pool {
+		t.Fatal("openDB returned the same pool twice")
+	}
+
+	// Closing one pool leaves the other usable.
+	first.pool.Close()
+	err = second.pool.Ping(context.Background())
+	if err != nil {
+		t.Errorf("second pool unusable after the first was closed: %v", err)
+	}
+}
+
+func TestDBAcquireAndQueryTimeouts(t *testing.T) {
+	cfg := testDBConfig(t)
+	cfg.db.maxOpenConns = "1"
+
+	db, err := openDB(cfg, jsonlog.New(io.Discard, jsonlog.LevelOff))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.pool.Close()
+
+	app := newTestApplication(t)
+	app.config.overload.retryAfter = 5 * time.Second
+	app.models = data.NewModels(db.pool, data.Passwords{}).WithTimeouts(data.Timeouts{
+		Acquire: 300 * time.Millisecond,
+		Query:   300 * time.Millisecond,
+	})
+
+	// With the only connection taken, queries fail once the acquire timeout is up.
+	conn, err := db.pool.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = app.models.Movies.DB.Exec(context.Background(), "SELECT 1")
+	if !errors.Is(err, data.ErrAcquireTimeout) {
+		t.Errorf("got error %v; want %v", err, data.ErrAcquireTimeout)
+	}
+
+	rr := serveAs(app, app.showMovieHandler, nil, withID(httptest.NewRequest(http.MethodGet, "/", nil), 1))
+	if rr.Code != http.StatusServiceUnavailable || rr.Header().Get("Retry-After") != "5" {
+		t.Errorf("got status %d with Retry-After %q; want %d with 5", rr.Code, rr.Header().Get("Retry-After"), http.StatusServiceUnavailable)
+	}
+
+	// Waiting for a connection doesn't use up the query's time: each stage here is
+	// within its own timeout, though together they're over either.
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		conn.Release()
+	}()
+	_, err = app.models.Movies.DB.Exec(context.Background(), "SELECT pg_sleep(0.2)")
+	if err != nil {
+		t.Errorf("got error %v; want the query to succeed", err)
+	}
+
+	// A query which runs too long fails with a query timeout.
+	_, err = app.models.Movies.DB.Exec(context.Background(), "SELECT pg_sleep(1)")
+	if !errors.Is(err, data.ErrQueryTimeout) || errors.Is(err, data.ErrAcquireTimeout) {
+		t.Errorf("got error %v; want %v", err, data.ErrQueryTimeout)
+	}
+}
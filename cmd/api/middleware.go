@@ -3,8 +3,12 @@ package main
 import (
 	"errors"
 	"expvar"
-	"fmt"
+	"math"
+	"net"
 	"net/http"
+	"net/netip"
+	"runtime/metrics"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -22,74 +26,287 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 		defer func() {
 			if err := recover(); err != nil {
 				w.Header().Set("Connection", "close")
-				app.serverErrorResponse(w, r, fmt.Errorf("%s", err))
+				app.serverErrorResponse(w, r, panicError{value: err})
 			}
 		}()
 		next.ServeHTTP(w, r)
 	})
 }
 
-func (app *application) rateLimit(next http.Handler) http.Handler {
+// clientLimiters holds a token bucket for each client, keyed by IP address or user.
+// Buckets which haven't been used for a few minutes are pruned.
+type clientLimiters struct {
+	mu      sync.Mutex
+	clients map[string]*clientLimiter
+}
 
-	type client struct {
-		limiter  *rate.Limiter
-		lastSeen time.Time
-	}
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
 
-	var (
-		mu      sync.Mutex
-		clients = make(map[string]*client)
-	)
+func newClientLimiters() *clientLimiters {
+	l := &clientLimiters{clients: make(map[string]*clientLimiter)}
 
 	go func() {
 		for {
 			time.Sleep(time.Minute)
-			mu.Lock()
+			l.mu.Lock()
 
-			for ip, client := range clients {
+			for key, client := range l.clients {
 				if time.Since(client.lastSeen) > 3*time.Minute {
-					delete(clients, ip)
+					delete(l.clients, key)
 				}
 			}
-			mu.Unlock()
+			l.mu.Unlock()
 		}
 	}()
 
+	return l
+}
+
+// reserve takes a request from the client's bucket, creating it with the given limit
+// and burst size if needed, and sets the rate limit headers. It returns how long the
+// client must wait before the request would be allowed, or 0 if it's allowed now.
+func (l *clientLimiters) reserve(w http.ResponseWriter, key string, limit rate.Limit, size int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, found := l.clients[key]; !found {
+		l.clients[key] = &clientLimiter{limiter: rate.NewLimiter(limit, size)}
+	}
+
+	l.clients[key].lastSeen = time.Now()
+
+	reservation := l.clients[key].limiter.Reserve()
+	delay := reservation.Delay()
+	if delay > 0 {
+		reservation.Cancel()
+	}
+	setRateLimitHeaders(w, l.clients[key].limiter)
+	return delay
+}
+
+// rateLimitIP limits the rate of requests from each IP address. It runs before
+// authenticate, so that a flood of requests is turned away before any tokens are
+// looked up.
+func (app *application) rateLimitIP(next http.Handler) http.Handler {
+	if !app.config.limiter.enabled {
+		return next
+	}
+
+	// The limits are validated at startup.
+	rps, _ := strconv.ParseFloat(app.config.limiter.rps, 64)
+	burst, _ := strconv.Atoi(app.config.limiter.burst)
+
+	limiters := newClientLimiters()
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		delay := limiters.reserve(w, "ip:"+app.clientIP(r), rate.Limit(rps), burst)
+		if delay > 0 {
+			app.rateLimitExceededResponse(w, r, delay)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
 
-		if app.config.limiter.enabled {
+// rateLimitUser additionally limits authenticated users by their user ID, with a
+// separate limit, after authenticate has identified them. Anonymous requests are only
+// limited by rateLimitIP.
+func (app *application) rateLimitUser(next http.Handler) http.Handler {
+	if !app.config.limiter.enabled {
+		return next
+	}
 
-			// Extract the client's IP address from the request.
-			ip := realip.FromRequest(r)
+	limiters := newClientLimiters()
 
-			mu.Lock()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := app.contextGetUser(r)
+		if user.IsAnonymous() {
+			next.ServeHTTP(w, r)
+			return
+		}
 
-			rps, err := strconv.ParseFloat(app.config.limiter.rps, 64)
-			if err != nil {
-				return
-			}
-			burst, err := strconv.Atoi(app.config.limiter.burst)
-			if err != nil {
-				return
-			}
-			if _, found := clients[ip]; !found {
-				clients[ip] = &client{limiter: rate.NewLimiter(rate.Limit(rps), burst)}
+		key := "user:" + strconv.FormatInt(user.ID, 10)
+		delay := limiters.reserve(w, key, rate.Limit(app.config.limiter.userRPS), app.config.limiter.userBurst)
+		if delay > 0 {
+			app.rateLimitExceededResponse(w, r, delay)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// setRateLimitHeaders reports the state of the client's token bucket: its size, the
+// whole tokens left in it, and the seconds until it's full again.
+func setRateLimitHeaders(w http.ResponseWriter, limiter *rate.Limiter) {
+	tokens := limiter.Tokens()
+	reset := math.Ceil((float64(limiter.Burst()) - tokens) / float64(limiter.Limit()))
+
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(limiter.Burst()))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(max(int(tokens), 0)))
+	w.Header().Set("X-RateLimit-Reset", strconv.Itoa(max(int(reset), 0)))
+}
+
+// defaultContentSecurityPolicy suits JSON responses, which never need to load anything
+// or be framed.
+const defaultContentSecurityPolicy = "default-src 'none'; frame-ancestors 'none'"
+
+// securityHeaders sets headers which stop browsers from sniffing, framing or leaking
+// the referrer of responses. Every route serves JSON, including the OpenAPI document,
+// so one policy fits them all; a route serving HTML docs would need its own.
+func (app *application) securityHeaders(next http.Handler) http.Handler {
+	if !app.config.securityHeaders.enabled {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("X-Frame-Options", "DENY")
+		w.Header().Set("Referrer-Policy", "no-referrer")
+		if policy := app.config.securityHeaders.contentSecurityPolicy; policy != "" {
+			w.Header().Set("Content-Security-Policy", policy)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// strictTransportSecurity sends the Strict-Transport-Security header on responses to
+// HTTPS requests, whether TLS was terminated here or, as reported by X-Forwarded-Proto,
+// by a trusted proxy. Browsers ignore the header over plain HTTP.
+func (app *application) strictTransportSecurity(next http.Handler) http.Handler {
+	if !app.config.hsts.enabled {
+		return next
+	}
+
+	value := "max-age=" + strconv.FormatInt(int64(app.config.hsts.maxAge.Seconds()), 10)
+	if app.config.hsts.includeSubdomains {
+		value += "; includeSubDomains"
+	}
+	if app.config.hsts.preload {
+		value += "; preload"
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil || (app.fromTrustedProxy(r) && strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")) {
+			w.Header().Set("Strict-Transport-Security", value)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// overloadSamples are the runtime metrics checked by shedOverload.
+var overloadSamples = []metrics.Sample{
+	{Name: "/sched/goroutines:goroutines"},
+	{Name: "/memory/classes/heap/objects:bytes"},
+}
+
+// shedOverload rejects requests with a 503 while the goroutine count or the live heap
+// is over its threshold, as a last resort against cascading failure. The healthcheck
+// is exempt so that it keeps reporting. Entering and leaving overload are logged, but
+// not every rejected request.
+func (app *application) shedOverload(next http.Handler) http.Handler {
+	if app.config.overload.maxGoroutines == 0 && app.config.overload.maxHeapBytes == 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/v1/healthcheck") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		samples := slices.Clone(overloadSamples)
+		metrics.Read(samples)
+		goroutines := samples[0].Value.Uint64()
+		heapBytes := samples[1].Value.Uint64()
+
+		overloaded := (app.config.overload.maxGoroutines > 0 && goroutines > uint64(app.config.overload.maxGoroutines)) ||
+			(app.config.overload.maxHeapBytes > 0 && heapBytes > uint64(app.config.overload.maxHeapBytes))
+
+		if app.overloaded.Swap(overloaded) != overloaded {
+			message := "server overloaded, rejecting requests"
+			if !overloaded {
+				message = "server no longer overloaded"
 			}
+			app.logger.PrintInfo(message, map[string]string{
+				"goroutines": strconv.FormatUint(goroutines, 10),
+				"heap_bytes": strconv.FormatUint(heapBytes, 10),
+			})
+		}
+
+		if overloaded {
+			app.overloadedResponse(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitDBConcurrency wraps handlers which run expensive queries, rejecting requests
+// with a 503 once -max-db-concurrency of them are in flight, so that they can't take
+// every pooled connection and stall the cheap queries behind authentication and the
+// other endpoints. Requests are rejected rather than queued, as queued ones would only
+// hold their connections to the server while the pool is busy.
+func (app *application) limitDBConcurrency(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if app.dbSlots == nil {
+			next(w, r)
+			return
+		}
 
-			clients[ip].lastSeen = time.Now()
+		select {
+		case app.dbSlots <- struct{}{}:
+			defer func() { <-app.dbSlots }()
+			next(w, r)
+		default:
+			app.dbBusyResponse(w, r)
+		}
+	}
+}
 
-			if !clients[ip].limiter.Allow() {
-				mu.Unlock()
-				app.rateLimitExceededResponse(w, r)
+// limitURLLength rejects requests whose URL, including the query string, is longer
+// than the configured limit, before any filters are parsed from it.
+func (app *application) limitURLLength(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.RequestURI) > app.config.maxURLBytes {
+			app.uriTooLongResponse(w, r, app.config.maxURLBytes)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// readOnlyExempt reports whether a write to the path is allowed in read-only mode. Only
+// the admin endpoint which toggles the mode is, so that it can be switched back, and
+// signing in, as the admin may need a token to reach it. Signing in only inserts the
+// new token; the other token endpoints send email or update tokens, so they're
+// rejected like any other write.
+func readOnlyExempt(path string) bool {
+	return path == "/v1/admin/read-only" || path == "/v1/tokens/authentication"
+}
+
+// enforceReadOnly rejects writes while the application is in read-only mode, except to
+// the paths exempted by readOnlyExempt.
+func (app *application) enforceReadOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.readOnly.Load() && !readOnlyExempt(r.URL.Path) {
+			switch r.Method {
+			case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+				app.readOnlyResponse(w, r)
 				return
 			}
-
-			// Very importantly, unlock the mutex before calling the next handler in the chain.
-			mu.Unlock()
-			next.ServeHTTP(w, r)
 		}
+		next.ServeHTTP(w, r)
 	})
+}
 
+// loaders attaches per-request data loaders to the request context.
+func (app *application) loaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, app.contextSetUserLoader(r))
+	})
 }
 
 func (app *application) authenticate(next http.Handler) http.Handler {
@@ -99,27 +316,60 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		// header in the request.
 		w.Header().Add("Vary", "Authorization")
 
-		authorizationHeader := r.Header.Get("Authorization")
-		if authorizationHeader == "" {
+		if app.config.gateway.trustUserHeader {
+			if email := r.Header.Get(authenticatedUserHeader); email != "" {
+				if !app.fromTrustedProxy(r) {
+					app.logger.PrintInfo("ignored authenticated user header from untrusted peer", map[string]string{
+						"remote_addr": r.RemoteAddr,
+					})
+				} else {
+					user, err := app.modelsFor(r).Users.GetByEmail(email)
+					if err != nil {
+						switch {
+						case errors.Is(err, data.ErrRecordNotFound):
+							app.invalidCredentialsResponse(w, r)
+						default:
+							app.serverErrorResponse(w, r, err)
+						}
+						return
+					}
+
+					// The gateway vouches for the user's identity, not for their
+					// account still being open.
+					if user.DeactivatedAt != nil {
+						app.deactivatedAccountResponse(w, r)
+						return
+					}
+
+					r = app.contextSetUser(r, user)
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+		}
+
+		// Only a request with no Authorization header at all is anonymous. A header
+		// which is present but empty, repeated, or malformed is rejected.
+		authorizationHeaders := r.Header.Values("Authorization")
+		if len(authorizationHeaders) == 0 {
 			r = app.contextSetUser(r, data.AnonymousUser)
 			next.ServeHTTP(w, r)
 			return
 		}
 
-		headerParts := strings.Split(authorizationHeader, " ")
-		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
+		token, ok := parseBearerToken(authorizationHeaders)
+		if !ok {
 			app.invalidAuthenticationTokenResponse(w, r)
 			return
 		}
 
-		token := headerParts[1]
 		v := validator.New()
 		if data.ValidateTokenPlaintext(v, token); !v.Valid() {
 			app.invalidAuthenticationTokenResponse(w, r)
 			return
 		}
 
-		user, err := app.models.Users.GetForToken(data.ScopeAuthentication, token)
+		user, err := app.modelsFor(r).Users.GetForToken(data.ScopeAuthentication, token)
 		if err != nil {
 			switch {
 			case errors.Is(err, data.ErrRecordNotFound):
@@ -130,11 +380,143 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			return
 		}
 
+		if !app.checkScopeSunset(w, r, data.ScopeAuthentication) {
+			app.invalidAuthenticationTokenResponse(w, r)
+			return
+		}
+
+		if app.config.tokens.binding != "none" {
+			ok, err := app.checkTokenBinding(r, token)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+			if !ok {
+				app.invalidAuthenticationTokenResponse(w, r)
+				return
+			}
+		}
+
+		if user.ImpersonatorID != 0 {
+			w.Header().Set("X-Impersonated-By", strconv.FormatInt(user.ImpersonatorID, 10))
+		}
+
 		r = app.contextSetUser(r, user)
 		next.ServeHTTP(w, r)
 	})
 }
 
+// checkTokenBinding reports whether the request comes from the same client that the
+// authentication token was issued to, according to the configured binding. Tokens
+// issued without binding information are accepted.
+func (app *application) checkTokenBinding(r *http.Request, tokenPlaintext string) (bool, error) {
+	token, err := app.modelsFor(r).Tokens.Get(data.ScopeAuthentication, tokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+
+	binding := app.config.tokens.binding
+	ip := app.clientIP(r)
+	userAgent := r.UserAgent()
+
+	ipMismatch := (binding == "ip" || binding == "both") && token.IP != "" && token.IP != ip
+	userAgentMismatch := (binding == "user-agent" || binding == "both") && token.UserAgent != "" && token.UserAgent != userAgent
+
+	if ipMismatch || userAgentMismatch {
+		app.logger.PrintInfo("authentication token used from a different client", map[string]string{
+			"user_id":            strconv.FormatInt(token.UserID, 10),
+			"issued_ip":          token.IP,
+			"request_ip":         ip,
+			"issued_user_agent":  token.UserAgent,
+			"request_user_agent": userAgent,
+		})
+		return false, nil
+	}
+	return true, nil
+}
+
+// parseBearerToken extracts the token from the values of the Authorization header.
+// Exactly one header in the form "Bearer <token>" is accepted; the scheme is matched
+// case-insensitively and surrounding whitespace is ignored.
+func parseBearerToken(values []string) (string, bool) {
+	if len(values) != 1 {
+		return "", false
+	}
+
+	headerParts := strings.Fields(values[0])
+	if len(headerParts) != 2 || !strings.EqualFold(headerParts[0], "Bearer") {
+		return "", false
+	}
+	return headerParts[1], true
+}
+
+// authenticatedUserHeader carries the email address of a user already authenticated
+// by an upstream gateway.
+const authenticatedUserHeader = "X-Authenticated-User"
+
+// fromTrustedProxy reports whether the request's immediate peer is a trusted proxy.
+// The peer address is taken from the connection, never from forwarding headers, as
+// those could be set by the client.
+func (app *application) fromTrustedProxy(r *http.Request) bool {
+	addrPort, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	addr := addrPort.Addr().Unmap()
+
+	for _, prefix := range app.config.gateway.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the IP address of the client making the request. Forwarding headers
+// such as X-Forwarded-For are only honoured from trusted proxies; otherwise the address
+// of the immediate peer is used.
+func (app *application) clientIP(r *http.Request) string {
+	if app.fromTrustedProxy(r) {
+		return realip.FromRequest(r)
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// checkScopeSunset reports whether a token in the given scope may still be used. A
+// token in a deprecated scope is accepted until the scope's sunset, with a Sunset
+// header (RFC 8594) and a logged warning, and rejected after it.
+func (app *application) checkScopeSunset(w http.ResponseWriter, r *http.Request, scope string) bool {
+	sunset, deprecated := data.ScopeSunset(scope)
+	if !deprecated {
+		return true
+	}
+
+	properties := map[string]string{
+		"scope":  scope,
+		"sunset": sunset.Format(time.RFC3339),
+		"path":   r.URL.Path,
+	}
+
+	if !time.Now().Before(sunset) {
+		app.logger.PrintInfo("rejected token in sunset scope", properties)
+		return false
+	}
+
+	w.Header().Set("Sunset", sunset.UTC().Format(http.TimeFormat))
+	app.logger.PrintInfo("token in deprecated scope used", properties)
+	return true
+}
+
 func (app *application) requireAuthenticatedUser(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		user := app.contextGetUser(r)
@@ -159,15 +541,64 @@ func (app *application) requireActivatedUser(next http.HandlerFunc) http.Handler
 	return app.requireAuthenticatedUser(fn)
 }
 
+// requireNonce guards a sensitive request with a one-time nonce, which the caller gets
+// from GET /v1/nonce and sends in the X-Nonce header. The nonce is used up before the
+// handler runs, even if the request then fails, so a request recovered from a log
+// can't be replayed. It must be wrapped in requireAuthenticatedUser, as nonces are
+// issued to a user.
+func (app *application) requireNonce(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		nonce := r.Header.Get("X-Nonce")
+		if nonce == "" {
+			app.nonceRequiredResponse(w, r)
+			return
+		}
+
+		err := app.modelsFor(r).Tokens.Consume(data.ScopeNonce, nonce, app.contextGetUser(r).ID)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.invalidNonceResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		if !app.checkScopeSunset(w, r, data.ScopeNonce) {
+			app.invalidNonceResponse(w, r)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
 func (app *application) requirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
+	return app.requireAnyPermission([]string{code}, next)
+}
+
+// requirePublicReadPermission is like requirePermission, except that with public reads
+// everyone, including the anonymous user, is let through. It's only used for the
+// endpoints public reads open up: GET /v1/movies and GET /v1/movies/:id.
+func (app *application) requirePublicReadPermission(code string, next http.HandlerFunc) http.HandlerFunc {
+	if app.config.publicReads {
+		return next
+	}
+	return app.requirePermission(code, next)
+}
+
+// requireAnyPermission is like requirePermission, but lets through users holding any
+// one of the permissions.
+func (app *application) requireAnyPermission(codes []string, next http.HandlerFunc) http.HandlerFunc {
 	fn := func(w http.ResponseWriter, r *http.Request) {
 		user := app.contextGetUser(r)
 
-		permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+		permissions, err := app.modelsFor(r).Permissions.GetAllForUser(user.ID)
 		if err != nil {
 			app.serverErrorResponse(w, r, err)
 			return
-		} else if !permissions.Include(code) {
+		} else if !slices.ContainsFunc(codes, permissions.Include) {
 			app.notPermittedResponse(w, r)
 			return
 		}
@@ -175,7 +606,37 @@ func (app *application) requirePermission(code string, next http.HandlerFunc) ht
 		next.ServeHTTP(w, r)
 	}
 
-	return app.requireActivatedUser(fn)
+	// Activation is only required if it's required for every one of the permissions.
+	if !slices.ContainsFunc(codes, func(code string) bool { return !app.activationRequired(code) }) {
+		return app.requireActivatedUser(fn)
+	}
+	return app.requireAuthenticatedUser(fn)
+}
+
+// activationRequired reports whether a user must have activated their account to use
+// an endpoint guarded by the given permission. With -require-activation=all (the
+// default) every permission-guarded endpoint requires activation. With "writes", the
+// endpoints guarded by a read permission (GET /v1/movies and GET /v1/movies/:id) are
+// open to authenticated but unactivated users, and all others still require activation.
+func (app *application) activationRequired(code string) bool {
+	if app.config.requireActivation == "writes" {
+		return !strings.HasSuffix(code, ":read")
+	}
+	return true
+}
+
+// corsOriginAllowed reports whether cross-origin requests from origin are allowed: any
+// origin when reflecting origins in development, and otherwise only trusted ones.
+func (app *application) corsOriginAllowed(origin string) bool {
+	if app.config.cors.reflectOrigin {
+		return true
+	}
+	for i := range app.config.cors.trustedOrigins {
+		if origin == app.config.cors.trustedOrigins[i] {
+			return true
+		}
+	}
+	return false
 }
 
 func (app *application) enableCORS(next http.Handler) http.Handler {
@@ -184,19 +645,14 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
 		w.Header().Add("Vary", "Access-Control-Request-Method")
 
 		origin := r.Header.Get("Origin")
-		if origin != "" {
-			for i := range app.config.cors.trustedOrigins {
-				if origin == app.config.cors.trustedOrigins[i] {
-					w.Header().Set("Access-Control-Allow-Origin", origin)
-					// Process preflight (OPTIONS) requests.
-					if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
-						w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, PUT, PATCH, DELETE")
-						w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
-						w.WriteHeader(http.StatusOK)
-						return
-					}
-					break
-				}
+		if origin != "" && app.corsOriginAllowed(origin) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			// Process preflight (OPTIONS) requests.
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, PUT, PATCH, DELETE")
+				w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, If-Match, If-None-Match, X-Nonce")
+				w.WriteHeader(http.StatusOK)
+				return
 			}
 		}
 
@@ -204,12 +660,50 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
 	})
 }
 
-func (app *application) metrics(next http.Handler) http.Handler {
-	totalRequestsReceived := expvar.NewInt("total_requests_received")
-	totalResponsesSent := expvar.NewInt("total_responses_sent")
-	totalProcessingTimeMicroseconds := expvar.NewInt("total_processing_time_μs")
-	totalResponsesSentByStatus := expvar.NewMap("total_responses_sent_by_status")
+// compress encodes responses with Brotli, gzip or deflate, as negotiated from the
+// Accept-Encoding header, once they reach -compression-min-size bytes. It's a no-op
+// when -enable-compression is off.
+func (app *application) compress(next http.Handler) http.Handler {
+	if !app.config.compression.enabled {
+		return next
+	}
 
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"), app.config.compression.brotli)
+		if encoding == "" || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressWriter{
+			ResponseWriter: w,
+			encoding:       encoding,
+			level:          app.config.compression.level,
+			minSize:        app.config.compression.minSize,
+		}
+		defer func() {
+			err := cw.Close()
+			if err != nil {
+				app.logError(r, err)
+			}
+		}()
+
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// The request metrics are published once per process, however many times the routes
+// are built.
+var (
+	totalRequestsReceived           = expvar.NewInt("total_requests_received")
+	totalResponsesSent              = expvar.NewInt("total_responses_sent")
+	totalProcessingTimeMicroseconds = expvar.NewInt("total_processing_time_μs")
+	totalResponsesSentByStatus      = expvar.NewMap("total_responses_sent_by_status")
+)
+
+func (app *application) metrics(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		totalRequestsReceived.Add(1)
 		metrics := httpsnoop.CaptureMetrics(next, w, r)
@@ -218,3 +712,41 @@ func (app *application) metrics(next http.Handler) http.Handler {
 		totalResponsesSentByStatus.Add(strconv.Itoa(metrics.Code), 1)
 	})
 }
+
+// logRequests logs each completed request. Error responses (4xx and 5xx) are always
+// logged, but only one in every -log-sample-rate successful responses is, to cut the
+// noise; the number left out is summarized periodically by logSampledOutRequests.
+func (app *application) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		metrics := httpsnoop.CaptureMetrics(next, w, r)
+
+		if metrics.Code < 400 {
+			n := app.requestLog.successes.Add(1)
+			if app.config.logging.sampleRate == 0 || n%int64(app.config.logging.sampleRate) != 0 {
+				app.requestLog.sampledOut.Add(1)
+				return
+			}
+		}
+
+		app.logger.PrintInfo("request completed", map[string]string{
+			"request_id":     app.contextGetRequestID(r),
+			"request_method": r.Method,
+			"request_url":    r.URL.String(),
+			"status":         strconv.Itoa(metrics.Code),
+			"duration":       metrics.Duration.String(),
+			"bytes":          strconv.FormatInt(metrics.Written, 10),
+		})
+	})
+}
+
+// logSampledOutRequests logs how many successful requests have gone unlogged since it
+// last ran.
+func (app *application) logSampledOutRequests() {
+	n := app.requestLog.sampledOut.Swap(0)
+	if n == 0 {
+		return
+	}
+	app.logger.PrintInfo("successful requests not logged due to sampling", map[string]string{
+		"count": strconv.FormatInt(n, 10),
+	})
+}
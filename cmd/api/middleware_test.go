@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"greenlight.yp2743.me/internal/data"
+	"greenlight.yp2743.me/internal/jsonlog"
+)
+
+func TestAuthenticateTrustedGateway(t *testing.T) {
+	app := newTestDBApplication(t)
+	app.config.gateway.trustUserHeader = true
+	app.config.gateway.trustedProxies = []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}
+
+	active := newTestUser(t, app)
+	deactivated := newTestUser(t, app)
+	now := time.Now()
+	deactivated.Activated = false
+	deactivated.DeactivatedAt = &now
+	err := app.models.Users.Update(deactivated)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := app.authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Test-User", app.contextGetUser(r).Email)
+	}))
+
+	tests := []struct {
+		email      string
+		wantStatus int
+	}{
+		{active.Email, http.StatusOK},
+		{deactivated.Email, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		// httptest requests come from 192.0.2.1.
+		r := httptest.NewRequest(http.MethodGet, "/v1/movies", nil)
+		r.Header.Set(authenticatedUserHeader, tt.email)
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, r)
+		if rr.Code != tt.wantStatus {
+			t.Errorf("%s: got status %d; want %d", tt.email, rr.Code, tt.wantStatus)
+		}
+		if rr.Code == http.StatusOK && rr.Header().Get("X-Test-User") != tt.email {
+			t.Errorf("%s: authenticated as %q", tt.email, rr.Header().Get("X-Test-User"))
+		}
+	}
+}
+
+func TestAnonymousReads(t *testing.T) {
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+
+	// The public reads setting is read per request.
+	app := newTestApplication(t)
+	router := app.routes()
+
+	for _, publicReads := range []bool{false, true} {
+		app.config.publicReads = publicReads
+
+		// The guard on GET /v1/movies and GET /v1/movies/:id.
+		wantStatus := http.StatusUnauthorized
+		if publicReads {
+			wantStatus = http.StatusOK
+		}
+		rr := serveAs(app, app.requirePublicReadPermission("movies:read", ok), nil, httptest.NewRequest(http.MethodGet, "/v1/movies", nil))
+		if rr.Code != wantStatus {
+			t.Errorf("public reads %t, movie reads: got status %d; want %d", publicReads, rr.Code, wantStatus)
+		}
+
+		// Other reads stay closed to anonymous users either way.
+		for _, path := range []string{"/v1/movies/1/script", "/v1/movies/1/history"} {
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+			if rr.Code != http.StatusUnauthorized {
+				t.Errorf("public reads %t, GET %s: got status %d; want %d", publicReads, path, rr.Code, http.StatusUnauthorized)
+			}
+		}
+	}
+}
+
+func TestLogRequestsSampling(t *testing.T) {
+	tests := []struct {
+		sampleRate     int
+		wantSuccesses  int
+		wantSampledOut string
+	}{
+		{1, 30, ""},
+		{10, 3, "27"},
+		{0, 0, "30"},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("rate %d", tt.sampleRate), func(t *testing.T) {
+			var buf bytes.Buffer
+			app := newTestApplication(t)
+			app.logger = jsonlog.New(&buf, jsonlog.LevelInfo)
+			app.config.logging.sampleRate = tt.sampleRate
+
+			handler := app.logRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				status, _ := strconv.Atoi(r.URL.Query().Get("status"))
+				w.WriteHeader(status)
+			}))
+			for _, status := range []int{http.StatusOK, http.StatusNotFound, http.StatusInternalServerError} {
+				n := 30
+				if status != http.StatusOK {
+					n = 5
+				}
+				for i := 0; i < n; i++ {
+					handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, fmt.Sprintf("/v1/movies?status=%d", status), nil))
+				}
+			}
+			app.logSampledOutRequests()
+
+			counts := map[string]int{}
+			var sampledOut string
+			dec := json.NewDecoder(&buf)
+			for dec.More() {
+				var entry struct {
+					Message    string            `json:"message"`
+					Properties map[string]string `json:"properties"`
+				}
+				err := dec.Decode(&entry)
+				if err != nil {
+					t.Fatal(err)
+				}
+				switch entry.Message {
+				case "request completed":
+					counts[entry.Properties["status"]]++
+				case "successful requests not logged due to sampling":
+					sampledOut = entry.Properties["count"]
+				}
+			}
+
+			// Errors are always logged, whatever the rate.
+			if counts["404"] != 5 || counts["500"] != 5 {
+				t.Errorf("got %d 404s and %d 500s logged; want all 5 of each", counts["404"], counts["500"])
+			}
+			if counts["200"] != tt.wantSuccesses {
+				t.Errorf("got %d successes logged; want %d", counts["200"], tt.wantSuccesses)
+			}
+			if sampledOut != tt.wantSampledOut {
+				t.Errorf("got %q summarized as sampled out; want %q", sampledOut, tt.wantSampledOut)
+			}
+		})
+	}
+}
+
+func TestEnableCORSByEnvironment(t *testing.T) {
+	tests := []struct {
+		env            string
+		trustedOrigins []string
+		origin         string
+		wantAllowed    bool
+	}{
+		// Development reflects any origin, unless there's an allowlist.
+		{"development", nil, "http://localhost:3000", true},
+		{"development", []string{"https://app.example.com"}, "http://localhost:3000", false},
+		{"development", []string{"https://app.example.com"}, "https://app.example.com", true},
+		// Production never reflects arbitrary origins.
+		{"production", nil, "http://localhost:3000", false},
+		{"production", []string{"https://app.example.com"}, "https://evil.example.com", false},
+		{"production", []string{"https://app.example.com"}, "https://app.example.com", true},
+	}
+
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		app := newTestApplication(t)
+		app.config.env = tt.env
+		app.config.cors.trustedOrigins = tt.trustedOrigins
+		configureCORS(&app.config, jsonlog.New(&buf, jsonlog.LevelInfo))
+
+		// Reflecting origins is always called out in the logs.
+		if warned := bytes.Contains(buf.Bytes(), []byte("allowing requests from any origin")); warned != app.config.cors.reflectOrigin {
+			t.Errorf("%s with %v: got warning %t; want %t", tt.env, tt.trustedOrigins, warned, app.config.cors.reflectOrigin)
+		}
+
+		for _, method := range []string{http.MethodGet, http.MethodOptions} {
+			r := httptest.NewRequest(method, "/v1/movies", nil)
+			r.Header.Set("Origin", tt.origin)
+			if method == http.MethodOptions {
+				r.Header.Set("Access-Control-Request-Method", http.MethodPut)
+			}
+
+			rr := httptest.NewRecorder()
+			app.enableCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(rr, r)
+
+			got := rr.Header().Get("Access-Control-Allow-Origin")
+			if tt.wantAllowed && got != tt.origin {
+				t.Errorf("%s with %v, %s from %s: got Access-Control-Allow-Origin %q; want %q", tt.env, tt.trustedOrigins, method, tt.origin, got, tt.origin)
+			}
+			if !tt.wantAllowed && got != "" {
+				t.Errorf("%s with %v, %s from %s: got Access-Control-Allow-Origin %q; want none", tt.env, tt.trustedOrigins, method, tt.origin, got)
+			}
+		}
+	}
+}
+
+func TestLimitDBConcurrency(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.overload.retryAfter = 5 * time.Second
+	app.dbSlots = make(chan struct{}, 2)
+
+	// Fill the budget with requests which hold their slots until released.
+	started := make(chan struct{})
+	release := make(chan struct{})
+	heavy := app.limitDBConcurrency(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	})
+
+	done := make(chan int)
+	for i := 0; i < cap(app.dbSlots); i++ {
+		go func() {
+			rr := httptest.NewRecorder()
+			heavy(rr, httptest.NewRequest(http.MethodGet, "/v1/movies", nil))
+			done <- rr.Code
+		}()
+		<-started
+	}
+
+	rr := httptest.NewRecorder()
+	heavy(rr, httptest.NewRequest(http.MethodGet, "/v1/movies", nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d over the budget; want %d", rr.Code, http.StatusServiceUnavailable)
+	}
+	if got := rr.Header().Get("Retry-After"); got != "5" {
+		t.Errorf("got Retry-After %q; want %q", got, "5")
+	}
+
+	// Cheap endpoints aren't held up by the saturated budget.
+	rr = httptest.NewRecorder()
+	app.livenessHandler(rr, httptest.NewRequest(http.MethodGet, "/v1/healthcheck", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("got status %d from the liveness check; want %d", rr.Code, http.StatusOK)
+	}
+
+	close(release)
+	for i := 0; i < cap(app.dbSlots); i++ {
+		if code := <-done; code != http.StatusOK {
+			t.Errorf("got status %d from a request within the budget; want %d", code, http.StatusOK)
+		}
+	}
+
+	// Once the slots are released, heavy requests are served again.
+	go func() { <-started }()
+	rr = httptest.NewRecorder()
+	heavy(rr, httptest.NewRequest(http.MethodGet, "/v1/movies", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("got status %d after the budget freed up; want %d", rr.Code, http.StatusOK)
+	}
+}
+
+func TestRequireNonce(t *testing.T) {
+	app := newTestDBApplication(t)
+	user := newTestUser(t, app)
+	other := newTestUser(t, app)
+
+	newNonce := func(user *data.User) string {
+		t.Helper()
+
+		rr := serveAs(app, app.createNonceHandler, user, httptest.NewRequest(http.MethodGet, "/v1/nonce", nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusOK, rr.Body)
+		}
+		if got := rr.Header().Get("Cache-Control"); got != "no-store" {
+			t.Errorf("got Cache-Control %q; want no-store", got)
+		}
+
+		var response struct {
+			Nonce struct {
+				Token string `json:"token"`
+			} `json:"nonce"`
+		}
+		err := json.Unmarshal(rr.Body.Bytes(), &response)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response.Nonce.Token
+	}
+
+	calls := 0
+	guarded := app.requireNonce(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	authentication, err := app.models.Tokens.NewForScope(user.ID, data.ScopeAuthentication)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nonce := newNonce(user)
+	tests := []struct {
+		name       string
+		nonce      string
+		wantStatus int
+	}{
+		{"missing", "", http.StatusPreconditionRequired},
+		{"another user's", newNonce(other), http.StatusForbidden},
+		{"another scope", authentication.Plaintext, http.StatusForbidden},
+		{"valid", nonce, http.StatusNoContent},
+		{"reused", nonce, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodDelete, "/v1/users/me", nil)
+		if tt.nonce != "" {
+			r.Header.Set("X-Nonce", tt.nonce)
+		}
+		rr := serveAs(app, guarded, user, r)
+		if rr.Code != tt.wantStatus {
+			t.Errorf("%s: got status %d; want %d: %s", tt.name, rr.Code, tt.wantStatus, rr.Body)
+		}
+	}
+
+	if calls != 1 {
+		t.Errorf("handler ran %d times; want once", calls)
+	}
+}
+
+func TestEnforceReadOnly(t *testing.T) {
+	app := newTestApplication(t)
+	app.readOnly.Store(true)
+	router := app.routes()
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		want   int
+	}{
+		{http.MethodPost, "/v1/movies", `{}`, http.StatusServiceUnavailable},
+		{http.MethodPost, "/v1/tokens/password-reset", `{"email": "alice@example.com"}`, http.StatusServiceUnavailable},
+		{http.MethodPost, "/v1/tokens/refresh", `{}`, http.StatusServiceUnavailable},
+		{http.MethodPost, "/v1/tokens/refresh-ttl", `{}`, http.StatusServiceUnavailable},
+		{http.MethodGet, "/v1/healthcheck", "", http.StatusOK},
+
+		// The exempt endpoints get as far as their handlers.
+		{http.MethodPost, "/v1/tokens/authentication", `{}`, http.StatusUnprocessableEntity},
+		{http.MethodPut, "/v1/admin/read-only", `{}`, http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)))
+		if rr.Code != tt.want {
+			t.Errorf("%s %s: got status %d; want %d: %s", tt.method, tt.path, rr.Code, tt.want, rr.Body)
+		}
+	}
+}
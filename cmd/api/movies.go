@@ -1,22 +1,30 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"mime"
 	"net/http"
+	"reflect"
+	"slices"
+	"sort"
+	"time"
 
 	"greenlight.yp2743.me/internal/data"
 	"greenlight.yp2743.me/internal/validator"
 )
 
-func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request) {
+// getMovie loads the movie identified by the :id route parameter, sending the
+// appropriate error response and returning false if it can't be found.
+func (app *application) getMovie(w http.ResponseWriter, r *http.Request) (*data.Movie, bool) {
 	id, err := app.readIDParam(r)
 	if err != nil {
 		app.notFoundResponse(w, r)
-		return
+		return nil, false
 	}
 
-	movie, err := app.models.Movies.Get(id)
+	movie, err := app.modelsFor(r).Movies.Get(id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -24,35 +32,195 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
+		return nil, false
+	}
+
+	err = app.setMovieAuthors(r, movie)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return nil, false
+	}
+
+	err = app.hideRestrictedFields(r, movie)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return nil, false
+	}
+	return movie, true
+}
+
+// setMovieAuthors fills in the CreatedBy name of each movie, using the request's user
+// loader so that all the authors are fetched with a single query.
+func (app *application) setMovieAuthors(r *http.Request, movies ...*data.Movie) error {
+	ids := make([]int64, 0, len(movies))
+	for _, movie := range movies {
+		if movie.CreatedByID != 0 {
+			ids = append(ids, movie.CreatedByID)
+		}
+	}
+
+	users, err := app.contextGetUserLoader(r).LoadMany(ids)
+	if err != nil {
+		return err
+	}
+
+	for _, movie := range movies {
+		if user, ok := users[movie.CreatedByID]; ok {
+			movie.CreatedBy = user.Name
+		}
+	}
+	return nil
+}
+
+func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request) {
+	movie, ok := app.getMovie(w, r)
+	if !ok {
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil)
+	etag, err := app.movieETag(r, movie)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("ETag", etag)
+	headers.Set("Last-Modified", movie.UpdatedAt.UTC().Format(http.TimeFormat))
+
+	if etagMatches(r.Header.Get("If-None-Match"), etag, true) {
+		app.notModifiedResponse(w, headers)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showMovieV2Handler(w http.ResponseWriter, r *http.Request) {
+	movie, ok := app.getMovie(w, r)
+	if !ok {
+		return
+	}
+
+	etag, err := app.movieETag(r, movie)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("ETag", etag)
+	headers.Set("Last-Modified", movie.UpdatedAt.UTC().Format(http.TimeFormat))
+
+	if etagMatches(r.Header.Get("If-None-Match"), etag, true) {
+		app.notModifiedResponse(w, headers)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie.V2()}, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
 
+// movieETag returns the entity tag of the movie as GET /v1/movies/:id renders it for the
+// request, given a movie with its author set and restricted fields hidden. The tag is
+// a hash of the rendered body, so that it changes with everything the body depends
+// on: the movie's version, its author's name, the caller's permissions, the negotiated
+// API version and the output format settings.
+func (app *application) movieETag(r *http.Request, movie *data.Movie) (string, error) {
+	var representation interface{} = movie
+	if version, _ := app.requestedVersion(r); version == 2 {
+		representation = movie.V2()
+	}
+
+	js, _, err := app.encodeJSON(envelope{"movie": representation})
+	if err != nil {
+		return "", err
+	}
+	return bodyETag(js), nil
+}
+
+// checkMovieIfMatch reports whether the If-Match header of the request, if there is
+// one, matches the movie's current entity tag.
+func (app *application) checkMovieIfMatch(r *http.Request, movie *data.Movie) (bool, error) {
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" {
+		return true, nil
+	}
+
+	etag, err := app.movieETag(r, movie)
+	if err != nil {
+		return false, err
+	}
+	return etagMatches(ifMatch, etag, false), nil
+}
+
+var (
+	errMovieQuotaExceeded = errors.New("movie quota exceeded")
+	errPreconditionFailed = errors.New("precondition failed")
+)
+
+// movieQuotaExceeded reports whether creating n more movies would take the user over
+// the maximum allowed within the rolling quota window, counting the movies models can
+// see. Admins aren't subject to the quota.
+//
+// It should be called in the transaction which inserts the movies: the user's movies
+// are locked until the transaction ends, so that concurrent requests can't both pass
+// the check.
+func (app *application) movieQuotaExceeded(models data.Models, user *data.User, n int) (bool, error) {
+	if app.config.quota.movies == 0 {
+		return false, nil
+	}
+
+	permissions, err := models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		return false, err
+	}
+	if permissions.Include("admin") {
+		return false, nil
+	}
+
+	err = models.Movies.LockCreator(user.ID)
+	if err != nil {
+		return false, err
+	}
+
+	count, err := models.Movies.CountCreatedBySince(user.ID, time.Now().Add(-app.config.quota.window))
+	if err != nil {
+		return false, err
+	}
+	return count+n > app.config.quota.movies, nil
+}
+
 func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Request) {
 
 	var input struct {
-		Title   string       `json:"title"`
-		Year    int32        `json:"year"`
-		Runtime data.Runtime `json:"runtime"`
-		Genres  []string     `json:"genres"`
+		Title          string   `json:"title"`
+		Year           int32    `json:"year"`
+		RuntimeMinutes int32    `json:"runtime_minutes"`
+		Genres         []string `json:"genres"`
 	}
 
-	err := app.readJSON(w, r, &input)
+	// Older clients send the runtime as a "<n> mins" string under "runtime".
+	legacyWarnings, err := app.readAdaptedJSON(w, r, &input, movieRequestRenames)
 	if err != nil {
 		app.badRequestResponse(w, r, err)
 		return
 	}
 
+	user := app.contextGetUser(r)
+
 	movie := &data.Movie{
-		Title:   input.Title,
-		Year:    input.Year,
-		Runtime: input.Runtime,
-		Genres:  input.Genres,
+		Title:       data.NormalizeTitle(input.Title),
+		Year:        input.Year,
+		Runtime:     data.Runtime(input.RuntimeMinutes),
+		Genres:      input.Genres,
+		CreatedByID: user.ID,
+		CreatedBy:   user.Name,
 	}
 
 	v := validator.New()
@@ -62,89 +230,543 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	err = app.models.Movies.Insert(movie)
+	err = app.modelsFor(r).Transaction(func(tx data.Models) error {
+		exceeded, err := app.movieQuotaExceeded(tx, user, 1)
+		if err != nil {
+			return err
+		} else if exceeded {
+			return errMovieQuotaExceeded
+		}
+
+		err = tx.Movies.Insert(movie)
+		if err != nil {
+			return err
+		}
+		return app.recordMovieEvent(tx, r, movie.ID, data.MovieEventCreate, data.DiffMovies(nil, movie))
+	})
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		switch {
+		case errors.Is(err, errMovieQuotaExceeded):
+			app.quotaExceededResponse(w, r)
+		case errors.Is(err, data.ErrDuplicateMovie):
+			app.handleDuplicateMovie(w, r, movie)
+		case errors.Is(err, data.ErrTooManyGenres):
+			app.tooManyGenresResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
 	headers := make(http.Header)
 	headers.Set("Location", fmt.Sprintf("/v1/movies/%d", movie.ID))
+	for _, warning := range legacyWarnings {
+		headers.Add("Warning", warning)
+	}
 
-	err = app.writeJSON(w, http.StatusCreated, envelope{"movie": movie}, headers)
+	env := envelope{"movie": movie}
+	if len(v.Warnings) > 0 {
+		env["warnings"] = v.Warnings
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, env, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
 
-func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Request) {
+const (
+	movieBatchChunkSize = 100
+	movieBatchMaxBytes  = 32 << 20
+	movieBatchTimeout   = 30 * time.Second
+)
 
-	id, err := app.readIDParam(r)
-	if err != nil {
-		app.notFoundResponse(w, r)
-		return
+// createMoviesBatchHandler creates each movie in a JSON array, returning the movies
+// created, the outcome of every item by its index, and a summary. Under the default
+// all-or-nothing batch policy the movies are inserted in a single transaction, and
+// none are created if any of them fails.
+//
+// The array is read and inserted in chunks, so that only one chunk of the request is
+// held in memory at a time, and the quota is checked before each chunk is inserted.
+// The response grows with the number of items, which -max-batch-items caps.
+// As the transaction stays open while the body is read, the batch is stopped once it
+// has run for movieBatchTimeout, and the route is wrapped in limitDBConcurrency.
+func (app *application) createMoviesBatchHandler(w http.ResponseWriter, r *http.Request) {
+
+	type movieInput struct {
+		Title          string   `json:"title"`
+		Year           int32    `json:"year"`
+		RuntimeMinutes int32    `json:"runtime_minutes"`
+		Genres         []string `json:"genres"`
 	}
 
-	movie, err := app.models.Movies.Get(id)
+	body := app.newJSONArrayReader(w, r, movieBatchMaxBytes)
+	user := app.contextGetUser(r)
+	deadline := time.Now().Add(movieBatchTimeout)
+
+	var (
+		chunk     []movieInput
+		chunkErrs []error
+		offset    int
+		done      bool
+		stopped   error
+		created   = []*data.Movie{}
+	)
+
+	// next reads the following chunk of the array. An error which stops the batch part
+	// way through a chunk is held back until the items read before it are processed.
+	next := func(models data.Models) (int, error) {
+		offset += len(chunk)
+		chunk, chunkErrs = chunk[:0], chunkErrs[:0]
+
+		if !done && stopped == nil && time.Now().After(deadline) {
+			stopped = batchStopError{fmt.Errorf("batch must complete within %s", movieBatchTimeout)}
+		}
+
+		for !done && stopped == nil && len(chunk) < movieBatchChunkSize {
+			var input movieInput
+			more, err := body.next(&input)
+
+			var elementErr *jsonElementError
+			switch {
+			case errors.As(err, &elementErr):
+			case err != nil:
+				stopped = batchStopError{err}
+				continue
+			case !more:
+				done = true
+				continue
+			}
+
+			if offset+len(chunk) == data.Limits.BatchItems {
+				stopped = batchStopError{&fieldError{field: "movies", message: fmt.Sprintf("must not contain more than %d movies", data.Limits.BatchItems)}}
+				continue
+			}
+
+			chunk = append(chunk, input)
+			chunkErrs = append(chunkErrs, err)
+		}
+
+		if done && offset+len(chunk) == 0 {
+			stopped = batchStopError{&fieldError{field: "movies", message: "must contain at least 1 movie"}}
+		}
+		if len(chunk) == 0 {
+			return 0, stopped
+		}
+
+		exceeded, err := app.movieQuotaExceeded(models, user, len(chunk))
+		if err != nil {
+			return 0, err
+		} else if exceeded {
+			stopped = batchStopError{errMovieQuotaExceeded}
+			return 0, stopped
+		}
+		return len(chunk), nil
+	}
+
+	report, err := app.runBatch(r, next, func(tx data.Models, i int) error {
+		input := chunk[i-offset]
+
+		if err := chunkErrs[i-offset]; err != nil {
+			return batchItemError{err.Error()}
+		}
+
+		movie := &data.Movie{
+			Title:       data.NormalizeTitle(input.Title),
+			Year:        input.Year,
+			Runtime:     data.Runtime(input.RuntimeMinutes),
+			Genres:      input.Genres,
+			CreatedByID: user.ID,
+			CreatedBy:   user.Name,
+		}
+
+		v := validator.New()
+		if data.ValidateMovie(v, movie); !v.Valid() {
+			return batchItemError{v.Errors}
+		}
+
+		// Under best-effort the chunk's quota check ran outside the items'
+		// transactions, so each item is checked again as it's inserted.
+		if app.config.batchPolicy == batchBestEffort {
+			exceeded, err := app.movieQuotaExceeded(tx, user, 1)
+			if err != nil {
+				return err
+			} else if exceeded {
+				return batchItemError{"movie quota exceeded"}
+			}
+		}
+
+		err := tx.Movies.Insert(movie)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrDuplicateMovie):
+				return batchItemError{"a movie with this title and year already exists"}
+			case errors.Is(err, data.ErrTooManyGenres):
+				return batchItemError{map[string]string{"genres": "contains too many genres"}}
+			default:
+				return err
+			}
+		}
+
+		err = app.recordMovieEvent(tx, r, movie.ID, data.MovieEventCreate, data.DiffMovies(nil, movie))
+		if err != nil {
+			return err
+		}
+
+		created = append(created, movie)
+		return nil
+	})
 	if err != nil {
+		var stop batchStopError
 		switch {
-		case errors.Is(err, data.ErrRecordNotFound):
-			app.notFoundResponse(w, r)
+		case errors.Is(err, errMovieQuotaExceeded):
+			app.quotaExceededResponse(w, r)
+		case errors.As(err, &stop):
+			app.badRequestResponse(w, r, stop.err)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
 
+	if report.rolledBack {
+		created = created[:0]
+	}
+
+	status := app.batchStatus(report.summary)
+	if report.summary.Failed == 0 {
+		status = http.StatusCreated
+	}
+
+	err = app.writeJSON(w, status, envelope{"movies": created, "results": report.results(), "summary": report.summary}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// recordMovieEvent adds an event to the movie's history, attributed to the request's
+// user.
+func (app *application) recordMovieEvent(tx data.Models, r *http.Request, movieID int64, action string, changes map[string]data.FieldChange) error {
+	return tx.MovieEvents.Insert(&data.MovieEvent{
+		MovieID: data.ID(movieID),
+		ActorID: data.ID(app.contextGetUser(r).ID),
+		Action:  action,
+		Changes: changes,
+	})
+}
+
+// handleDuplicateMovie sends a 409 response pointing at the movie which already holds
+// the natural key (title, year) of the given movie.
+func (app *application) handleDuplicateMovie(w http.ResponseWriter, r *http.Request, movie *data.Movie) {
+	existing, err := app.modelsFor(r).Movies.GetByTitleYear(movie.Title, movie.Year)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.duplicateMovieResponse(w, r, existing)
+}
+
+// upsertMovieHandler creates the movie if no movie with the same title and year exists,
+// and otherwise updates that movie, responding with 201 or 200 respectively. Deleted
+// movies don't count: restoring one is left to the restore endpoint. With If-Match,
+// the movie must already exist and match the entity tag.
+func (app *application) upsertMovieHandler(w http.ResponseWriter, r *http.Request) {
+
 	var input struct {
-		Title   *string       `json:"title"`
-		Year    *int32        `json:"year"`
-		Runtime *data.Runtime `json:"runtime"`
-		Genres  []string      `json:"genres"`
+		Title          string   `json:"title"`
+		Year           int32    `json:"year"`
+		RuntimeMinutes int32    `json:"runtime_minutes"`
+		Genres         []string `json:"genres"`
+		Version        int32    `json:"version"`
 	}
 
-	err = app.readJSON(w, r, &input)
+	legacyWarnings, err := app.readAdaptedJSON(w, r, &input, movieRequestRenames)
 	if err != nil {
 		app.badRequestResponse(w, r, err)
 		return
 	}
 
-	if input.Title != nil {
-		movie.Title = *input.Title
+	user := app.contextGetUser(r)
+
+	movie := &data.Movie{
+		Title:       data.NormalizeTitle(input.Title),
+		Year:        input.Year,
+		Runtime:     data.Runtime(input.RuntimeMinutes),
+		Genres:      input.Genres,
+		Version:     input.Version,
+		CreatedByID: user.ID,
+	}
+
+	v := validator.New()
+
+	if data.ValidateMovie(v, movie); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	ifMatch := r.Header.Get("If-Match")
+
+	var created bool
+	err = app.modelsFor(r).Transaction(func(tx data.Models) error {
+		before, err := tx.Movies.GetByTitleYear(movie.Title, movie.Year)
+		if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+			return err
+		}
+
+		// If-Match needs a current representation to match, and pins the update to
+		// the version it was taken from.
+		if ifMatch != "" {
+			if before == nil {
+				return errPreconditionFailed
+			}
+			current := *before
+			err := app.setMovieAuthors(r, &current)
+			if err == nil {
+				err = app.hideRestrictedFields(r, &current)
+			}
+			if err != nil {
+				return err
+			}
+
+			match, err := app.checkMovieIfMatch(r, &current)
+			if err != nil {
+				return err
+			} else if !match {
+				return errPreconditionFailed
+			}
+			if movie.Version == 0 {
+				movie.Version = before.Version
+			}
+		}
+
+		// Creating a movie counts towards the quota, as it does through POST.
+		if before == nil {
+			exceeded, err := app.movieQuotaExceeded(tx, user, 1)
+			if err != nil {
+				return err
+			} else if exceeded {
+				return errMovieQuotaExceeded
+			}
+		}
+
+		created, err = tx.Movies.Upsert(movie)
+		if err != nil {
+			return err
+		}
+
+		action := data.MovieEventUpdate
+		if created {
+			action, before = data.MovieEventCreate, nil
+		}
+		return app.recordMovieEvent(tx, r, movie.ID, action, data.DiffMovies(before, movie))
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, errMovieQuotaExceeded):
+			app.quotaExceededResponse(w, r)
+		case errors.Is(err, errPreconditionFailed), errors.Is(err, data.ErrEditConflict) && ifMatch != "":
+			app.preconditionFailedResponse(w, r)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		case errors.Is(err, data.ErrDuplicateMovie):
+			app.handleDuplicateMovie(w, r, movie)
+		case errors.Is(err, data.ErrTooManyGenres):
+			app.tooManyGenresResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.setMovieAuthors(r, movie)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{"movie": movie}
+	if len(v.Warnings) > 0 {
+		env["warnings"] = v.Warnings
+	}
+
+	status := http.StatusOK
+	headers := make(http.Header)
+	if created {
+		status = http.StatusCreated
+		headers.Set("Location", fmt.Sprintf("/v1/movies/%d", movie.ID))
+	}
+	for _, warning := range legacyWarnings {
+		headers.Add("Warning", warning)
 	}
-	if input.Year != nil {
-		movie.Year = *input.Year
+
+	err = app.writeJSON(w, status, env, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
 	}
-	if input.Runtime != nil {
-		movie.Runtime = *input.Runtime
+}
+
+// patchMovie applies the fields present in a PATCH body to the movie, returning the
+// columns which were changed. Fields which are absent are left untouched. For a JSON
+// Merge Patch (RFC 7386) null clears the field, leaving validation to reject clearing
+// a required one; otherwise null is rejected outright.
+func patchMovie(movie *data.Movie, fields map[string]json.RawMessage, mergePatch bool) ([]string, error) {
+	columns := make([]string, 0, len(fields))
+	for key, value := range fields {
+		var dst interface{}
+		column := key
+		switch key {
+		case "title":
+			dst = &movie.Title
+		case "year":
+			dst = &movie.Year
+		case "runtime_minutes":
+			dst, column = (*int32)(&movie.Runtime), "runtime"
+		case "genres":
+			dst = &movie.Genres
+		case "notes":
+			dst = &movie.Notes
+		default:
+			return nil, fmt.Errorf("body contains unknown key %q", key)
+		}
+
+		if string(value) == "null" {
+			if !mergePatch {
+				return nil, fmt.Errorf("body must not contain null for field %q", key)
+			}
+			// Unmarshalling null leaves most values unchanged, so clear it directly.
+			reflect.ValueOf(dst).Elem().SetZero()
+			columns = append(columns, column)
+			continue
+		}
+		err := json.Unmarshal(value, dst)
+		if err != nil {
+			return nil, fmt.Errorf("body contains incorrect JSON type for field %q", key)
+		}
+		if key == "title" {
+			movie.Title = data.NormalizeTitle(movie.Title)
+		}
+		columns = append(columns, column)
+	}
+
+	// Keep the generated UPDATE statement stable for a given set of fields.
+	sort.Strings(columns)
+	return columns, nil
+}
+
+// updateMovieHandler applies a partial update to the movie, writing only the fields
+// the client sent. A body sent as application/merge-patch+json is a JSON Merge Patch,
+// in which null clears a field. Either way the update only succeeds if the movie is
+// still at the version it was read at, and if the client sends If-Match, matches the
+// entity tag it names, failing with 412 rather than 409 if not.
+func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Request) {
+
+	movie, ok := app.getMovie(w, r)
+	if !ok {
+		return
+	}
+
+	ifMatch := r.Header.Get("If-Match")
+	match, err := app.checkMovieIfMatch(r, movie)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	} else if !match {
+		app.preconditionFailedResponse(w, r)
+		return
+	}
+
+	var fields map[string]json.RawMessage
+	err = app.readJSON(w, r, &fields)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	// Restricted fields can only be written by callers who can see them.
+	if _, ok := fields["notes"]; ok {
+		permissions, err := app.modelsFor(r).Permissions.GetAllForUser(app.contextGetUser(r).ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if !permissions.Include("movies:notes") {
+			app.notPermittedResponse(w, r)
+			return
+		}
+	}
+
+	// Older clients send the runtime as a "<n> mins" string under "runtime".
+	legacyWarnings, err := adaptFields(fields, movieRequestRenames)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
 	}
-	if input.Genres != nil {
-		movie.Genres = input.Genres
+
+	before := *movie
+	before.Genres = slices.Clone(movie.Genres)
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	columns, err := patchMovie(movie, fields, mediaType == "application/merge-patch+json")
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
 	}
 
 	v := validator.New()
+	v.Check(len(columns) > 0, "body", "must contain at least one of title, year, runtime_minutes, genres or notes")
 	if data.ValidateMovie(v, movie); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	err = app.models.Movies.Update(movie)
+	err = app.modelsFor(r).Transaction(func(tx data.Models) error {
+		err := tx.Movies.Update(movie, columns...)
+		if err != nil {
+			return err
+		}
+		return app.recordMovieEvent(tx, r, movie.ID, data.MovieEventUpdate, data.DiffMovies(&before, movie))
+	})
 	if err != nil {
 		switch {
+		case errors.Is(err, data.ErrEditConflict) && ifMatch != "":
+			app.preconditionFailedResponse(w, r)
 		case errors.Is(err, data.ErrEditConflict):
 			app.editConflictResponse(w, r)
+		case errors.Is(err, data.ErrDuplicateMovie):
+			app.handleDuplicateMovie(w, r, movie)
+		case errors.Is(err, data.ErrTooManyGenres):
+			app.tooManyGenresResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil)
+	env := envelope{"movie": movie}
+	if len(v.Warnings) > 0 {
+		env["warnings"] = v.Warnings
+	}
+
+	etag, err := app.movieETag(r, movie)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("ETag", etag)
+	for _, warning := range legacyWarnings {
+		headers.Add("Warning", warning)
+	}
+
+	err = app.writeJSON(w, http.StatusOK, env, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
 
+// deleteMovieHandler deletes the movie. If the client sends If-Match, the movie is only
+// deleted if it still matches the entity tag, failing with 412 if not.
 func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Request) {
 
 	id, err := app.readIDParam(r)
@@ -153,7 +775,70 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	err = app.models.Movies.Delete(id)
+	// Without If-Match, any version of the movie is deleted.
+	var version int32
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch != "" {
+		movie, ok := app.getMovie(w, r)
+		if !ok {
+			return
+		}
+
+		match, err := app.checkMovieIfMatch(r, movie)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		} else if !match {
+			app.preconditionFailedResponse(w, r)
+			return
+		}
+		version = movie.Version
+	}
+
+	err = app.modelsFor(r).Transaction(func(tx data.Models) error {
+		var err error
+		if app.config.moviesSoftDelete {
+			err = tx.Movies.SoftDelete(id, version)
+		} else {
+			err = tx.Movies.Delete(id, version)
+		}
+		if err != nil {
+			return err
+		}
+		return app.recordMovieEvent(tx, r, id, data.MovieEventDelete, nil)
+	})
+
+	// The movie existed when it was matched, so it has changed since.
+	if ifMatch != "" && errors.Is(err, data.ErrRecordNotFound) {
+		app.preconditionFailedResponse(w, r)
+		return
+	}
+	app.deletedResponse(w, r, err)
+}
+
+// restoreMovieHandler restores a soft-deleted movie. The client may send the version
+// it expects the deleted movie to have; otherwise the stored version is used, which
+// still guards against a concurrent restore.
+func (app *application) restoreMovieHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Version *int32 `json:"version"`
+	}
+
+	if r.Body != http.NoBody {
+		err = app.readJSON(w, r, &input)
+		if err != nil {
+			app.badRequestResponse(w, r, err)
+			return
+		}
+	}
+
+	movie, err := app.modelsFor(r).Movies.GetDeleted(id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -164,17 +849,60 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"message": "movie successfully deleted"}, nil)
+	if input.Version != nil {
+		movie.Version = *input.Version
+	}
+
+	err = app.modelsFor(r).Transaction(func(tx data.Models) error {
+		err := tx.Movies.RestoreMovie(movie)
+		if err != nil {
+			return err
+		}
+		return app.recordMovieEvent(tx, r, movie.ID, data.MovieEventRestore, nil)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		case errors.Is(err, data.ErrDuplicateMovie):
+			app.handleDuplicateMovie(w, r, movie)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.setMovieAuthors(r, movie)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.hideRestrictedFields(r, movie)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
 
 func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	app.listMovies(w, r, 1)
+}
+
+func (app *application) listMoviesV2Handler(w http.ResponseWriter, r *http.Request) {
+	app.listMovies(w, r, 2)
+}
+
+// listMovies writes a page of movies in the representation of the given API version.
+func (app *application) listMovies(w http.ResponseWriter, r *http.Request, version int) {
 
 	var input struct {
-		Title  string
-		Genres []string
+		data.MovieListFilters
 		data.Filters
 	}
 
@@ -185,24 +913,147 @@ func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request
 
 	input.Title = app.readString(qs, "title", "")
 	input.Genres = app.readCSV(qs, "genres", []string{})
+	input.GenresMatch = app.readString(qs, "genres_match", data.GenresMatchAll)
+	input.YearFrom = app.readOptionalInt(qs, "year_from", v)
+	input.YearTo = app.readOptionalInt(qs, "year_to", v)
+	input.CreatedFrom = app.readTime(qs, "created_from", v)
+	input.CreatedTo = app.readTime(qs, "created_to", v)
 
 	input.Filters.Page = app.readInt(qs, "page", 1, v)
 	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
 	input.Filters.Sort = app.readString(qs, "sort", "id")
-	input.Filters.SortSafelist = []string{"id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime"}
+	input.Filters.SortSafelist = []string{"id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime", "relevance"}
+
+	// Passing after, empty for the first page, switches to cursor pagination, which
+	// doesn't use page.
+	useCursor := qs.Has("after")
+	v.Check(!useCursor || !qs.Has("page"), "page", "must not be combined with after")
 
+	if input.Filters.Sort == "relevance" {
+		v.Check(input.Title != "", "sort", "relevance requires a title to search for")
+		v.Check(!useCursor, "sort", "relevance can't be combined with after")
+	}
+
+	data.ValidateMovieListFilters(v, input.MovieListFilters)
 	if data.ValidateFilters(v, input.Filters); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	movies, metadata, err := app.models.Movies.GetAll(input.Title, input.Genres, input.Filters)
+	var after *data.Cursor
+	if cursor := qs.Get("after"); cursor != "" {
+		var err error
+		after, err = data.DecodeCursor(cursor, input.Filters.Sort)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrCursorMismatch):
+				v.AddError("after", "was issued for a different sort, start again from the first page")
+			default:
+				v.AddError("after", "must be a cursor returned in a previous response")
+			}
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+	}
+
+	var movies []*data.Movie
+	var metadata data.Metadata
+	var err error
+	if useCursor {
+		movies, metadata, err = app.modelsFor(r).Movies.GetAllCursor(input.MovieListFilters, input.Filters, after)
+	} else {
+		movies, metadata, err = app.modelsFor(r).Movies.GetAll(input.MovieListFilters, input.Filters)
+	}
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.setMovieAuthors(r, movies...)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.hideRestrictedFields(r, movies)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	var representation interface{} = movies
+	if version == 2 {
+		v2 := make([]*data.MovieV2, len(movies))
+		for i, movie := range movies {
+			v2[i] = movie.V2()
+		}
+		representation = v2
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"movies": representation, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// movieHistoryHandler lists the events recorded for a movie, oldest first by default.
+// History outlives the movie, so a deleted movie's events can still be listed.
+func (app *application) movieHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "created_at")
+	input.Filters.SortSafelist = []string{"created_at", "-created_at"}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	events, metadata, err := app.modelsFor(r).MovieEvents.GetAllForMovie(id, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// A movie with no recorded events may predate history, so it only 404s if the
+	// movie doesn't exist either.
+	if len(events) == 0 {
+		_, err = app.modelsFor(r).Movies.Get(id)
+		if errors.Is(err, data.ErrRecordNotFound) {
+			_, err = app.modelsFor(r).Movies.GetDeleted(id)
+		}
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.notFoundResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+	}
+
+	err = app.hideRestrictedChanges(r, events)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"movies": movies, "metadata": metadata}, nil)
+	err = app.writeJSON(w, http.StatusOK, envelope{"events": events, "metadata": metadata}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
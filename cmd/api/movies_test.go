@@ -0,0 +1,488 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+
+	"greenlight.yp2743.me/internal/data"
+)
+
+// usersDB is a DBTX which answers UserModel.GetByIDs from a fixed set of users,
+// counting the queries it's sent.
+type usersDB struct {
+	users   map[int64]*data.User
+	queries atomic.Int64
+}
+
+func (db *usersDB) Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error) {
+	panic("unexpected exec")
+}
+
+func (db *usersDB) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+	db.queries.Add(1)
+
+	rows := &valueRows{}
+	for _, id := range args[0].([]int64) {
+		if user, ok := db.users[id]; ok {
+			rows.values = append(rows.values, []interface{}{
+				user.ID, user.CreatedAt, user.UpdatedAt, user.Name, user.Email,
+				user.PasswordHash, user.Activated, user.DeactivatedAt, user.Version,
+			})
+		}
+	}
+	return rows, nil
+}
+
+func (db *usersDB) QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+	panic("unexpected query")
+}
+
+// valueRows is a pgx.Rows over values which already have the types scanned into.
+type valueRows struct {
+	values [][]interface{}
+	next   int
+}
+
+func (r *valueRows) Close()                                       {}
+func (r *valueRows) Err() error                                   { return nil }
+func (r *valueRows) CommandTag() pgconn.CommandTag                { return pgconn.CommandTag{} }
+func (r *valueRows) FieldDescriptions() []pgconn.FieldDescription { return nil }
+func (r *valueRows) RawValues() [][]byte                          { return nil }
+func (r *valueRows) Conn() *pgx.Conn                              { return nil }
+
+func (r *valueRows) Next() bool {
+	r.next++
+	return r.next <= len(r.values)
+}
+
+func (r *valueRows) Values() ([]interface{}, error) {
+	return r.values[r.next-1], nil
+}
+
+func (r *valueRows) Scan(dest ...interface{}) error {
+	row := r.values[r.next-1]
+	if len(dest) != len(row) {
+		return fmt.Errorf("scanning %d columns into %d values", len(row), len(dest))
+	}
+	for i, value := range row {
+		reflect.ValueOf(dest[i]).Elem().Set(reflect.ValueOf(value))
+	}
+	return nil
+}
+
+func TestSetMovieAuthors(t *testing.T) {
+	db := &usersDB{users: make(map[int64]*data.User)}
+	for id := int64(1); id <= 5; id++ {
+		db.users[id] = &data.User{ID: id, Name: fmt.Sprintf("Author %d", id), CreatedAt: time.Now()}
+	}
+
+	app := newTestApplication(t)
+	app.models.Users = data.UserModel{DB: db}
+
+	// 50 movies by 5 authors, and one by a user who has since been deleted.
+	var movies []*data.Movie
+	for i := 0; i < 50; i++ {
+		movies = append(movies, &data.Movie{ID: int64(i + 1), CreatedByID: int64(i%5 + 1)})
+	}
+	movies = append(movies, &data.Movie{ID: 51, CreatedByID: 99})
+
+	r := app.contextSetUserLoader(httptest.NewRequest(http.MethodGet, "/v1/movies", nil))
+	err := app.setMovieAuthors(r, movies...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := db.queries.Load(); n != 1 {
+		t.Errorf("got %d user queries for %d movies; want 1", n, len(movies))
+	}
+	for _, movie := range movies[:50] {
+		if want := fmt.Sprintf("Author %d", movie.CreatedByID); movie.CreatedBy != want {
+			t.Errorf("movie %d: got author %q; want %q", movie.ID, movie.CreatedBy, want)
+		}
+	}
+	if movies[50].CreatedBy != "" {
+		t.Errorf("movie by a deleted user: got author %q; want none", movies[50].CreatedBy)
+	}
+
+	// Authors already loaded for the request aren't looked up again.
+	err = app.setMovieAuthors(r, movies[:10]...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := db.queries.Load(); n != 1 {
+		t.Errorf("got %d user queries after a second lookup; want 1", n)
+	}
+}
+
+func TestDeleteMovieHandler(t *testing.T) {
+	for _, softDelete := range []bool{false, true} {
+		t.Run(fmt.Sprintf("soft delete %t", softDelete), func(t *testing.T) {
+			app := newTestDBApplication(t)
+			app.config.moviesSoftDelete = softDelete
+			user := newTestUser(t, app, "movies:write")
+			movie := newTestMovie(t, app, user)
+
+			del := func() *httptest.ResponseRecorder {
+				r := withID(httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/v1/movies/%d", movie.ID), nil), movie.ID)
+				return serveAs(app, app.deleteMovieHandler, user, r)
+			}
+
+			rr := del()
+			if rr.Code != http.StatusNoContent || rr.Body.Len() != 0 {
+				t.Fatalf("got status %d and body %q; want %d and no body", rr.Code, rr.Body, http.StatusNoContent)
+			}
+
+			rr = del()
+			if rr.Code != http.StatusNotFound {
+				t.Errorf("repeat delete: got status %d; want %d", rr.Code, http.StatusNotFound)
+			}
+		})
+	}
+}
+
+func TestCreateMovieHandlerTooManyGenres(t *testing.T) {
+	app := newTestApplication(t)
+
+	genres := make([]string, 5000)
+	for i := range genres {
+		genres[i] = fmt.Sprintf("%q", fmt.Sprintf("genre %d", i))
+	}
+	body := fmt.Sprintf(`{"title": "Casablanca", "year": 1942, "runtime_minutes": 102, "genres": [%s]}`, strings.Join(genres, ","))
+
+	// The application has no database, so this would panic rather than fail
+	// validation if the insert were attempted.
+	r := httptest.NewRequest(http.MethodPost, "/v1/movies", strings.NewReader(body))
+	rr := serveAs(app, app.createMovieHandler, &data.User{ID: 1, Name: "Test User", Activated: true}, r)
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusUnprocessableEntity, rr.Body)
+	}
+	if !strings.Contains(rr.Body.String(), "must not contain more than") {
+		t.Errorf("response doesn't report the genres: %s", rr.Body)
+	}
+}
+
+func TestCreateMovieHandlerCaseInsensitiveConflict(t *testing.T) {
+	app := newTestDBApplication(t)
+	user := newTestUser(t, app, "movies:write")
+	existing := newTestMovie(t, app, user)
+
+	tests := []struct {
+		title      string
+		year       int32
+		wantStatus int
+	}{
+		{strings.ToLower(existing.Title), existing.Year, http.StatusConflict},
+		{strings.ToUpper(existing.Title), existing.Year, http.StatusConflict},
+		{strings.ToLower(existing.Title), existing.Year + 1, http.StatusCreated},
+	}
+
+	for _, tt := range tests {
+		body := fmt.Sprintf(`{"title": %q, "year": %d, "runtime_minutes": 100, "genres": ["drama"]}`, tt.title, tt.year)
+		r := httptest.NewRequest(http.MethodPost, "/v1/movies", strings.NewReader(body))
+		rr := serveAs(app, app.createMovieHandler, user, r)
+		if rr.Code != tt.wantStatus {
+			t.Errorf("%q (%d): got status %d; want %d: %s", tt.title, tt.year, rr.Code, tt.wantStatus, rr.Body)
+			continue
+		}
+
+		if tt.wantStatus == http.StatusConflict {
+			want := fmt.Sprintf("/v1/movies/%d", existing.ID)
+			if location := rr.Header().Get("Location"); location != want {
+				t.Errorf("%q: got Location %q; want %q", tt.title, location, want)
+			}
+		}
+	}
+}
+
+func TestRestoreMovieHandler(t *testing.T) {
+	app := newTestDBApplication(t)
+	app.config.moviesSoftDelete = true
+	user := newTestUser(t, app, "movies:write")
+	movie := newTestMovie(t, app, user)
+
+	rr := serveAs(app, app.deleteMovieHandler, user, withID(httptest.NewRequest(http.MethodDelete, "/", nil), movie.ID))
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("delete: got status %d; want %d: %s", rr.Code, http.StatusNoContent, rr.Body)
+	}
+	if _, err := app.models.Movies.Get(movie.ID); !errors.Is(err, data.ErrRecordNotFound) {
+		t.Fatalf("got %v fetching a soft-deleted movie; want ErrRecordNotFound", err)
+	}
+
+	deleted, err := app.models.Movies.GetDeleted(movie.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restore := func(body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPut, "/", strings.NewReader(body))
+		if body == "" {
+			r.Body = http.NoBody
+		}
+		return serveAs(app, app.restoreMovieHandler, user, withID(r, movie.ID))
+	}
+
+	// A restore against a stale version is an edit conflict.
+	rr = restore(fmt.Sprintf(`{"version": %d}`, deleted.Version+1))
+	if rr.Code != http.StatusConflict {
+		t.Errorf("stale version: got status %d; want %d: %s", rr.Code, http.StatusConflict, rr.Body)
+	}
+
+	rr = restore(fmt.Sprintf(`{"version": %d}`, deleted.Version))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusOK, rr.Body)
+	}
+	restored, err := app.models.Movies.Get(movie.ID)
+	if err != nil {
+		t.Fatalf("restored movie: %v", err)
+	}
+	if restored.Version != deleted.Version+1 {
+		t.Errorf("got version %d; want %d", restored.Version, deleted.Version+1)
+	}
+
+	// Only deleted movies can be restored.
+	rr = restore("")
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("repeat restore: got status %d; want %d", rr.Code, http.StatusNotFound)
+	}
+}
+
+func TestCreateMovieHandler(t *testing.T) {
+	app := newTestDBApplication(t)
+	user := newTestUser(t, app, "movies:write")
+
+	title := fmt.Sprintf("Created %s", user.Email)
+	body := fmt.Sprintf(`{"title": %q, "year": 1999, "runtime_minutes": 136, "genres": ["sci-fi"]}`, title)
+	rr := serveAs(app, app.createMovieHandler, user, httptest.NewRequest(http.MethodPost, "/v1/movies", strings.NewReader(body)))
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusCreated, rr.Body)
+	}
+
+	var response struct {
+		Movie map[string]interface{} `json:"movie"`
+	}
+	err := json.Unmarshal(rr.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The response carries the fields set by the server, not just those sent.
+	for _, field := range []string{"id", "created_at", "updated_at", "version", "title", "year", "runtime", "genres", "created_by"} {
+		if value, ok := response.Movie[field]; !ok || value == "" || value == float64(0) {
+			t.Errorf("got %s %v; want it set: %s", field, value, rr.Body)
+		}
+	}
+
+	stored, err := app.models.Movies.GetByTitleYear(title, 1999)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := response.Movie["id"].(float64); int64(id) != stored.ID {
+		t.Errorf("got id %v; want %d", response.Movie["id"], stored.ID)
+	}
+	if location := rr.Header().Get("Location"); location != fmt.Sprintf("/v1/movies/%d", stored.ID) {
+		t.Errorf("got Location %q; want /v1/movies/%d", location, stored.ID)
+	}
+}
+
+func TestListMoviesRelevanceRequiresTitle(t *testing.T) {
+	app := newTestApplication(t)
+
+	rr := serveAs(app, app.listMoviesHandler, nil, httptest.NewRequest(http.MethodGet, "/v1/movies?sort=relevance", nil))
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusUnprocessableEntity, rr.Body)
+	}
+	if !strings.Contains(rr.Body.String(), "relevance requires a title") {
+		t.Errorf("response doesn't explain the rejection: %s", rr.Body)
+	}
+}
+
+func TestListMoviesByRelevance(t *testing.T) {
+	app := newTestDBApplication(t)
+	user := newTestUser(t, app, "movies:read")
+
+	// A word made up for this run, so that only the movies seeded here match it.
+	word := strings.Map(func(r rune) rune { return 'a' + (r-'0')%26 }, strconv.FormatInt(time.Now().UnixNano(), 10))
+
+	// The more often a title contains the word, the better it ranks. The movies are
+	// inserted out of that order, so that sorting by ID wouldn't pass.
+	titles := []string{
+		fmt.Sprintf("The %s Chronicles", word),
+		fmt.Sprintf("%[1]s %[1]s %[1]s", word),
+		fmt.Sprintf("%[1]s and %[1]s", word),
+	}
+	for _, title := range titles {
+		movie := &data.Movie{Title: title, Year: 2000, Runtime: 100, Genres: []string{"drama"}, CreatedByID: user.ID}
+		err := app.models.Movies.Insert(movie)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rr := serveAs(app, app.listMoviesHandler, user, httptest.NewRequest(http.MethodGet, "/v1/movies?sort=relevance&title="+word, nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusOK, rr.Body)
+	}
+
+	var response struct {
+		Movies []struct {
+			Title string `json:"title"`
+		} `json:"movies"`
+	}
+	err := json.Unmarshal(rr.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{titles[1], titles[2], titles[0]}
+	var got []string
+	for _, movie := range response.Movies {
+		got = append(got, movie.Title)
+	}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
+
+func TestUpdateMovieRecordsDiff(t *testing.T) {
+	app := newTestDBApplication(t)
+	user := newTestUser(t, app, "movies:read", "movies:write")
+	movie := newTestMovie(t, app, user)
+
+	body := `{"title": "` + movie.Title + ` II", "runtime_minutes": 120}`
+	r := withID(httptest.NewRequest(http.MethodPatch, "/", strings.NewReader(body)), movie.ID)
+	rr := serveAs(app, app.updateMovieHandler, user, r)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusOK, rr.Body)
+	}
+
+	rr = serveAs(app, app.movieHistoryHandler, user, withID(httptest.NewRequest(http.MethodGet, "/", nil), movie.ID))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("history: got status %d; want %d: %s", rr.Code, http.StatusOK, rr.Body)
+	}
+
+	var response struct {
+		Events []struct {
+			Action  string                            `json:"action"`
+			ActorID data.ID                           `json:"actor_id"`
+			Changes map[string]map[string]interface{} `json:"changes"`
+		} `json:"events"`
+	}
+	err := json.Unmarshal(rr.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Events) != 1 {
+		t.Fatalf("got %d events; want 1: %s", len(response.Events), rr.Body)
+	}
+
+	event := response.Events[0]
+	if event.Action != data.MovieEventUpdate || int64(event.ActorID) != user.ID {
+		t.Errorf("got %s by %d; want an update by %d", event.Action, event.ActorID, user.ID)
+	}
+
+	// Only the fields which changed are recorded, runtimes in minutes.
+	want := map[string]map[string]interface{}{
+		"title":   {"from": movie.Title, "to": movie.Title + " II"},
+		"runtime": {"from": float64(100), "to": float64(120)},
+	}
+	if !reflect.DeepEqual(event.Changes, want) {
+		t.Errorf("got changes %v; want %v", event.Changes, want)
+	}
+}
+
+func TestMovieConditionalRequests(t *testing.T) {
+	app := newTestDBApplication(t)
+	user := newTestUser(t, app, "movies:read", "movies:write")
+	movie := newTestMovie(t, app, user)
+
+	get := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if ifNoneMatch != "" {
+			r.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		return serveAs(app, app.showMovieHandler, user, withID(r, movie.ID))
+	}
+
+	rr := get("")
+	etag := rr.Header().Get("ETag")
+	if rr.Code != http.StatusOK || etag == "" {
+		t.Fatalf("got status %d and ETag %q; want %d with an ETag", rr.Code, etag, http.StatusOK)
+	}
+
+	t.Run("If-None-Match", func(t *testing.T) {
+		tests := []struct {
+			name       string
+			header     string
+			wantStatus int
+		}{
+			{"absent", "", http.StatusOK},
+			{"match", etag, http.StatusNotModified},
+			{"weak match", "W/" + etag, http.StatusNotModified},
+			{"mismatch", `"stale"`, http.StatusOK},
+		}
+
+		for _, tt := range tests {
+			rr := get(tt.header)
+			if rr.Code != tt.wantStatus {
+				t.Errorf("%s: got status %d; want %d", tt.name, rr.Code, tt.wantStatus)
+			}
+			if got := rr.Header().Get("ETag"); got != etag {
+				t.Errorf("%s: got ETag %q; want %q", tt.name, got, etag)
+			}
+			if rr.Code == http.StatusNotModified && rr.Body.Len() != 0 {
+				t.Errorf("%s: got a body with the 304: %s", tt.name, rr.Body)
+			}
+		}
+	})
+
+	t.Run("If-Match", func(t *testing.T) {
+		patch := func(ifMatch, body string) *httptest.ResponseRecorder {
+			r := httptest.NewRequest(http.MethodPatch, "/", strings.NewReader(body))
+			if ifMatch != "" {
+				r.Header.Set("If-Match", ifMatch)
+			}
+			return serveAs(app, app.updateMovieHandler, user, withID(r, movie.ID))
+		}
+
+		rr := patch(`"stale"`, `{"runtime_minutes": 101}`)
+		if rr.Code != http.StatusPreconditionFailed {
+			t.Fatalf("mismatch: got status %d; want %d: %s", rr.Code, http.StatusPreconditionFailed, rr.Body)
+		}
+
+		rr = patch(etag, `{"runtime_minutes": 102}`)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("match: got status %d; want %d: %s", rr.Code, http.StatusOK, rr.Body)
+		}
+		updated := rr.Header().Get("ETag")
+		if updated == etag {
+			t.Errorf("ETag %q didn't change with the update", etag)
+		}
+
+		// The tag the update replaced no longer matches.
+		rr = patch(etag, `{"runtime_minutes": 103}`)
+		if rr.Code != http.StatusPreconditionFailed {
+			t.Errorf("old tag: got status %d; want %d: %s", rr.Code, http.StatusPreconditionFailed, rr.Body)
+		}
+
+		rr = patch("", `{"runtime_minutes": 104}`)
+		if rr.Code != http.StatusOK {
+			t.Errorf("absent: got status %d; want %d: %s", rr.Code, http.StatusOK, rr.Body)
+		}
+		if got := get("").Header().Get("ETag"); got == updated {
+			t.Errorf("ETag %q didn't change with the update", got)
+		}
+	})
+}
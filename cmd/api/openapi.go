@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"greenlight.yp2743.me/internal/data"
+	"greenlight.yp2743.me/internal/openapi"
+)
+
+// openAPIDocument describes the API's public surface: authentication, registration
+// and the movie endpoints. Schemas are derived from the data types, so the fields they
+// list follow the types' JSON tags; the ID and runtime formats follow the startup
+// configuration.
+func (app *application) openAPIDocument() *openapi.Document {
+	b := openapi.New("Greenlight", version)
+	b.BearerAuth("bearerAuth", "An authentication token from POST /v1/tokens/authentication.")
+
+	id := &openapi.Schema{Type: "integer", Format: "int64"}
+	if data.StringifyIDs {
+		id = &openapi.Schema{Type: "string", Description: "An integer ID, encoded as a string."}
+	}
+	b.Override(data.ID(0), id)
+
+	runtime := &openapi.Schema{Type: "string", Description: `The runtime in minutes, such as "107 mins".`}
+	if data.RuntimeFormat == "hms" {
+		runtime.Description = `The runtime in hours and minutes, such as "1h 47m".`
+	}
+	b.Override(data.Runtime(0), runtime)
+
+	// Movie and User swap their int64 ID for the ID type when encoded.
+	movie := b.Component("Movie", data.Movie{})
+	movie.Properties["id"] = b.SchemaOf(data.ID(0))
+	movie.Properties["notes"].Description = "Only present for callers with the movies:notes permission."
+	user := b.Component("User", data.User{})
+	user.Properties["id"] = b.SchemaOf(data.ID(0))
+
+	b.Component("Token", data.Token{})
+	b.Component("Metadata", data.Metadata{})
+	b.Component("MovieEvent", data.MovieEvent{})
+	b.AddComponent("Error", openapi.Object(map[string]*openapi.Schema{
+		"error": {Type: "string"},
+	}))
+	b.AddComponent("ValidationError", openapi.Object(map[string]*openapi.Schema{
+		"error": {
+			Type:                 "object",
+			Description:          "Error messages keyed by the field they apply to.",
+			AdditionalProperties: &openapi.Schema{Type: "string"},
+		},
+	}))
+
+	public := &[]openapi.SecurityRequirement{}
+
+	// With -response-envelope off single resources are sent bare, and listings as an
+	// array with their metadata in X-Pagination-* headers.
+	envelope := func(key string, schema *openapi.Schema) map[string]openapi.MediaType {
+		if !app.config.responseEnvelope {
+			return openapi.JSON(schema)
+		}
+		return openapi.JSON(openapi.Object(map[string]*openapi.Schema{key: schema}))
+	}
+	list := func(key, component string) map[string]openapi.MediaType {
+		items := &openapi.Schema{Type: "array", Items: openapi.Ref(component)}
+		if !app.config.responseEnvelope {
+			return openapi.JSON(items)
+		}
+		return openapi.JSON(openapi.Object(map[string]*openapi.Schema{
+			key:        items,
+			"metadata": openapi.Ref("Metadata"),
+		}))
+	}
+	body := func(v interface{}, required ...string) *openapi.RequestBody {
+		schema := b.SchemaOf(v)
+		schema.Required = required
+		return &openapi.RequestBody{Required: true, Content: openapi.JSON(schema)}
+	}
+	responses := func(success map[string]openapi.Response, errors ...int) map[string]openapi.Response {
+		for _, status := range errors {
+			ref := "Error"
+			if status == http.StatusUnprocessableEntity {
+				ref = "ValidationError"
+			}
+			success[fmt.Sprint(status)] = openapi.Response{
+				Description: http.StatusText(status),
+				Content:     openapi.JSON(openapi.Ref(ref)),
+			}
+		}
+		return success
+	}
+	pagination := []openapi.Parameter{
+		{Name: "page", In: "query", Description: "Page number, from 1.", Schema: &openapi.Schema{Type: "integer"}},
+		{Name: "page_size", In: "query", Description: "Results per page, up to 100.", Schema: &openapi.Schema{Type: "integer"}},
+	}
+
+	type movieInput struct {
+		Title          string   `json:"title"`
+		Year           int32    `json:"year"`
+		RuntimeMinutes int32    `json:"runtime_minutes"`
+		Genres         []string `json:"genres"`
+	}
+
+	b.Add(http.MethodGet, "/v1/movies", &openapi.Operation{
+		Summary: "List movies",
+		Tags:    []string{"movies"},
+		Parameters: append([]openapi.Parameter{
+			{Name: "title", In: "query", Description: "Full-text search on the title.", Schema: &openapi.Schema{Type: "string"}},
+			{Name: "genres", In: "query", Description: "Comma separated genres to filter by.", Schema: &openapi.Schema{Type: "string"}},
+			{Name: "genres_match", In: "query", Description: "Whether movies must have all of the genres, or any of them.", Schema: &openapi.Schema{Type: "string", Enum: []string{"all", "any"}}},
+			{Name: "year_from", In: "query", Description: "Earliest release year, inclusive.", Schema: &openapi.Schema{Type: "integer"}},
+			{Name: "year_to", In: "query", Description: "Latest release year, inclusive.", Schema: &openapi.Schema{Type: "integer"}},
+			{Name: "created_from", In: "query", Description: "Earliest creation time, inclusive.", Schema: &openapi.Schema{Type: "string", Format: "date-time"}},
+			{Name: "created_to", In: "query", Description: "Latest creation time, inclusive.", Schema: &openapi.Schema{Type: "string", Format: "date-time"}},
+			{Name: "sort", In: "query", Schema: &openapi.Schema{Type: "string", Enum: []string{"id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime", "relevance"}}},
+			{Name: "after", In: "query", Description: "Cursor from metadata.next_cursor, for keyset pagination instead of page.", Schema: &openapi.Schema{Type: "string"}},
+		}, pagination...),
+		Responses: responses(map[string]openapi.Response{
+			"200": {Description: "The movies", Content: list("movies", "Movie")},
+		}, http.StatusUnauthorized, http.StatusForbidden, http.StatusUnprocessableEntity),
+	})
+	b.Add(http.MethodPost, "/v1/movies", &openapi.Operation{
+		Summary:     "Create a movie",
+		Tags:        []string{"movies"},
+		RequestBody: body(movieInput{}, "title", "year", "runtime_minutes", "genres"),
+		Responses: responses(map[string]openapi.Response{
+			"201": {Description: "The created movie", Content: envelope("movie", openapi.Ref("Movie"))},
+		}, http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusConflict, http.StatusUnprocessableEntity, http.StatusTooManyRequests),
+	})
+	b.Add(http.MethodGet, "/v1/movies/:id", &openapi.Operation{
+		Summary: "Show a movie",
+		Tags:    []string{"movies"},
+		Responses: responses(map[string]openapi.Response{
+			"200": {Description: "The movie", Content: envelope("movie", openapi.Ref("Movie"))},
+		}, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound),
+	})
+	patch := body(struct {
+		Title          string   `json:"title"`
+		Year           int32    `json:"year"`
+		RuntimeMinutes int32    `json:"runtime_minutes"`
+		Genres         []string `json:"genres"`
+		Notes          string   `json:"notes"`
+	}{})
+	patch.Content["application/merge-patch+json"] = patch.Content["application/json"]
+	b.Add(http.MethodPatch, "/v1/movies/:id", &openapi.Operation{
+		Summary:     "Update a movie",
+		Description: "Only the fields present in the body are changed. As application/json none of them may be null; as application/merge-patch+json (RFC 7386) null clears a field.",
+		Tags:        []string{"movies"},
+		RequestBody: patch,
+		Responses: responses(map[string]openapi.Response{
+			"200": {Description: "The updated movie", Content: envelope("movie", openapi.Ref("Movie"))},
+		}, http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound, http.StatusConflict, http.StatusUnprocessableEntity),
+	})
+	b.Add(http.MethodDelete, "/v1/movies/:id", &openapi.Operation{
+		Summary: "Delete a movie",
+		Tags:    []string{"movies"},
+		Responses: responses(map[string]openapi.Response{
+			"204": {Description: "The movie was deleted"},
+		}, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound),
+	})
+	b.Add(http.MethodGet, "/v1/movies/:id/history", &openapi.Operation{
+		Summary:    "List a movie's change history",
+		Tags:       []string{"movies"},
+		Parameters: pagination,
+		Responses: responses(map[string]openapi.Response{
+			"200": {Description: "The movie's events", Content: list("events", "MovieEvent")},
+		}, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound, http.StatusUnprocessableEntity),
+	})
+
+	b.Add(http.MethodPost, "/v1/users", &openapi.Operation{
+		Summary: "Register a user",
+		Tags:    []string{"users"},
+		RequestBody: body(struct {
+			Name     string `json:"name"`
+			Email    string `json:"email"`
+			Password string `json:"password"`
+		}{}, "name", "email", "password"),
+		Responses: responses(map[string]openapi.Response{
+			"201": {Description: "The registered user, who must activate their account", Content: envelope("user", openapi.Ref("User"))},
+		}, http.StatusBadRequest, http.StatusUnprocessableEntity),
+		Security: public,
+	})
+	b.Add(http.MethodPut, "/v1/users/activated", &openapi.Operation{
+		Summary: "Activate a user",
+		Tags:    []string{"users"},
+		RequestBody: body(struct {
+			Token string `json:"token"`
+		}{}, "token"),
+		Responses: responses(map[string]openapi.Response{
+			"200": {Description: "The activated user", Content: envelope("user", openapi.Ref("User"))},
+		}, http.StatusBadRequest, http.StatusConflict, http.StatusUnprocessableEntity),
+		Security: public,
+	})
+	b.Add(http.MethodDelete, "/v1/users/me", &openapi.Operation{
+		Summary:     "Deactivate your account",
+		Description: "Deactivates the authenticated user's account and deletes all of their tokens. Only an admin can reactivate it.",
+		Tags:        []string{"users"},
+		RequestBody: body(struct {
+			Password string `json:"password"`
+		}{}, "password"),
+		Responses: responses(map[string]openapi.Response{
+			"204": {Description: "The account was deactivated"},
+		}, http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusConflict, http.StatusUnprocessableEntity),
+	})
+
+	b.Add(http.MethodPost, "/v1/tokens/authentication", &openapi.Operation{
+		Summary: "Log in",
+		Tags:    []string{"tokens"},
+		RequestBody: body(struct {
+			Email    string `json:"email"`
+			Password string `json:"password"`
+		}{}, "email", "password"),
+		Responses: responses(map[string]openapi.Response{
+			"201": {Description: "An authentication token and a refresh token", Content: openapi.JSON(openapi.Object(map[string]*openapi.Schema{
+				"authentication_token": openapi.Ref("Token"),
+				"refresh_token":        openapi.Ref("Token"),
+			}))},
+		}, http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusUnprocessableEntity),
+		Security: public,
+	})
+
+	b.Add(http.MethodGet, "/v1/healthcheck/live", &openapi.Operation{
+		Summary:   "Check the process is up",
+		Tags:      []string{"health"},
+		Responses: map[string]openapi.Response{"200": {Description: "The process is serving requests"}},
+		Security:  public,
+	})
+	b.Add(http.MethodGet, "/v1/healthcheck/ready", &openapi.Operation{
+		Summary: "Check the dependencies are reachable",
+		Tags:    []string{"health"},
+		Responses: map[string]openapi.Response{
+			"200": {Description: "Ready to serve traffic, possibly degraded by a slow database"},
+			"503": {Description: "A dependency check failed"},
+		},
+		Security: public,
+	})
+
+	return b.Document()
+}
+
+// openAPIHandler serves the OpenAPI document, which is built once since it only
+// depends on the startup configuration.
+func (app *application) openAPIHandler() http.HandlerFunc {
+	js, err := json.MarshalIndent(app.openAPIDocument(), "", "\t")
+	if err != nil {
+		panic(err)
+	}
+	js = append(js, '\n')
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(js)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"greenlight.yp2743.me/internal/data"
+)
+
+const (
+	outboxBatchSize = 50
+	outboxLease     = 5 * time.Minute
+
+	outboxMaxRetryDelay = 6 * time.Hour
+)
+
+// dispatchOutbox sends pending outbox messages. Each claimed message is leased, so a
+// message whose send is interrupted by a crash is retried by a later dispatch once the
+// lease expires. A message that fails to send is retried with exponential backoff,
+// until it has been attempted -email-max-attempts times.
+func (app *application) dispatchOutbox() {
+	for {
+		messages, err := app.models.Outbox.Claim(outboxBatchSize, outboxLease)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+			return
+		}
+
+		for _, message := range messages {
+			var token *data.Token
+			if message.Token != nil {
+				token, err = app.mintOutboxToken(message)
+				if err != nil {
+					app.failOutboxMessage(message, err)
+					continue
+				}
+			}
+
+			err = app.mailer.Send(message.Recipient, message.Template, message.Data)
+			if err != nil {
+				// The token never reached the recipient, so it mustn't stay usable. A
+				// retry mints a new one.
+				if token != nil {
+					if err := app.models.Tokens.Delete(token); err != nil {
+						app.logger.PrintError(err, nil)
+					}
+				}
+				app.failOutboxMessage(message, err)
+				continue
+			}
+
+			err = app.models.Outbox.MarkSent(message.ID)
+			if err != nil {
+				app.logger.PrintError(err, map[string]string{
+					"outbox_id": strconv.FormatInt(message.ID, 10),
+				})
+			}
+		}
+
+		if len(messages) < outboxBatchSize {
+			return
+		}
+	}
+}
+
+// mintOutboxToken creates the token a message delivers, and adds its plaintext and
+// expiry to the message's data.
+func (app *application) mintOutboxToken(message *data.OutboxMessage) (*data.Token, error) {
+	var token *data.Token
+	err := app.models.Transaction(func(tx data.Models) error {
+		var err error
+		switch message.Token.Scope {
+		case data.ScopeEmailChange:
+			// An email change is confirmed from the new address, which the message is
+			// sent to.
+			token, err = tx.Tokens.NewEmailChange(message.Token.UserID, message.Recipient)
+		default:
+			token, err = tx.Tokens.NewForScope(message.Token.UserID, message.Token.Scope)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if message.Data == nil {
+		message.Data = make(map[string]interface{})
+	}
+	message.Data[message.Token.Key] = token.Plaintext
+	message.Data["tokenExpiry"] = emailExpiry(token)
+	return token, nil
+}
+
+// failOutboxMessage logs a failed send and schedules the message's next attempt, or
+// gives up on it once it has run out of attempts.
+func (app *application) failOutboxMessage(message *data.OutboxMessage, sendErr error) {
+	properties := map[string]string{
+		"outbox_id": strconv.FormatInt(message.ID, 10),
+		"attempts":  strconv.Itoa(message.Attempts),
+		"recipient": message.Recipient,
+		"template":  message.Template,
+	}
+
+	var err error
+	if message.Attempts >= app.config.outbox.maxAttempts {
+		app.logger.PrintError(fmt.Errorf("giving up on email after %d attempts: %w", message.Attempts, sendErr), properties)
+		err = app.models.Outbox.MarkFailed(message.ID)
+	} else {
+		delay := outboxRetryDelay(app.config.outbox.retryDelay, message.Attempts)
+		properties["retry_in"] = delay.String()
+		app.logger.PrintError(sendErr, properties)
+		err = app.models.Outbox.Retry(message.ID, delay)
+	}
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{
+			"outbox_id": strconv.FormatInt(message.ID, 10),
+		})
+	}
+}
+
+// outboxRetryDelay returns the delay before the next attempt at a message which has
+// failed attempts times: base, doubling with each attempt up to outboxMaxRetryDelay.
+func outboxRetryDelay(base time.Duration, attempts int) time.Duration {
+	delay := base
+	for i := 1; i < attempts && delay < outboxMaxRetryDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, outboxMaxRetryDelay)
+}
+
+// emailExpiry formats a token's expiry for the email which delivers it.
+func emailExpiry(token *data.Token) string {
+	return token.Expiry.UTC().Format(time.RFC1123)
+}
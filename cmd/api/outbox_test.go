@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"greenlight.yp2743.me/internal/data"
+)
+
+type sentEmail struct {
+	recipient string
+	template  string
+	data      map[string]interface{}
+}
+
+// testMailer records the emails it's asked to send, failing the first failures sends
+// to each recipient. Ping returns pingErr.
+type testMailer struct {
+	mu       sync.Mutex
+	failures int
+	attempts map[string]int
+	sent     []sentEmail
+	pingErr  error
+}
+
+func (m *testMailer) Send(recipient, templateFile string, data interface{}) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.attempts == nil {
+		m.attempts = make(map[string]int)
+	}
+	m.attempts[recipient]++
+	if m.attempts[recipient] <= m.failures {
+		return errors.New("provider unavailable")
+	}
+
+	email := sentEmail{recipient: recipient, template: templateFile}
+	if fields, ok := data.(map[string]interface{}); ok {
+		email.data = make(map[string]interface{}, len(fields))
+		for key, value := range fields {
+			email.data[key] = value
+		}
+	}
+	m.sent = append(m.sent, email)
+	return nil
+}
+
+func (m *testMailer) Ping(ctx context.Context) error {
+	return m.pingErr
+}
+
+// sentTo returns the emails sent to the recipient.
+func (m *testMailer) sentTo(recipient string) []sentEmail {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var emails []sentEmail
+	for _, email := range m.sent {
+		if email.recipient == recipient {
+			emails = append(emails, email)
+		}
+	}
+	return emails
+}
+
+func TestDispatchOutboxAfterCrash(t *testing.T) {
+	app := newTestDBApplication(t)
+	app.config.outbox.maxAttempts = 5
+	app.config.outbox.retryDelay = time.Second
+	mailer := &testMailer{}
+	app.mailer = mailer
+
+	user := newTestUser(t, app)
+	user.Activated = false
+	err := app.models.Users.Update(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message := &data.OutboxMessage{
+		Recipient: user.Email,
+		Template:  "user_welcome.html",
+		Data:      map[string]interface{}{"userID": user.ID},
+		Token:     &data.OutboxToken{UserID: user.ID, Scope: data.ScopeActivation, Key: "activationToken"},
+	}
+	err = app.models.Outbox.Insert(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A dispatcher claims the message and then crashes before sending it.
+	const lease = time.Second
+	claimed, err := app.models.Outbox.Claim(10_000, lease)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, m := range claimed {
+		found = found || m.ID == message.ID
+	}
+	if !found {
+		t.Fatalf("message %d wasn't claimed", message.ID)
+	}
+
+	// While the crashed dispatcher's lease holds, the message isn't sent again.
+	app.dispatchOutbox()
+	if emails := mailer.sentTo(user.Email); len(emails) != 0 {
+		t.Fatalf("message was sent during the lease: %v", emails)
+	}
+
+	// After a restart, once the lease has expired, it's sent.
+	time.Sleep(lease + 100*time.Millisecond)
+	app.dispatchOutbox()
+
+	emails := mailer.sentTo(user.Email)
+	if len(emails) != 1 {
+		t.Fatalf("got %d emails; want 1", len(emails))
+	}
+	if emails[0].data["tokenExpiry"] == nil {
+		t.Errorf("email has no token expiry: %v", emails[0].data)
+	}
+
+	// The token was minted when the email was sent, and works.
+	plaintext, _ := emails[0].data["activationToken"].(string)
+	activated, err := app.models.Users.GetForToken(data.ScopeActivation, plaintext)
+	if err != nil {
+		t.Fatalf("activation token from the email: %v", err)
+	}
+	if activated.ID != user.ID {
+		t.Errorf("token is for user %d; want %d", activated.ID, user.ID)
+	}
+
+	// Once sent, it's never sent again.
+	time.Sleep(lease + 100*time.Millisecond)
+	app.dispatchOutbox()
+	if emails := mailer.sentTo(user.Email); len(emails) != 1 {
+		t.Errorf("got %d emails after another dispatch; want 1", len(emails))
+	}
+}
+
+func TestOutboxRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{3, 4 * time.Minute},
+		{8, 128 * time.Minute},
+		{9, 256 * time.Minute},
+		{10, outboxMaxRetryDelay},
+		{100, outboxMaxRetryDelay},
+	}
+
+	for _, tt := range tests {
+		got := outboxRetryDelay(time.Minute, tt.attempts)
+		if got != tt.want {
+			t.Errorf("outboxRetryDelay(1m, %d) = %s; want %s", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestDispatchOutboxRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		failures     int
+		wantAttempts int
+		wantSent     bool
+	}{
+		{"succeeds after failures", 2, 3, true},
+		{"gives up", 10, 4, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestDBApplication(t)
+			app.config.outbox.maxAttempts = 4
+			app.config.outbox.retryDelay = 50 * time.Millisecond
+			mailer := &testMailer{failures: tt.failures}
+			app.mailer = mailer
+
+			message := &data.OutboxMessage{
+				Recipient: fmt.Sprintf("retry-%d@example.com", time.Now().UnixNano()),
+				Template:  "user_welcome.html",
+			}
+			err := app.models.Outbox.Insert(message)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The delays are 50ms, 100ms and 200ms, so each dispatch finds the message
+			// due again.
+			for i := 0; i < 6; i++ {
+				app.dispatchOutbox()
+				time.Sleep(250 * time.Millisecond)
+			}
+
+			mailer.mu.Lock()
+			attempts := mailer.attempts[message.Recipient]
+			mailer.mu.Unlock()
+			if attempts != tt.wantAttempts {
+				t.Errorf("got %d attempts; want %d", attempts, tt.wantAttempts)
+			}
+			if sent := len(mailer.sentTo(message.Recipient)) == 1; sent != tt.wantSent {
+				t.Errorf("got sent %t; want %t", sent, tt.wantSent)
+			}
+
+			var sent, failed bool
+			err = app.models.Movies.DB.QueryRow(context.Background(),
+				`SELECT sent_at IS NOT NULL, failed_at IS NOT NULL FROM outbox WHERE id = $1`, message.ID).Scan(&sent, &failed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sent != tt.wantSent || failed == tt.wantSent {
+				t.Errorf("got sent %t and failed %t in the outbox; want sent %t", sent, failed, tt.wantSent)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"reflect"
+	"sync"
+)
+
+// Struct fields tagged sensitive:"true" (password hashes, token hashes and the like)
+// are zeroed by writeJSON before a response is encoded. They should also be tagged
+// json:"-"; the redaction is a second line of defence in case that's ever lost.
+
+// redactionNeeded caches, per type, whether values of it may hold sensitive fields
+// which would be encoded.
+var redactionNeeded sync.Map
+
+// redact returns a copy of the envelope with sensitive fields zeroed. Only the parts
+// of the envelope which contain sensitive fields are copied.
+func redact(data envelope) envelope {
+	return redactValue(reflect.ValueOf(data)).Interface().(envelope)
+}
+
+func redactValue(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		return redactValue(v.Elem())
+
+	case reflect.Pointer:
+		if v.IsNil() || !needsRedaction(v.Type()) {
+			return v
+		}
+		elem := redactValue(v.Elem())
+		p := reflect.New(elem.Type())
+		p.Elem().Set(elem)
+		return p
+
+	case reflect.Struct:
+		if !needsRedaction(v.Type()) {
+			return v
+		}
+		c := reflect.New(v.Type()).Elem()
+		c.Set(v)
+		for i := 0; i < c.NumField(); i++ {
+			field := c.Type().Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			if isSensitive(field) {
+				c.Field(i).Set(reflect.Zero(field.Type))
+			} else if needsRedaction(field.Type) {
+				c.Field(i).Set(redactValue(c.Field(i)))
+			}
+		}
+		return c
+
+	case reflect.Slice, reflect.Array:
+		if (v.Kind() == reflect.Slice && v.IsNil()) || !needsRedaction(v.Type()) {
+			return v
+		}
+		c := reflect.New(v.Type()).Elem()
+		if v.Kind() == reflect.Slice {
+			c.Set(reflect.MakeSlice(v.Type(), v.Len(), v.Len()))
+		}
+		for i := 0; i < v.Len(); i++ {
+			c.Index(i).Set(redactValue(v.Index(i)))
+		}
+		return c
+
+	case reflect.Map:
+		if v.IsNil() || !needsRedaction(v.Type()) {
+			return v
+		}
+		c := reflect.MakeMapWithSize(v.Type(), v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			c.SetMapIndex(iter.Key(), redactValue(iter.Value()))
+		}
+		return c
+	}
+	return v
+}
+
+// needsRedaction reports whether values of type t may contain a sensitive field which
+// would be encoded. Interface types may hold anything, so they always need checking.
+func needsRedaction(t reflect.Type) bool {
+	if needed, ok := redactionNeeded.Load(t); ok {
+		return needed.(bool)
+	}
+	needed := typeNeedsRedaction(t, map[reflect.Type]bool{})
+	redactionNeeded.Store(t, needed)
+	return needed
+}
+
+// typeNeedsRedaction does the work of needsRedaction. Types already being inspected
+// further up are skipped, which terminates recursive types.
+func typeNeedsRedaction(t reflect.Type, visiting map[reflect.Type]bool) bool {
+	if needed, ok := redactionNeeded.Load(t); ok {
+		return needed.(bool)
+	}
+	if visiting[t] {
+		return false
+	}
+	visiting[t] = true
+	defer delete(visiting, t)
+
+	switch t.Kind() {
+	case reflect.Interface:
+		return true
+	case reflect.Pointer, reflect.Slice, reflect.Array, reflect.Map:
+		return typeNeedsRedaction(t.Elem(), visiting)
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			if isSensitive(field) && field.Tag.Get("json") != "-" {
+				return true
+			}
+			if typeNeedsRedaction(field.Type, visiting) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isSensitive(field reflect.StructField) bool {
+	return field.Tag.Get("sensitive") == "true"
+}
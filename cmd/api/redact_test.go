@@ -0,0 +1,120 @@
+package main
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"greenlight.yp2743.me/internal/data"
+)
+
+func TestRedact(t *testing.T) {
+	// leaky has lost its json:"-" tag, so only redaction keeps the secret out.
+	type leaky struct {
+		Name   string `json:"name"`
+		Secret string `json:"secret" sensitive:"true"`
+	}
+
+	user := &data.User{Name: "Alice", PasswordHash: "$2a$12$hash"}
+	env := envelope{
+		"user":   user,
+		"leaks":  []leaky{{Name: "a", Secret: "s3cret"}},
+		"nested": map[string]interface{}{"leak": &leaky{Name: "b", Secret: "s3cret"}},
+	}
+
+	app := newTestApplication(t)
+	js, _, err := app.encodeJSON(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(js), "s3cret") || strings.Contains(string(js), "$2a$") {
+		t.Errorf("response contains a sensitive field: %s", js)
+	}
+	if !strings.Contains(string(js), `"name": "a"`) || !strings.Contains(string(js), `"name": "b"`) {
+		t.Errorf("response lost other fields: %s", js)
+	}
+
+	// The values being encoded are left as they were.
+	if user.PasswordHash != "$2a$12$hash" || env["leaks"].([]leaky)[0].Secret != "s3cret" {
+		t.Error("redaction changed the original values")
+	}
+}
+
+// secretFieldRX matches the names of fields which are likely to hold secrets.
+var secretFieldRX = regexp.MustCompile(`(?i)password|secret|token|hash|nonce|apikey`)
+
+// TestSensitiveFieldsTagged scans the structs in the data package, which are what
+// responses are built from, and fails for any string or byte slice field named like a
+// secret which isn't tagged for redaction.
+func TestSensitiveFieldsTagged(t *testing.T) {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, "../../internal/data", func(fi fs.FileInfo) bool {
+		return !strings.HasSuffix(fi.Name(), "_test.go")
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checked := 0
+	for _, pkg := range pkgs {
+		for _, file := range pkg.Files {
+			ast.Inspect(file, func(n ast.Node) bool {
+				spec, ok := n.(*ast.TypeSpec)
+				if !ok {
+					return true
+				}
+				st, ok := spec.Type.(*ast.StructType)
+				if !ok {
+					return true
+				}
+
+				for _, field := range st.Fields.List {
+					if !holdsText(field.Type) {
+						continue
+					}
+					var tag reflect.StructTag
+					if field.Tag != nil {
+						s, _ := strconv.Unquote(field.Tag.Value)
+						tag = reflect.StructTag(s)
+					}
+					for _, name := range field.Names {
+						if !name.IsExported() || !secretFieldRX.MatchString(name.Name) {
+							continue
+						}
+						checked++
+						if tag.Get("sensitive") != "true" {
+							t.Errorf("%s: %s.%s looks like a secret but isn't tagged sensitive:\"true\"", fset.Position(name.Pos()), spec.Name.Name, name.Name)
+						}
+					}
+				}
+				return true
+			})
+		}
+	}
+
+	// Guard against the scan silently finding nothing.
+	if checked == 0 {
+		t.Fatal("no secret fields were found to check")
+	}
+}
+
+// holdsText reports whether a field's type is a string or a byte slice, the types a
+// secret would be held in.
+func holdsText(expr ast.Expr) bool {
+	switch expr := expr.(type) {
+	case *ast.Ident:
+		return expr.Name == "string"
+	case *ast.ArrayType:
+		ident, ok := expr.Elt.(*ast.Ident)
+		return ok && ident.Name == "byte"
+	case *ast.StarExpr:
+		return holdsText(expr.X)
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"greenlight.yp2743.me/internal/data"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// requestIDRX matches the request IDs accepted from clients. It's deliberately strict,
+// as the ID ends up in logs and in SQL comments.
+var requestIDRX = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+const nanoidAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789_-"
+
+// newRequestID generates a random request ID, either a version 4 UUID or a 21
+// character nanoid.
+func newRequestID(format string) string {
+	switch format {
+	case "nanoid":
+		b := make([]byte, 21)
+		if _, err := rand.Read(b); err != nil {
+			panic(err)
+		}
+		// The alphabet has 64 characters, so masking each byte is unbiased.
+		for i := range b {
+			b[i] = nanoidAlphabet[b[i]&63]
+		}
+		return string(b)
+	default:
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			panic(err)
+		}
+		b[6] = (b[6] & 0x0f) | 0x40
+		b[8] = (b[8] & 0x3f) | 0x80
+		return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+	}
+}
+
+// requestID identifies each request, reusing a well-formed X-Request-ID from the
+// client (or an upstream proxy) and otherwise generating one. The ID is echoed back in
+// the response and stored in the request context.
+func (app *application) requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !requestIDRX.MatchString(id) {
+			id = newRequestID(app.config.requestIDFormat)
+		}
+
+		w.Header().Set(requestIDHeader, id)
+
+		r = app.contextSetRequestID(r, id)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// modelsFor returns the models to use while handling the request. With -db-tag-queries,
+// their queries carry the request ID for correlation with the database's logs, and for
+// GET requests, reads failing with transient errors are retried.
+func (app *application) modelsFor(r *http.Request) data.Models {
+	models := app.models
+	if app.config.db.tagQueries {
+		models = models.WithQueryTag("request_id=" + app.contextGetRequestID(r))
+	}
+
+	// GET requests only read, so their queries can be retried safely.
+	if app.config.db.readRetries > 0 && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		models = models.WithRetries(data.RetryPolicy{
+			Retries: app.config.db.readRetries,
+			Backoff: app.config.db.readRetryBackoff,
+			OnRetry: func(err error, attempt int) {
+				app.logger.PrintInfo("retrying read after transient database error", map[string]string{
+					"request_id": app.contextGetRequestID(r),
+					"attempt":    strconv.Itoa(attempt),
+					"error":      err.Error(),
+				})
+			},
+		})
+	}
+	return models
+}
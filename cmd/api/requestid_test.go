@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestNewRequestID(t *testing.T) {
+	tests := []struct {
+		format string
+		want   *regexp.Regexp
+	}{
+		{"uuid", regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)},
+		{"nanoid", regexp.MustCompile(`^[A-Za-z0-9_-]{21}$`)},
+	}
+
+	for _, tt := range tests {
+		seen := make(map[string]bool)
+		for i := 0; i < 100; i++ {
+			id := newRequestID(tt.format)
+			if !tt.want.MatchString(id) {
+				t.Fatalf("%s: got %q", tt.format, id)
+			}
+			if !requestIDRX.MatchString(id) {
+				t.Fatalf("%s: %q wouldn't be accepted back from a client", tt.format, id)
+			}
+			if seen[id] {
+				t.Fatalf("%s: got %q twice", tt.format, id)
+			}
+			seen[id] = true
+		}
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.requestIDFormat = "nanoid"
+
+	tests := []struct {
+		name   string
+		header string
+		keep   bool
+	}{
+		{"none", "", false},
+		{"valid", "upstream-1234.abc", true},
+		{"comment", "*/ DROP TABLE movies; /*", false},
+		{"too long", strings.Repeat("a", 65), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			handler := app.requestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = app.contextGetRequestID(r)
+			}))
+
+			r := httptest.NewRequest(http.MethodGet, "/v1/healthcheck", nil)
+			if tt.header != "" {
+				r.Header.Set(requestIDHeader, tt.header)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, r)
+
+			if tt.keep && got != tt.header {
+				t.Errorf("got request ID %q; want the client's %q", got, tt.header)
+			}
+			if !tt.keep && (got == tt.header || len(got) != 21) {
+				t.Errorf("got request ID %q; want a new nanoid", got)
+			}
+			if echoed := rr.Header().Get(requestIDHeader); echoed != got {
+				t.Errorf("got %s header %q; want %q", requestIDHeader, echoed, got)
+			}
+		})
+	}
+}
+
+func TestModelsForTagsQueries(t *testing.T) {
+	app := newTestDBApplication(t)
+	app.config.db.tagQueries = true
+
+	var query string
+	handler := app.requestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The database reports the statement a backend is running, tag included.
+		err := app.modelsFor(r).Movies.DB.QueryRow(context.Background(), "SELECT query FROM pg_stat_activity WHERE pid = pg_backend_pid()").Scan(&query)
+		if err != nil {
+			t.Error(err)
+		}
+	}))
+
+	r := httptest.NewRequest(http.MethodGet, "/v1/movies", nil)
+	r.Header.Set(requestIDHeader, "trace-me-42")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	if !strings.HasPrefix(query, "/* request_id=trace-me-42 */ ") {
+		t.Errorf("got query %q in pg_stat_activity; want it tagged with the request ID", query)
+	}
+}
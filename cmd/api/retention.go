@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strconv"
+	"time"
+)
+
+const (
+	purgeInterval  = time.Hour
+	purgeBatchSize = 500
+)
+
+// purgeSoftDeleted permanently deletes movies which have been soft-deleted for longer
+// than -soft-delete-retention, and their history with them. It deletes in batches, so
+// that no single statement holds locks on a large number of rows, and logs how many
+// were purged.
+func (app *application) purgeSoftDeleted() {
+	cutoff := time.Now().Add(-app.config.deletedRetention)
+
+	var total int64
+	for {
+		n, err := app.models.Movies.PurgeDeleted(cutoff, purgeBatchSize)
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{
+				"purged_movies": strconv.FormatInt(total, 10),
+			})
+			return
+		}
+		total += n
+
+		// A short batch means there's nothing left, or only rows locked by a
+		// concurrent restore, which the next run will pick up.
+		if n < purgeBatchSize {
+			break
+		}
+
+		select {
+		case <-app.shutdown:
+			return
+		default:
+		}
+	}
+
+	if total > 0 {
+		app.logger.PrintInfo("purged soft-deleted movies", map[string]string{
+			"purged_movies": strconv.FormatInt(total, 10),
+			"retention":     app.config.deletedRetention.String(),
+		})
+	}
+}
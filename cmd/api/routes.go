@@ -13,20 +13,69 @@ func (app *application) routes() http.Handler {
 	router.NotFound = http.HandlerFunc(app.notFoundResponse)
 	router.MethodNotAllowed = http.HandlerFunc(app.methodNotAllowedResponse)
 
-	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.livenessHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/healthcheck/live", app.livenessHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/healthcheck/ready", app.readinessHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/openapi.json", app.openAPIHandler())
 
-	router.HandlerFunc(http.MethodGet, "/v1/movies", app.requirePermission("movies:read", app.listMoviesHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/movies", app.requirePublicReadPermission("movies:read", app.limitDBConcurrency(app.versioned(versionedHandlers{
+		1: app.deprecated("GET /v1/movies", app.listMoviesHandler),
+		2: app.listMoviesV2Handler,
+	}))))
 	router.HandlerFunc(http.MethodPost, "/v1/movies", app.requirePermission("movies:write", app.createMovieHandler))
-	router.HandlerFunc(http.MethodGet, "/v1/movies/:id", app.requirePermission("movies:read", app.showMovieHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/movies", app.requirePermission("movies:write", app.upsertMovieHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/movies/batch", app.requirePermission("movies:write", app.limitDBConcurrency(app.createMoviesBatchHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/movies/:id", app.requirePublicReadPermission("movies:read", app.versioned(versionedHandlers{
+		1: app.deprecated("GET /v1/movies/:id", app.showMovieHandler),
+		2: app.showMovieV2Handler,
+	})))
 	router.HandlerFunc(http.MethodPatch, "/v1/movies/:id", app.requirePermission("movies:write", app.updateMovieHandler))
 	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id", app.requirePermission("movies:write", app.deleteMovieHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/movies/:id/restore", app.requirePermission("movies:write", app.restoreMovieHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/movies/:id/script", app.requirePermission("movies:read", app.showMovieScriptHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/movies/:id/history", app.requireAnyPermission([]string{"movies:read", "admin"}, app.limitDBConcurrency(app.movieHistoryHandler)))
+	router.HandlerFunc(http.MethodPut, "/v1/movies/:id/script", app.requirePermission("movies:write", app.updateMovieScriptHandler))
 
 	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
 	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/users/password", app.updateUserPasswordHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/users/email", app.confirmEmailChangeHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/email", app.requireActivatedUser(app.requireNonce(app.createEmailChangeHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me", app.requireActivatedUser(app.requireNonce(app.deactivateUserHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/export", app.requireAuthenticatedUser(app.limitDBConcurrency(app.exportUserDataHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/exports/:id", app.requireAuthenticatedUser(app.showUserExportHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/sessions", app.requireAuthenticatedUser(app.listSessionsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/nonce", app.requireAuthenticatedUser(app.createNonceHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/me/capabilities", app.requireAuthenticatedUser(app.capabilitiesHandler))
 
 	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/refresh", app.refreshAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/password-reset", app.createPasswordResetTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/refresh-ttl", app.requireAuthenticatedUser(app.refreshTokenTTLHandler))
 
-	router.Handler(http.MethodGet, "/debug/vars", expvar.Handler())
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users", app.requirePermission("admin", app.createUserHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/imports/users", app.requirePermission("admin", app.limitDBConcurrency(app.importUsersHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/impersonate", app.requirePermission("admin", app.requireNonce(app.impersonateUserHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/reactivate", app.requirePermission("admin", app.reactivateUserHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users/:id/permissions", app.requirePermission("admin:permissions", app.showUserPermissionsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/permissions", app.requirePermission("admin:permissions", app.grantUserPermissionsHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/permissions", app.requirePermission("admin:permissions", app.revokeUserPermissionsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/roles", app.requirePermission("admin:permissions", app.assignUserRoleHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/roles", app.requirePermission("admin:permissions", app.listRolesHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/stats", app.requirePermission("admin", app.adminStatsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/tokens", app.requirePermission("admin", app.limitDBConcurrency(app.listTokensHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/permissions", app.requirePermission("admin", app.listPermissionsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/recompute-aggregates", app.requirePermission("admin", app.recomputeAggregatesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/resend-pending-activations", app.requirePermission("admin", app.resendPendingActivationsHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/admin/read-only", app.requirePermission("admin", app.updateReadOnlyHandler))
 
-	return app.metrics(app.recoverPanic(app.enableCORS(app.rateLimit(app.authenticate(router)))))
+	// The metrics are open in development and staging, but in production they're
+	// restricted to admins.
+	if app.config.env == "production" {
+		router.HandlerFunc(http.MethodGet, "/debug/vars", app.requirePermission("admin", expvar.Handler().ServeHTTP))
+	} else {
+		router.Handler(http.MethodGet, "/debug/vars", expvar.Handler())
+	}
+
+	return app.requestID(app.logRequests(app.metrics(app.securityHeaders(app.strictTransportSecurity(app.shedOverload(app.limitURLLength(app.compress(app.recoverPanic(app.enableCORS(app.rateLimitIP(app.authenticate(app.rateLimitUser(app.enforceReadOnly(app.loaders(router)))))))))))))))
 }
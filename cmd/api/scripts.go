@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+
+	"greenlight.yp2743.me/internal/data"
+)
+
+// scriptChunkSize is the number of bytes of a script stored in the database at a time.
+const scriptChunkSize = 64 << 10
+
+// updateMovieScriptHandler replaces a movie's script with the plain text request body.
+// The body is spooled to a temporary file rather than held in memory, and only then
+// written to the database in chunks, so that a slow upload doesn't hold a transaction
+// open.
+func (app *application) updateMovieScriptHandler(w http.ResponseWriter, r *http.Request) {
+	movie, ok := app.getMovie(w, r)
+	if !ok {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, app.config.maxScriptBytes)
+
+	spool, err := spoolBody(r.Body)
+	if err != nil {
+		var maxBytesError *http.MaxBytesError
+		switch {
+		case errors.As(err, &maxBytesError):
+			app.contentTooLargeResponse(w, r, maxBytesError.Limit)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	defer spool.Close()
+
+	var size int64
+	err = app.modelsFor(r).Transaction(func(tx data.Models) error {
+		var err error
+		size, err = tx.Scripts.Save(movie.ID, spool, scriptChunkSize)
+		return err
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrInvalidScriptEncoding):
+			app.failedValidationResponse(w, r, map[string]string{"script": "must be valid UTF-8 text without NUL bytes"})
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"script": map[string]int64{"size": size}}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// spoolBody copies a request body to a temporary file, returning the file rewound to
+// its start. Closing the file also removes it.
+func spoolBody(body io.Reader) (*spooledBody, error) {
+	f, err := os.CreateTemp("", "greenlight-upload-*")
+	if err != nil {
+		return nil, err
+	}
+	spool := &spooledBody{f}
+
+	_, err = io.Copy(f, body)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		spool.Close()
+		return nil, err
+	}
+	return spool, nil
+}
+
+type spooledBody struct {
+	*os.File
+}
+
+func (s *spooledBody) Close() error {
+	err := s.File.Close()
+	os.Remove(s.Name())
+	return err
+}
+
+// showMovieScriptHandler streams a movie's script back as plain text, with its length
+// in Content-Length.
+func (app *application) showMovieScriptHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	started := false
+	err = app.modelsFor(r).Scripts.Stream(id, w, func(size int64) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		w.WriteHeader(http.StatusOK)
+		started = true
+	})
+	if err != nil {
+		switch {
+		// Once the status has been sent, a failure part way through can only be logged.
+		case started:
+			app.logError(r, err)
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSpoolBody(t *testing.T) {
+	content := strings.Repeat("INT. DINER - NIGHT\n", 10_000)
+
+	spool, err := spoolBody(strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := spool.Name()
+
+	got, err := io.ReadAll(spool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != content {
+		t.Errorf("read back %d bytes; want the %d written", len(got), len(content))
+	}
+
+	spool.Close()
+	if _, err := os.Stat(name); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("spool file still exists after Close: %v", err)
+	}
+}
+
+func TestMovieScriptRoundTrip(t *testing.T) {
+	app := newTestDBApplication(t)
+	app.config.maxScriptBytes = 1 << 20
+	user := newTestUser(t, app, "movies:read", "movies:write")
+	movie := newTestMovie(t, app, user)
+
+	// Several chunks, with a multi-byte character split across a chunk boundary.
+	script := strings.Repeat("x", scriptChunkSize-1) + "é" + strings.Repeat("FADE OUT.\n", 20_000)
+
+	r := withID(httptest.NewRequest(http.MethodPut, "/v1/movies/1/script", strings.NewReader(script)), movie.ID)
+	rr := serveAs(app, app.updateMovieScriptHandler, user, r)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("upload: got status %d; want %d: %s", rr.Code, http.StatusOK, rr.Body)
+	}
+
+	r = withID(httptest.NewRequest(http.MethodGet, "/v1/movies/1/script", nil), movie.ID)
+	rr = serveAs(app, app.showMovieScriptHandler, user, r)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("download: got status %d; want %d: %s", rr.Code, http.StatusOK, rr.Body)
+	}
+	if got := rr.Header().Get("Content-Length"); got != strconv.Itoa(len(script)) {
+		t.Errorf("got Content-Length %s; want %d", got, len(script))
+	}
+	if !bytes.Equal(rr.Body.Bytes(), []byte(script)) {
+		t.Errorf("downloaded %d bytes which differ from the %d uploaded", rr.Body.Len(), len(script))
+	}
+}
+
+func TestMovieScriptUploadRejected(t *testing.T) {
+	app := newTestDBApplication(t)
+	app.config.maxScriptBytes = 1 << 10
+	user := newTestUser(t, app, "movies:read", "movies:write")
+	movie := newTestMovie(t, app, user)
+
+	tests := []struct {
+		name       string
+		script     string
+		wantStatus int
+	}{
+		{"oversize", strings.Repeat("x", 1<<10+1), http.StatusRequestEntityTooLarge},
+		{"invalid UTF-8", "FADE IN \xff", http.StatusUnprocessableEntity},
+		{"NUL byte", "FADE IN \x00", http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := withID(httptest.NewRequest(http.MethodPut, "/v1/movies/1/script", strings.NewReader(tt.script)), movie.ID)
+			rr := serveAs(app, app.updateMovieScriptHandler, user, r)
+			if rr.Code != tt.wantStatus {
+				t.Errorf("got status %d; want %d: %s", rr.Code, tt.wantStatus, rr.Body)
+			}
+		})
+	}
+
+	// Nothing was stored.
+	r := withID(httptest.NewRequest(http.MethodGet, "/v1/movies/1/script", nil), movie.ID)
+	rr := serveAs(app, app.showMovieScriptHandler, user, r)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("download after rejected uploads: got status %d; want %d", rr.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/getsentry/sentry-go"
+	"greenlight.yp2743.me/internal/data"
+)
+
+// panicError wraps a value recovered from a panic, so that it's reported as such.
+type panicError struct {
+	value interface{}
+}
+
+func (e panicError) Error() string {
+	return fmt.Sprintf("%s", e.value)
+}
+
+// initSentry configures the Sentry client. With an empty DSN, reporting is a no-op.
+func initSentry(dsn, env string) error {
+	if dsn == "" {
+		return nil
+	}
+	return sentry.Init(sentry.ClientOptions{
+		Dsn:         dsn,
+		Environment: env,
+		Release:     version,
+		BeforeSend:  scrubSentryEvent,
+	})
+}
+
+// scrubSentryEvent removes credentials from an event before it leaves the process.
+func scrubSentryEvent(event *sentry.Event, hint *sentry.EventHint) *sentry.Event {
+	if event.Request != nil {
+		for key := range event.Request.Headers {
+			switch strings.ToLower(key) {
+			case "authorization", "cookie", "x-authenticated-user":
+				event.Request.Headers[key] = "[Filtered]"
+			}
+		}
+		event.Request.Cookies = ""
+		event.Request.Data = ""
+		event.Request.QueryString = ""
+	}
+	return event
+}
+
+// reportError sends a server-side error to Sentry along with details of the request.
+func (app *application) reportError(r *http.Request, err error) {
+	if app.config.sentry.dsn == "" {
+		return
+	}
+
+	hub := sentry.CurrentHub().Clone()
+	hub.ConfigureScope(func(scope *sentry.Scope) {
+		scope.SetRequest(r)
+		scope.SetTag("method", r.Method)
+		scope.SetTag("path", r.URL.Path)
+		if id := app.contextGetRequestID(r); id != "" {
+			scope.SetTag("request_id", id)
+		}
+
+		if user, ok := r.Context().Value(userContextKey).(*data.User); ok && !user.IsAnonymous() {
+			scope.SetUser(sentry.User{ID: strconv.FormatInt(user.ID, 10)})
+		}
+
+		var pe panicError
+		if errors.As(err, &pe) {
+			scope.SetTag("panic", "true")
+			scope.SetLevel(sentry.LevelFatal)
+		}
+	})
+	hub.CaptureException(err)
+}
@@ -2,24 +2,44 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 )
 
-func (app *application) serve() error {
+// tlsVersions are the accepted values of -tls-min-version.
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
 
-	srv := &http.Server{
+// newServer returns the server for the handler, configured with the application's
+// timeouts and limits.
+func (app *application) newServer(handler http.Handler) *http.Server {
+	return &http.Server{
 		Addr:         fmt.Sprintf(":" + app.config.port),
-		Handler:      app.routes(),
+		Handler:      handler,
 		IdleTimeout:  time.Minute,
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 30 * time.Second,
+
+		MaxHeaderBytes: app.config.maxHeaderBytes,
+
+		TLSConfig: &tls.Config{
+			MinVersion: tlsVersions[app.config.tls.minVersion],
+		},
 	}
+}
+
+func (app *application) serve() error {
+
+	srv := app.newServer(app.routes())
 
 	shutdownError := make(chan error)
 
@@ -43,19 +63,29 @@ func (app *application) serve() error {
 		}
 
 		app.logger.PrintInfo("completing background tasks", map[string]string{
-			"addr": srv.Addr,
+			"addr":    srv.Addr,
+			"pending": strconv.FormatInt(app.backgroundTasks.Load(), 10),
 		})
 
-		app.wg.Wait()
+		// Signal periodic background jobs to stop after their current run.
+		close(app.shutdown)
+
+		app.drainBackgroundTasks(app.config.drainTimeout)
 		shutdownError <- nil
 	}()
 
 	app.logger.PrintInfo("starting server", map[string]string{
 		"addr": srv.Addr,
 		"env":  app.config.env,
+		"tls":  strconv.FormatBool(app.config.tls.certFile != ""),
 	})
 
-	err := srv.ListenAndServe()
+	var err error
+	if app.config.tls.certFile != "" {
+		err = srv.ListenAndServeTLS(app.config.tls.certFile, app.config.tls.keyFile)
+	} else {
+		err = srv.ListenAndServe()
+	}
 	if !errors.Is(err, http.ErrServerClosed) {
 		return err
 	}
@@ -71,3 +101,24 @@ func (app *application) serve() error {
 
 	return nil
 }
+
+// drainBackgroundTasks waits up to timeout for the background tasks to finish. Tasks
+// still running after that are abandoned; emails they were sending remain in the
+// outbox and are retried on the next start.
+func (app *application) drainBackgroundTasks(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		app.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		app.logger.PrintInfo("background tasks completed", nil)
+	case <-time.After(timeout):
+		app.logger.PrintInfo("warning: timed out waiting for background tasks, abandoning them", map[string]string{
+			"abandoned": strconv.FormatInt(app.backgroundTasks.Load(), 10),
+			"timeout":   timeout.String(),
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"greenlight.yp2743.me/internal/jsonlog"
+)
+
+func TestRequestSizeLimits(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.maxHeaderBytes = 4096
+	app.config.maxURLBytes = 100
+
+	handler := app.limitURLLength(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts := httptest.NewUnstartedServer(handler)
+	ts.Config = app.newServer(handler)
+	ts.Start()
+	defer ts.Close()
+
+	tests := []struct {
+		name       string
+		path       string
+		header     string
+		wantStatus int
+	}{
+		{"within limits", "/v1/movies?title=alien", "", http.StatusOK},
+		{"long URL", "/v1/movies?genres=" + strings.Repeat("drama,", 20), "", http.StatusRequestURITooLong},
+		// The server allows some slack over MaxHeaderBytes, so this is well over.
+		{"large headers", "/v1/movies", strings.Repeat("a", 16<<10), http.StatusRequestHeaderFieldsTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := http.NewRequest(http.MethodGet, ts.URL+tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.header != "" {
+				r.Header.Set("X-Padding", tt.header)
+			}
+
+			resp, err := ts.Client().Do(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("got status %d; want %d", resp.StatusCode, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestDrainBackgroundTasks(t *testing.T) {
+	t.Run("waits", func(t *testing.T) {
+		var buf bytes.Buffer
+		app := newTestApplication(t)
+		app.logger = jsonlog.New(&buf, jsonlog.LevelInfo)
+
+		var finished atomic.Bool
+		app.background(func() {
+			time.Sleep(200 * time.Millisecond)
+			finished.Store(true)
+		})
+
+		app.drainBackgroundTasks(5 * time.Second)
+		if !finished.Load() {
+			t.Error("drain returned before the task finished")
+		}
+		if !strings.Contains(buf.String(), "background tasks completed") {
+			t.Errorf("got logs %s; want the drain to be reported complete", buf.String())
+		}
+	})
+
+	t.Run("times out", func(t *testing.T) {
+		var buf bytes.Buffer
+		app := newTestApplication(t)
+		app.logger = jsonlog.New(&buf, jsonlog.LevelInfo)
+
+		release := make(chan struct{})
+		defer close(release)
+		app.background(func() { <-release })
+
+		start := time.Now()
+		app.drainBackgroundTasks(50 * time.Millisecond)
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("drain blocked for %s despite its timeout", elapsed)
+		}
+		if !strings.Contains(buf.String(), `"abandoned":"1"`) {
+			t.Errorf("got logs %s; want the abandoned task reported", buf.String())
+		}
+	})
+}
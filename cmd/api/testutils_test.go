@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/julienschmidt/httprouter"
+
+	"greenlight.yp2743.me/internal/data"
+	"greenlight.yp2743.me/internal/jsonlog"
+)
+
+// newTestApplication returns an application with the default settings and no
+// database, for tests of code which doesn't query it.
+func newTestApplication(t *testing.T) *application {
+	t.Helper()
+
+	app := &application{
+		logger:   jsonlog.New(io.Discard, jsonlog.LevelOff),
+		shutdown: make(chan struct{}),
+	}
+	app.config.batchPolicy = batchAllOrNothing
+	app.config.responseEnvelope = true
+	app.config.runtimeFormat = "mins"
+	app.config.requireActivation = "all"
+	app.config.maxURLBytes = 8192
+	return app
+}
+
+// newTestDBApplication returns an application backed by the database named by the
+// GREENLIGHT_TEST_DSN environment variable, which must already be migrated. The test
+// is skipped if the variable isn't set.
+func newTestDBApplication(t *testing.T) *application {
+	t.Helper()
+
+	dsn := os.Getenv("GREENLIGHT_TEST_DSN")
+	if dsn == "" {
+		t.Skip("GREENLIGHT_TEST_DSN is not set")
+	}
+
+	pool, err := pgxpool.New(context.Background(), dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(pool.Close)
+
+	passwords := data.Passwords{Current: data.BcryptHasher{Cost: 4}}
+	passwords.Supported = []data.PasswordHasher{passwords.Current}
+
+	app := newTestApplication(t)
+	app.models = data.NewModels(pool, passwords)
+	return app
+}
+
+var testUserCount atomic.Int64
+
+// newTestUser inserts an activated user with a unique email address, with the given
+// permissions.
+func newTestUser(t *testing.T, app *application, permissions ...string) *data.User {
+	t.Helper()
+
+	n := testUserCount.Add(1)
+	user := &data.User{
+		Name:      fmt.Sprintf("Test User %d", n),
+		Email:     fmt.Sprintf("test-%d-%d@example.com", time.Now().UnixNano(), n),
+		Password:  "pa55word-for-tests",
+		Activated: true,
+	}
+	err := app.models.Users.Insert(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(permissions) > 0 {
+		err = app.models.Permissions.AddForUser(user.ID, permissions...)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return user
+}
+
+var testMovieCount atomic.Int64
+
+// newTestMovie inserts a movie with a unique title, created by the user.
+func newTestMovie(t *testing.T, app *application, user *data.User) *data.Movie {
+	t.Helper()
+
+	movie := &data.Movie{
+		Title:       fmt.Sprintf("Test Movie %d-%d", time.Now().UnixNano(), testMovieCount.Add(1)),
+		Year:        2000,
+		Runtime:     100,
+		Genres:      []string{"drama"},
+		CreatedByID: user.ID,
+		CreatedBy:   user.Name,
+	}
+	err := app.models.Movies.Insert(movie)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return movie
+}
+
+// withID returns the request with the :id route parameter set, as the router would.
+func withID(r *http.Request, id int64) *http.Request {
+	params := httprouter.Params{{Key: "id", Value: strconv.FormatInt(id, 10)}}
+	return r.WithContext(context.WithValue(r.Context(), httprouter.ParamsKey, params))
+}
+
+// serveAs runs the handler for a request made by the user, which may be nil for an
+// anonymous request, and returns the recorded response.
+func serveAs(app *application, handler http.HandlerFunc, user *data.User, r *http.Request) *httptest.ResponseRecorder {
+	if user == nil {
+		user = data.AnonymousUser
+	}
+	r = app.contextSetUser(r, user)
+
+	rr := httptest.NewRecorder()
+	handler(rr, r)
+	return rr
+}
@@ -3,9 +3,9 @@ package main
 import (
 	"errors"
 	"net/http"
+	"strconv"
 	"time"
 
-	"github.com/alexedwards/argon2id"
 	"greenlight.yp2743.me/internal/data"
 	"greenlight.yp2743.me/internal/validator"
 )
@@ -30,7 +30,7 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 
-	user, err := app.models.Users.GetByEmail(input.Email)
+	user, err := app.modelsFor(r).Users.GetByEmail(input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -41,7 +41,7 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 
-	match, err := argon2id.ComparePasswordAndHash(input.Password, user.Password)
+	match, needsRehash, err := app.modelsFor(r).Users.PasswordMatches(user, input.Password)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -50,13 +50,239 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 
-	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+	if user.DeactivatedAt != nil {
+		app.deactivatedAccountResponse(w, r)
+		return
+	}
+
+	// Transparently upgrade hashes produced by an outdated algorithm, now that we
+	// have the plaintext password to hand.
+	if needsRehash {
+		app.background(func() {
+			err := app.modelsFor(r).Users.UpdatePasswordHash(user, input.Password)
+			if err != nil {
+				app.logger.PrintError(err, nil)
+			}
+		})
+	}
+
+	var token, refresh *data.Token
+	err = app.modelsFor(r).Transaction(func(tx data.Models) error {
+		var err error
+		token, refresh, err = tx.Tokens.NewRefreshPair(user.ID, nil, app.clientIP(r), r.UserAgent())
+		return err
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token, "refresh_token": refresh}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// refreshAuthenticationTokenHandler exchanges a refresh token for a new authentication
+// token and a new refresh token, rotating out the one presented. Presenting a refresh
+// token which has already been rotated means it has leaked, so every token descended
+// from the same login is revoked.
+func (app *application) refreshAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+
+	var input struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateTokenPlaintext(v, input.RefreshToken); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	current, err := app.modelsFor(r).Tokens.GetRefresh(input.RefreshToken)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if current.Rotated {
+		app.revokeTokenFamily(r, current)
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+
+	if !app.checkScopeSunset(w, r, data.ScopeRefresh) {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+
+	var token, refresh *data.Token
+	err = app.modelsFor(r).Transaction(func(tx data.Models) error {
+		err := tx.Tokens.Rotate(current)
+		if err != nil {
+			return err
+		}
+		token, refresh, err = tx.Tokens.NewRefreshPair(current.UserID, current.Family, app.clientIP(r), r.UserAgent())
+		return err
+	})
+	if err != nil {
+		switch {
+		// Another request rotated the token first.
+		case errors.Is(err, data.ErrTokenReused):
+			app.revokeTokenFamily(r, current)
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token, "refresh_token": refresh}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// revokeTokenFamily deletes every token descended from the same login as a reused
+// refresh token. Failures are logged, as the client is refused either way.
+func (app *application) revokeTokenFamily(r *http.Request, token *data.Token) {
+	app.logger.PrintInfo("refresh token reused, revoking token family", map[string]string{
+		"user_id":    strconv.FormatInt(token.UserID, 10),
+		"request_id": app.contextGetRequestID(r),
+	})
+
+	err := app.modelsFor(r).Tokens.DeleteFamily(token.Family)
+	if err != nil {
+		app.logError(r, err)
+	}
+}
+
+// createNonceHandler issues a one-time nonce for a sensitive request, such as an email
+// change, guarded by requireNonce.
+func (app *application) createNonceHandler(w http.ResponseWriter, r *http.Request) {
+	nonce, err := app.modelsFor(r).Tokens.NewForScope(app.contextGetUser(r).ID, data.ScopeNonce)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token}, nil)
+	headers := make(http.Header)
+	headers.Set("Cache-Control", "no-store")
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"nonce": nonce}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// refreshTokenTTLHandler extends the expiry of the token used to authenticate the
+// request by the configured TTL, without extending it beyond the maximum lifetime
+// measured from when it was issued.
+func (app *application) refreshTokenTTLHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	// Impersonation tokens are deliberately short-lived and can't be extended.
+	if user.ImpersonatorID != 0 {
+		app.notPermittedResponse(w, r)
+		return
+	}
+
+	plaintext, ok := parseBearerToken(r.Header.Values("Authorization"))
+	if !ok {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+
+	token, err := app.modelsFor(r).Tokens.Get(data.ScopeAuthentication, plaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	expiry := time.Now().Add(app.config.tokens.ttl)
+	if limit := token.CreatedAt.Add(app.config.tokens.maxLifetime); expiry.After(limit) {
+		expiry = limit
+	}
+	if !expiry.After(token.Expiry) {
+		app.tokenLifetimeExceededResponse(w, r)
+		return
+	}
+
+	err = app.modelsFor(r).Tokens.UpdateExpiry(token, expiry)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"authentication_token": map[string]time.Time{"expiry": token.Expiry}}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createPasswordResetTokenHandler emails a password reset token to the user with the
+// given address, if they exist and are activated. The response is the same either way,
+// so that it can't be used to find out which addresses are registered.
+func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r *http.Request) {
+
+	var input struct {
+		Email string `json:"email"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.modelsFor(r).Users.GetByEmail(input.Email)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if user != nil && user.Activated {
+		err = app.modelsFor(r).Outbox.Insert(&data.OutboxMessage{
+			Recipient: user.Email,
+			Template:  "token_password_reset.html",
+			Token:     &data.OutboxToken{UserID: user.ID, Scope: data.ScopePasswordReset, Key: "passwordResetToken"},
+		})
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		app.background(app.dispatchOutbox)
+	}
+
+	env := envelope{"message": "if that email address belongs to an activated account, you will receive an email with password reset instructions"}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
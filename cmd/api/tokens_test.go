@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alexedwards/argon2id"
+
+	"greenlight.yp2743.me/internal/data"
+)
+
+func TestCreateAuthenticationTokenRehashesWeakPassword(t *testing.T) {
+	app := newTestDBApplication(t)
+
+	strong := data.Argon2idHasher{Params: &argon2id.Params{Memory: 16 * 1024, Iterations: 2, Parallelism: 1, SaltLength: 16, KeyLength: 32}}
+	weak := data.Argon2idHasher{Params: &argon2id.Params{Memory: 8 * 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}}
+	app.models.Users.Passwords = data.Passwords{Current: strong, Supported: []data.PasswordHasher{strong}}
+
+	user := newTestUser(t, app)
+	weakHash, err := weak.Hash("pa55word-for-tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.Password, user.PasswordHash = "", weakHash
+	err = app.models.Users.Update(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := `{"email": "` + user.Email + `", "password": "pa55word-for-tests"}`
+	r := httptest.NewRequest(http.MethodPost, "/v1/tokens/authentication", strings.NewReader(body))
+	rr := serveAs(app, app.createAuthenticationTokenHandler, nil, r)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusCreated, rr.Body)
+	}
+
+	// The rehash runs in the background, after the response.
+	app.wg.Wait()
+
+	upgraded, err := app.models.Users.Get(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upgraded.PasswordHash == weakHash || strong.NeedsRehash(upgraded.PasswordHash) {
+		t.Errorf("hash wasn't upgraded: %s", upgraded.PasswordHash)
+	}
+	if upgraded.Version != user.Version {
+		t.Errorf("got version %d; want %d, as the password hasn't changed", upgraded.Version, user.Version)
+	}
+
+	match, _, err := app.models.Users.PasswordMatches(upgraded, "pa55word-for-tests")
+	if err != nil || !match {
+		t.Errorf("upgraded hash doesn't match the password: %v", err)
+	}
+}
+
+func TestRefreshTokenTTLHandler(t *testing.T) {
+	app := newTestDBApplication(t)
+	user := newTestUser(t, app)
+
+	token, err := app.models.Tokens.New(user.ID, time.Minute, data.ScopeAuthentication)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refresh := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/v1/tokens/refresh-ttl", nil)
+		r.Header.Set("Authorization", "Bearer "+token.Plaintext)
+		return serveAs(app, app.refreshTokenTTLHandler, user, r)
+	}
+
+	t.Run("extended", func(t *testing.T) {
+		app.config.tokens.ttl = time.Hour
+		app.config.tokens.maxLifetime = 24 * time.Hour
+
+		rr := refresh()
+		if rr.Code != http.StatusOK {
+			t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusOK, rr.Body)
+		}
+
+		stored, err := app.models.Tokens.Get(data.ScopeAuthentication, token.Plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.Expiry.Before(time.Now().Add(59 * time.Minute)) {
+			t.Errorf("got expiry %s; want about an hour from now", stored.Expiry)
+		}
+	})
+
+	t.Run("capped", func(t *testing.T) {
+		app.config.tokens.ttl = 3 * time.Hour
+		app.config.tokens.maxLifetime = 2 * time.Hour
+
+		// The first refresh extends the token as far as the cap allows...
+		rr := refresh()
+		if rr.Code != http.StatusOK {
+			t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusOK, rr.Body)
+		}
+		stored, err := app.models.Tokens.Get(data.ScopeAuthentication, token.Plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := stored.CreatedAt.Add(2 * time.Hour); !stored.Expiry.Equal(want) {
+			t.Errorf("got expiry %s; want %s", stored.Expiry, want)
+		}
+
+		// ...and the next is rejected, leaving the expiry as it was.
+		rr = refresh()
+		if rr.Code != http.StatusForbidden {
+			t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusForbidden, rr.Body)
+		}
+		again, err := app.models.Tokens.Get(data.ScopeAuthentication, token.Plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !again.Expiry.Equal(stored.Expiry) {
+			t.Errorf("got expiry %s; want it unchanged at %s", again.Expiry, stored.Expiry)
+		}
+	})
+}
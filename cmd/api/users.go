@@ -3,6 +3,8 @@ package main
 import (
 	"errors"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"greenlight.yp2743.me/internal/data"
@@ -32,12 +34,53 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 
 	v := validator.New()
 
-	if data.ValidateUser(v, user); !v.Valid() {
+	data.ValidateUser(v, user)
+	data.ValidateEmailNotReserved(v, user.Email)
+	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	err = app.models.Users.Insert(user)
+	// With -bootstrap-admin, the first user on a fresh deployment is made an admin, as
+	// there's nobody else who could grant them the permission.
+	bootstrapped := false
+
+	// The user, their permissions, activation token and welcome email are recorded
+	// atomically, so the email can't be lost if the process dies before sending it.
+	err = app.modelsFor(r).Transaction(func(tx data.Models) error {
+		bootstrapped = false
+		if app.config.bootstrapAdmin {
+			empty, err := tx.Users.NoUsersLocked()
+			if err != nil {
+				return err
+			}
+			bootstrapped = empty
+			user.Activated = empty
+		}
+
+		err := tx.Users.Insert(user)
+		if err != nil {
+			return err
+		}
+
+		if bootstrapped {
+			return tx.Permissions.AddAllForUser(user.ID)
+		}
+
+		err = tx.Permissions.AddForUser(user.ID, "movies:read")
+		if err != nil {
+			return err
+		}
+
+		return tx.Outbox.Insert(&data.OutboxMessage{
+			Recipient: user.Email,
+			Template:  "user_welcome.html",
+			Data: map[string]interface{}{
+				"userID": user.ID,
+			},
+			Token: &data.OutboxToken{UserID: user.ID, Scope: data.ScopeActivation, Key: "activationToken"},
+		})
+	})
 	if err != nil {
 		switch {
 		// Manually add a message to the validator instance
@@ -50,38 +93,285 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	err = app.models.Permissions.AddForUser(user.ID, "movies:read")
+	if bootstrapped {
+		app.logger.PrintInfo("BOOTSTRAP ADMIN: first user activated and granted every permission", map[string]string{
+			"user_id": strconv.FormatInt(user.ID, 10),
+			"email":   user.Email,
+		})
+	} else {
+		app.background(app.dispatchOutbox)
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"user": user}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Request) {
+
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.modelsFor(r).Users.GetForToken(data.ScopeActivation, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired activation token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
-	token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+	if !app.checkScopeSunset(w, r, data.ScopeActivation) {
+		v.AddError("token", "invalid or expired activation token")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user.Activated = true
+	err = app.modelsFor(r).Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.modelsFor(r).Tokens.DeleteAllForUser(data.ScopeActivation, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateUserPasswordHandler sets a new password for the user identified by a password
+// reset token. All of the user's tokens are then deleted, so that the reset token can
+// only be used once and anyone holding a session under the old password is signed out.
+func (app *application) updateUserPasswordHandler(w http.ResponseWriter, r *http.Request) {
+
+	var input struct {
+		Password       string `json:"password"`
+		TokenPlaintext string `json:"token"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
 		return
 	}
 
-	app.background(func() {
+	v := validator.New()
+	data.ValidatePasswordPlaintext(v, input.Password)
+	data.ValidateTokenPlaintext(v, input.TokenPlaintext)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
 
-		data := map[string]interface{}{
-			"activationToken": token.Plaintext,
-			"userID":          user.ID,
+	user, err := app.modelsFor(r).Users.GetForToken(data.ScopePasswordReset, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired password reset token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
 		}
+		return
+	}
 
-		err = app.mailer.Send(user.Email, "user_welcome.html", data)
+	if !app.checkScopeSunset(w, r, data.ScopePasswordReset) {
+		v.AddError("token", "invalid or expired password reset token")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user.Password = input.Password
+	err = app.modelsFor(r).Transaction(func(tx data.Models) error {
+		err := tx.Users.Update(user)
 		if err != nil {
-			app.logger.PrintError(err, nil)
+			return err
+		}
+
+		for _, scope := range data.Scopes() {
+			err := tx.Tokens.DeleteAllForUser(scope, user.ID)
+			if err != nil {
+				return err
+			}
 		}
+		return nil
 	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
 
-	err = app.writeJSON(w, http.StatusAccepted, envelope{"user": user}, nil)
+	env := envelope{"message": "your password was successfully reset"}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
 
-func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Request) {
+// createEmailChangeHandler starts changing the caller's email address by sending a
+// confirmation token to the new address. The address isn't changed until the token is
+// confirmed, and requesting another change invalidates any earlier tokens.
+func (app *application) createEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+
+	var input struct {
+		Email string `json:"email"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	v := validator.New()
+	data.ValidateEmail(v, input.Email)
+	data.ValidateEmailNotReserved(v, input.Email)
+	v.Check(!strings.EqualFold(input.Email, user.Email), "email", "must be different from the current email address")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	_, err = app.modelsFor(r).Users.GetByEmail(input.Email)
+	switch {
+	case err == nil:
+		app.duplicateEmailResponse(w, r)
+		return
+	case !errors.Is(err, data.ErrRecordNotFound):
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.modelsFor(r).Transaction(func(tx data.Models) error {
+		err := tx.Tokens.DeleteAllForUser(data.ScopeEmailChange, user.ID)
+		if err != nil {
+			return err
+		}
+
+		return tx.Outbox.Insert(&data.OutboxMessage{
+			Recipient: input.Email,
+			Template:  "token_email_change.html",
+			Token:     &data.OutboxToken{UserID: user.ID, Scope: data.ScopeEmailChange, Key: "emailChangeToken"},
+		})
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.background(app.dispatchOutbox)
+
+	env := envelope{"message": "an email will be sent to the new address containing instructions to confirm the change"}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deactivateUserHandler deactivates the authenticated user's own account, once they've
+// confirmed it with their password and a nonce. The account is kept, but left
+// unactivated so it can't be used, and every token the user holds is deleted, signing
+// them out everywhere. Only an admin can reactivate it.
+func (app *application) deactivateUserHandler(w http.ResponseWriter, r *http.Request) {
+
+	var input struct {
+		Password string `json:"password"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	// An admin acting as the user mustn't be able to close their account.
+	if user.ImpersonatorID != 0 {
+		app.notPermittedResponse(w, r)
+		return
+	}
+
+	v := validator.New()
+	v.Check(input.Password != "", "password", "must be provided")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	match, _, err := app.modelsFor(r).Users.PasswordMatches(user, input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	} else if !match {
+		v.AddError("password", "does not match your current password")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	now := time.Now()
+	user.Activated = false
+	user.DeactivatedAt = &now
+
+	err = app.modelsFor(r).Transaction(func(tx data.Models) error {
+		err := tx.Users.Update(user)
+		if err != nil {
+			return err
+		}
+
+		for _, scope := range data.Scopes() {
+			err := tx.Tokens.DeleteAllForUser(scope, user.ID)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, data.ErrEditConflict) {
+		app.editConflictResponse(w, r)
+		return
+	}
+	app.deletedResponse(w, r, err)
+}
+
+// confirmEmailChangeHandler applies the email change identified by a confirmation
+// token. The new address is checked for duplicates again, since it may have been
+// registered since the change was requested.
+func (app *application) confirmEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
 
 	var input struct {
 		TokenPlaintext string `json:"token"`
@@ -98,11 +388,14 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	user, err := app.models.Users.GetForToken(data.ScopeActivation, input.TokenPlaintext)
+	user, err := app.modelsFor(r).Users.GetForToken(data.ScopeEmailChange, input.TokenPlaintext)
+	if err == nil {
+		user.Email, err = app.modelsFor(r).Tokens.GetPendingEmail(input.TokenPlaintext)
+	}
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
-			v.AddError("token", "invalid or expired activation token")
+			v.AddError("token", "invalid or expired email change token")
 			app.failedValidationResponse(w, r, v.Errors)
 		default:
 			app.serverErrorResponse(w, r, err)
@@ -110,10 +403,23 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	user.Activated = true
-	err = app.models.Users.Update(user)
+	if !app.checkScopeSunset(w, r, data.ScopeEmailChange) {
+		v.AddError("token", "invalid or expired email change token")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.modelsFor(r).Transaction(func(tx data.Models) error {
+		err := tx.Users.Update(user)
+		if err != nil {
+			return err
+		}
+		return tx.Tokens.DeleteAllForUser(data.ScopeEmailChange, user.ID)
+	})
 	if err != nil {
 		switch {
+		case errors.Is(err, data.ErrDuplicateEmail):
+			app.duplicateEmailResponse(w, r)
 		case errors.Is(err, data.ErrEditConflict):
 			app.editConflictResponse(w, r)
 		default:
@@ -122,13 +428,102 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	err = app.models.Tokens.DeleteAllForUser(data.ScopeActivation, user.ID)
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listSessionsHandler lists the caller's active sessions, one per unexpired
+// authentication token, most recent first.
+func (app *application) listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	tokens, err := app.modelsFor(r).Tokens.GetAllForUser(data.ScopeAuthentication, user.ID)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	sessions := make([]data.TokenMetadata, 0, len(tokens))
+	for _, token := range tokens {
+		sessions = append(sessions, token.Metadata())
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"sessions": sessions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// capabilitiesHandler describes the caller and what they can do in one response, so
+// that clients can gate their UI without several round-trips. Two-factor
+// authentication isn't supported yet, so it's always reported as disabled.
+func (app *application) capabilitiesHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	permissions, err := app.modelsFor(r).Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if permissions == nil {
+		permissions = data.Permissions{}
+	}
+
+	status := "active"
+	if !user.Activated {
+		status = "pending_activation"
+	}
+
+	// Users authenticated by a trusted gateway have no token of ours.
+	var token map[string]interface{}
+	if plaintext, ok := parseBearerToken(r.Header.Values("Authorization")); ok {
+		t, err := app.modelsFor(r).Tokens.Get(data.ScopeAuthentication, plaintext)
+		if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if t != nil {
+			token = map[string]interface{}{
+				"expiry":       t.Expiry,
+				"impersonated": t.ImpersonatorID != 0,
+			}
+		}
+	}
+
+	// The movie quota doesn't apply to admins, or when it's disabled.
+	var quota map[string]interface{}
+	if app.config.quota.movies > 0 && !permissions.Include("admin") {
+		used, err := app.modelsFor(r).Movies.CountCreatedBySince(user.ID, time.Now().Add(-app.config.quota.window))
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		quota = map[string]interface{}{
+			"limit":     app.config.quota.movies,
+			"remaining": max(app.config.quota.movies-used, 0),
+			"window":    app.config.quota.window.String(),
+		}
+	}
+
+	env := envelope{
+		"user":        user,
+		"permissions": permissions,
+		"account": map[string]interface{}{
+			"status":             status,
+			"two_factor_enabled": false,
+		},
+		"token": token,
+		"features": map[string]interface{}{
+			"read_only":          app.readOnly.Load(),
+			"public_reads":       app.config.publicReads,
+			"movies_soft_delete": app.config.moviesSoftDelete,
+			"movie_quota":        quota,
+		},
+	}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
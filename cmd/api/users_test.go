@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"greenlight.yp2743.me/internal/data"
+)
+
+func TestDeactivateUserHandler(t *testing.T) {
+	app := newTestDBApplication(t)
+	user := newTestUser(t, app)
+
+	tokens := make(map[string]string)
+	for _, scope := range []string{data.ScopeAuthentication, data.ScopeRefresh, data.ScopePasswordReset, data.ScopeNonce} {
+		token, err := app.models.Tokens.New(user.ID, time.Hour, scope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens[scope] = token.Plaintext
+	}
+
+	// A wrong password leaves the account and its tokens alone.
+	r := httptest.NewRequest(http.MethodDelete, "/v1/users/me", strings.NewReader(`{"password": "not-the-password"}`))
+	rr := serveAs(app, app.deactivateUserHandler, user, r)
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("got status %d with a wrong password; want %d", rr.Code, http.StatusUnprocessableEntity)
+	}
+	for scope, plaintext := range tokens {
+		_, err := app.models.Users.GetForToken(scope, plaintext)
+		if err != nil {
+			t.Fatalf("%s token after a failed deactivation: %v", scope, err)
+		}
+	}
+
+	r = httptest.NewRequest(http.MethodDelete, "/v1/users/me", strings.NewReader(`{"password": "pa55word-for-tests"}`))
+	rr = serveAs(app, app.deactivateUserHandler, user, r)
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusNoContent, rr.Body)
+	}
+
+	for scope, plaintext := range tokens {
+		_, err := app.models.Users.GetForToken(scope, plaintext)
+		if !errors.Is(err, data.ErrRecordNotFound) {
+			t.Errorf("%s token after deactivation: got error %v; want %v", scope, err, data.ErrRecordNotFound)
+		}
+	}
+
+	deactivated, err := app.models.Users.Get(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deactivated.Activated || deactivated.DeactivatedAt == nil {
+		t.Errorf("got activated %t and deactivated at %v; want a deactivated account", deactivated.Activated, deactivated.DeactivatedAt)
+	}
+}
+
+func TestRegisterUserHandler(t *testing.T) {
+	app := newTestDBApplication(t)
+	app.mailer = &testMailer{}
+
+	email := fmt.Sprintf("register-%d@example.com", time.Now().UnixNano())
+	body := fmt.Sprintf(`{"name": "Alice", "email": %q, "password": "pa55word-for-tests"}`, email)
+	rr := serveAs(app, app.registerUserHandler, nil, httptest.NewRequest(http.MethodPost, "/v1/users", strings.NewReader(body)))
+	app.wg.Wait()
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusCreated, rr.Body)
+	}
+
+	var response struct {
+		User map[string]interface{} `json:"user"`
+	}
+	err := json.Unmarshal(rr.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The response carries the fields set by the server, not just those sent.
+	for _, field := range []string{"id", "created_at", "updated_at", "version", "name", "email"} {
+		if value, ok := response.User[field]; !ok || value == "" || value == float64(0) {
+			t.Errorf("got %s %v; want it set: %s", field, value, rr.Body)
+		}
+	}
+	if activated, ok := response.User["activated"]; !ok || activated != false {
+		t.Errorf("got activated %v; want false", activated)
+	}
+	if strings.Contains(rr.Body.String(), "pa55word") || strings.Contains(rr.Body.String(), "password") {
+		t.Errorf("response mentions the password: %s", rr.Body)
+	}
+
+	stored, err := app.models.Users.GetByEmail(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := response.User["id"].(float64); int64(id) != stored.ID {
+		t.Errorf("got id %v; want %d", response.User["id"], stored.ID)
+	}
+}
+
+func TestRegisterUserHandlerReservedEmail(t *testing.T) {
+	app := newTestApplication(t)
+
+	// The application has no database, so the address must be rejected before the
+	// insert is attempted.
+	body := `{"name": "Mallory", "email": "Postmaster@example.com", "password": "pa55word-for-tests"}`
+	rr := serveAs(app, app.registerUserHandler, nil, httptest.NewRequest(http.MethodPost, "/v1/users", strings.NewReader(body)))
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusUnprocessableEntity, rr.Body)
+	}
+	if !strings.Contains(rr.Body.String(), "reserved address") {
+		t.Errorf("response doesn't explain the rejection: %s", rr.Body)
+	}
+}
+
+func TestListSessionsHandler(t *testing.T) {
+	app := newTestDBApplication(t)
+	user := newTestUser(t, app)
+	other := newTestUser(t, app)
+
+	list := func(user *data.User) (*httptest.ResponseRecorder, []data.TokenMetadata) {
+		rr := serveAs(app, app.listSessionsHandler, user, httptest.NewRequest(http.MethodGet, "/v1/users/me/sessions", nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusOK, rr.Body)
+		}
+
+		var response struct {
+			Sessions []data.TokenMetadata `json:"sessions"`
+		}
+		err := json.Unmarshal(rr.Body.Bytes(), &response)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rr, response.Sessions
+	}
+
+	// With no tokens, the list is empty rather than null.
+	rr, _ := list(user)
+	if !strings.Contains(rr.Body.String(), `"sessions": []`) {
+		t.Errorf("got %s; want an empty list", rr.Body)
+	}
+
+	const userAgent = "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.0 Safari/605.1.15"
+	live, err := app.models.Tokens.NewWithBinding(user.ID, time.Hour, data.ScopeAuthentication, "192.0.2.1", userAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seeded := []*data.Token{live}
+
+	// None of these are the user's sessions.
+	for _, seed := range []struct {
+		userID int64
+		ttl    time.Duration
+		scope  string
+	}{
+		{user.ID, -time.Hour, data.ScopeAuthentication},
+		{user.ID, time.Hour, data.ScopeActivation},
+		{other.ID, time.Hour, data.ScopeAuthentication},
+	} {
+		token, err := app.models.Tokens.New(seed.userID, seed.ttl, seed.scope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seeded = append(seeded, token)
+	}
+
+	rr, sessions := list(user)
+	if len(sessions) != 1 {
+		t.Fatalf("got %d sessions; want 1: %s", len(sessions), rr.Body)
+	}
+	session := sessions[0]
+	if session.Scope != data.ScopeAuthentication || session.IP != "192.0.2.1" || session.Device == "" || session.CreatedAt.IsZero() {
+		t.Errorf("got session %+v", session)
+	}
+	if !session.Expiry.Round(time.Millisecond).Equal(live.Expiry.Round(time.Millisecond)) {
+		t.Errorf("got expiry %s; want %s", session.Expiry, live.Expiry)
+	}
+
+	for _, token := range seeded {
+		if strings.Contains(rr.Body.String(), token.Plaintext) {
+			t.Errorf("response contains a token plaintext: %s", rr.Body)
+		}
+	}
+}
+
+func TestCapabilitiesHandler(t *testing.T) {
+	app := newTestDBApplication(t)
+	app.config.quota.movies = 10
+	app.config.quota.window = 24 * time.Hour
+	user := newTestUser(t, app, "movies:read", "movies:write")
+	newTestMovie(t, app, user)
+
+	token, err := app.models.Tokens.New(user.ID, time.Hour, data.ScopeAuthentication)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/v1/me/capabilities", nil)
+	r.Header.Set("Authorization", "Bearer "+token.Plaintext)
+	rr := serveAs(app, app.capabilitiesHandler, user, r)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusOK, rr.Body)
+	}
+
+	var response struct {
+		User        *data.User `json:"user"`
+		Permissions []string   `json:"permissions"`
+		Account     *struct {
+			Status           string `json:"status"`
+			TwoFactorEnabled *bool  `json:"two_factor_enabled"`
+		} `json:"account"`
+		Token *struct {
+			Expiry time.Time `json:"expiry"`
+		} `json:"token"`
+		Features *struct {
+			ReadOnly   *bool `json:"read_only"`
+			MovieQuota *struct {
+				Limit     int `json:"limit"`
+				Remaining int `json:"remaining"`
+			} `json:"movie_quota"`
+		} `json:"features"`
+	}
+	err = json.Unmarshal(rr.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if response.User == nil || response.User.ID != user.ID {
+		t.Errorf("got user %+v; want user %d", response.User, user.ID)
+	}
+	sort.Strings(response.Permissions)
+	if strings.Join(response.Permissions, ",") != "movies:read,movies:write" {
+		t.Errorf("got permissions %v", response.Permissions)
+	}
+	if response.Account == nil || response.Account.Status != "active" || response.Account.TwoFactorEnabled == nil {
+		t.Errorf("got account %+v", response.Account)
+	}
+	if response.Token == nil || !response.Token.Expiry.Round(time.Millisecond).Equal(token.Expiry.Round(time.Millisecond)) {
+		t.Errorf("got token %+v; want expiry %s", response.Token, token.Expiry)
+	}
+	if response.Features == nil || response.Features.ReadOnly == nil || response.Features.MovieQuota == nil {
+		t.Fatalf("got features %+v; want every flag", response.Features)
+	}
+	if quota := response.Features.MovieQuota; quota.Limit != 10 || quota.Remaining != 9 {
+		t.Errorf("got quota %+v; want 9 of 10 remaining", quota)
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	app := newTestDBApplication(t)
+	mailer := &testMailer{}
+	app.mailer = mailer
+	user := newTestUser(t, app)
+
+	requestReset := func(email string) *httptest.ResponseRecorder {
+		body := fmt.Sprintf(`{"email": %q}`, email)
+		rr := serveAs(app, app.createPasswordResetTokenHandler, nil, httptest.NewRequest(http.MethodPost, "/v1/tokens/password-reset", strings.NewReader(body)))
+		app.wg.Wait()
+		return rr
+	}
+	resetPassword := func(token, password string) *httptest.ResponseRecorder {
+		body := fmt.Sprintf(`{"token": %q, "password": %q}`, token, password)
+		return serveAs(app, app.updateUserPasswordHandler, nil, httptest.NewRequest(http.MethodPut, "/v1/users/password", strings.NewReader(body)))
+	}
+
+	// Unknown addresses get the same response, so that accounts can't be enumerated.
+	known := requestReset(user.Email)
+	unknown := requestReset("nobody-" + user.Email)
+	if known.Code != http.StatusAccepted || unknown.Code != http.StatusAccepted || known.Body.String() != unknown.Body.String() {
+		t.Fatalf("got %d %s and %d %s; want identical 202 responses", known.Code, known.Body, unknown.Code, unknown.Body)
+	}
+
+	emails := mailer.sentTo(user.Email)
+	if len(emails) != 1 || emails[0].template != "token_password_reset.html" {
+		t.Fatalf("got emails %v; want one password reset email", emails)
+	}
+	token, _ := emails[0].data["passwordResetToken"].(string)
+
+	rr := resetPassword(token, "new-pa55word")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusOK, rr.Body)
+	}
+	updated, err := app.models.Users.Get(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	match, _, err := app.models.Users.PasswordMatches(updated, "new-pa55word")
+	if err != nil || !match {
+		t.Errorf("new password doesn't match: %v", err)
+	}
+
+	// The token can only be used once.
+	rr = resetPassword(token, "another-pa55word")
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("reused token: got status %d; want %d: %s", rr.Code, http.StatusUnprocessableEntity, rr.Body)
+	}
+
+	expired, err := app.models.Tokens.New(user.ID, -time.Minute, data.ScopePasswordReset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = resetPassword(expired.Plaintext, "another-pa55word")
+	if rr.Code != http.StatusUnprocessableEntity || !strings.Contains(rr.Body.String(), "invalid or expired") {
+		t.Errorf("expired token: got status %d; want %d: %s", rr.Code, http.StatusUnprocessableEntity, rr.Body)
+	}
+}
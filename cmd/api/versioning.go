@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const vendorMediaTypePrefix = "application/vnd.greenlight.v"
+
+// supportedVersions lists the API versions that can be requested via the Accept header.
+var supportedVersions = map[int]bool{1: true, 2: true}
+
+var errUnsupportedVersion = errors.New("unsupported API version")
+
+// versionedHandlers maps an API version to the handler implementing it for a route.
+type versionedHandlers map[int]http.HandlerFunc
+
+// requestedVersion reads the API version from an Accept header such as
+// "application/vnd.greenlight.v2+json". Requests without a vendor media type get v1.
+func (app *application) requestedVersion(r *http.Request) (int, error) {
+	for _, mediaRange := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, _ := strings.Cut(strings.TrimSpace(mediaRange), ";")
+		mediaType = strings.TrimSpace(mediaType)
+
+		if !strings.HasPrefix(mediaType, vendorMediaTypePrefix) || !strings.HasSuffix(mediaType, "+json") {
+			continue
+		}
+
+		v := strings.TrimSuffix(strings.TrimPrefix(mediaType, vendorMediaTypePrefix), "+json")
+		version, err := strconv.Atoi(v)
+		if err != nil || !supportedVersions[version] {
+			return 0, errUnsupportedVersion
+		}
+		return version, nil
+	}
+	return 1, nil
+}
+
+// versioned selects the handler matching the version negotiated via the Accept header.
+// If a route has no variant for the requested version, the latest earlier variant is used.
+func (app *application) versioned(handlers versionedHandlers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept")
+
+		version, err := app.requestedVersion(r)
+		if err != nil {
+			app.notAcceptableResponse(w, r)
+			return
+		}
+
+		for v := version; v >= 1; v-- {
+			if handler, ok := handlers[v]; ok {
+				handler(w, r)
+				return
+			}
+		}
+		app.notAcceptableResponse(w, r)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestVersioned(t *testing.T) {
+	app := newTestApplication(t)
+
+	handler := app.versioned(versionedHandlers{
+		1: func(w http.ResponseWriter, r *http.Request) { w.Header().Set("X-Version", "1") },
+		2: func(w http.ResponseWriter, r *http.Request) { w.Header().Set("X-Version", "2") },
+	})
+	v1Only := app.versioned(versionedHandlers{
+		1: func(w http.ResponseWriter, r *http.Request) { w.Header().Set("X-Version", "1") },
+	})
+
+	tests := []struct {
+		name        string
+		handler     http.HandlerFunc
+		accept      string
+		wantStatus  int
+		wantVersion int
+	}{
+		{"no Accept header", handler, "", http.StatusOK, 1},
+		{"plain JSON", handler, "application/json", http.StatusOK, 1},
+		{"v1", handler, "application/vnd.greenlight.v1+json", http.StatusOK, 1},
+		{"v2", handler, "application/vnd.greenlight.v2+json", http.StatusOK, 2},
+		{"v2 with parameters", handler, "text/html, application/vnd.greenlight.v2+json; q=0.9", http.StatusOK, 2},
+		{"v2 on a route without a v2 variant", v1Only, "application/vnd.greenlight.v2+json", http.StatusOK, 1},
+		{"unsupported version", handler, "application/vnd.greenlight.v9+json", http.StatusNotAcceptable, 0},
+		{"malformed version", handler, "application/vnd.greenlight.vx+json", http.StatusNotAcceptable, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v1/movies/1", nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+
+			rr := httptest.NewRecorder()
+			tt.handler(rr, r)
+
+			if rr.Code != tt.wantStatus {
+				t.Errorf("got status %d; want %d", rr.Code, tt.wantStatus)
+			}
+			if tt.wantVersion != 0 && rr.Header().Get("X-Version") != strconv.Itoa(tt.wantVersion) {
+				t.Errorf("got version %q; want %d", rr.Header().Get("X-Version"), tt.wantVersion)
+			}
+			if rr.Header().Get("Vary") != "Accept" {
+				t.Errorf("got Vary %q; want Accept", rr.Header().Get("Vary"))
+			}
+		})
+	}
+}
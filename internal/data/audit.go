@@ -0,0 +1,99 @@
+package data
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	AuditActionImpersonate       = "impersonate"
+	AuditActionGrantPermissions  = "grant_permissions"
+	AuditActionRevokePermissions = "revoke_permissions"
+	AuditActionAssignRole        = "assign_role"
+	AuditActionReactivate        = "reactivate"
+)
+
+// An AuditEntry records a privileged action taken by one user, possibly on another.
+type AuditEntry struct {
+	ID           int64                  `json:"id"`
+	CreatedAt    time.Time              `json:"created_at"`
+	ActorID      int64                  `json:"actor_id"`
+	Action       string                 `json:"action"`
+	TargetUserID int64                  `json:"target_user_id,omitempty"`
+	Details      map[string]interface{} `json:"details,omitempty"`
+}
+
+type AuditModel struct {
+	DB DBTX
+}
+
+func (m AuditModel) Insert(entry *AuditEntry) error {
+
+	query := `INSERT INTO audit_log (actor_id, action, target_user_id, details)
+			VALUES ($1, $2, NULLIF($3, 0), $4)
+			RETURNING id, created_at`
+
+	details := entry.Details
+	if details == nil {
+		details = map[string]interface{}{}
+	}
+
+	args := []interface{}{entry.ActorID, entry.Action, entry.TargetUserID, details}
+	ctx := context.Background()
+
+	return m.DB.QueryRow(ctx, query, args...).Scan(&entry.ID, &entry.CreatedAt)
+}
+
+// CountForActorSince returns how many times the actor performed the action since the
+// given time.
+func (m AuditModel) CountForActorSince(actorID int64, action string, since time.Time) (int, error) {
+
+	query := `SELECT count(*)
+			FROM audit_log
+			WHERE actor_id = $1 AND action = $2 AND created_at > $3`
+
+	ctx := context.Background()
+
+	var count int
+	err := m.DB.QueryRow(ctx, query, actorID, action, since).Scan(&count)
+	return count, err
+}
+
+// GetAllForUser returns the entries in which the user was either the actor or the
+// target, oldest first.
+func (m AuditModel) GetAllForUser(userID int64) ([]*AuditEntry, error) {
+
+	query := `SELECT id, created_at, COALESCE(actor_id, 0), action, COALESCE(target_user_id, 0), details
+			FROM audit_log
+			WHERE actor_id = $1 OR target_user_id = $1
+			ORDER BY id`
+
+	ctx := context.Background()
+
+	rows, err := m.DB.Query(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []*AuditEntry{}
+	for rows.Next() {
+		var entry AuditEntry
+		err := rows.Scan(
+			&entry.ID,
+			&entry.CreatedAt,
+			&entry.ActorID,
+			&entry.Action,
+			&entry.TargetUserID,
+			&entry.Details,
+		)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, &entry)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
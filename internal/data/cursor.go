@@ -0,0 +1,67 @@
+package data
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+)
+
+var (
+	ErrInvalidCursor  = errors.New("invalid cursor")
+	ErrCursorMismatch = errors.New("cursor was issued for a different sort")
+)
+
+// A Cursor marks a position in a keyset-paginated listing: the sort it was issued for,
+// and the sort column value and ID of the last row returned. Clients only see it as an
+// opaque string.
+type Cursor struct {
+	Sort  string      `json:"s"`
+	Value interface{} `json:"v"`
+	ID    int64       `json:"id"`
+}
+
+// Encode returns the cursor as URL-safe base64.
+func (c Cursor) Encode() string {
+	js, err := json.Marshal(c)
+	if err != nil {
+		// A cursor only ever holds strings and integers.
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(js)
+}
+
+// DecodeCursor parses a cursor returned by Encode, checking that it was issued for
+// the given sort.
+func DecodeCursor(s, sort string) (*Cursor, error) {
+	js, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.UseNumber()
+
+	var c Cursor
+	err = dec.Decode(&c)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	if c.Sort != sort {
+		return nil, ErrCursorMismatch
+	}
+
+	// Numeric sort values come back as json.Number, and are bound as integers.
+	switch value := c.Value.(type) {
+	case json.Number:
+		c.Value, err = value.Int64()
+		if err != nil {
+			return nil, ErrInvalidCursor
+		}
+	case string:
+	default:
+		return nil, ErrInvalidCursor
+	}
+
+	return &c, nil
+}
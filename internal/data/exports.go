@@ -0,0 +1,125 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// An Export is a copy of a user's data generated in the background, kept until it
+// expires so that the user can download it once they have been told it's ready.
+type Export struct {
+	ID          int64           `json:"id"`
+	UserID      int64           `json:"-"`
+	CreatedAt   time.Time       `json:"created_at"`
+	CompletedAt *time.Time      `json:"completed_at,omitempty"`
+	ExpiresAt   time.Time       `json:"expires_at"`
+	Bundle      json.RawMessage `json:"-"`
+}
+
+type ExportModel struct {
+	DB DBTX
+}
+
+// Insert records a pending export for the user, which expires after ttl.
+func (m ExportModel) Insert(userID int64, ttl time.Duration) (*Export, error) {
+
+	query := `INSERT INTO exports (user_id, expires_at)
+			VALUES ($1, $2)
+			RETURNING id, created_at, expires_at`
+
+	ctx := context.Background()
+
+	export := &Export{UserID: userID}
+	err := m.DB.QueryRow(ctx, query, userID, time.Now().Add(ttl)).Scan(&export.ID, &export.CreatedAt, &export.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return export, nil
+}
+
+// Complete stores the generated bundle for a pending export.
+func (m ExportModel) Complete(id int64, bundle json.RawMessage) error {
+
+	query := `UPDATE exports
+			SET bundle = $2, completed_at = NOW()
+			WHERE id = $1 AND completed_at IS NULL`
+
+	ctx := context.Background()
+
+	result, err := m.DB.Exec(ctx, query, id, bundle)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// Get returns the user's unexpired export with the given ID. Its Bundle is nil until
+// the export has completed.
+func (m ExportModel) Get(id, userID int64) (*Export, error) {
+
+	query := `SELECT id, user_id, created_at, completed_at, expires_at, bundle
+			FROM exports
+			WHERE id = $1 AND user_id = $2 AND expires_at > $3`
+
+	ctx := context.Background()
+
+	var export Export
+	var bundle []byte
+	err := m.DB.QueryRow(ctx, query, id, userID, time.Now()).Scan(
+		&export.ID,
+		&export.UserID,
+		&export.CreatedAt,
+		&export.CompletedAt,
+		&export.ExpiresAt,
+		&bundle,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	if bundle != nil {
+		export.Bundle = bundle
+	}
+	return &export, nil
+}
+
+// ItemCount returns roughly how many records an export for the user would contain,
+// so that large exports can be generated in the background.
+func (m ExportModel) ItemCount(userID int64) (int, error) {
+
+	query := `SELECT
+			(SELECT count(*) FROM movies WHERE created_by = $1 AND deleted_at IS NULL) +
+			(SELECT count(*) FROM ratings WHERE user_id = $1) +
+			(SELECT count(*) FROM audit_log WHERE actor_id = $1 OR target_user_id = $1)`
+
+	ctx := context.Background()
+
+	var count int
+	err := m.DB.QueryRow(ctx, query, userID).Scan(&count)
+	return count, err
+}
+
+// DeleteExpired removes exports which have expired, returning how many there were.
+func (m ExportModel) DeleteExpired() (int64, error) {
+
+	query := `DELETE FROM exports WHERE expires_at <= $1`
+
+	ctx := context.Background()
+
+	result, err := m.DB.Exec(ctx, query, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
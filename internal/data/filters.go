@@ -52,6 +52,10 @@ type Metadata struct {
 	FirstPage    int `json:"first_page,omitempty"`
 	LastPage     int `json:"last_page,omitempty"`
 	TotalRecords int `json:"total_records,omitempty"`
+
+	// NextCursor is set on keyset-paginated listings when there are more rows, and is
+	// passed back as the after parameter to fetch them.
+	NextCursor string `json:"next_cursor,omitempty"`
 }
 
 func calculateMetadata(totalRecords, page, pageSize int) Metadata {
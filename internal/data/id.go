@@ -0,0 +1,40 @@
+package data
+
+import (
+	"errors"
+	"strconv"
+)
+
+var ErrInvalidIDFormat = errors.New("invalid id format")
+
+// StringifyIDs makes IDs marshal as JSON strings rather than numbers, for clients
+// (such as JavaScript) which can't represent every int64 exactly. It's set once at
+// startup, before any responses are written.
+var StringifyIDs bool
+
+// ID is a resource identifier.
+type ID int64
+
+func (id ID) MarshalJSON() ([]byte, error) {
+	s := strconv.FormatInt(int64(id), 10)
+	if StringifyIDs {
+		s = strconv.Quote(s)
+	}
+	return []byte(s), nil
+}
+
+// UnmarshalJSON accepts an ID as either a JSON number or a string.
+func (id *ID) UnmarshalJSON(jsonValue []byte) error {
+	s := string(jsonValue)
+	if unquoted, err := strconv.Unquote(s); err == nil {
+		s = unquoted
+	}
+
+	i, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return ErrInvalidIDFormat
+	}
+
+	*id = ID(i)
+	return nil
+}
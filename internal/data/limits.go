@@ -0,0 +1,16 @@
+package data
+
+// ListLimits caps the number of entries accepted in list fields.
+type ListLimits struct {
+	Genres      int
+	Permissions int
+	BatchItems  int
+}
+
+// Limits are the caps enforced by the validators. They're set once at startup,
+// before any requests are served.
+var Limits = ListLimits{
+	Genres:      5,
+	Permissions: 20,
+	BatchItems:  100,
+}
@@ -0,0 +1,54 @@
+package data
+
+import "sync"
+
+// UserLoader batches and caches user lookups by ID. It's intended to live for the
+// duration of a single request, so that rendering a list of resources which refer to
+// users costs one query rather than one per resource.
+type UserLoader struct {
+	users UserModel
+	mu    sync.Mutex
+	cache map[int64]*User
+}
+
+func (m UserModel) NewLoader() *UserLoader {
+	return &UserLoader{
+		users: m,
+		cache: make(map[int64]*User),
+	}
+}
+
+// LoadMany returns the users with the given IDs, fetching any which aren't already
+// cached in a single query. Unknown IDs are absent from the result.
+func (l *UserLoader) LoadMany(ids []int64) (map[int64]*User, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var missing []int64
+	seen := make(map[int64]bool)
+	for _, id := range ids {
+		if _, cached := l.cache[id]; !cached && !seen[id] {
+			missing = append(missing, id)
+			seen[id] = true
+		}
+	}
+
+	if len(missing) > 0 {
+		users, err := l.users.GetByIDs(missing)
+		if err != nil {
+			return nil, err
+		}
+		// Cache misses too, so that unknown IDs aren't looked up again.
+		for _, id := range missing {
+			l.cache[id] = users[id]
+		}
+	}
+
+	result := make(map[int64]*User, len(ids))
+	for _, id := range ids {
+		if user := l.cache[id]; user != nil {
+			result[id] = user
+		}
+	}
+	return result, nil
+}
@@ -1,8 +1,11 @@
 package data
 
 import (
+	"context"
 	"errors"
 
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
@@ -12,18 +15,187 @@ var (
 	ErrEditConflict = errors.New("edit conflict")
 )
 
+// DBTX is satisfied by both *pgxpool.Pool and pgx.Tx, so that the models can run
+// their queries either directly against the pool or inside a transaction.
+type DBTX interface {
+	Exec(ctx context.Context, sql string, arguments ...interface{}) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+}
+
 type Models struct {
+	Audit       AuditModel
+	Exports     ExportModel
 	Movies      MovieModel
+	MovieEvents MovieEventModel
+	Outbox      OutboxModel
 	Permissions PermissionModel
+	Ratings     RatingModel
+	Roles       RoleModel
+	Scripts     ScriptModel
+	Stats       StatsModel
 	Tokens      TokenModel
 	Users       UserModel
+
+	// pool is nil for models which are bound to a transaction, and tx is set instead.
+	pool *pgxpool.Pool
+	tx   pgx.Tx
+	db   DBTX
+
+	// queryTag, if set, is prefixed to every query as an SQL comment.
+	queryTag string
+	// retry, if set, retries reads outside transactions which fail transiently.
+	retry *RetryPolicy
+	// timeouts, if set, bounds acquiring a connection and running a query separately.
+	timeouts *Timeouts
+}
+
+// NewModels returns the models for the pool. Their queries run under DefaultTimeouts
+// until WithTimeouts sets others.
+func NewModels(db *pgxpool.Pool, passwords Passwords) Models {
+	models := newModels(db, passwords)
+	models.pool = db
+	return models.WithTimeouts(DefaultTimeouts)
 }
 
-func NewModels(db *pgxpool.Pool) Models {
+func newModels(db DBTX, passwords Passwords) Models {
 	return Models{
+		Audit:       AuditModel{DB: db},
+		Exports:     ExportModel{DB: db},
 		Movies:      MovieModel{DB: db},
+		MovieEvents: MovieEventModel{DB: db},
+		Outbox:      OutboxModel{DB: db},
 		Permissions: PermissionModel{DB: db},
+		Ratings:     RatingModel{DB: db},
+		Roles:       RoleModel{DB: db},
+		Scripts:     ScriptModel{DB: db},
+		Stats:       StatsModel{DB: db},
 		Tokens:      TokenModel{DB: db},
-		Users:       UserModel{DB: db},
+		Users:       UserModel{DB: db, Passwords: passwords},
+		db:          db,
+	}
+}
+
+// rebuild returns a copy of the models whose queries go through the wrappers selected
+// by queryTag and retry.
+func (m Models) rebuild() Models {
+	db := m.db
+	if m.timeouts != nil {
+		db = timedDB{DBTX: db, pool: m.pool, timeouts: *m.timeouts}
+	}
+	if m.retry != nil && m.tx == nil {
+		db = retryingDB{DBTX: db, policy: *m.retry}
+	}
+	if m.queryTag != "" {
+		db = taggedDB{DBTX: db, comment: "/* " + m.queryTag + " */ "}
 	}
+
+	models := newModels(db, m.Users.Passwords)
+	models.pool = m.pool
+	models.tx = m.tx
+	models.db = m.db
+	models.queryTag = m.queryTag
+	models.retry = m.retry
+	models.timeouts = m.timeouts
+	return models
+}
+
+// WithQueryTag returns a copy of the models which prefix every query with the tag as
+// an SQL comment, so that statements seen in the database's logs and pg_stat_activity
+// can be traced back to what issued them. The tag must not contain "*/".
+func (m Models) WithQueryTag(tag string) Models {
+	m.queryTag = tag
+	return m.rebuild()
+}
+
+// WithRetries returns a copy of the models which retry reads that fail with a
+// transient error, such as a dropped connection, under the given policy. Writes are
+// never retried, and neither is anything run in a transaction.
+func (m Models) WithRetries(policy RetryPolicy) Models {
+	m.retry = &policy
+	return m.rebuild()
+}
+
+// WithTimeouts returns a copy of the models which wait at most timeouts.Acquire for a
+// pooled connection, failing with ErrAcquireTimeout, and then give each query
+// timeouts.Query to run, failing with ErrQueryTimeout.
+func (m Models) WithTimeouts(timeouts Timeouts) Models {
+	m.timeouts = &timeouts
+	return m.rebuild()
+}
+
+type taggedDB struct {
+	DBTX
+	comment string
+}
+
+func (t taggedDB) Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error) {
+	return t.DBTX.Exec(ctx, t.comment+sql, args...)
+}
+
+func (t taggedDB) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+	return t.DBTX.Query(ctx, t.comment+sql, args...)
+}
+
+func (t taggedDB) QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+	return t.DBTX.QueryRow(ctx, t.comment+sql, args...)
+}
+
+// Ping checks that the database is reachable.
+func (m Models) Ping(ctx context.Context) error {
+	if m.pool == nil {
+		return errors.New("no database connection pool")
+	}
+	return m.pool.Ping(ctx)
+}
+
+// Stat returns the connection pool's statistics, or nil for models bound to a
+// transaction.
+func (m Models) Stat() *pgxpool.Stat {
+	if m.pool == nil {
+		return nil
+	}
+	return m.pool.Stat()
+}
+
+// Transaction runs fn with models bound to a new transaction, which is committed if
+// fn returns nil and rolled back otherwise. Called on models which are already bound
+// to a transaction, it nests using a savepoint.
+func (m Models) Transaction(fn func(tx Models) error) error {
+	if m.pool == nil && m.tx == nil {
+		return fn(m)
+	}
+
+	ctx := context.Background()
+
+	// Within a transaction, Begin creates a savepoint, so that a nested transaction
+	// can fail and be rolled back without aborting the outer one.
+	var tx pgx.Tx
+	var err error
+	switch {
+	case m.tx != nil:
+		tx, err = m.tx.Begin(ctx)
+	case m.timeouts != nil:
+		tx, err = beginTimed(ctx, m.pool, *m.timeouts)
+	default:
+		tx, err = m.pool.Begin(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	// Rollback is a no-op once the transaction has been committed.
+	defer tx.Rollback(ctx)
+
+	txModels := newModels(tx, m.Users.Passwords)
+	txModels.tx = tx
+	txModels.queryTag = m.queryTag
+	txModels.timeouts = m.timeouts
+	txModels = txModels.rebuild()
+
+	err = fn(txModels)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
 }
@@ -0,0 +1,142 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+)
+
+const (
+	MovieEventCreate  = "create"
+	MovieEventUpdate  = "update"
+	MovieEventDelete  = "delete"
+	MovieEventRestore = "restore"
+)
+
+// A FieldChange records the value of a movie field before and after an event. From is
+// nil when the movie was created.
+type FieldChange struct {
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+// A MovieEvent records a change made to a movie, and who made it. The movie ID isn't a
+// foreign key, so that the history of a deleted movie is kept.
+type MovieEvent struct {
+	ID        ID                     `json:"id"`
+	CreatedAt time.Time              `json:"created_at"`
+	MovieID   ID                     `json:"movie_id"`
+	ActorID   ID                     `json:"actor_id,omitempty"`
+	Action    string                 `json:"action"`
+	Changes   map[string]FieldChange `json:"changes,omitempty"`
+}
+
+// movieFields returns the fields of a movie recorded in its history. The runtime is
+// recorded in minutes, whatever format runtimes are rendered in.
+func movieFields(movie *Movie) map[string]interface{} {
+	return map[string]interface{}{
+		"title":   movie.Title,
+		"year":    movie.Year,
+		"runtime": int32(movie.Runtime),
+		"genres":  movie.Genres,
+		"notes":   movie.Notes,
+	}
+}
+
+// DiffMovies returns the fields which differ between two versions of a movie. A nil
+// before gives every field of after, as for a newly created movie.
+func DiffMovies(before, after *Movie) map[string]FieldChange {
+	changes := map[string]FieldChange{}
+
+	if before == nil {
+		for field, value := range movieFields(after) {
+			changes[field] = FieldChange{To: value}
+		}
+		return changes
+	}
+
+	from, to := movieFields(before), movieFields(after)
+	for field := range to {
+		if !equalFieldValues(from[field], to[field]) {
+			changes[field] = FieldChange{From: from[field], To: to[field]}
+		}
+	}
+	return changes
+}
+
+func equalFieldValues(a, b interface{}) bool {
+	as, aok := a.([]string)
+	bs, bok := b.([]string)
+	if aok && bok {
+		return slices.Equal(as, bs)
+	}
+	return a == b
+}
+
+type MovieEventModel struct {
+	DB DBTX
+}
+
+func (m MovieEventModel) Insert(event *MovieEvent) error {
+
+	query := `INSERT INTO movie_events (movie_id, actor_id, action, changes)
+			VALUES ($1, NULLIF($2, 0), $3, $4)
+			RETURNING id, created_at`
+
+	changes := event.Changes
+	if changes == nil {
+		changes = map[string]FieldChange{}
+	}
+
+	args := []interface{}{int64(event.MovieID), int64(event.ActorID), event.Action, changes}
+	ctx := context.Background()
+
+	return m.DB.QueryRow(ctx, query, args...).Scan(&event.ID, &event.CreatedAt)
+}
+
+// GetAllForMovie returns a page of the movie's events.
+func (m MovieEventModel) GetAllForMovie(movieID int64, filters Filters) ([]*MovieEvent, Metadata, error) {
+
+	query := fmt.Sprintf(`SELECT count(*) OVER(), id, created_at, movie_id, COALESCE(actor_id, 0), action, changes
+						FROM movie_events
+						WHERE movie_id = $1
+						ORDER BY %s %s, id %s
+						LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortDirection(), filters.sortDirection())
+
+	ctx := context.Background()
+
+	rows, err := m.DB.Query(ctx, query, movieID, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	events := []*MovieEvent{}
+
+	for rows.Next() {
+		var event MovieEvent
+		err := rows.Scan(
+			&totalRecords,
+			&event.ID,
+			&event.CreatedAt,
+			&event.MovieID,
+			&event.ActorID,
+			&event.Action,
+			&event.Changes,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		events = append(events, &event)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return events, metadata, nil
+}
@@ -0,0 +1,62 @@
+package data
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffMovies(t *testing.T) {
+	before := &Movie{Title: "Alien", Year: 1979, Runtime: 117, Genres: []string{"horror", "sci-fi"}, Notes: "director's cut pending"}
+
+	tests := []struct {
+		name   string
+		before *Movie
+		after  *Movie
+		want   map[string]FieldChange
+	}{
+		{
+			name:   "created",
+			before: nil,
+			after:  before,
+			want: map[string]FieldChange{
+				"title":   {To: "Alien"},
+				"year":    {To: int32(1979)},
+				"runtime": {To: int32(117)},
+				"genres":  {To: []string{"horror", "sci-fi"}},
+				"notes":   {To: "director's cut pending"},
+			},
+		},
+		{
+			name:   "unchanged",
+			before: before,
+			after:  &Movie{Title: "Alien", Year: 1979, Runtime: 117, Genres: []string{"horror", "sci-fi"}, Notes: "director's cut pending"},
+			want:   map[string]FieldChange{},
+		},
+		{
+			name:   "updated",
+			before: before,
+			after:  &Movie{Title: "Aliens", Year: 1979, Runtime: 137, Genres: []string{"horror", "sci-fi"}, Notes: "director's cut pending"},
+			want: map[string]FieldChange{
+				"title":   {From: "Alien", To: "Aliens"},
+				"runtime": {From: int32(117), To: int32(137)},
+			},
+		},
+		{
+			name:   "genres reordered",
+			before: before,
+			after:  &Movie{Title: "Alien", Year: 1979, Runtime: 117, Genres: []string{"sci-fi", "horror"}, Notes: "director's cut pending"},
+			want: map[string]FieldChange{
+				"genres": {From: []string{"horror", "sci-fi"}, To: []string{"sci-fi", "horror"}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := DiffMovies(tt.before, tt.after)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -2,23 +2,109 @@ package data
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/jackc/pgx/v5"
-	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jackc/pgx/v5/pgconn"
 	"greenlight.yp2743.me/internal/validator"
 )
 
+var ErrDuplicateMovie = errors.New("duplicate movie")
+
+// isDuplicateMovieError reports whether err is a unique violation (SQLSTATE 23505) on
+// the movies natural key constraint, or on the optional case-insensitive index over it.
+func isDuplicateMovieError(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) || pgErr.Code != "23505" {
+		return false
+	}
+	return pgErr.ConstraintName == "movies_title_year_key" || pgErr.ConstraintName == "movies_lower_title_year_key"
+}
+
+// MaxGenres is the most genres a movie can have at any configuration, matching the
+// genres_length_check constraint.
+const MaxGenres = 100
+
+var ErrTooManyGenres = errors.New("too many genres")
+
+// isGenresLengthError reports whether err is a check violation (SQLSTATE 23514) on
+// the genres length constraint.
+func isGenresLengthError(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23514" && pgErr.ConstraintName == "genres_length_check"
+}
+
 type Movie struct {
 	ID        int64     `json:"id"`
-	CreatedAt time.Time `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
 	Title     string    `json:"title"`
 	Year      int32     `json:"year,omitempty"`
 	Runtime   Runtime   `json:"runtime,omitempty"`
 	Genres    []string  `json:"genres,omitempty"`
 	Version   int32     `json:"version"`
+
+	// CreatedByID is the ID of the user who created the movie, or 0 if unknown.
+	// CreatedBy holds their name, and is filled in by the handlers when rendering.
+	CreatedByID int64  `json:"-"`
+	CreatedBy   string `json:"created_by,omitempty"`
+
+	// Notes are internal, and only shown to callers with the movies:notes permission.
+	Notes string `json:"notes,omitempty"`
+}
+
+// MarshalJSON renders the ID via the ID type, so that it honours StringifyIDs.
+func (movie Movie) MarshalJSON() ([]byte, error) {
+	type movieFields Movie
+	return json.Marshal(struct {
+		ID ID `json:"id"`
+		movieFields
+	}{ID(movie.ID), movieFields(movie)})
+}
+
+// MovieV2 is the version 2 representation of a movie, which reports the runtime as a
+// plain number of minutes under runtime_minutes.
+type MovieV2 struct {
+	ID             ID        `json:"id"`
+	Title          string    `json:"title"`
+	Year           int32     `json:"year,omitempty"`
+	RuntimeMinutes int32     `json:"runtime_minutes,omitempty"`
+	Genres         []string  `json:"genres,omitempty"`
+	Version        int32     `json:"version"`
+	CreatedBy      string    `json:"created_by,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+func (movie *Movie) V2() *MovieV2 {
+	return &MovieV2{
+		ID:             ID(movie.ID),
+		Title:          movie.Title,
+		Year:           movie.Year,
+		RuntimeMinutes: int32(movie.Runtime),
+		Genres:         movie.Genres,
+		Version:        movie.Version,
+		CreatedBy:      movie.CreatedBy,
+		CreatedAt:      movie.CreatedAt,
+		UpdatedAt:      movie.UpdatedAt,
+	}
+}
+
+// NormalizeTitles enables NormalizeTitle. It's set once at startup.
+var NormalizeTitles = false
+
+// NormalizeTitle trims the whitespace around a title and collapses each run of
+// whitespace within it to a single space, when NormalizeTitles is enabled. The case of
+// the title is left as it is.
+func NormalizeTitle(title string) string {
+	if !NormalizeTitles {
+		return title
+	}
+	return strings.Join(strings.Fields(title), " ")
 }
 
 func ValidateMovie(v *validator.Validator, movie *Movie) {
@@ -32,28 +118,39 @@ func ValidateMovie(v *validator.Validator, movie *Movie) {
 
 	v.Check(movie.Runtime != 0, "runtime", "must be provided")
 	v.Check(movie.Runtime > 0, "runtime", "must be a positive integer")
+	v.CheckWarning(movie.Runtime <= 500, "runtime", "is unusually long, please check it is correct")
 
 	v.Check(movie.Genres != nil, "genres", "must be provided")
 	v.Check(len(movie.Genres) >= 1, "genres", "must contain at least 1 genre")
-	v.Check(len(movie.Genres) <= 5, "genres", "must not contain more than 5 genres")
+	v.Check(len(movie.Genres) <= Limits.Genres, "genres", fmt.Sprintf("must not contain more than %d genres", Limits.Genres))
 	v.Check(validator.Unique(movie.Genres), "genres", "must not contain duplicate values")
 }
 
 type MovieModel struct {
-	DB *pgxpool.Pool
+	DB DBTX
 }
 
 func (m MovieModel) Insert(movie *Movie) error {
-	query := `INSERT INTO movies (title, year, runtime, genres)
-			VALUES ($1, $2, $3, $4)
-			RETURNING id, created_at, version`
+	query := `INSERT INTO movies (title, year, runtime, genres, created_by)
+			VALUES ($1, $2, $3, $4, NULLIF($5, 0))
+			RETURNING id, created_at, updated_at, version`
 
-	args := []interface{}{movie.Title, movie.Year, movie.Runtime, movie.Genres}
+	args := []interface{}{movie.Title, movie.Year, movie.Runtime, movie.Genres, movie.CreatedByID}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+	ctx := context.Background()
 
-	return m.DB.QueryRow(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version)
+	err := m.DB.QueryRow(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.UpdatedAt, &movie.Version)
+	if err != nil {
+		switch {
+		case isDuplicateMovieError(err):
+			return ErrDuplicateMovie
+		case isGenresLengthError(err):
+			return ErrTooManyGenres
+		default:
+			return err
+		}
+	}
+	return nil
 }
 
 func (m MovieModel) Get(id int64) (*Movie, error) {
@@ -61,23 +158,25 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 		return nil, ErrRecordNotFound
 	}
 
-	query := `SELECT id, created_at, title, year, runtime, genres, version
+	query := `SELECT id, created_at, updated_at, title, year, runtime, genres, notes, version, COALESCE(created_by, 0)
 			FROM movies
-			WHERE id = $1`
+			WHERE id = $1 AND deleted_at IS NULL`
 
 	var movie Movie
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+	ctx := context.Background()
 
 	err := m.DB.QueryRow(ctx, query, id).Scan(
 		&movie.ID,
 		&movie.CreatedAt,
+		&movie.UpdatedAt,
 		&movie.Title,
 		&movie.Year,
 		&movie.Runtime,
 		&movie.Genres,
+		&movie.Notes,
 		&movie.Version,
+		&movie.CreatedByID,
 	)
 
 	if err != nil {
@@ -92,27 +191,157 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 	return &movie, nil
 }
 
-func (m MovieModel) Update(movie *Movie) error {
-	query := `UPDATE movies
-			SET title = $1, year = $2, runtime = $3, genres = $4, version = version + 1
-			WHERE id = $5 AND version = $6
-			RETURNING version`
+// Upsert inserts the movie, or updates the existing movie with the same title and year.
+// A soft-deleted movie is left deleted, and a new movie created alongside it. When
+// updating, a non-zero movie.Version must
+// match the stored version or ErrEditConflict is returned. It reports whether a new
+// movie was created.
+func (m MovieModel) Upsert(movie *Movie) (bool, error) {
+	query := `INSERT INTO movies (title, year, runtime, genres, created_by)
+			VALUES ($1, $2, $3, $4, NULLIF($5, 0))
+			ON CONFLICT (title, year) WHERE deleted_at IS NULL DO UPDATE
+			SET runtime = EXCLUDED.runtime, genres = EXCLUDED.genres, updated_at = NOW(), version = movies.version + 1
+			WHERE $6 = 0 OR movies.version = $6
+			RETURNING id, created_at, updated_at, version, COALESCE(created_by, 0), xmax = 0`
+
+	args := []interface{}{movie.Title, movie.Year, movie.Runtime, movie.Genres, movie.CreatedByID, movie.Version}
+
+	ctx := context.Background()
+
+	// xmax is zero only for a freshly inserted row.
+	var created bool
+	err := m.DB.QueryRow(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.UpdatedAt, &movie.Version, &movie.CreatedByID, &created)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return false, ErrEditConflict
+		case isDuplicateMovieError(err):
+			// Only the case-insensitive index can be violated here, as a conflict on
+			// the exact natural key is resolved by the upsert itself.
+			return false, ErrDuplicateMovie
+		case isGenresLengthError(err):
+			return false, ErrTooManyGenres
+		default:
+			return false, err
+		}
+	}
+	return created, nil
+}
+
+// GetByTitleYear looks up a movie by its natural key, ignoring the case of the title
+// but preferring an exact match.
+func (m MovieModel) GetByTitleYear(title string, year int32) (*Movie, error) {
+	query := `SELECT id, created_at, updated_at, title, year, runtime, genres, notes, version, COALESCE(created_by, 0)
+			FROM movies
+			WHERE lower(title) = lower($1) AND year = $2 AND deleted_at IS NULL
+			ORDER BY title = $1 DESC
+			LIMIT 1`
+
+	var movie Movie
+
+	ctx := context.Background()
 
-	args := []interface{}{
-		movie.Title,
-		movie.Year,
-		movie.Runtime,
-		movie.Genres,
-		movie.ID,
-		movie.Version,
+	err := m.DB.QueryRow(ctx, query, title, year).Scan(
+		&movie.ID,
+		&movie.CreatedAt,
+		&movie.UpdatedAt,
+		&movie.Title,
+		&movie.Year,
+		&movie.Runtime,
+		&movie.Genres,
+		&movie.Notes,
+		&movie.Version,
+		&movie.CreatedByID,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+	return &movie, nil
+}
+
+// CountCreatedBySince returns how many movies the user has created since the given time.
+func (m MovieModel) CountCreatedBySince(userID int64, since time.Time) (int, error) {
+	query := `SELECT count(*)
+			FROM movies
+			WHERE created_by = $1 AND created_at > $2`
+
+	ctx := context.Background()
 
-	err := m.DB.QueryRow(ctx, query, args...).Scan(&movie.Version)
+	var count int
+	err := m.DB.QueryRow(ctx, query, userID, since).Scan(&count)
+	return count, err
+}
+
+// LockCreator takes a lock on the movies created by the user which is held until the
+// end of the transaction, so that a quota check and the inserts which follow it can't
+// interleave with another request's. It has no lasting effect outside a transaction.
+func (m MovieModel) LockCreator(userID int64) error {
+	query := `SELECT pg_advisory_xact_lock(hashtext('movies.created_by'), hashint8($1))`
+
+	ctx := context.Background()
+
+	_, err := m.DB.Exec(ctx, query, userID)
+	return err
+}
+
+// updatableColumn returns the value of one of the movie columns which Update can set.
+func (movie *Movie) updatableColumn(column string) (interface{}, bool) {
+	switch column {
+	case "title":
+		return movie.Title, true
+	case "year":
+		return movie.Year, true
+	case "runtime":
+		return movie.Runtime, true
+	case "genres":
+		return movie.Genres, true
+	case "notes":
+		return movie.Notes, true
+	default:
+		return nil, false
+	}
+}
+
+// Update writes the given columns of the movie, or all of title, year, runtime and
+// genres if none are given, leaving the others as they are in the database.
+func (m MovieModel) Update(movie *Movie, columns ...string) error {
+	if len(columns) == 0 {
+		columns = []string{"title", "year", "runtime", "genres"}
+	}
+
+	set := make([]string, 0, len(columns))
+	args := make([]interface{}, 0, len(columns)+2)
+	for _, column := range columns {
+		value, ok := movie.updatableColumn(column)
+		if !ok {
+			return fmt.Errorf("data: movie column %q can't be updated", column)
+		}
+		args = append(args, value)
+		set = append(set, fmt.Sprintf("%s = $%d", column, len(args)))
+	}
+	args = append(args, movie.ID, movie.Version)
+
+	query := fmt.Sprintf(`UPDATE movies
+			SET %s, updated_at = NOW(), version = version + 1
+			WHERE id = $%d AND version = $%d AND deleted_at IS NULL
+			RETURNING updated_at, version`, strings.Join(set, ", "), len(args)-1, len(args))
+
+	ctx := context.Background()
+
+	err := m.DB.QueryRow(ctx, query, args...).Scan(&movie.UpdatedAt, &movie.Version)
 	if err != nil {
 		switch {
+		case isDuplicateMovieError(err):
+			return ErrDuplicateMovie
+		case isGenresLengthError(err):
+			return ErrTooManyGenres
 		case errors.Is(err, pgx.ErrNoRows):
 			return ErrEditConflict
 		default:
@@ -122,18 +351,17 @@ func (m MovieModel) Update(movie *Movie) error {
 	return nil
 }
 
-func (m MovieModel) Delete(id int64) error {
+func (m MovieModel) Delete(id int64, version int32) error {
 	if id < 1 {
 		return ErrRecordNotFound
 	}
 
 	query := `DELETE FROM movies
-			WHERE id = $1`
+			WHERE id = $1 AND deleted_at IS NULL AND ($2 = 0 OR version = $2)`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+	ctx := context.Background()
 
-	result, err := m.DB.Exec(ctx, query, id)
+	result, err := m.DB.Exec(ctx, query, id, version)
 	if err != nil {
 		return err
 	} else if result.RowsAffected() == 0 {
@@ -143,21 +371,261 @@ func (m MovieModel) Delete(id int64) error {
 	return nil
 }
 
-func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
+// SoftDelete marks the movie as deleted, hiding it from Get and GetAll until it is
+// restored. Like Delete, it only deletes the movie at a non-zero version.
+func (m MovieModel) SoftDelete(id int64, version int32) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
 
-	query := fmt.Sprintf(`SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, version
-						FROM movies
-						WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')
-						AND (genres @> $2 OR $2 = '{}')
-						ORDER BY %s %s, id ASC
-						LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
+	query := `UPDATE movies
+			SET deleted_at = NOW()
+			WHERE id = $1 AND deleted_at IS NULL AND ($2 = 0 OR version = $2)`
+
+	ctx := context.Background()
+
+	result, err := m.DB.Exec(ctx, query, id, version)
+	if err != nil {
+		return err
+	} else if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// PurgeDeleted permanently deletes up to limit movies which were soft-deleted before
+// the cutoff, together with their history, returning how many movies were deleted.
+// Rows locked by a concurrent restore are skipped until a later purge.
+func (m MovieModel) PurgeDeleted(cutoff time.Time, limit int) (int64, error) {
+
+	query := `WITH purged AS (
+				DELETE FROM movies
+				WHERE id IN (
+					SELECT id FROM movies
+					WHERE deleted_at < $1
+					ORDER BY deleted_at
+					LIMIT $2
+					FOR UPDATE SKIP LOCKED
+				)
+				RETURNING id
+			), events AS (
+				DELETE FROM movie_events
+				WHERE movie_id IN (SELECT id FROM purged)
+			)
+			SELECT count(*) FROM purged`
+
+	ctx := context.Background()
+
+	var purged int64
+	err := m.DB.QueryRow(ctx, query, cutoff, limit).Scan(&purged)
+	if err != nil {
+		return 0, err
+	}
+	return purged, nil
+}
+
+// RecomputeAggregates recomputes the denormalized average_rating and review_count of
+// up to limit movies with IDs after afterID from their ratings, correcting any which
+// have drifted. It returns the last ID it covered, which is 0 once there are no movies
+// left, and how many movies it corrected. Corrections don't change a movie's version,
+// as they aren't edits.
+func (m MovieModel) RecomputeAggregates(afterID int64, limit int) (int64, int64, error) {
+
+	query := `WITH batch AS (
+				SELECT id FROM movies
+				WHERE id > $1
+				ORDER BY id
+				LIMIT $2
+			), aggregates AS (
+				SELECT batch.id,
+					COALESCE(round(avg(ratings.rating), 2), 0) AS average_rating,
+					count(*) FILTER (WHERE ratings.review <> '') AS review_count
+				FROM batch
+				LEFT JOIN ratings ON ratings.movie_id = batch.id
+				GROUP BY batch.id
+			), corrected AS (
+				UPDATE movies
+				SET average_rating = aggregates.average_rating, review_count = aggregates.review_count
+				FROM aggregates
+				WHERE movies.id = aggregates.id
+				AND (movies.average_rating <> aggregates.average_rating OR movies.review_count <> aggregates.review_count)
+				RETURNING movies.id
+			)
+			SELECT COALESCE((SELECT max(id) FROM batch), 0), (SELECT count(*) FROM corrected)`
+
+	ctx := context.Background()
+
+	var lastID, corrected int64
+	err := m.DB.QueryRow(ctx, query, afterID, limit).Scan(&lastID, &corrected)
+	if err != nil {
+		return 0, 0, err
+	}
+	return lastID, corrected, nil
+}
+
+// GetDeleted fetches a soft-deleted movie, returning ErrRecordNotFound if the movie
+// doesn't exist or hasn't been deleted.
+func (m MovieModel) GetDeleted(id int64) (*Movie, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `SELECT id, created_at, updated_at, title, year, runtime, genres, notes, version, COALESCE(created_by, 0)
+			FROM movies
+			WHERE id = $1 AND deleted_at IS NOT NULL`
+
+	var movie Movie
+
+	ctx := context.Background()
+
+	err := m.DB.QueryRow(ctx, query, id).Scan(
+		&movie.ID,
+		&movie.CreatedAt,
+		&movie.UpdatedAt,
+		&movie.Title,
+		&movie.Year,
+		&movie.Runtime,
+		&movie.Genres,
+		&movie.Notes,
+		&movie.Version,
+		&movie.CreatedByID,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &movie, nil
+}
+
+// RestoreMovie clears deleted_at on a soft-deleted movie. As with Update, movie.Version
+// must match the stored version, otherwise ErrEditConflict is returned.
+func (m MovieModel) RestoreMovie(movie *Movie) error {
+	query := `UPDATE movies
+			SET deleted_at = NULL, updated_at = NOW(), version = version + 1
+			WHERE id = $1 AND version = $2 AND deleted_at IS NOT NULL
+			RETURNING updated_at, version`
+
+	ctx := context.Background()
+
+	err := m.DB.QueryRow(ctx, query, movie.ID, movie.Version).Scan(&movie.UpdatedAt, &movie.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return ErrEditConflict
+		// Another movie has taken the natural key since this one was deleted.
+		case isDuplicateMovieError(err):
+			return ErrDuplicateMovie
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// How a movie listing matches the genres it's filtered by.
+const (
+	GenresMatchAll = "all"
+	GenresMatchAny = "any"
+)
+
+// MovieListFilters selects the movies in a listing. An empty field doesn't filter.
+type MovieListFilters struct {
+	// Title is searched for with full-text search.
+	Title  string
+	Genres []string
+	// GenresMatch is GenresMatchAll to list movies with every one of the genres, or
+	// GenresMatchAny for those with at least one.
+	GenresMatch string
+
+	// The inclusive ranges of release year and creation time. A nil bound leaves that
+	// end of the range open.
+	YearFrom, YearTo       *int
+	CreatedFrom, CreatedTo *time.Time
+}
+
+func ValidateMovieListFilters(v *validator.Validator, f MovieListFilters) {
+	v.Check(len(f.Genres) <= Limits.Genres, "genres", fmt.Sprintf("must not contain more than %d genres", Limits.Genres))
+	v.Check(validator.In(f.GenresMatch, GenresMatchAll, GenresMatchAny), "genres_match", "must be all or any")
+
+	// Years outside the range ValidateMovie accepts would match nothing, so they're
+	// most likely mistakes.
+	for key, year := range map[string]*int{"year_from": f.YearFrom, "year_to": f.YearTo} {
+		if year != nil {
+			v.Check(*year >= 1888, key, "must be greater than 1888")
+			v.Check(*year <= time.Now().Year(), key, "must not be in the future")
+		}
+	}
+	if f.YearFrom != nil && f.YearTo != nil {
+		v.Check(*f.YearFrom <= *f.YearTo, "year_to", "must not be before year_from")
+	}
+	if f.CreatedFrom != nil && f.CreatedTo != nil {
+		v.Check(!f.CreatedTo.Before(*f.CreatedFrom), "created_to", "must not be before created_from")
+	}
+}
+
+// where returns the conditions shared by the movie listings.
+func (f MovieListFilters) where() whereClause {
+	var w whereClause
+	w.where("deleted_at IS NULL")
+	if f.Title != "" {
+		w.where("to_tsvector('simple', title) @@ plainto_tsquery('simple', ?)", f.Title)
+	}
+	if len(f.Genres) > 0 {
+		if f.GenresMatch == GenresMatchAny {
+			w.overlaps("genres", f.Genres)
+		} else {
+			w.contains("genres", f.Genres)
+		}
+	}
+
+	var yearFrom, yearTo, createdFrom, createdTo interface{}
+	if f.YearFrom != nil {
+		yearFrom = *f.YearFrom
+	}
+	if f.YearTo != nil {
+		yearTo = *f.YearTo
+	}
+	if f.CreatedFrom != nil {
+		createdFrom = *f.CreatedFrom
+	}
+	if f.CreatedTo != nil {
+		createdTo = *f.CreatedTo
+	}
+	w.between("year", yearFrom, yearTo)
+	w.between("created_at", createdFrom, createdTo)
+	return w
+}
+
+func (m MovieModel) GetAll(listFilters MovieListFilters, filters Filters) ([]*Movie, Metadata, error) {
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+	w := listFilters.where()
 
-	args := []interface{}{title, genres, filters.limit(), filters.offset()}
+	where := w.String()
+
+	// Sorting by relevance ranks the matches for the title search, best first.
+	orderBy := fmt.Sprintf("%s %s", filters.sortColumn(), filters.sortDirection())
+	if filters.sortColumn() == "relevance" {
+		orderBy = fmt.Sprintf("ts_rank(to_tsvector('simple', title), plainto_tsquery('simple', %s)) DESC", w.param(listFilters.Title))
+	}
 
-	rows, err := m.DB.Query(ctx, query, args...)
+	limit, offset := w.param(filters.limit()), w.param(filters.offset())
+
+	query := fmt.Sprintf(`SELECT count(*) OVER(), id, created_at, updated_at, title, year, runtime, genres, notes, version, COALESCE(created_by, 0)
+						FROM movies
+						%s
+						ORDER BY %s, id ASC
+						LIMIT %s OFFSET %s`, where, orderBy, limit, offset)
+
+	ctx := context.Background()
+
+	rows, err := m.DB.Query(ctx, query, w.args...)
 	if err != nil {
 		return nil, Metadata{}, err
 	}
@@ -172,11 +640,14 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 			&totalRecords,
 			&movie.ID,
 			&movie.CreatedAt,
+			&movie.UpdatedAt,
 			&movie.Title,
 			&movie.Year,
 			&movie.Runtime,
 			&movie.Genres,
+			&movie.Notes,
 			&movie.Version,
+			&movie.CreatedByID,
 		)
 		if err != nil {
 			return nil, Metadata{}, err
@@ -193,3 +664,128 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 
 	return movies, metadata, nil
 }
+
+// GetAllCursor returns the page of movies following the after cursor, or the first
+// page if after is nil, using keyset pagination on the sort column and ID. Both are
+// ordered in the sort direction so the position can be compared as a row value. The
+// returned metadata carries the cursor for the next page, if there is one.
+func (m MovieModel) GetAllCursor(listFilters MovieListFilters, filters Filters, after *Cursor) ([]*Movie, Metadata, error) {
+
+	w := listFilters.where()
+
+	column, direction := filters.sortColumn(), filters.sortDirection()
+	if after != nil {
+		operator := ">"
+		if direction == "DESC" {
+			operator = "<"
+		}
+		w.where(fmt.Sprintf("(%s, id) %s (?, ?)", column, operator), after.Value, after.ID)
+	}
+
+	where := w.String()
+	// Fetch one extra row to find out whether there's a next page.
+	limit := w.param(filters.limit() + 1)
+
+	query := fmt.Sprintf(`SELECT id, created_at, updated_at, title, year, runtime, genres, notes, version, COALESCE(created_by, 0)
+						FROM movies
+						%s
+						ORDER BY %s %s, id %s
+						LIMIT %s`, where, column, direction, direction, limit)
+
+	ctx := context.Background()
+
+	rows, err := m.DB.Query(ctx, query, w.args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	movies := []*Movie{}
+	for rows.Next() {
+		var movie Movie
+		err := rows.Scan(
+			&movie.ID,
+			&movie.CreatedAt,
+			&movie.UpdatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			&movie.Genres,
+			&movie.Notes,
+			&movie.Version,
+			&movie.CreatedByID,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		movies = append(movies, &movie)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := Metadata{PageSize: filters.PageSize}
+	if len(movies) > filters.PageSize {
+		movies = movies[:filters.PageSize]
+		last := movies[len(movies)-1]
+		metadata.NextCursor = Cursor{Sort: filters.Sort, Value: last.sortValue(column), ID: last.ID}.Encode()
+	}
+
+	return movies, metadata, nil
+}
+
+// sortValue returns the value of one of the columns movie listings can be sorted by.
+func (movie *Movie) sortValue(column string) interface{} {
+	switch column {
+	case "title":
+		return movie.Title
+	case "year":
+		return int64(movie.Year)
+	case "runtime":
+		return int64(movie.Runtime)
+	default:
+		return movie.ID
+	}
+}
+
+// GetAllCreatedBy returns every movie created by the user, oldest first.
+func (m MovieModel) GetAllCreatedBy(userID int64) ([]*Movie, error) {
+
+	query := `SELECT id, created_at, updated_at, title, year, runtime, genres, notes, version, COALESCE(created_by, 0)
+			FROM movies
+			WHERE created_by = $1 AND deleted_at IS NULL
+			ORDER BY id`
+
+	ctx := context.Background()
+
+	rows, err := m.DB.Query(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	movies := []*Movie{}
+	for rows.Next() {
+		var movie Movie
+		err := rows.Scan(
+			&movie.ID,
+			&movie.CreatedAt,
+			&movie.UpdatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			&movie.Genres,
+			&movie.Notes,
+			&movie.Version,
+			&movie.CreatedByID,
+		)
+		if err != nil {
+			return nil, err
+		}
+		movies = append(movies, &movie)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return movies, nil
+}
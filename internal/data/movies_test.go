@@ -0,0 +1,161 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+
+	"greenlight.yp2743.me/internal/validator"
+)
+
+// errRow is a pgx.Row whose Scan fails with err.
+type errRow struct {
+	err error
+}
+
+func (r errRow) Scan(dest ...interface{}) error {
+	return r.err
+}
+
+// errDB is a DBTX which fails every statement with err, as the database would.
+type errDB struct {
+	err error
+}
+
+func (db errDB) Exec(ctx context.Context, sql string, arguments ...interface{}) (pgconn.CommandTag, error) {
+	return pgconn.CommandTag{}, db.err
+}
+
+func (db errDB) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+	return nil, db.err
+}
+
+func (db errDB) QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+	return errRow{db.err}
+}
+
+func manyGenres(n int) []string {
+	genres := make([]string, n)
+	for i := range genres {
+		genres[i] = fmt.Sprintf("genre %d", i)
+	}
+	return genres
+}
+
+func TestValidateMovieGenres(t *testing.T) {
+	tests := []struct {
+		genres    []string
+		wantError string
+	}{
+		{manyGenres(1), ""},
+		{manyGenres(Limits.Genres), ""},
+		{manyGenres(Limits.Genres + 1), fmt.Sprintf("must not contain more than %d genres", Limits.Genres)},
+		{manyGenres(5000), fmt.Sprintf("must not contain more than %d genres", Limits.Genres)},
+	}
+
+	for _, tt := range tests {
+		movie := &Movie{Title: "Casablanca", Year: 1942, Runtime: 102, Genres: tt.genres}
+
+		v := validator.New()
+		ValidateMovie(v, movie)
+		if got := v.Errors["genres"]; got != tt.wantError {
+			t.Errorf("%d genres: got error %q; want %q", len(tt.genres), got, tt.wantError)
+		}
+	}
+}
+
+func TestMovieInsertGenresLengthError(t *testing.T) {
+	tests := []struct {
+		err     error
+		wantErr error
+	}{
+		{&pgconn.PgError{Code: "23514", ConstraintName: "genres_length_check"}, ErrTooManyGenres},
+		// Other check violations are passed on as they are.
+		{&pgconn.PgError{Code: "23514", ConstraintName: "runtime_check"}, nil},
+	}
+
+	for _, tt := range tests {
+		m := MovieModel{DB: errDB{tt.err}}
+		err := m.Insert(&Movie{Title: "Casablanca", Year: 1942, Runtime: 102, Genres: manyGenres(MaxGenres + 1)})
+
+		want := tt.wantErr
+		if want == nil {
+			want = tt.err
+		}
+		if !errors.Is(err, want) {
+			t.Errorf("%v: got %v; want %v", tt.err, err, want)
+		}
+	}
+}
+
+func TestMovieInsertDuplicate(t *testing.T) {
+	tests := []struct {
+		err     error
+		wantErr error
+	}{
+		{&pgconn.PgError{Code: "23505", ConstraintName: "movies_title_year_key"}, ErrDuplicateMovie},
+		{&pgconn.PgError{Code: "23505", ConstraintName: "movies_lower_title_year_key"}, ErrDuplicateMovie},
+		// Other unique violations are passed on as they are.
+		{&pgconn.PgError{Code: "23505", ConstraintName: "movies_pkey"}, nil},
+	}
+
+	for _, tt := range tests {
+		m := MovieModel{DB: errDB{tt.err}}
+		err := m.Insert(&Movie{Title: "the matrix", Year: 1999, Runtime: 136, Genres: []string{"sci-fi"}})
+
+		want := tt.wantErr
+		if want == nil {
+			want = tt.err
+		}
+		if !errors.Is(err, want) {
+			t.Errorf("%v: got %v; want %v", tt.err, err, want)
+		}
+	}
+}
+
+// setNormalizeTitles sets NormalizeTitles for the duration of the test.
+func setNormalizeTitles(t *testing.T, normalize bool) {
+	t.Helper()
+
+	previous := NormalizeTitles
+	NormalizeTitles = normalize
+	t.Cleanup(func() { NormalizeTitles = previous })
+}
+
+func TestNormalizeTitle(t *testing.T) {
+	tests := []struct {
+		title string
+		want  string
+	}{
+		{"  The   Matrix  ", "The Matrix"},
+		{"The\tMatrix\nReloaded", "The Matrix Reloaded"},
+		{"the MATRIX", "the MATRIX"},
+		{"The Matrix", "The Matrix"},
+		{" \t ", ""},
+	}
+
+	for _, normalize := range []bool{false, true} {
+		setNormalizeTitles(t, normalize)
+
+		for _, tt := range tests {
+			want := tt.title
+			if normalize {
+				want = tt.want
+			}
+			if got := NormalizeTitle(tt.title); got != want {
+				t.Errorf("normalize %t: got %q for %q; want %q", normalize, got, tt.title, want)
+			}
+		}
+	}
+
+	// A title of only whitespace is then missing, rather than a blank title.
+	v := validator.New()
+	ValidateMovie(v, &Movie{Title: NormalizeTitle("   "), Year: 1999, Runtime: 136, Genres: []string{"sci-fi"}})
+	if v.Errors["title"] != "must be provided" {
+		t.Errorf("got title error %q; want %q", v.Errors["title"], "must be provided")
+	}
+}
@@ -0,0 +1,137 @@
+package data
+
+import (
+	"context"
+	"time"
+)
+
+// An OutboxMessage is an email which is recorded in the same transaction as the
+// change that triggers it, and delivered afterwards by a background dispatcher.
+type OutboxMessage struct {
+	ID        int64
+	CreatedAt time.Time
+	Recipient string
+	Template  string
+	Data      map[string]interface{}
+	Attempts  int
+
+	// Token, if set, is minted by the dispatcher when the message is sent, so that its
+	// plaintext is never stored in the outbox.
+	Token *OutboxToken
+
+	// Delay, if set when inserting, holds the message back from dispatch for that long.
+	Delay time.Duration
+}
+
+// An OutboxToken describes the token an outbox message delivers. Its plaintext is
+// passed to the template under Key, and its expiry under "tokenExpiry".
+type OutboxToken struct {
+	UserID int64  `json:"user_id"`
+	Scope  string `json:"scope"`
+	Key    string `json:"key"`
+}
+
+type OutboxModel struct {
+	DB DBTX
+}
+
+func (m OutboxModel) Insert(message *OutboxMessage) error {
+
+	query := `INSERT INTO outbox (recipient, template, data, token, available_at)
+			VALUES ($1, $2, $3, $4, now() + $5 * interval '1 millisecond')
+			RETURNING id, created_at`
+
+	args := []interface{}{message.Recipient, message.Template, message.Data, message.Token, message.Delay.Milliseconds()}
+	ctx := context.Background()
+
+	return m.DB.QueryRow(ctx, query, args...).Scan(&message.ID, &message.CreatedAt)
+}
+
+// Claim leases up to limit unsent messages for the given duration. A message which
+// is not marked as sent before its lease expires (because sending failed or the
+// process crashed) becomes available to be claimed again.
+func (m OutboxModel) Claim(limit int, lease time.Duration) ([]*OutboxMessage, error) {
+
+	query := `UPDATE outbox
+			SET attempts = attempts + 1, available_at = now() + $2 * interval '1 millisecond'
+			WHERE id IN (
+				SELECT id FROM outbox
+				WHERE sent_at IS NULL AND failed_at IS NULL AND available_at <= now()
+				ORDER BY id
+				LIMIT $1
+				FOR UPDATE SKIP LOCKED
+			)
+			RETURNING id, created_at, recipient, template, data, token, attempts`
+
+	ctx := context.Background()
+
+	rows, err := m.DB.Query(ctx, query, limit, lease.Milliseconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []*OutboxMessage{}
+	for rows.Next() {
+		var message OutboxMessage
+		err := rows.Scan(
+			&message.ID,
+			&message.CreatedAt,
+			&message.Recipient,
+			&message.Template,
+			&message.Data,
+			&message.Token,
+			&message.Attempts,
+		)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, &message)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// MarkSent records that a message was sent. Its data is cleared, as it's no longer
+// needed and may be personal.
+func (m OutboxModel) MarkSent(id int64) error {
+
+	query := `UPDATE outbox
+			SET sent_at = now(), data = '{}'
+			WHERE id = $1`
+
+	ctx := context.Background()
+
+	_, err := m.DB.Exec(ctx, query, id)
+	return err
+}
+
+// Retry makes a message whose send failed available to be claimed again after delay,
+// rather than when its lease expires.
+func (m OutboxModel) Retry(id int64, delay time.Duration) error {
+
+	query := `UPDATE outbox
+			SET available_at = now() + $2 * interval '1 millisecond'
+			WHERE id = $1`
+
+	ctx := context.Background()
+
+	_, err := m.DB.Exec(ctx, query, id, delay.Milliseconds())
+	return err
+}
+
+// MarkFailed gives up on a message, so that it's never claimed again. Its data is
+// cleared, as for a sent message.
+func (m OutboxModel) MarkFailed(id int64) error {
+
+	query := `UPDATE outbox
+			SET failed_at = now(), data = '{}'
+			WHERE id = $1`
+
+	ctx := context.Background()
+
+	_, err := m.DB.Exec(ctx, query, id)
+	return err
+}
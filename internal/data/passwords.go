@@ -0,0 +1,140 @@
+package data
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/alexedwards/argon2id"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// A PasswordHasher hashes and verifies passwords with one algorithm. Hashes are
+// stored in their algorithm's standard encoding, which begins with an identifying
+// prefix ("$argon2id$", "$2a$" and so on), so any stored hash can be matched to the
+// hasher that produced it. NeedsRehash reports whether a hash it owns was created
+// with weaker cost parameters than the hasher currently uses.
+type PasswordHasher interface {
+	Hash(plaintext string) (string, error)
+	Matches(plaintext, hash string) (bool, error)
+	Owns(hash string) bool
+	NeedsRehash(hash string) bool
+}
+
+type Argon2idHasher struct {
+	Params *argon2id.Params
+}
+
+func (h Argon2idHasher) Hash(plaintext string) (string, error) {
+	return argon2id.CreateHash(plaintext, h.Params)
+}
+
+func (h Argon2idHasher) Matches(plaintext, hash string) (bool, error) {
+	return argon2id.ComparePasswordAndHash(plaintext, hash)
+}
+
+func (h Argon2idHasher) Owns(hash string) bool {
+	return strings.HasPrefix(hash, "$argon2id$")
+}
+
+func (h Argon2idHasher) NeedsRehash(hash string) bool {
+	params, _, _, err := argon2id.DecodeHash(hash)
+	if err != nil {
+		return false
+	}
+	return params.Memory < h.Params.Memory ||
+		params.Iterations < h.Params.Iterations ||
+		params.Parallelism < h.Params.Parallelism ||
+		params.SaltLength < h.Params.SaltLength ||
+		params.KeyLength < h.Params.KeyLength
+}
+
+type BcryptHasher struct {
+	Cost int
+}
+
+func (h BcryptHasher) Hash(plaintext string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(plaintext), h.Cost)
+	return string(hash), err
+}
+
+func (h BcryptHasher) Matches(plaintext, hash string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(plaintext))
+	switch {
+	case err == nil:
+		return true, nil
+	case err == bcrypt.ErrMismatchedHashAndPassword:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+func (h BcryptHasher) Owns(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+func (h BcryptHasher) NeedsRehash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err == nil && cost < h.Cost
+}
+
+// Passwords hashes new passwords with the Current hasher, while still verifying
+// hashes produced by any of the Supported ones.
+type Passwords struct {
+	Current   PasswordHasher
+	Supported []PasswordHasher
+}
+
+// NewPasswords returns a Passwords which hashes with the named algorithm
+// (argon2id or bcrypt), using the given cost parameters, and verifies hashes from either.
+func NewPasswords(algorithm string, argon2idParams *argon2id.Params, bcryptCost int) (Passwords, error) {
+	argon := Argon2idHasher{Params: argon2idParams}
+	bc := BcryptHasher{Cost: bcryptCost}
+	supported := []PasswordHasher{argon, bc}
+
+	switch algorithm {
+	case "argon2id":
+		return Passwords{Current: argon, Supported: supported}, nil
+	case "bcrypt":
+		return Passwords{Current: bc, Supported: supported}, nil
+	default:
+		return Passwords{}, fmt.Errorf("unknown password hashing algorithm %q", algorithm)
+	}
+}
+
+func (p Passwords) Hash(plaintext string) (string, error) {
+	return p.Current.Hash(plaintext)
+}
+
+// Matches verifies plaintext against hash using whichever hasher produced it, and
+// reports whether the hash should be replaced, either because it was produced by a
+// different algorithm or with weaker cost parameters than the current hasher uses.
+func (p Passwords) Matches(plaintext, hash string) (match bool, needsRehash bool, err error) {
+	// Users imported without a password have an empty hash, which matches nothing.
+	if hash == "" {
+		return false, false, nil
+	}
+
+	for _, hasher := range p.Supported {
+		if !hasher.Owns(hash) {
+			continue
+		}
+
+		match, err = hasher.Matches(plaintext, hash)
+		if err != nil || !match {
+			return false, false, err
+		}
+		return true, !p.Current.Owns(hash) || p.Current.NeedsRehash(hash), nil
+	}
+	return false, false, fmt.Errorf("unrecognized password hash format")
+}
+
+// Recognizes reports whether hash was produced by one of the supported hashers.
+func (p Passwords) Recognizes(hash string) bool {
+	for _, hasher := range p.Supported {
+		if hasher.Owns(hash) {
+			return true
+		}
+	}
+	return false
+}
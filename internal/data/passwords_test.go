@@ -0,0 +1,71 @@
+package data
+
+import (
+	"testing"
+
+	"github.com/alexedwards/argon2id"
+)
+
+var (
+	weakArgon2id   = &argon2id.Params{Memory: 8 * 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+	strongArgon2id = &argon2id.Params{Memory: 16 * 1024, Iterations: 2, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+)
+
+func TestPasswordsMatches(t *testing.T) {
+	current := Argon2idHasher{Params: strongArgon2id}
+	passwords := Passwords{Current: current, Supported: []PasswordHasher{current, BcryptHasher{Cost: 4}}}
+
+	hash := func(hasher PasswordHasher) string {
+		t.Helper()
+		h, err := hasher.Hash("pa55word")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+
+	tests := []struct {
+		name            string
+		plaintext       string
+		hash            string
+		wantMatch       bool
+		wantNeedsRehash bool
+	}{
+		{"current parameters", "pa55word", hash(current), true, false},
+		{"weaker parameters", "pa55word", hash(Argon2idHasher{Params: weakArgon2id}), true, true},
+		{"weaker parameters, wrong password", "wrong", hash(Argon2idHasher{Params: weakArgon2id}), false, false},
+		{"other algorithm", "pa55word", hash(BcryptHasher{Cost: 4}), true, true},
+		{"no password", "pa55word", "", false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			match, needsRehash, err := passwords.Matches(tt.plaintext, tt.hash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if match != tt.wantMatch || needsRehash != tt.wantNeedsRehash {
+				t.Errorf("got match %t and needs rehash %t; want %t and %t", match, needsRehash, tt.wantMatch, tt.wantNeedsRehash)
+			}
+		})
+	}
+}
+
+func TestArgon2idNeedsRehash(t *testing.T) {
+	hasher := Argon2idHasher{Params: strongArgon2id}
+
+	for _, params := range []*argon2id.Params{
+		{Memory: 8 * 1024, Iterations: 2, Parallelism: 1, SaltLength: 16, KeyLength: 32},
+		{Memory: 16 * 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32},
+		{Memory: 16 * 1024, Iterations: 2, Parallelism: 1, SaltLength: 8, KeyLength: 32},
+		{Memory: 16 * 1024, Iterations: 2, Parallelism: 1, SaltLength: 16, KeyLength: 16},
+	} {
+		hash, err := argon2id.CreateHash("pa55word", params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !hasher.NeedsRehash(hash) {
+			t.Errorf("hash with %+v doesn't need a rehash", *params)
+		}
+	}
+}
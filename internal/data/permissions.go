@@ -2,9 +2,7 @@ package data
 
 import (
 	"context"
-	"time"
-
-	"github.com/jackc/pgx/v5/pgxpool"
+	"fmt"
 )
 
 type Permissions []string
@@ -18,8 +16,15 @@ func (p Permissions) Include(code string) bool {
 	return false
 }
 
+// PermissionGrant records that a user holds a permission.
+type PermissionGrant struct {
+	UserID ID     `json:"user_id"`
+	Email  string `json:"email"`
+	Code   string `json:"code"`
+}
+
 type PermissionModel struct {
-	DB *pgxpool.Pool
+	DB DBTX
 }
 
 func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
@@ -30,8 +35,7 @@ func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 			INNER JOIN users ON users_permissions.user_id = users.id
 			WHERE users.id = $1`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+	ctx := context.Background()
 
 	rows, err := m.DB.Query(ctx, query, userID)
 	if err != nil {
@@ -54,14 +58,133 @@ func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 	return permissions, nil
 }
 
+// AddForUser grants the permissions to the user. Granting a permission the user
+// already holds is a no-op.
 func (m PermissionModel) AddForUser(userID int64, codes ...string) error {
 
 	query := `INSERT INTO users_permissions
-			SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)`
+			SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
+			ON CONFLICT DO NOTHING`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+	ctx := context.Background()
 
 	_, err := m.DB.Exec(ctx, query, userID, codes)
 	return err
 }
+
+// RemoveForUser revokes the permissions from the user. Revoking a permission the user
+// doesn't hold is a no-op.
+func (m PermissionModel) RemoveForUser(userID int64, codes ...string) error {
+
+	query := `DELETE FROM users_permissions
+			USING permissions
+			WHERE users_permissions.permission_id = permissions.id
+			AND users_permissions.user_id = $1
+			AND permissions.code = ANY($2)`
+
+	ctx := context.Background()
+
+	_, err := m.DB.Exec(ctx, query, userID, codes)
+	return err
+}
+
+// GetUnknown returns those of the codes which aren't in the permissions table.
+func (m PermissionModel) GetUnknown(codes []string) ([]string, error) {
+
+	query := `SELECT code FROM unnest($1::text[]) AS code
+			WHERE code NOT IN (SELECT code FROM permissions)
+			ORDER BY code`
+
+	ctx := context.Background()
+
+	rows, err := m.DB.Query(ctx, query, codes)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var unknown []string
+	for rows.Next() {
+		var code string
+		err := rows.Scan(&code)
+		if err != nil {
+			return nil, err
+		}
+		unknown = append(unknown, code)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return unknown, nil
+}
+
+// AddAllForUser grants the user every permission there is.
+func (m PermissionModel) AddAllForUser(userID int64) error {
+
+	query := `INSERT INTO users_permissions
+			SELECT $1, permissions.id FROM permissions
+			ON CONFLICT DO NOTHING`
+
+	ctx := context.Background()
+
+	_, err := m.DB.Exec(ctx, query, userID)
+	return err
+}
+
+// GetAllGrants returns a page of permission grants, optionally only those of one user
+// (if userID is non-zero) or of one permission code (if code is non-empty).
+func (m PermissionModel) GetAllGrants(userID int64, code string, filters Filters) ([]*PermissionGrant, Metadata, error) {
+
+	var w whereClause
+	if userID != 0 {
+		w.equal("users.id", userID)
+	}
+	if code != "" {
+		w.equal("permissions.code", code)
+	}
+
+	where := w.String()
+	limit, offset := w.param(filters.limit()), w.param(filters.offset())
+
+	query := fmt.Sprintf(`SELECT count(*) OVER(), users.id AS user_id, users.email, permissions.code AS code
+						FROM users_permissions
+						INNER JOIN permissions ON users_permissions.permission_id = permissions.id
+						INNER JOIN users ON users_permissions.user_id = users.id
+						%s
+						ORDER BY %s %s, user_id ASC, code ASC
+						LIMIT %s OFFSET %s`, where, filters.sortColumn(), filters.sortDirection(), limit, offset)
+
+	ctx := context.Background()
+
+	rows, err := m.DB.Query(ctx, query, w.args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	grants := []*PermissionGrant{}
+
+	for rows.Next() {
+		var grant PermissionGrant
+		err := rows.Scan(
+			&totalRecords,
+			&grant.UserID,
+			&grant.Email,
+			&grant.Code,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		grants = append(grants, &grant)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return grants, metadata, nil
+}
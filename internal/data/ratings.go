@@ -0,0 +1,54 @@
+package data
+
+import (
+	"context"
+	"time"
+)
+
+// A Rating is a user's score for a movie, with an optional written review.
+type Rating struct {
+	MovieID   ID        `json:"movie_id"`
+	CreatedAt time.Time `json:"created_at"`
+	Rating    int16     `json:"rating"`
+	Review    string    `json:"review,omitempty"`
+}
+
+type RatingModel struct {
+	DB DBTX
+}
+
+// GetAllForUser returns the ratings the user has given, oldest first.
+func (m RatingModel) GetAllForUser(userID int64) ([]*Rating, error) {
+
+	query := `SELECT movie_id, created_at, rating, review
+			FROM ratings
+			WHERE user_id = $1
+			ORDER BY created_at, movie_id`
+
+	ctx := context.Background()
+
+	rows, err := m.DB.Query(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ratings := []*Rating{}
+	for rows.Next() {
+		var rating Rating
+		err := rows.Scan(
+			&rating.MovieID,
+			&rating.CreatedAt,
+			&rating.Rating,
+			&rating.Review,
+		)
+		if err != nil {
+			return nil, err
+		}
+		ratings = append(ratings, &rating)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return ratings, nil
+}
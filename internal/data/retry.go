@@ -0,0 +1,108 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// RetryPolicy controls how reads which fail with a transient error are retried.
+type RetryPolicy struct {
+	// Retries is the number of attempts made after the first, and Backoff the delay
+	// before the first retry, doubling for each one after.
+	Retries int
+	Backoff time.Duration
+
+	// OnRetry, if set, is called before each retry with the error which caused it.
+	OnRetry func(err error, attempt int)
+}
+
+// isTransientError reports whether err is worth retrying: the query wasn't sent, the
+// connection couldn't be established, or the server gave up on it without applying it.
+func isTransientError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch pgErr.Code {
+		case "40001", "40P01", "57P01", "57P02", "57P03":
+			return true
+		}
+		// Class 08 is connection exceptions.
+		return strings.HasPrefix(pgErr.Code, "08")
+	}
+
+	// A failure to dial, or any other error pgconn guarantees happened before the query
+	// was sent, can't have had an effect.
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	var safe interface{ SafeToRetry() bool }
+	return errors.As(err, &safe) && safe.SafeToRetry()
+}
+
+// retry calls fn until it succeeds, fails with an error which isn't transient, or the
+// policy's retries are used up.
+func (p RetryPolicy) retry(ctx context.Context, fn func() error) error {
+	backoff := p.Backoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if attempt > p.Retries || !isTransientError(err) {
+			return err
+		}
+
+		if p.OnRetry != nil {
+			p.OnRetry(err, attempt)
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// retryingDB retries the queries run through Query and QueryRow under a RetryPolicy.
+// Exec is passed straight through, since it's used for writes.
+type retryingDB struct {
+	DBTX
+	policy RetryPolicy
+}
+
+func (d retryingDB) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+	var rows pgx.Rows
+	err := d.policy.retry(ctx, func() error {
+		var err error
+		rows, err = d.DBTX.Query(ctx, sql, args...)
+		return err
+	})
+	return rows, err
+}
+
+func (d retryingDB) QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+	return retryingRow{db: d, ctx: ctx, sql: sql, args: args}
+}
+
+// retryingRow defers running the query until Scan, as QueryRow only reports errors
+// from there.
+type retryingRow struct {
+	db   retryingDB
+	ctx  context.Context
+	sql  string
+	args []interface{}
+}
+
+func (r retryingRow) Scan(dest ...interface{}) error {
+	return r.db.policy.retry(r.ctx, func() error {
+		return r.db.DBTX.QueryRow(r.ctx, r.sql, r.args...).Scan(dest...)
+	})
+}
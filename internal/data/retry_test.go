@@ -0,0 +1,97 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// flakyDB is a DBTX whose statements fail with err for the first failures attempts,
+// and then succeed.
+type flakyDB struct {
+	err      error
+	failures int
+	attempts int
+}
+
+func (db *flakyDB) attempt() error {
+	db.attempts++
+	if db.attempts <= db.failures {
+		return db.err
+	}
+	return nil
+}
+
+func (db *flakyDB) Exec(ctx context.Context, sql string, arguments ...interface{}) (pgconn.CommandTag, error) {
+	return pgconn.NewCommandTag("UPDATE 1"), db.attempt()
+}
+
+func (db *flakyDB) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+	panic("unexpected query")
+}
+
+func (db *flakyDB) QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+	return errRow{db.attempt()}
+}
+
+func TestRetryingDB(t *testing.T) {
+	connectionLost := &pgconn.PgError{Code: "08006"}
+
+	tests := []struct {
+		name         string
+		err          error
+		failures     int
+		wantErr      error
+		wantAttempts int
+	}{
+		{"transient then success", connectionLost, 1, nil, 2},
+		{"serialization failure", &pgconn.PgError{Code: "40001"}, 1, nil, 2},
+		{"retries used up", connectionLost, 10, connectionLost, 3},
+		{"no rows", pgx.ErrNoRows, 1, pgx.ErrNoRows, 1},
+		{"unique violation", &pgconn.PgError{Code: "23505"}, 1, &pgconn.PgError{Code: "23505"}, 1},
+		{"timeout", context.DeadlineExceeded, 1, context.DeadlineExceeded, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &flakyDB{err: tt.err, failures: tt.failures}
+			var retries []int
+			models := newModels(db, Passwords{}).WithRetries(RetryPolicy{
+				Retries: 2,
+				Backoff: time.Millisecond,
+				OnRetry: func(err error, attempt int) { retries = append(retries, attempt) },
+			})
+
+			err := models.Movies.DB.QueryRow(context.Background(), "SELECT 1").Scan()
+			switch {
+			case tt.wantErr == nil && err != nil:
+				t.Errorf("got error %v", err)
+			case tt.wantErr != nil && (err == nil || err.Error() != tt.wantErr.Error()):
+				t.Errorf("got error %v; want %v", err, tt.wantErr)
+			}
+			if db.attempts != tt.wantAttempts {
+				t.Errorf("got %d attempts; want %d", db.attempts, tt.wantAttempts)
+			}
+			if len(retries) != tt.wantAttempts-1 {
+				t.Errorf("got %d retries logged; want %d", len(retries), tt.wantAttempts-1)
+			}
+		})
+	}
+}
+
+func TestRetryingDBNeverRetriesWrites(t *testing.T) {
+	db := &flakyDB{err: &pgconn.PgError{Code: "08006"}, failures: 1}
+	models := newModels(db, Passwords{}).WithRetries(RetryPolicy{Retries: 2, Backoff: time.Millisecond})
+
+	_, err := models.Movies.DB.Exec(context.Background(), "UPDATE movies SET title = 'x'")
+	if !errors.Is(err, db.err) {
+		t.Errorf("got error %v; want %v", err, db.err)
+	}
+	if db.attempts != 1 {
+		t.Errorf("got %d attempts; want 1", db.attempts)
+	}
+}
@@ -0,0 +1,78 @@
+package data
+
+import (
+	"context"
+)
+
+// A Role is a named set of permissions which can be granted to a user in one go.
+// Assigning a role grants its permissions individually; users don't hold roles as such.
+type Role struct {
+	Name        string   `json:"name"`
+	Permissions []string `json:"permissions"`
+}
+
+type RoleModel struct {
+	DB DBTX
+}
+
+// GetAll returns every role with its permissions, ordered by name.
+func (m RoleModel) GetAll() ([]*Role, error) {
+
+	query := `SELECT roles.name, COALESCE(array_agg(permissions.code ORDER BY permissions.code) FILTER (WHERE permissions.code IS NOT NULL), '{}')
+			FROM roles
+			LEFT JOIN roles_permissions ON roles_permissions.role_id = roles.id
+			LEFT JOIN permissions ON roles_permissions.permission_id = permissions.id
+			GROUP BY roles.name
+			ORDER BY roles.name`
+
+	ctx := context.Background()
+
+	rows, err := m.DB.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []*Role{}
+	for rows.Next() {
+		var role Role
+		err := rows.Scan(&role.Name, &role.Permissions)
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, &role)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+// AssignToUser grants the user every permission in the named role, returning
+// ErrRecordNotFound if there's no such role. Permissions the user already holds are
+// left as they are.
+func (m RoleModel) AssignToUser(userID int64, name string) error {
+
+	query := `WITH role AS (
+				SELECT id FROM roles WHERE name = $2
+			), granted AS (
+				INSERT INTO users_permissions
+				SELECT $1, roles_permissions.permission_id
+				FROM roles_permissions
+				WHERE roles_permissions.role_id IN (SELECT id FROM role)
+				ON CONFLICT DO NOTHING
+			)
+			SELECT count(*) FROM role`
+
+	ctx := context.Background()
+
+	var found int
+	err := m.DB.QueryRow(ctx, query, userID, name).Scan(&found)
+	if err != nil {
+		return err
+	}
+	if found == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
@@ -3,26 +3,75 @@ package data
 import (
 	"errors"
 	"fmt"
+	"math"
+	"regexp"
 	"strconv"
 	"strings"
 )
 
 var ErrInvalidRuntimeFormat = errors.New("invalid runtime format")
 
+// RuntimeFormat selects how runtimes are rendered: "mins" ("107 mins") or "hms"
+// ("1h 47m"). It's set once at startup, before any responses are written.
+var RuntimeFormat = "mins"
+
+var runtimeHMRX = regexp.MustCompile(`^(?:(\d+)h)? ?(?:(\d+)m)?$`)
+
 type Runtime int32
 
 func (r Runtime) MarshalJSON() ([]byte, error) {
 	jsonValue := fmt.Sprintf("%d mins", r)
+	if RuntimeFormat == "hms" {
+		jsonValue = r.hm()
+	}
 	quotedJSONValue := strconv.Quote(jsonValue)
 	return []byte(quotedJSONValue), nil
 }
 
+// hm renders the runtime in hours and minutes, omitting a zero component.
+func (r Runtime) hm() string {
+	hours, minutes := r/60, r%60
+	switch {
+	case hours == 0:
+		return fmt.Sprintf("%dm", minutes)
+	case minutes == 0:
+		return fmt.Sprintf("%dh", hours)
+	default:
+		return fmt.Sprintf("%dh %dm", hours, minutes)
+	}
+}
+
 func (r *Runtime) UnmarshalJSON(jsonValue []byte) error {
 	// We expect the incoming JSON value to be a string in the format "<runtime> mins",
+	// or in hours and minutes such as "1h 47m".
 	unquotedJSONValue, err := strconv.Unquote(string(jsonValue))
 	if err != nil {
 		return ErrInvalidRuntimeFormat
 	}
+
+	if match := runtimeHMRX.FindStringSubmatch(unquotedJSONValue); match != nil && unquotedJSONValue != "" {
+		var minutes int64
+		if match[1] != "" {
+			hours, err := strconv.ParseInt(match[1], 10, 32)
+			if err != nil {
+				return ErrInvalidRuntimeFormat
+			}
+			minutes = hours * 60
+		}
+		if match[2] != "" {
+			m, err := strconv.ParseInt(match[2], 10, 32)
+			if err != nil {
+				return ErrInvalidRuntimeFormat
+			}
+			minutes += m
+		}
+		if minutes > math.MaxInt32 {
+			return ErrInvalidRuntimeFormat
+		}
+		*r = Runtime(minutes)
+		return nil
+	}
+
 	// Split the string to isolate the part containing the number.
 	parts := strings.Split(unquotedJSONValue, " ")
 	if len(parts) != 2 || parts[1] != "mins" {
@@ -0,0 +1,102 @@
+package data
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+// setRuntimeFormat sets RuntimeFormat for the duration of the test.
+func setRuntimeFormat(t *testing.T, format string) {
+	t.Helper()
+
+	previous := RuntimeFormat
+	RuntimeFormat = format
+	t.Cleanup(func() { RuntimeFormat = previous })
+}
+
+func TestRuntimeMarshalJSON(t *testing.T) {
+	tests := []struct {
+		runtime Runtime
+		mins    string
+		hms     string
+	}{
+		{45, `"45 mins"`, `"45m"`},
+		{60, `"60 mins"`, `"1h"`},
+		{107, `"107 mins"`, `"1h 47m"`},
+		{180, `"180 mins"`, `"3h"`},
+	}
+
+	for _, format := range []string{"mins", "hms"} {
+		setRuntimeFormat(t, format)
+
+		for _, tt := range tests {
+			want := tt.mins
+			if format == "hms" {
+				want = tt.hms
+			}
+
+			got, err := json.Marshal(tt.runtime)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != want {
+				t.Errorf("%s: got %s for %d; want %s", format, got, tt.runtime, want)
+			}
+		}
+	}
+}
+
+func TestRuntimeUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    Runtime
+		wantErr bool
+	}{
+		{`"107 mins"`, 107, false},
+		{`"1h 47m"`, 107, false},
+		{`"1h47m"`, 107, false},
+		{`"2h"`, 120, false},
+		{`"45m"`, 45, false},
+		{`107`, 0, true},
+		{`""`, 0, true},
+		{`"107"`, 0, true},
+		{`"107 minutes"`, 0, true},
+		{`"1h 47"`, 0, true},
+		{`"99999999999h"`, 0, true},
+	}
+
+	for _, tt := range tests {
+		var got Runtime
+		err := json.Unmarshal([]byte(tt.input), &got)
+		switch {
+		case tt.wantErr && !errors.Is(err, ErrInvalidRuntimeFormat):
+			t.Errorf("%s: got error %v; want ErrInvalidRuntimeFormat", tt.input, err)
+		case !tt.wantErr && err != nil:
+			t.Errorf("%s: got error %v", tt.input, err)
+		case got != tt.want:
+			t.Errorf("%s: got %d; want %d", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestRuntimeRoundTrip(t *testing.T) {
+	for _, format := range []string{"mins", "hms"} {
+		setRuntimeFormat(t, format)
+
+		for _, runtime := range []Runtime{1, 59, 60, 61, 107, 120, 600, 1439} {
+			js, err := json.Marshal(runtime)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got Runtime
+			err = json.Unmarshal(js, &got)
+			if err != nil {
+				t.Errorf("%s: %s doesn't unmarshal: %v", format, js, err)
+			} else if got != runtime {
+				t.Errorf("%s: %d became %s, then %d", format, runtime, js, got)
+			}
+		}
+	}
+}
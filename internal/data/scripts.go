@@ -0,0 +1,176 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+var ErrInvalidScriptEncoding = errors.New("script must be valid UTF-8 text without NUL bytes")
+
+// isForeignKeyViolation reports whether err is a foreign key violation (SQLSTATE 23503).
+func isForeignKeyViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23503"
+}
+
+// ScriptModel stores the scripts of movies, which may be too large to hold in memory
+// and so are written and read in chunks. Each chunk is stored as a row of its own, so
+// that adding one doesn't rewrite those before it.
+type ScriptModel struct {
+	DB DBTX
+}
+
+// scriptStreamTimeout bounds the single query which streams a script back, which has
+// to outlast the client reading it.
+const scriptStreamTimeout = 5 * time.Minute
+
+// Save replaces the script of a movie with the contents of r, storing it chunkSize
+// bytes at a time. It must be called within a transaction, so that a failed upload
+// leaves the previous script in place. It returns the number of bytes stored.
+func (m ScriptModel) Save(movieID int64, r io.Reader, chunkSize int) (int64, error) {
+
+	query := `INSERT INTO movie_scripts (movie_id)
+			VALUES ($1)
+			ON CONFLICT (movie_id) DO UPDATE
+			SET updated_at = NOW()`
+
+	ctx := context.Background()
+	_, err := m.DB.Exec(ctx, query, movieID)
+	if err != nil {
+		if isForeignKeyViolation(err) {
+			return 0, ErrRecordNotFound
+		}
+		return 0, err
+	}
+
+	query = `DELETE FROM movie_script_chunks
+			WHERE movie_id = $1`
+
+	_, err = m.DB.Exec(ctx, query, movieID)
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		total int64
+		seq   int
+		carry []byte
+		buf   = make([]byte, chunkSize)
+	)
+	for {
+		n, readErr := io.ReadFull(r, buf)
+		if readErr != nil && !errors.Is(readErr, io.EOF) && !errors.Is(readErr, io.ErrUnexpectedEOF) {
+			return 0, readErr
+		}
+
+		chunk := append(carry, buf[:n]...)
+		carry = nil
+
+		// Hold back a rune split across the chunk boundary until the next read.
+		if readErr == nil {
+			cut := incompleteRuneStart(chunk)
+			carry = append([]byte(nil), chunk[cut:]...)
+			chunk = chunk[:cut]
+		}
+
+		if !utf8.Valid(chunk) || bytes.IndexByte(chunk, 0) >= 0 {
+			return 0, ErrInvalidScriptEncoding
+		}
+
+		if len(chunk) > 0 {
+			err := m.insertChunk(movieID, seq, chunk)
+			if err != nil {
+				return 0, err
+			}
+			total += int64(len(chunk))
+			seq++
+		}
+
+		if readErr != nil {
+			return total, nil
+		}
+	}
+}
+
+func (m ScriptModel) insertChunk(movieID int64, seq int, chunk []byte) error {
+
+	query := `INSERT INTO movie_script_chunks (movie_id, seq, content)
+			VALUES ($1, $2, $3)`
+
+	ctx := context.Background()
+
+	_, err := m.DB.Exec(ctx, query, movieID, seq, string(chunk))
+	return err
+}
+
+// incompleteRuneStart returns the index at which an incomplete UTF-8 sequence at the
+// end of b begins, or len(b) if b ends on a rune boundary.
+func incompleteRuneStart(b []byte) int {
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if !utf8.FullRune(b[i:]) {
+				return i
+			}
+			break
+		}
+	}
+	return len(b)
+}
+
+// Stream writes a movie's script to w a chunk at a time. The script is read by a single
+// query, so its size and content come from the same snapshot: start is called with the
+// size in bytes before any of the content is written. It returns ErrRecordNotFound,
+// without calling start, if the movie has no script or has been deleted.
+func (m ScriptModel) Stream(movieID int64, w io.Writer, start func(size int64)) error {
+
+	query := `SELECT COALESCE(movie_script_chunks.content, ''),
+				COALESCE(sum(octet_length(movie_script_chunks.content)) OVER (), 0)
+			FROM movie_scripts
+			INNER JOIN movies ON movies.id = movie_scripts.movie_id
+			LEFT JOIN movie_script_chunks ON movie_script_chunks.movie_id = movie_scripts.movie_id
+			WHERE movie_scripts.movie_id = $1 AND movies.deleted_at IS NULL
+			ORDER BY movie_script_chunks.seq`
+
+	ctx := withQueryTimeout(context.Background(), scriptStreamTimeout)
+
+	rows, err := m.DB.Query(ctx, query, movieID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	started := false
+	for rows.Next() {
+		var (
+			chunk string
+			size  int64
+		)
+		err := rows.Scan(&chunk, &size)
+		if err != nil {
+			return err
+		}
+
+		if !started {
+			start(size)
+			started = true
+		}
+
+		_, err = io.WriteString(w, chunk)
+		if err != nil {
+			return err
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	if !started {
+		return ErrRecordNotFound
+	}
+	return nil
+}
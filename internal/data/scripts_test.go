@@ -0,0 +1,81 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// chunkDB is a DBTX which records the script chunks inserted through it.
+type chunkDB struct {
+	chunks []string
+}
+
+func (db *chunkDB) Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error) {
+	if strings.Contains(sql, "INSERT INTO movie_script_chunks") {
+		if seq := args[1].(int); seq != len(db.chunks) {
+			return pgconn.CommandTag{}, errors.New("chunk out of sequence")
+		}
+		db.chunks = append(db.chunks, args[2].(string))
+	}
+	return pgconn.NewCommandTag("INSERT 0 1"), nil
+}
+
+func (db *chunkDB) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+	panic("unexpected query")
+}
+
+func (db *chunkDB) QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+	panic("unexpected query")
+}
+
+func TestScriptSaveChunks(t *testing.T) {
+	const chunkSize = 16
+
+	tests := []struct {
+		name   string
+		script string
+	}{
+		{"empty", ""},
+		{"shorter than a chunk", "FADE IN:"},
+		{"exact chunks", strings.Repeat("x", 2*chunkSize)},
+		{"rune split across chunks", strings.Repeat("x", chunkSize-1) + "é" + strings.Repeat("y", chunkSize)},
+		{"four-byte runes", strings.Repeat("🎬", 20)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &chunkDB{}
+			size, err := ScriptModel{DB: db}.Save(1, strings.NewReader(tt.script), chunkSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if size != int64(len(tt.script)) {
+				t.Errorf("got size %d; want %d", size, len(tt.script))
+			}
+			if got := strings.Join(db.chunks, ""); got != tt.script {
+				t.Errorf("chunks join to %q; want %q", got, tt.script)
+			}
+			for i, chunk := range db.chunks {
+				if !utf8.ValidString(chunk) || len(chunk) > chunkSize+utf8.UTFMax {
+					t.Errorf("chunk %d is %q", i, chunk)
+				}
+			}
+		})
+	}
+}
+
+func TestScriptSaveInvalidEncoding(t *testing.T) {
+	for _, script := range []string{"FADE IN \xff", "FADE\x00IN", strings.Repeat("x", 40) + "\xc3"} {
+		_, err := ScriptModel{DB: &chunkDB{}}.Save(1, strings.NewReader(script), 16)
+		if !errors.Is(err, ErrInvalidScriptEncoding) {
+			t.Errorf("%q: got error %v; want %v", script, err, ErrInvalidScriptEncoding)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package data
+
+import (
+	"context"
+)
+
+type Stats struct {
+	TotalUsers        int `json:"total_users"`
+	ActivatedUsers    int `json:"activated_users"`
+	TotalMovies       int `json:"total_movies"`
+	MoviesLast7Days   int `json:"movies_last_7_days"`
+	MoviesLast30Days  int `json:"movies_last_30_days"`
+	TokensIssuedToday int `json:"tokens_issued_today"`
+}
+
+type StatsModel struct {
+	DB DBTX
+}
+
+// Get computes the aggregate counts with a single round-trip. Tokens issued today
+// only counts tokens which still exist, since used and expired ones are deleted.
+func (m StatsModel) Get() (*Stats, error) {
+
+	query := `SELECT
+				(SELECT count(*) FROM users),
+				(SELECT count(*) FROM users WHERE activated),
+				(SELECT count(*) FROM movies WHERE deleted_at IS NULL),
+				(SELECT count(*) FROM movies WHERE deleted_at IS NULL AND created_at > now() - interval '7 days'),
+				(SELECT count(*) FROM movies WHERE deleted_at IS NULL AND created_at > now() - interval '30 days'),
+				(SELECT count(*) FROM tokens WHERE created_at >= date_trunc('day', now()))`
+
+	var stats Stats
+
+	ctx := context.Background()
+
+	err := m.DB.QueryRow(ctx, query).Scan(
+		&stats.TotalUsers,
+		&stats.ActivatedUsers,
+		&stats.TotalMovies,
+		&stats.MoviesLast7Days,
+		&stats.MoviesLast30Days,
+		&stats.TokensIssuedToday,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &stats, nil
+}
@@ -0,0 +1,180 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var (
+	// ErrAcquireTimeout means no pooled connection became free in time, so the query
+	// was never sent.
+	ErrAcquireTimeout = errors.New("timed out waiting for a database connection")
+	// ErrQueryTimeout means a query was sent but didn't finish in time. It wraps the
+	// error returned by the driver.
+	ErrQueryTimeout = errors.New("database query timed out")
+)
+
+// Timeouts bounds the two stages of running a query separately, so that a busy pool
+// fails fast without cutting short queries which have got a connection.
+type Timeouts struct {
+	// Acquire is how long to wait for a connection from the pool.
+	Acquire time.Duration
+	// Query is how long a query may run once it has a connection, replacing any
+	// deadline set by the caller. A query run with a context from withQueryTimeout
+	// gets that timeout instead.
+	Query time.Duration
+}
+
+// DefaultTimeouts are the timeouts NewModels starts with.
+var DefaultTimeouts = Timeouts{Acquire: time.Second, Query: 3 * time.Second}
+
+type queryTimeoutKey struct{}
+
+// withQueryTimeout returns a context which gives the queries run with it timeout to
+// run, in place of Timeouts.Query, for the few which legitimately take longer.
+func withQueryTimeout(ctx context.Context, timeout time.Duration) context.Context {
+	return context.WithValue(ctx, queryTimeoutKey{}, timeout)
+}
+
+// timedDB runs queries under Timeouts. Outside a transaction it acquires a connection
+// explicitly, holding it until the query's rows are closed; inside one, pool is nil and
+// only the query timeout applies, as the transaction already holds its connection.
+type timedDB struct {
+	DBTX
+	pool     *pgxpool.Pool
+	timeouts Timeouts
+}
+
+// start returns the connection to run a query on, and a context with a fresh query
+// deadline. The returned function must be called once the query is finished with.
+func (d timedDB) start(ctx context.Context) (DBTX, context.Context, func(), error) {
+	var db DBTX = d.DBTX
+	release := func() {}
+
+	if d.pool != nil {
+		conn, err := acquire(ctx, d.pool, d.timeouts.Acquire)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		db, release = conn, conn.Release
+	}
+
+	timeout := d.timeouts.Query
+	if t, ok := ctx.Value(queryTimeoutKey{}).(time.Duration); ok {
+		timeout = t
+	}
+
+	queryCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), timeout)
+	return db, queryCtx, func() {
+		cancel()
+		release()
+	}, nil
+}
+
+// acquire gets a connection from the pool, waiting at most timeout for one.
+func acquire(ctx context.Context, pool *pgxpool.Pool, timeout time.Duration) (*pgxpool.Conn, error) {
+	acquireCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	conn, err := pool.Acquire(acquireCtx)
+	if err != nil && errors.Is(acquireCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+		return nil, ErrAcquireTimeout
+	}
+	return conn, err
+}
+
+// beginTimed starts a transaction, waiting at most the acquire timeout for its
+// connection. The BEGIN itself shares that deadline, as it's trivial next to the wait;
+// the pool releases the connection when the transaction ends.
+func beginTimed(ctx context.Context, pool *pgxpool.Pool, timeouts Timeouts) (pgx.Tx, error) {
+	beginCtx, cancel := context.WithTimeout(ctx, timeouts.Acquire)
+	defer cancel()
+
+	tx, err := pool.Begin(beginCtx)
+	if err != nil && errors.Is(beginCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+		return nil, ErrAcquireTimeout
+	}
+	return tx, err
+}
+
+// queryError marks err as a query timeout if the query's deadline has passed.
+func queryError(ctx context.Context, err error) error {
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %w", ErrQueryTimeout, err)
+	}
+	return err
+}
+
+func (d timedDB) Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error) {
+	db, queryCtx, done, err := d.start(ctx)
+	if err != nil {
+		return pgconn.CommandTag{}, err
+	}
+	defer done()
+
+	tag, err := db.Exec(queryCtx, sql, args...)
+	return tag, queryError(queryCtx, err)
+}
+
+func (d timedDB) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+	db, queryCtx, done, err := d.start(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(queryCtx, sql, args...)
+	if err != nil {
+		done()
+		return nil, queryError(queryCtx, err)
+	}
+	return &timedRows{Rows: rows, ctx: queryCtx, done: done}, nil
+}
+
+func (d timedDB) QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+	return timedRow{db: d, ctx: ctx, sql: sql, args: args}
+}
+
+// timedRows holds the connection and the query deadline until the rows are closed.
+type timedRows struct {
+	pgx.Rows
+	ctx    context.Context
+	done   func()
+	closed bool
+}
+
+func (r *timedRows) Close() {
+	r.Rows.Close()
+	if !r.closed {
+		r.closed = true
+		r.done()
+	}
+}
+
+func (r *timedRows) Err() error {
+	return queryError(r.ctx, r.Rows.Err())
+}
+
+// timedRow defers running the query until Scan, as QueryRow only reports errors from
+// there.
+type timedRow struct {
+	db   timedDB
+	ctx  context.Context
+	sql  string
+	args []interface{}
+}
+
+func (r timedRow) Scan(dest ...interface{}) error {
+	db, queryCtx, done, err := r.db.start(r.ctx)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	return queryError(queryCtx, db.QueryRow(queryCtx, r.sql, r.args...).Scan(dest...))
+}
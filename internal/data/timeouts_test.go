@@ -0,0 +1,107 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// slowDB is a DBTX whose statements take delay to run, failing with the context's
+// error if it's done first, as the driver would.
+type slowDB struct {
+	delay time.Duration
+}
+
+func (db slowDB) run(ctx context.Context) error {
+	select {
+	case <-time.After(db.delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (db slowDB) Exec(ctx context.Context, sql string, arguments ...interface{}) (pgconn.CommandTag, error) {
+	return pgconn.NewCommandTag("SELECT 1"), db.run(ctx)
+}
+
+func (db slowDB) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+	panic("unexpected query")
+}
+
+func (db slowDB) QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+	return errRow{db.run(ctx)}
+}
+
+func TestTimedDBQueryTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		delay   time.Duration
+		wantErr bool
+	}{
+		{"within the timeout", 10 * time.Millisecond, false},
+		{"past the timeout", time.Second, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// With no pool, as in a transaction, only the query timeout applies.
+			db := timedDB{DBTX: slowDB{tt.delay}, timeouts: Timeouts{Acquire: time.Hour, Query: 100 * time.Millisecond}}
+
+			_, execErr := db.Exec(context.Background(), "SELECT 1")
+			scanErr := db.QueryRow(context.Background(), "SELECT 1").Scan()
+
+			for _, err := range []error{execErr, scanErr} {
+				switch {
+				case !tt.wantErr && err != nil:
+					t.Errorf("got error %v", err)
+				case tt.wantErr && !(errors.Is(err, ErrQueryTimeout) && errors.Is(err, context.DeadlineExceeded)):
+					t.Errorf("got error %v; want a query timeout wrapping the deadline", err)
+				case errors.Is(err, ErrAcquireTimeout):
+					t.Errorf("got an acquire timeout without a pool: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestTimedDBReplacesCallerDeadline(t *testing.T) {
+	db := timedDB{DBTX: slowDB{50 * time.Millisecond}, timeouts: Timeouts{Acquire: time.Hour, Query: time.Second}}
+
+	// The query timeout replaces the caller's shorter deadline.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err := db.Exec(ctx, "SELECT 1")
+	if err != nil {
+		t.Errorf("got error %v; want the query to run to completion", err)
+	}
+}
+
+func TestTimedDBOtherErrors(t *testing.T) {
+	db := timedDB{DBTX: errDB{pgx.ErrNoRows}, timeouts: Timeouts{Acquire: time.Hour, Query: time.Second}}
+
+	err := db.QueryRow(context.Background(), "SELECT 1").Scan()
+	if !errors.Is(err, pgx.ErrNoRows) || errors.Is(err, ErrQueryTimeout) {
+		t.Errorf("got error %v; want %v as it is", err, pgx.ErrNoRows)
+	}
+}
+
+func TestTimedDBLongerQueryTimeout(t *testing.T) {
+	db := timedDB{DBTX: slowDB{200 * time.Millisecond}, timeouts: Timeouts{Acquire: time.Hour, Query: 100 * time.Millisecond}}
+
+	// A query given its own, longer timeout runs past Timeouts.Query.
+	_, err := db.Exec(withQueryTimeout(context.Background(), time.Second), "SELECT 1")
+	if err != nil {
+		t.Errorf("got error %v; want the query to run to completion", err)
+	}
+
+	_, err = db.Exec(context.Background(), "SELECT 1")
+	if !errors.Is(err, ErrQueryTimeout) {
+		t.Errorf("got error %v; want %v", err, ErrQueryTimeout)
+	}
+}
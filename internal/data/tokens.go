@@ -5,23 +5,192 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base32"
+	"errors"
+	"fmt"
+	"strings"
 	"time"
 
-	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jackc/pgx/v5"
 	"greenlight.yp2743.me/internal/validator"
 )
 
 const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication"
+	ScopeRefresh        = "refresh"
+	ScopePasswordReset  = "password-reset"
+	ScopeEmailChange    = "email-change"
+	ScopeNonce          = "nonce"
 )
 
+var (
+	ErrUnknownScope = errors.New("unknown token scope")
+	ErrTokenReused  = errors.New("refresh token reused")
+)
+
+// scopeSunsets is the registry of token scopes. A scope with a non-zero sunset is
+// deprecated: its tokens are still accepted until the sunset, and rejected after.
+var scopeSunsets = map[string]time.Time{
+	ScopeActivation:     {},
+	ScopeAuthentication: {},
+	ScopeRefresh:        {},
+	ScopePasswordReset:  {},
+	ScopeEmailChange:    {},
+	ScopeNonce:          {},
+}
+
+// DeprecateScope marks a scope as deprecated, to be sunset at the given time.
+func DeprecateScope(scope string, sunset time.Time) error {
+	if _, ok := scopeSunsets[scope]; !ok {
+		return ErrUnknownScope
+	}
+	scopeSunsets[scope] = sunset
+	return nil
+}
+
+// ScopeSunset returns the sunset time of a scope, and whether it is deprecated.
+func ScopeSunset(scope string) (time.Time, bool) {
+	sunset := scopeSunsets[scope]
+	return sunset, !sunset.IsZero()
+}
+
+// Scopes returns every registered token scope, in no particular order.
+func Scopes() []string {
+	scopes := make([]string, 0, len(scopeSunsets))
+	for scope := range scopeSunsets {
+		scopes = append(scopes, scope)
+	}
+	return scopes
+}
+
+// scopeTTLs is the default lifetime of tokens in each scope, used by NewForScope.
+var scopeTTLs = map[string]time.Duration{
+	ScopeActivation:     3 * 24 * time.Hour,
+	ScopeAuthentication: 24 * time.Hour,
+	ScopeRefresh:        30 * 24 * time.Hour,
+	ScopePasswordReset:  45 * time.Minute,
+	ScopeEmailChange:    24 * time.Hour,
+	ScopeNonce:          5 * time.Minute,
+}
+
+// SetScopeTTL sets the default lifetime of tokens in a scope. It must be called before
+// any requests are served.
+func SetScopeTTL(scope string, ttl time.Duration) error {
+	if _, ok := scopeSunsets[scope]; !ok {
+		return ErrUnknownScope
+	}
+	scopeTTLs[scope] = ttl
+	return nil
+}
+
+// ScopeTTL returns the default lifetime of tokens in a scope.
+func ScopeTTL(scope string) time.Duration {
+	return scopeTTLs[scope]
+}
+
 type Token struct {
 	Plaintext string    `json:"token"`
-	Hash      []byte    `json:"-"`
+	Hash      []byte    `json:"-" sensitive:"true"`
 	UserID    int64     `json:"-"`
 	Expiry    time.Time `json:"expiry"`
 	Scope     string    `json:"-"`
+	CreatedAt time.Time `json:"-"`
+	IP        string    `json:"-"`
+	UserAgent string    `json:"-"`
+
+	// ImpersonatorID is the ID of the admin the token was issued to when it lets them
+	// act as UserID, and 0 for ordinary tokens.
+	ImpersonatorID int64 `json:"-"`
+
+	// Family links the tokens descended from one login through refresh token rotation.
+	// It's the hash of the first refresh token in the chain, and nil for tokens issued
+	// outside it. Rotated is set once a refresh token has been exchanged.
+	Family  []byte `json:"-"`
+	Rotated bool   `json:"-"`
+}
+
+// TokenMetadata describes a token without its plaintext or hash, for listing tokens
+// back to their owner or an admin.
+type TokenMetadata struct {
+	UserID         ID        `json:"user_id"`
+	Scope          string    `json:"scope"`
+	CreatedAt      time.Time `json:"created_at"`
+	Expiry         time.Time `json:"expiry"`
+	IP             string    `json:"ip,omitempty"`
+	UserAgent      string    `json:"user_agent,omitempty"`
+	Device         string    `json:"device,omitempty"`
+	ImpersonatorID ID        `json:"impersonator_id,omitempty"`
+}
+
+func (t *Token) Metadata() TokenMetadata {
+	return TokenMetadata{
+		UserID:         ID(t.UserID),
+		Scope:          t.Scope,
+		CreatedAt:      t.CreatedAt,
+		Expiry:         t.Expiry,
+		IP:             t.IP,
+		UserAgent:      t.UserAgent,
+		Device:         deviceName(t.UserAgent),
+		ImpersonatorID: ID(t.ImpersonatorID),
+	}
+}
+
+// Browsers and platforms recognised by deviceName, in the order they're checked. Order
+// matters as most User-Agent strings also name the browsers they're derived from.
+var (
+	userAgentBrowsers = []struct{ token, name string }{
+		{"Edg/", "Edge"},
+		{"OPR/", "Opera"},
+		{"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"},
+		{"Safari/", "Safari"},
+		{"curl/", "curl"},
+	}
+	userAgentPlatforms = []struct{ token, name string }{
+		{"Android", "Android"},
+		{"iPhone", "iOS"},
+		{"iPad", "iOS"},
+		{"Windows", "Windows"},
+		{"Mac OS X", "macOS"},
+		{"Linux", "Linux"},
+	}
+)
+
+// deviceName summarises a User-Agent header as a browser and platform, such as
+// "Firefox on Windows", or returns "" if neither is recognised.
+func deviceName(userAgent string) string {
+	var browser, platform string
+	for _, b := range userAgentBrowsers {
+		if strings.Contains(userAgent, b.token) {
+			browser = b.name
+			break
+		}
+	}
+	for _, p := range userAgentPlatforms {
+		if strings.Contains(userAgent, p.token) {
+			platform = p.name
+			break
+		}
+	}
+
+	switch {
+	case browser != "" && platform != "":
+		return browser + " on " + platform
+	case browser != "":
+		return browser
+	default:
+		return platform
+	}
+}
+
+// TokenFilter selects the tokens listed by GetAll. Zero values leave a field
+// unfiltered, and a nil bound leaves that end of the expiry window open.
+type TokenFilter struct {
+	Scope         string
+	UserID        int64
+	Expired       *bool
+	ExpiresAfter  *time.Time
+	ExpiresBefore *time.Time
 }
 
 func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error) {
@@ -52,39 +221,427 @@ func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
 }
 
 type TokenModel struct {
-	DB *pgxpool.Pool
+	DB DBTX
 }
 
 func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token, error) {
+	return m.NewWithBinding(userID, ttl, scope, "", "")
+}
+
+// NewForScope creates a token with the default lifetime of its scope.
+func (m TokenModel) NewForScope(userID int64, scope string) (*Token, error) {
+	return m.New(userID, ScopeTTL(scope), scope)
+}
+
+// NewWithBinding creates a token which records the IP address and user-agent of the
+// client it was issued to, so that later use can be checked against them.
+func (m TokenModel) NewWithBinding(userID int64, ttl time.Duration, scope, ip, userAgent string) (*Token, error) {
 	token, err := generateToken(userID, ttl, scope)
 	if err != nil {
 		return nil, err
 	}
+	token.IP = ip
+	token.UserAgent = userAgent
+
 	err = m.Insert(token)
 	return token, err
 }
 
+// NewImpersonation creates an authentication token which lets the admin identified by
+// impersonatorID act as the user.
+func (m TokenModel) NewImpersonation(userID, impersonatorID int64, ttl time.Duration) (*Token, error) {
+	token, err := generateToken(userID, ttl, ScopeAuthentication)
+	if err != nil {
+		return nil, err
+	}
+	token.ImpersonatorID = impersonatorID
+
+	err = m.Insert(token)
+	return token, err
+}
+
+// NewRefreshPair creates an authentication token and a refresh token bound to the
+// client, each with the default lifetime of its scope. The tokens join the given
+// family, or start a new one if family is nil.
+func (m TokenModel) NewRefreshPair(userID int64, family []byte, ip, userAgent string) (*Token, *Token, error) {
+	refresh, err := generateToken(userID, ScopeTTL(ScopeRefresh), ScopeRefresh)
+	if err != nil {
+		return nil, nil, err
+	}
+	if family == nil {
+		family = refresh.Hash
+	}
+	refresh.Family, refresh.IP, refresh.UserAgent = family, ip, userAgent
+
+	access, err := generateToken(userID, ScopeTTL(ScopeAuthentication), ScopeAuthentication)
+	if err != nil {
+		return nil, nil, err
+	}
+	access.Family, access.IP, access.UserAgent = family, ip, userAgent
+
+	err = m.Insert(refresh)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = m.Insert(access)
+	if err != nil {
+		return nil, nil, err
+	}
+	return access, refresh, nil
+}
+
+// NewEmailChange creates a token confirming a change of the user's email address to
+// email. The new address is held against the token until it's confirmed, so the user
+// keeps their current address in the meantime.
+func (m TokenModel) NewEmailChange(userID int64, email string) (*Token, error) {
+	token, err := m.NewForScope(userID, ScopeEmailChange)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `INSERT INTO email_changes (token_hash, email)
+			VALUES ($1, $2)`
+
+	ctx := context.Background()
+
+	_, err = m.DB.Exec(ctx, query, token.Hash, email)
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// GetPendingEmail returns the new email address held against an unexpired email
+// change token.
+func (m TokenModel) GetPendingEmail(tokenPlaintext string) (string, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `SELECT email_changes.email
+			FROM email_changes
+			INNER JOIN tokens
+			ON tokens.hash = email_changes.token_hash
+			WHERE tokens.hash = $1
+			AND tokens.scope = $2
+			AND tokens.expiry > $3`
+
+	ctx := context.Background()
+
+	var email string
+	err := m.DB.QueryRow(ctx, query, tokenHash[:], ScopeEmailChange, time.Now()).Scan(&email)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return "", ErrRecordNotFound
+		default:
+			return "", err
+		}
+	}
+	return email, nil
+}
+
 func (m TokenModel) Insert(token *Token) error {
 
-	query := `INSERT INTO tokens (hash, user_id, expiry, scope)
-			VALUES ($1, $2, $3, $4)`
+	query := `INSERT INTO tokens (hash, user_id, expiry, scope, ip, user_agent, impersonator_id, family)
+			VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, 0), $8)`
 
-	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope}
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope, token.IP, token.UserAgent, token.ImpersonatorID, token.Family}
+	ctx := context.Background()
 
 	_, err := m.DB.Exec(ctx, query, args...)
 	return err
 }
 
+// Consume deletes the user's unexpired token of the scope, so that it can only be used
+// once. It returns ErrRecordNotFound if there was no such token, including when it had
+// already been used.
+func (m TokenModel) Consume(tokenScope, tokenPlaintext string, userID int64) error {
+
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `DELETE FROM tokens
+			WHERE hash = $1
+			AND scope = $2
+			AND user_id = $3
+			AND expiry > $4`
+
+	ctx := context.Background()
+
+	result, err := m.DB.Exec(ctx, query, tokenHash[:], tokenScope, userID, time.Now())
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+func (m TokenModel) Get(tokenScope, tokenPlaintext string) (*Token, error) {
+
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `SELECT hash, user_id, expiry, scope, created_at, ip, user_agent, COALESCE(impersonator_id, 0)
+			FROM tokens
+			WHERE hash = $1
+			AND scope = $2
+			AND expiry > $3`
+
+	args := []interface{}{tokenHash[:], tokenScope, time.Now()}
+	var token Token
+	ctx := context.Background()
+
+	err := m.DB.QueryRow(ctx, query, args...).Scan(
+		&token.Hash,
+		&token.UserID,
+		&token.Expiry,
+		&token.Scope,
+		&token.CreatedAt,
+		&token.IP,
+		&token.UserAgent,
+		&token.ImpersonatorID,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &token, nil
+}
+
+// GetRefresh fetches an unexpired refresh token, including one which has already been
+// rotated, so that its reuse can be detected.
+func (m TokenModel) GetRefresh(tokenPlaintext string) (*Token, error) {
+
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `SELECT hash, user_id, expiry, created_at, ip, user_agent, family, rotated_at IS NOT NULL
+			FROM tokens
+			WHERE hash = $1
+			AND scope = $2
+			AND expiry > $3`
+
+	token := Token{Scope: ScopeRefresh}
+	ctx := context.Background()
+
+	err := m.DB.QueryRow(ctx, query, tokenHash[:], ScopeRefresh, time.Now()).Scan(
+		&token.Hash,
+		&token.UserID,
+		&token.Expiry,
+		&token.CreatedAt,
+		&token.IP,
+		&token.UserAgent,
+		&token.Family,
+		&token.Rotated,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &token, nil
+}
+
+// Rotate marks a refresh token as exchanged. The row is kept until it expires so that
+// a later attempt to use it again is recognised. ErrTokenReused is returned if the
+// token has already been rotated.
+func (m TokenModel) Rotate(token *Token) error {
+
+	query := `UPDATE tokens
+			SET rotated_at = NOW()
+			WHERE hash = $1 AND rotated_at IS NULL`
+
+	ctx := context.Background()
+
+	result, err := m.DB.Exec(ctx, query, token.Hash)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return ErrTokenReused
+	}
+
+	token.Rotated = true
+	return nil
+}
+
+// DeleteFamily revokes every token in a refresh token family.
+func (m TokenModel) DeleteFamily(family []byte) error {
+
+	query := `DELETE FROM tokens
+			WHERE family = $1`
+
+	ctx := context.Background()
+
+	_, err := m.DB.Exec(ctx, query, family)
+	return err
+}
+
+// UpdateExpiry sets a new expiry time on the token.
+func (m TokenModel) UpdateExpiry(token *Token, expiry time.Time) error {
+
+	query := `UPDATE tokens
+			SET expiry = $1
+			WHERE hash = $2`
+
+	ctx := context.Background()
+
+	result, err := m.DB.Exec(ctx, query, expiry, token.Hash)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	token.Expiry = expiry
+	return nil
+}
+
+// GetAll returns a page of the tokens matching the filter. Only metadata is loaded;
+// the hash is never selected.
+func (m TokenModel) GetAll(filter TokenFilter, filters Filters) ([]*Token, Metadata, error) {
+
+	var w whereClause
+	if filter.Scope != "" {
+		w.equal("scope", filter.Scope)
+	}
+	if filter.UserID != 0 {
+		w.equal("user_id", filter.UserID)
+	}
+	if filter.Expired != nil {
+		if *filter.Expired {
+			w.where("expiry <= ?", time.Now())
+		} else {
+			w.where("expiry > ?", time.Now())
+		}
+	}
+	var after, before interface{}
+	if filter.ExpiresAfter != nil {
+		after = *filter.ExpiresAfter
+	}
+	if filter.ExpiresBefore != nil {
+		before = *filter.ExpiresBefore
+	}
+	w.between("expiry", after, before)
+
+	where := w.String()
+	limit, offset := w.param(filters.limit()), w.param(filters.offset())
+
+	query := fmt.Sprintf(`SELECT count(*) OVER(), user_id, expiry, scope, created_at, ip, user_agent, COALESCE(impersonator_id, 0)
+						FROM tokens
+						%s
+						ORDER BY %s %s, hash ASC
+						LIMIT %s OFFSET %s`, where, filters.sortColumn(), filters.sortDirection(), limit, offset)
+
+	ctx := context.Background()
+
+	rows, err := m.DB.Query(ctx, query, w.args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	tokens := []*Token{}
+
+	for rows.Next() {
+		var token Token
+		err := rows.Scan(
+			&totalRecords,
+			&token.UserID,
+			&token.Expiry,
+			&token.Scope,
+			&token.CreatedAt,
+			&token.IP,
+			&token.UserAgent,
+			&token.ImpersonatorID,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		tokens = append(tokens, &token)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return tokens, metadata, nil
+}
+
+// GetAllForUser returns the user's unexpired, unrotated tokens in the given scope, or in
+// every scope if scope is empty. Only metadata is loaded; the hash is never selected.
+func (m TokenModel) GetAllForUser(scope string, userID int64) ([]*Token, error) {
+
+	query := `SELECT user_id, expiry, scope, created_at, ip, user_agent, COALESCE(impersonator_id, 0)
+			FROM tokens
+			WHERE user_id = $1
+			AND (scope = $2 OR $2 = '')
+			AND expiry > $3
+			AND rotated_at IS NULL
+			ORDER BY created_at DESC`
+
+	ctx := context.Background()
+
+	rows, err := m.DB.Query(ctx, query, userID, scope, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []*Token{}
+	for rows.Next() {
+		var token Token
+		err := rows.Scan(
+			&token.UserID,
+			&token.Expiry,
+			&token.Scope,
+			&token.CreatedAt,
+			&token.IP,
+			&token.UserAgent,
+			&token.ImpersonatorID,
+		)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, &token)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
 func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
 
 	query := `DELETE FROM tokens
 			WHERE scope = $1 AND user_id = $2`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+	ctx := context.Background()
 
 	_, err := m.DB.Exec(ctx, query, scope, userID)
 	return err
 }
+
+// Delete deletes the token.
+func (m TokenModel) Delete(token *Token) error {
+
+	query := `DELETE FROM tokens
+			WHERE hash = $1`
+
+	ctx := context.Background()
+
+	_, err := m.DB.Exec(ctx, query, token.Hash)
+	return err
+}
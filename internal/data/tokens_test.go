@@ -0,0 +1,92 @@
+package data
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// execDB is a DBTX which accepts every Exec, for tests of models which only write.
+type execDB struct{}
+
+func (execDB) Exec(ctx context.Context, sql string, arguments ...interface{}) (pgconn.CommandTag, error) {
+	return pgconn.NewCommandTag("INSERT 0 1"), nil
+}
+
+func (execDB) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+	panic("unexpected query")
+}
+
+func (execDB) QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+	panic("unexpected query")
+}
+
+// setScopeTTLs sets the lifetimes of the scopes for the duration of the test.
+func setScopeTTLs(t *testing.T, ttls map[string]time.Duration) {
+	t.Helper()
+
+	for scope, ttl := range ttls {
+		previous := ScopeTTL(scope)
+		err := SetScopeTTL(scope, ttl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { SetScopeTTL(scope, previous) })
+	}
+}
+
+func checkExpiry(t *testing.T, scope string, token *Token, ttl time.Duration, before, after time.Time) {
+	t.Helper()
+
+	if token.Expiry.Before(before.Add(ttl)) || token.Expiry.After(after.Add(ttl)) {
+		t.Errorf("%s token expires at %s; want %s after it was issued, at %s", scope, token.Expiry, ttl, before)
+	}
+}
+
+func TestNewForScopeExpiry(t *testing.T) {
+	// Each scope gets a lifetime unlike the defaults and the other scopes.
+	ttls := map[string]time.Duration{}
+	for i, scope := range Scopes() {
+		ttls[scope] = time.Duration(i+1) * 7 * time.Minute
+	}
+	setScopeTTLs(t, ttls)
+
+	m := TokenModel{DB: execDB{}}
+	for scope, ttl := range ttls {
+		before := time.Now()
+		token, err := m.NewForScope(42, scope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkExpiry(t, scope, token, ttl, before, time.Now())
+
+		if token.Scope != scope || token.UserID != 42 {
+			t.Errorf("got a %s token for user %d; want a %s token for user 42", token.Scope, token.UserID, scope)
+		}
+	}
+
+	before := time.Now()
+	access, refresh, err := m.NewRefreshPair(42, nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkExpiry(t, ScopeAuthentication, access, ttls[ScopeAuthentication], before, time.Now())
+	checkExpiry(t, ScopeRefresh, refresh, ttls[ScopeRefresh], before, time.Now())
+
+	before = time.Now()
+	emailChange, err := m.NewEmailChange(42, "new@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkExpiry(t, ScopeEmailChange, emailChange, ttls[ScopeEmailChange], before, time.Now())
+}
+
+func TestSetScopeTTLUnknownScope(t *testing.T) {
+	err := SetScopeTTL("no-such-scope", time.Hour)
+	if err != ErrUnknownScope {
+		t.Errorf("got error %v; want %v", err, ErrUnknownScope)
+	}
+}
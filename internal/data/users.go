@@ -3,12 +3,12 @@ package data
 import (
 	"context"
 	"crypto/sha256"
+	"encoding/json"
 	"errors"
+	"strings"
 	"time"
 
-	"github.com/alexedwards/argon2id"
 	"github.com/jackc/pgx/v5"
-	"github.com/jackc/pgx/v5/pgxpool"
 	"greenlight.yp2743.me/internal/validator"
 )
 
@@ -22,11 +22,31 @@ var (
 type User struct {
 	ID        int64     `json:"id"`
 	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
 	Name      string    `json:"name"`
 	Email     string    `json:"email"`
-	Password  string    `json:"-"`
-	Activated bool      `json:"activated"`
-	Version   int       `json:"-"`
+	// Password holds a new plaintext password to be hashed by Insert or Update, and
+	// PasswordHash the hash as stored in the database.
+	Password     string `json:"-" sensitive:"true"`
+	PasswordHash string `json:"-" sensitive:"true"`
+	Activated    bool   `json:"activated"`
+	// DeactivatedAt is set while the user has deactivated their account, which also
+	// leaves it unactivated.
+	DeactivatedAt *time.Time `json:"deactivated_at,omitempty"`
+	Version       int        `json:"version"`
+
+	// ImpersonatorID is set when the user was loaded via an impersonation token, and
+	// holds the ID of the admin acting as them.
+	ImpersonatorID int64 `json:"-"`
+}
+
+// MarshalJSON renders the ID via the ID type, so that it honours StringifyIDs.
+func (u User) MarshalJSON() ([]byte, error) {
+	type userFields User
+	return json.Marshal(struct {
+		ID ID `json:"id"`
+		userFields
+	}{ID(u.ID), userFields(u)})
 }
 
 func (u *User) IsAnonymous() bool {
@@ -38,12 +58,49 @@ func ValidateEmail(v *validator.Validator, email string) {
 	v.Check(validator.Matches(email, validator.EmailRX), "email", "must be a valid email address")
 }
 
+// ReservedEmails lists the addresses which can't be registered. An entry ending in "@",
+// such as "postmaster@", reserves that local part on every domain; any other entry is
+// an exact address. Matching ignores case.
+var ReservedEmails = []string{"admin@", "administrator@", "postmaster@", "hostmaster@", "webmaster@", "abuse@", "noreply@", "no-reply@"}
+
+// IsReservedEmail reports whether email matches one of the ReservedEmails.
+func IsReservedEmail(email string) bool {
+	at := strings.LastIndex(email, "@")
+	for _, reserved := range ReservedEmails {
+		if strings.HasSuffix(reserved, "@") {
+			if at >= 0 && strings.EqualFold(email[:at+1], reserved) {
+				return true
+			}
+		} else if strings.EqualFold(email, reserved) {
+			return true
+		}
+	}
+	return false
+}
+
+func ValidateEmailNotReserved(v *validator.Validator, email string) {
+	v.Check(!IsReservedEmail(email), "email", "is a reserved address and can't be registered")
+}
+
 func ValidatePasswordPlaintext(v *validator.Validator, password string) {
 	v.Check(password != "", "password", "must be provided")
 	v.Check(len(password) >= 8, "password", "must be at least 8 characters long")
 	v.Check(len(password) <= 72, "password", "must not be more than 72 characters long")
 }
 
+// ValidateImportedUser validates a user imported from another system, who has either
+// a password hash produced by a supported hasher or no password at all.
+func ValidateImportedUser(v *validator.Validator, user *User, passwords Passwords) {
+	v.Check(user.Name != "", "name", "must be provided")
+	v.Check(len(user.Name) <= 500, "name", "must not be more than 500 characters long")
+
+	ValidateEmail(v, user.Email)
+
+	if user.PasswordHash != "" {
+		v.Check(passwords.Recognizes(user.PasswordHash), "password_hash", "must be a supported password hash")
+	}
+}
+
 func ValidateUser(v *validator.Validator, user *User) {
 	v.Check(user.Name != "", "name", "must be provided")
 	v.Check(len(user.Name) <= 500, "name", "must not be more than 500 characters long")
@@ -54,25 +111,58 @@ func ValidateUser(v *validator.Validator, user *User) {
 }
 
 type UserModel struct {
-	DB *pgxpool.Pool
+	DB        DBTX
+	Passwords Passwords
+}
+
+// PasswordMatches checks plaintext against the user's stored hash, and reports whether
+// the hash was produced by an outdated algorithm and should be upgraded.
+func (m UserModel) PasswordMatches(user *User, plaintext string) (match bool, needsRehash bool, err error) {
+	return m.Passwords.Matches(plaintext, user.PasswordHash)
+}
+
+// UpdatePasswordHash re-hashes plaintext with the current algorithm and stores it,
+// without bumping the user's version since the password itself hasn't changed.
+func (m UserModel) UpdatePasswordHash(user *User, plaintext string) error {
+
+	hash, err := m.Passwords.Hash(plaintext)
+	if err != nil {
+		return err
+	}
+
+	query := `UPDATE users
+			SET password_hash = $1
+			WHERE id = $2 AND password_hash = $3`
+
+	ctx := context.Background()
+
+	_, err = m.DB.Exec(ctx, query, hash, user.ID, user.PasswordHash)
+	if err != nil {
+		return err
+	}
+	user.PasswordHash = hash
+	return nil
 }
 
 func (m UserModel) Insert(user *User) error {
 
 	query := `INSERT INTO users (name, email, password_hash, activated)
 			VALUES ($1, $2, $3, $4)
-			RETURNING id, created_at, version`
+			RETURNING id, created_at, updated_at, version`
 
-	hashedPassword, err := argon2id.CreateHash(user.Password, argon2id.DefaultParams)
-	if err != nil {
-		return err
+	// A user imported from another system may arrive with only a password hash.
+	if user.Password != "" {
+		hashedPassword, err := m.Passwords.Hash(user.Password)
+		if err != nil {
+			return err
+		}
+		user.PasswordHash = hashedPassword
 	}
 
-	args := []interface{}{user.Name, user.Email, hashedPassword, user.Activated}
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+	args := []interface{}{user.Name, user.Email, user.PasswordHash, user.Activated}
+	ctx := context.Background()
 
-	err = m.DB.QueryRow(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
+	err := m.DB.QueryRow(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.UpdatedAt, &user.Version)
 	if err != nil {
 		switch {
 		case err.Error() == ErrDuplicateEmailMessage:
@@ -84,23 +174,76 @@ func (m UserModel) Insert(user *User) error {
 	return nil
 }
 
+// bootstrapLockKey identifies the advisory lock taken by NoUsersLocked.
+const bootstrapLockKey = 7_386_269
+
+// NoUsersLocked reports whether the users table is empty. It must be called in a
+// transaction, as it takes an advisory lock until the transaction ends so that two
+// concurrent callers can't both see an empty table.
+func (m UserModel) NoUsersLocked() (bool, error) {
+
+	ctx := context.Background()
+
+	_, err := m.DB.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, bootstrapLockKey)
+	if err != nil {
+		return false, err
+	}
+
+	var empty bool
+	err = m.DB.QueryRow(ctx, `SELECT NOT EXISTS (SELECT 1 FROM users)`).Scan(&empty)
+	return empty, err
+}
+
+func (m UserModel) Get(id int64) (*User, error) {
+
+	query := `SELECT id, created_at, updated_at, name, email, password_hash, activated, deactivated_at, version
+			FROM users
+			WHERE id = $1`
+
+	var user User
+	ctx := context.Background()
+
+	err := m.DB.QueryRow(ctx, query, id).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.UpdatedAt,
+		&user.Name,
+		&user.Email,
+		&user.PasswordHash,
+		&user.Activated,
+		&user.DeactivatedAt,
+		&user.Version,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &user, nil
+}
+
 func (m UserModel) GetByEmail(email string) (*User, error) {
 
-	query := `SELECT id, created_at, name, email, password_hash, activated, version
+	query := `SELECT id, created_at, updated_at, name, email, password_hash, activated, deactivated_at, version
 			FROM users
 			WHERE email = $1`
 
 	var user User
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+	ctx := context.Background()
 
 	err := m.DB.QueryRow(ctx, query, email).Scan(
 		&user.ID,
 		&user.CreatedAt,
+		&user.UpdatedAt,
 		&user.Name,
 		&user.Email,
-		&user.Password,
+		&user.PasswordHash,
 		&user.Activated,
+		&user.DeactivatedAt,
 		&user.Version,
 	)
 
@@ -118,28 +261,32 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 func (m UserModel) Update(user *User) error {
 
 	query := `UPDATE users
-			SET name = $1, email = $2, password_hash = $3, activated = $4, version = version + 1
-			WHERE id = $5 AND version = $6
-			RETURNING version`
-
-	hashedPassword, err := argon2id.CreateHash(user.Password, argon2id.DefaultParams)
-	if err != nil {
-		return err
+			SET name = $1, email = $2, password_hash = $3, activated = $4, deactivated_at = $5, updated_at = NOW(), version = version + 1
+			WHERE id = $6 AND version = $7
+			RETURNING updated_at, version`
+
+	// Only hash the password when a new one has been set.
+	if user.Password != "" {
+		hashedPassword, err := m.Passwords.Hash(user.Password)
+		if err != nil {
+			return err
+		}
+		user.PasswordHash = hashedPassword
 	}
 
 	args := []interface{}{
 		user.Name,
 		user.Email,
-		hashedPassword,
+		user.PasswordHash,
 		user.Activated,
+		user.DeactivatedAt,
 		user.ID,
 		user.Version,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+	ctx := context.Background()
 
-	err = m.DB.QueryRow(ctx, query, args...).Scan(&user.Version)
+	err := m.DB.QueryRow(ctx, query, args...).Scan(&user.UpdatedAt, &user.Version)
 	if err != nil {
 		switch {
 		case err.Error() == ErrDuplicateEmailMessage:
@@ -157,7 +304,8 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 
 	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
 
-	query := `SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version
+	query := `SELECT users.id, users.created_at, users.updated_at, users.name, users.email, users.password_hash, users.activated, users.deactivated_at, users.version,
+				COALESCE(tokens.impersonator_id, 0)
 			FROM users
 			INNER JOIN tokens
 			ON users.id = tokens.user_id
@@ -167,17 +315,19 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 
 	args := []interface{}{tokenHash[:], tokenScope, time.Now()}
 	var user User
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+	ctx := context.Background()
 
 	err := m.DB.QueryRow(ctx, query, args...).Scan(
 		&user.ID,
 		&user.CreatedAt,
+		&user.UpdatedAt,
 		&user.Name,
 		&user.Email,
-		&user.Password,
+		&user.PasswordHash,
 		&user.Activated,
+		&user.DeactivatedAt,
 		&user.Version,
+		&user.ImpersonatorID,
 	)
 	if err != nil {
 		switch {
@@ -190,3 +340,123 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 
 	return &user, nil
 }
+
+// GetByIDs returns the users with the given IDs, keyed by ID. IDs which don't match a
+// user are simply absent from the result.
+func (m UserModel) GetByIDs(ids []int64) (map[int64]*User, error) {
+
+	query := `SELECT id, created_at, updated_at, name, email, password_hash, activated, deactivated_at, version
+			FROM users
+			WHERE id = ANY($1)`
+
+	ctx := context.Background()
+
+	rows, err := m.DB.Query(ctx, query, ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := make(map[int64]*User, len(ids))
+	for rows.Next() {
+		var user User
+		err := rows.Scan(
+			&user.ID,
+			&user.CreatedAt,
+			&user.UpdatedAt,
+			&user.Name,
+			&user.Email,
+			&user.PasswordHash,
+			&user.Activated,
+			&user.DeactivatedAt,
+			&user.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+		users[user.ID] = &user
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// GetUnactivated returns up to limit users who haven't activated their account, oldest
+// first. Users who deactivated their account aren't included.
+func (m UserModel) GetUnactivated(limit int) ([]*User, error) {
+
+	query := `SELECT id, created_at, updated_at, name, email, password_hash, activated, deactivated_at, version
+			FROM users
+			WHERE NOT activated AND deactivated_at IS NULL
+			ORDER BY id
+			LIMIT $1`
+
+	ctx := context.Background()
+
+	rows, err := m.DB.Query(ctx, query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []*User{}
+	for rows.Next() {
+		var user User
+		err := rows.Scan(
+			&user.ID,
+			&user.CreatedAt,
+			&user.UpdatedAt,
+			&user.Name,
+			&user.Email,
+			&user.PasswordHash,
+			&user.Activated,
+			&user.DeactivatedAt,
+			&user.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, &user)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// GetExistingEmails returns which of the given email addresses already belong to a
+// user, keyed in lower case.
+func (m UserModel) GetExistingEmails(emails []string) (map[string]bool, error) {
+
+	query := `SELECT email
+			FROM users
+			WHERE lower(email) = ANY($1)`
+
+	lowered := make([]string, len(emails))
+	for i, email := range emails {
+		lowered[i] = strings.ToLower(email)
+	}
+
+	ctx := context.Background()
+
+	rows, err := m.DB.Query(ctx, query, lowered)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	existing := make(map[string]bool, len(emails))
+	for rows.Next() {
+		var email string
+		err := rows.Scan(&email)
+		if err != nil {
+			return nil, err
+		}
+		existing[strings.ToLower(email)] = true
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return existing, nil
+}
@@ -0,0 +1,47 @@
+package data
+
+import (
+	"testing"
+
+	"greenlight.yp2743.me/internal/validator"
+)
+
+func TestIsReservedEmail(t *testing.T) {
+	previous := ReservedEmails
+	ReservedEmails = []string{"admin@", "noreply@", "security@example.com"}
+	t.Cleanup(func() { ReservedEmails = previous })
+
+	tests := []struct {
+		email string
+		want  bool
+	}{
+		// Local parts are reserved at every domain, whatever the case.
+		{"admin@example.com", true},
+		{"ADMIN@example.org", true},
+		{"NoReply@example.com", true},
+		// Full addresses are reserved only at their domain.
+		{"security@example.com", true},
+		{"Security@Example.com", true},
+		{"security@example.org", false},
+		// Addresses merely containing a reserved part are allowed.
+		{"admin.alice@example.com", false},
+		{"alice@admin.example.com", false},
+		{"sysadmin@example.com", false},
+		{"alice@example.com", false},
+	}
+
+	for _, tt := range tests {
+		if got := IsReservedEmail(tt.email); got != tt.want {
+			t.Errorf("%s: got %t; want %t", tt.email, got, tt.want)
+		}
+
+		v := validator.New()
+		ValidateEmailNotReserved(v, tt.email)
+		if v.Valid() == tt.want {
+			t.Errorf("%s: got errors %v", tt.email, v.Errors)
+		}
+		if tt.want && v.Errors["email"] != "is a reserved address and can't be registered" {
+			t.Errorf("%s: got message %q", tt.email, v.Errors["email"])
+		}
+	}
+}
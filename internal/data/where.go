@@ -0,0 +1,62 @@
+package data
+
+import (
+	"fmt"
+	"strings"
+)
+
+// whereClause composes a WHERE clause from optional filters. Column names and
+// conditions come from code, while every value is passed as a bind parameter, so
+// filter values are never interpolated into the SQL.
+type whereClause struct {
+	conditions []string
+	args       []interface{}
+}
+
+// param records a bind parameter and returns its placeholder.
+func (w *whereClause) param(value interface{}) string {
+	w.args = append(w.args, value)
+	return fmt.Sprintf("$%d", len(w.args))
+}
+
+// where adds a condition in which each "?" is replaced by a placeholder for the
+// corresponding value.
+func (w *whereClause) where(condition string, values ...interface{}) {
+	for _, value := range values {
+		condition = strings.Replace(condition, "?", w.param(value), 1)
+	}
+	w.conditions = append(w.conditions, condition)
+}
+
+func (w *whereClause) equal(column string, value interface{}) {
+	w.where(column+" = ?", value)
+}
+
+// between matches rows where column lies within the inclusive range. A nil bound
+// leaves that end of the range open.
+func (w *whereClause) between(column string, from, to interface{}) {
+	if from != nil {
+		w.where(column+" >= ?", from)
+	}
+	if to != nil {
+		w.where(column+" <= ?", to)
+	}
+}
+
+// contains matches rows where the array column contains all the values.
+func (w *whereClause) contains(column string, values []string) {
+	w.where(column+" @> ?", values)
+}
+
+// overlaps matches rows where the array column contains any of the values.
+func (w *whereClause) overlaps(column string, values []string) {
+	w.where(column+" && ?", values)
+}
+
+// String returns the WHERE clause, or an empty string if there are no conditions.
+func (w *whereClause) String() string {
+	if len(w.conditions) == 0 {
+		return ""
+	}
+	return "WHERE " + strings.Join(w.conditions, " AND ")
+}
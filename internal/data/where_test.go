@@ -0,0 +1,100 @@
+package data
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestWhereClause(t *testing.T) {
+	tests := []struct {
+		name     string
+		build    func(w *whereClause)
+		wantSQL  string
+		wantArgs []interface{}
+	}{
+		{
+			name:     "no filters",
+			build:    func(w *whereClause) {},
+			wantSQL:  "",
+			wantArgs: nil,
+		},
+		{
+			name:     "equality",
+			build:    func(w *whereClause) { w.equal("year", int32(1999)) },
+			wantSQL:  "WHERE year = $1",
+			wantArgs: []interface{}{int32(1999)},
+		},
+		{
+			name:     "closed range",
+			build:    func(w *whereClause) { w.between("year", 1990, 1999) },
+			wantSQL:  "WHERE year >= $1 AND year <= $2",
+			wantArgs: []interface{}{1990, 1999},
+		},
+		{
+			name:     "open range",
+			build:    func(w *whereClause) { w.between("year", nil, 1999) },
+			wantSQL:  "WHERE year <= $1",
+			wantArgs: []interface{}{1999},
+		},
+		{
+			name: "arrays",
+			build: func(w *whereClause) {
+				w.contains("genres", []string{"drama"})
+				w.overlaps("genres", []string{"comedy", "horror"})
+			},
+			wantSQL:  "WHERE genres @> $1 AND genres && $2",
+			wantArgs: []interface{}{[]string{"drama"}, []string{"comedy", "horror"}},
+		},
+		{
+			name: "multi-value condition",
+			build: func(w *whereClause) {
+				w.equal("year", 2000)
+				w.where("(rank > ? OR (rank = ? AND id > ?))", 0.5, 0.5, int64(7))
+			},
+			wantSQL:  "WHERE year = $1 AND (rank > $2 OR (rank = $3 AND id > $4))",
+			wantArgs: []interface{}{2000, 0.5, 0.5, int64(7)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var w whereClause
+			tt.build(&w)
+
+			if got := w.String(); got != tt.wantSQL {
+				t.Errorf("got SQL %q; want %q", got, tt.wantSQL)
+			}
+			if !reflect.DeepEqual(w.args, tt.wantArgs) {
+				t.Errorf("got args %#v; want %#v", w.args, tt.wantArgs)
+			}
+		})
+	}
+}
+
+func TestWhereClauseNeverInterpolatesValues(t *testing.T) {
+	hostile := []string{
+		"'; DROP TABLE movies; --",
+		`" OR 1=1 --`,
+		"$1",
+		"?",
+	}
+
+	for _, value := range hostile {
+		var w whereClause
+		w.equal("title", value)
+		w.contains("genres", []string{value})
+		w.between("year", value, value)
+
+		sql := w.String()
+		if strings.Contains(sql, value) && value != "$1" {
+			t.Errorf("SQL %q contains the value %q", sql, value)
+		}
+		if want := "WHERE title = $1 AND genres @> $2 AND year >= $3 AND year <= $4"; sql != want {
+			t.Errorf("got SQL %q for value %q; want %q", sql, value, want)
+		}
+		if len(w.args) != 4 {
+			t.Errorf("got %d args for value %q; want 4", len(w.args), value)
+		}
+	}
+}
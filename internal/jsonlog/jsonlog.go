@@ -2,9 +2,11 @@ package jsonlog
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
 	"os"
 	"runtime/debug"
+	"strings"
 	"sync"
 	"time"
 )
@@ -32,6 +34,23 @@ func (l Level) String() string {
 	}
 }
 
+// ParseLevel returns the level with the given name, as accepted in configuration:
+// "info", "error", "fatal" or "off".
+func ParseLevel(name string) (Level, error) {
+	switch strings.ToLower(name) {
+	case "info":
+		return LevelInfo, nil
+	case "error":
+		return LevelError, nil
+	case "fatal":
+		return LevelFatal, nil
+	case "off":
+		return LevelOff, nil
+	default:
+		return 0, fmt.Errorf("unknown log level %q", name)
+	}
+}
+
 type Logger struct {
 	out      io.Writer
 	minLevel Level
@@ -45,6 +64,12 @@ func New(out io.Writer, minLevel Level) *Logger {
 	}
 }
 
+// SetMinLevel changes the minimum level of entries written. It must be called before
+// the logger is shared between goroutines.
+func (l *Logger) SetMinLevel(minLevel Level) {
+	l.minLevel = minLevel
+}
+
 func (l *Logger) PrintInfo(message string, properties map[string]string) {
 	l.print(LevelInfo, message, properties)
 }
@@ -0,0 +1,113 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// DefaultHTTPEndpoint is SendGrid's v3 mail send endpoint.
+const DefaultHTTPEndpoint = "https://api.sendgrid.com/v3/mail/send"
+
+// HTTPMailer sends emails through an HTTP email API which accepts SendGrid's v3 mail
+// send request format, authenticating with a bearer API key.
+type HTTPMailer struct {
+	endpoint string
+	apiKey   string
+	sender   string
+	client   *http.Client
+}
+
+func NewHTTP(endpoint, apiKey, sender string) *HTTPMailer {
+	return &HTTPMailer{
+		endpoint: endpoint,
+		apiKey:   apiKey,
+		sender:   sender,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+type httpAddress struct {
+	Email string `json:"email"`
+}
+
+type httpContent struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type httpPersonalization struct {
+	To []httpAddress `json:"to"`
+}
+
+type httpMessage struct {
+	Personalizations []httpPersonalization `json:"personalizations"`
+	From             httpAddress           `json:"from"`
+	Subject          string                `json:"subject"`
+	Content          []httpContent         `json:"content"`
+}
+
+func (m *HTTPMailer) Send(recipient, templateFile string, data interface{}) error {
+	return send(templateFile, data, func(rendered *message) error {
+		body, err := json.Marshal(httpMessage{
+			Personalizations: []httpPersonalization{{To: []httpAddress{{Email: recipient}}}},
+			From:             httpAddress{Email: m.sender},
+			Subject:          rendered.subject,
+			Content: []httpContent{
+				{Type: "text/plain", Value: rendered.plainBody},
+				{Type: "text/html", Value: rendered.htmlBody},
+			},
+		})
+		if err != nil {
+			return err
+		}
+
+		req, err := http.NewRequest(http.MethodPost, m.endpoint, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+m.apiKey)
+		req.Header.Set("Content-Type", "application/json")
+
+		res, err := m.client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+
+		if res.StatusCode < 200 || res.StatusCode > 299 {
+			detail, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+			return fmt.Errorf("mailer: %s responded %s: %s", m.endpoint, res.Status, bytes.TrimSpace(detail))
+		}
+		return nil
+	})
+}
+
+// Ping checks that the API's host accepts TCP connections.
+func (m *HTTPMailer) Ping(ctx context.Context) error {
+	u, err := url.Parse(m.endpoint)
+	if err != nil {
+		return err
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = "443"
+		if u.Scheme == "http" {
+			port = "80"
+		}
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(u.Hostname(), port))
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
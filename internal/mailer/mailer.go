@@ -2,65 +2,87 @@ package mailer
 
 import (
 	"bytes"
+	"context"
 	"embed"
+	"expvar"
 	"html/template"
 	"time"
-
-	"github.com/go-mail/mail/v2"
 )
 
 //go:embed "templates"
 var templateFS embed.FS
 
-type Mailer struct {
-	dialer *mail.Dialer
-	sender string
-}
+// Email metrics, published via expvar and keyed by template file.
+var (
+	totalEmailsSent           = expvar.NewMap("total_emails_sent_by_template")
+	totalEmailsFailed         = expvar.NewMap("total_emails_failed_by_template")
+	totalSendTimeMicroseconds = expvar.NewMap("total_email_send_time_μs_by_template")
+)
 
-func New(host string, port int, username, password, sender string) Mailer {
-	dialer := mail.NewDialer(host, port, username, password)
-	dialer.Timeout = 5 * time.Second
+// Mailer sends templated emails. Implementations deliver via SMTP, an HTTP email API,
+// or not at all.
+type Mailer interface {
+	// Send renders the template with the data and delivers the email.
+	Send(recipient, templateFile string, data interface{}) error
+	// Ping checks that the mailer can reach its provider.
+	Ping(ctx context.Context) error
+}
 
-	return Mailer{
-		dialer: dialer,
-		sender: sender,
-	}
+// A message is a rendered email.
+type message struct {
+	subject   string
+	plainBody string
+	htmlBody  string
 }
 
-func (m Mailer) Send(recipient, templateFile string, data interface{}) error {
-	// Use the ParseFS() method to parse the required template file from the embedded
-	// file system.
+// render parses the template file from the embedded file system and executes its
+// subject, plainBody and htmlBody templates.
+func render(templateFile string, data interface{}) (*message, error) {
 	tmpl, err := template.New("email").ParseFS(templateFS, "templates/"+templateFile)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	subject := new(bytes.Buffer)
 	err = tmpl.ExecuteTemplate(subject, "subject", data)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	plainBody := new(bytes.Buffer)
 	err = tmpl.ExecuteTemplate(plainBody, "plainBody", data)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	htmlBody := new(bytes.Buffer)
 	err = tmpl.ExecuteTemplate(htmlBody, "htmlBody", data)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	msg := mail.NewMessage()
-	msg.SetHeader("To", recipient)
-	msg.SetHeader("From", m.sender)
-	msg.SetHeader("Subject", subject.String())
-	msg.SetBody("text/plain", plainBody.String())
-	msg.AddAlternative("text/html", htmlBody.String())
+	return &message{
+		subject:   subject.String(),
+		plainBody: plainBody.String(),
+		htmlBody:  htmlBody.String(),
+	}, nil
+}
+
+// send renders the template and passes the message to deliver, recording the outcome
+// and the time taken in the email metrics.
+func send(templateFile string, data interface{}, deliver func(*message) error) error {
+	start := time.Now()
+	err := func() error {
+		msg, err := render(templateFile, data)
+		if err != nil {
+			return err
+		}
+		return deliver(msg)
+	}()
+	totalSendTimeMicroseconds.Add(templateFile, time.Since(start).Microseconds())
 
-	err = m.dialer.DialAndSend(msg)
 	if err != nil {
+		totalEmailsFailed.Add(templateFile, 1)
 		return err
 	}
+	totalEmailsSent.Add(templateFile, 1)
 	return nil
 }
@@ -0,0 +1,47 @@
+package mailer
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderTokenExpiry(t *testing.T) {
+	tests := []struct {
+		template string
+		fallback string
+	}{
+		{"user_welcome.html", "expire in 3 days"},
+		{"token_password_reset.html", "expire in 45 minutes"},
+		{"token_email_change.html", "expire in 24 hours"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.template, func(t *testing.T) {
+			data := map[string]interface{}{"userID": 1}
+
+			// Messages queued before the expiry was added to their data still read
+			// sensibly.
+			msg, err := render(tt.template, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, body := range []string{msg.plainBody, msg.htmlBody} {
+				if !strings.Contains(strings.Join(strings.Fields(body), " "), tt.fallback) {
+					t.Errorf("body without an expiry doesn't contain %q:\n%s", tt.fallback, body)
+				}
+			}
+
+			data["tokenExpiry"] = "Thu, 15 Oct 2026 12:00:00 UTC"
+			msg, err = render(tt.template, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, body := range []string{msg.plainBody, msg.htmlBody} {
+				want := "expire at Thu, 15 Oct 2026 12:00:00 UTC"
+				if !strings.Contains(strings.Join(strings.Fields(body), " "), want) {
+					t.Errorf("body doesn't contain %q:\n%s", want, body)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,16 @@
+package mailer
+
+import "context"
+
+// NoopMailer renders emails but discards them, so that template errors still surface.
+// It's meant for tests and for local development without a mail provider.
+type NoopMailer struct{}
+
+func (NoopMailer) Send(recipient, templateFile string, data interface{}) error {
+	_, err := render(templateFile, data)
+	return err
+}
+
+func (NoopMailer) Ping(ctx context.Context) error {
+	return nil
+}
@@ -0,0 +1,115 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/go-mail/mail/v2"
+	"greenlight.yp2743.me/internal/jsonlog"
+)
+
+// SMTPServer holds the connection details for one SMTP provider.
+type SMTPServer struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+}
+
+// A transport delivers fully-formed messages. It's satisfied by *mail.Dialer, and
+// exists so that the failover logic doesn't depend on a real SMTP server.
+type transport interface {
+	DialAndSend(m ...*mail.Message) error
+}
+
+type provider struct {
+	name      string
+	transport transport
+}
+
+// SMTPMailer sends emails over SMTP, trying each configured provider in turn until one
+// succeeds.
+type SMTPMailer struct {
+	providers []provider
+	sender    string
+	logger    *jsonlog.Logger
+}
+
+func NewSMTP(logger *jsonlog.Logger, sender string, servers ...SMTPServer) *SMTPMailer {
+	providers := make([]provider, 0, len(servers))
+	for _, server := range servers {
+		dialer := mail.NewDialer(server.Host, server.Port, server.Username, server.Password)
+		dialer.Timeout = 5 * time.Second
+
+		providers = append(providers, provider{
+			name:      net.JoinHostPort(server.Host, strconv.Itoa(server.Port)),
+			transport: dialer,
+		})
+	}
+
+	return &SMTPMailer{
+		providers: providers,
+		sender:    sender,
+		logger:    logger,
+	}
+}
+
+// Ping checks that at least one of the providers accepts TCP connections.
+func (m *SMTPMailer) Ping(ctx context.Context) error {
+	if len(m.providers) == 0 {
+		return errors.New("no SMTP providers configured")
+	}
+
+	var errs []error
+	var dialer net.Dialer
+	for _, p := range m.providers {
+		conn, err := dialer.DialContext(ctx, "tcp", p.name)
+		if err == nil {
+			return conn.Close()
+		}
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+func (m *SMTPMailer) Send(recipient, templateFile string, data interface{}) error {
+	return send(templateFile, data, func(rendered *message) error {
+		msg := mail.NewMessage()
+		msg.SetHeader("To", recipient)
+		msg.SetHeader("From", m.sender)
+		msg.SetHeader("Subject", rendered.subject)
+		msg.SetBody("text/plain", rendered.plainBody)
+		msg.AddAlternative("text/html", rendered.htmlBody)
+
+		return m.deliver(msg)
+	})
+}
+
+// deliver tries each provider in order, failing over to the next one when a send
+// fails. It returns the errors from every provider if none of them succeed.
+func (m *SMTPMailer) deliver(msg *mail.Message) error {
+	if len(m.providers) == 0 {
+		return errors.New("mailer: no SMTP providers configured")
+	}
+
+	var errs []error
+	for i, p := range m.providers {
+		err := p.transport.DialAndSend(msg)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err)
+
+		if i < len(m.providers)-1 && m.logger != nil {
+			m.logger.PrintInfo("smtp provider failed, failing over", map[string]string{
+				"provider": p.name,
+				"next":     m.providers[i+1].name,
+				"error":    err.Error(),
+			})
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,265 @@
+// Package openapi builds OpenAPI 3.0 documents, deriving schemas from Go types by
+// their JSON struct tags so that the documented fields match what's encoded.
+package openapi
+
+import (
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+type Document struct {
+	OpenAPI    string                `json:"openapi"`
+	Info       Info                  `json:"info"`
+	Paths      map[string]PathItem   `json:"paths"`
+	Components Components            `json:"components"`
+	Security   []SecurityRequirement `json:"security,omitempty"`
+}
+
+type Info struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+// A PathItem holds the operations on a path, keyed by lower-case HTTP method.
+type PathItem map[string]*Operation
+
+type Operation struct {
+	Summary     string              `json:"summary"`
+	Description string              `json:"description,omitempty"`
+	Tags        []string            `json:"tags,omitempty"`
+	Parameters  []Parameter         `json:"parameters,omitempty"`
+	RequestBody *RequestBody        `json:"requestBody,omitempty"`
+	Responses   map[string]Response `json:"responses"`
+
+	// Security overrides the document's security requirements. A pointer to an empty
+	// slice marks an operation which needs no authentication.
+	Security *[]SecurityRequirement `json:"security,omitempty"`
+}
+
+type Parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+type RequestBody struct {
+	Required bool                 `json:"required,omitempty"`
+	Content  map[string]MediaType `json:"content"`
+}
+
+type Response struct {
+	Description string               `json:"description"`
+	Content     map[string]MediaType `json:"content,omitempty"`
+}
+
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+type Components struct {
+	Schemas         map[string]*Schema        `json:"schemas"`
+	SecuritySchemes map[string]SecurityScheme `json:"securitySchemes,omitempty"`
+}
+
+type SecurityScheme struct {
+	Type        string `json:"type"`
+	Scheme      string `json:"scheme,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+type SecurityRequirement map[string][]string
+
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Enum                 []string           `json:"enum,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+	OneOf                []*Schema          `json:"oneOf,omitempty"`
+}
+
+// Ref returns a schema referring to the named component schema.
+func Ref(name string) *Schema {
+	return &Schema{Ref: "#/components/schemas/" + name}
+}
+
+// JSON returns a request body or response content of application/json.
+func JSON(schema *Schema) map[string]MediaType {
+	return map[string]MediaType{"application/json": {Schema: schema}}
+}
+
+// Object returns an object schema with the given properties, all of them required.
+func Object(properties map[string]*Schema) *Schema {
+	schema := &Schema{Type: "object", Properties: properties}
+	for name := range properties {
+		schema.Required = append(schema.Required, name)
+	}
+	sort.Strings(schema.Required)
+	return schema
+}
+
+// Builder assembles a Document.
+type Builder struct {
+	doc       Document
+	overrides map[reflect.Type]*Schema
+}
+
+func New(title, version string) *Builder {
+	return &Builder{
+		doc: Document{
+			OpenAPI: "3.0.3",
+			Info:    Info{Title: title, Version: version},
+			Paths:   map[string]PathItem{},
+			Components: Components{
+				Schemas: map[string]*Schema{},
+			},
+		},
+		overrides: map[reflect.Type]*Schema{
+			reflect.TypeOf(time.Time{}): {Type: "string", Format: "date-time"},
+		},
+	}
+}
+
+// Override sets the schema used for values of v's type, for types whose JSON encoding
+// isn't described by their fields, such as those with a MarshalJSON method.
+func (b *Builder) Override(v interface{}, schema *Schema) {
+	b.overrides[reflect.TypeOf(v)] = schema
+}
+
+// BearerAuth requires a bearer token for every operation which doesn't override it.
+func (b *Builder) BearerAuth(name, description string) {
+	if b.doc.Components.SecuritySchemes == nil {
+		b.doc.Components.SecuritySchemes = map[string]SecurityScheme{}
+	}
+	b.doc.Components.SecuritySchemes[name] = SecurityScheme{Type: "http", Scheme: "bearer", Description: description}
+	b.doc.Security = []SecurityRequirement{{name: {}}}
+}
+
+// Component adds a schema derived from v to the document's components, and returns it
+// so that it can be adjusted.
+func (b *Builder) Component(name string, v interface{}) *Schema {
+	schema := b.SchemaOf(v)
+	b.doc.Components.Schemas[name] = schema
+	return schema
+}
+
+// AddComponent adds a schema to the document's components as is.
+func (b *Builder) AddComponent(name string, schema *Schema) {
+	b.doc.Components.Schemas[name] = schema
+}
+
+var pathParamRX = regexp.MustCompile(`:([A-Za-z_]+)`)
+
+// Add documents an operation. The path may use httprouter's :name parameters, which
+// are converted to {name} and documented as required integer path parameters unless
+// the operation already describes them.
+func (b *Builder) Add(method, path string, op *Operation) {
+	for _, match := range pathParamRX.FindAllStringSubmatch(path, -1) {
+		documented := false
+		for _, param := range op.Parameters {
+			if param.In == "path" && param.Name == match[1] {
+				documented = true
+			}
+		}
+		if !documented {
+			op.Parameters = append([]Parameter{{
+				Name:     match[1],
+				In:       "path",
+				Required: true,
+				Schema:   &Schema{Type: "integer", Format: "int64"},
+			}}, op.Parameters...)
+		}
+	}
+
+	path = pathParamRX.ReplaceAllString(path, "{$1}")
+	if b.doc.Paths[path] == nil {
+		b.doc.Paths[path] = PathItem{}
+	}
+	b.doc.Paths[path][strings.ToLower(method)] = op
+}
+
+func (b *Builder) Document() *Document {
+	return &b.doc
+}
+
+// SchemaOf derives a schema from v's type. Struct fields are named and omitted as
+// encoding/json would, and those not tagged omitempty are marked required, since
+// they're always present in an encoded value.
+func (b *Builder) SchemaOf(v interface{}) *Schema {
+	return b.schemaFor(reflect.TypeOf(v))
+}
+
+func (b *Builder) schemaFor(t reflect.Type) *Schema {
+	if schema, ok := b.overrides[t]; ok {
+		copied := *schema
+		return &copied
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return b.schemaFor(t.Elem())
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16:
+		return &Schema{Type: "integer", Format: "int32"}
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer", Format: "int64"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &Schema{Type: "string", Format: "byte"}
+		}
+		return &Schema{Type: "array", Items: b.schemaFor(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: b.schemaFor(t.Elem())}
+	case reflect.Struct:
+		schema := &Schema{Type: "object", Properties: map[string]*Schema{}}
+		b.addFields(schema, t)
+		sort.Strings(schema.Required)
+		return schema
+	}
+	// Interfaces may hold anything.
+	return &Schema{}
+}
+
+func (b *Builder) addFields(schema *Schema, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" || (!field.IsExported() && !field.Anonymous) {
+			continue
+		}
+
+		name, options, _ := strings.Cut(tag, ",")
+		if field.Anonymous && name == "" {
+			embedded := field.Type
+			if embedded.Kind() == reflect.Pointer {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				b.addFields(schema, embedded)
+				continue
+			}
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		schema.Properties[name] = b.schemaFor(field.Type)
+		if !strings.Contains(","+options+",", ",omitempty,") {
+			schema.Required = append(schema.Required, name)
+		}
+	}
+}
@@ -8,12 +8,18 @@ var (
 	EmailRX = regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+\\/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$")
 )
 
+// Validator collects hard errors, which cause input to be rejected, and warnings,
+// which flag input that is valid but suspicious without blocking the operation.
 type Validator struct {
-	Errors map[string]string
+	Errors   map[string]string
+	Warnings map[string]string
 }
 
 func New() *Validator {
-	return &Validator{Errors: make(map[string]string)}
+	return &Validator{
+		Errors:   make(map[string]string),
+		Warnings: make(map[string]string),
+	}
 }
 
 func (v *Validator) Valid() bool {
@@ -32,6 +38,18 @@ func (v *Validator) Check(ok bool, key, message string) {
 	}
 }
 
+func (v *Validator) AddWarning(key, message string) {
+	if _, exists := v.Warnings[key]; !exists {
+		v.Warnings[key] = message
+	}
+}
+
+func (v *Validator) CheckWarning(ok bool, key, message string) {
+	if !ok {
+		v.AddWarning(key, message)
+	}
+}
+
 func In(value string, list ...string) bool {
 	for i := range list {
 		if value == list[i] {
@@ -0,0 +1,2 @@
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS ip text NOT NULL DEFAULT '';
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS user_agent text NOT NULL DEFAULT '';
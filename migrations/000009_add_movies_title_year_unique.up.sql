@@ -0,0 +1,2 @@
+-- Required: PUT /v1/movies upserts on this key, which 000030 makes a partial index.
+ALTER TABLE movies ADD CONSTRAINT movies_title_year_key UNIQUE (title, year);
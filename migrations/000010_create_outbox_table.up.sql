@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS outbox (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    recipient text NOT NULL,
+    template text NOT NULL,
+    data jsonb NOT NULL,
+    attempts integer NOT NULL DEFAULT 0,
+    available_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    sent_at timestamp(0) with time zone
+);
+CREATE INDEX IF NOT EXISTS outbox_pending_idx ON outbox (id) WHERE sent_at IS NULL;
@@ -0,0 +1 @@
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS created_by bigint REFERENCES users ON DELETE SET NULL;
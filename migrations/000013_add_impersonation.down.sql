@@ -0,0 +1,2 @@
+ALTER TABLE tokens DROP COLUMN IF EXISTS impersonator_id;
+DROP TABLE IF EXISTS audit_log;
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS audit_log (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    actor_id bigint REFERENCES users ON DELETE SET NULL,
+    action text NOT NULL,
+    target_user_id bigint REFERENCES users ON DELETE SET NULL,
+    details jsonb NOT NULL DEFAULT '{}'
+);
+CREATE INDEX IF NOT EXISTS audit_log_actor_action_idx ON audit_log (actor_id, action, created_at);
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS impersonator_id bigint REFERENCES users ON DELETE CASCADE;
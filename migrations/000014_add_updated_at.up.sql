@@ -0,0 +1,5 @@
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW();
+UPDATE movies SET updated_at = created_at;
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW();
+UPDATE users SET updated_at = created_at;
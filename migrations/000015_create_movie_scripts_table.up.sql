@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS movie_scripts (
+    movie_id bigint PRIMARY KEY REFERENCES movies ON DELETE CASCADE,
+    script text NOT NULL DEFAULT '',
+    updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
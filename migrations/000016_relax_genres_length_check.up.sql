@@ -0,0 +1,4 @@
+-- The column only enforces data.MaxGenres, the ceiling for -max-genres. The configured
+-- limit, 5 by default, is enforced by validation.
+ALTER TABLE movies DROP CONSTRAINT IF EXISTS genres_length_check;
+ALTER TABLE movies ADD CONSTRAINT genres_length_check CHECK (array_length(genres, 1) BETWEEN 1 AND 100);
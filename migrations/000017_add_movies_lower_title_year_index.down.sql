@@ -0,0 +1 @@
+DROP INDEX IF EXISTS movies_lower_title_year_key;
@@ -0,0 +1,4 @@
+-- Forbids titles differing only in case within a year. This is part of the schema the
+-- API expects rather than an optional extra: rolling it back would also roll back every
+-- later migration.
+CREATE UNIQUE INDEX IF NOT EXISTS movies_lower_title_year_key ON movies (lower(title), year);
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS movie_events (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    movie_id bigint NOT NULL,
+    actor_id bigint REFERENCES users ON DELETE SET NULL,
+    action text NOT NULL,
+    changes jsonb NOT NULL DEFAULT '{}'
+);
+CREATE INDEX IF NOT EXISTS movie_events_movie_id_idx ON movie_events (movie_id, id);
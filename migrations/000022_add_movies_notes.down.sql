@@ -0,0 +1,2 @@
+DELETE FROM permissions WHERE code = 'movies:notes';
+ALTER TABLE movies DROP COLUMN IF EXISTS notes;
@@ -0,0 +1,3 @@
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS notes text NOT NULL DEFAULT '';
+INSERT INTO permissions (code)
+VALUES ('movies:notes');
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS movies_deleted_at_idx;
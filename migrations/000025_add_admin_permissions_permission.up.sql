@@ -0,0 +1,9 @@
+INSERT INTO permissions (code)
+VALUES ('admin:permissions');
+-- Existing admins keep being able to manage permissions.
+INSERT INTO users_permissions
+SELECT users_permissions.user_id, (SELECT id FROM permissions WHERE code = 'admin:permissions')
+FROM users_permissions
+INNER JOIN permissions ON users_permissions.permission_id = permissions.id
+WHERE permissions.code = 'admin'
+ON CONFLICT DO NOTHING;
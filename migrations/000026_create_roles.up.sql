@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS roles (
+    id bigserial PRIMARY KEY,
+    name text UNIQUE NOT NULL
+);
+CREATE TABLE IF NOT EXISTS roles_permissions (
+    role_id bigint NOT NULL REFERENCES roles ON DELETE CASCADE,
+    permission_id bigint NOT NULL REFERENCES permissions ON DELETE CASCADE,
+    PRIMARY KEY (role_id, permission_id)
+);
+-- Add the two roles that cover the movie permissions.
+INSERT INTO roles (name)
+VALUES
+    ('viewer'),
+    ('editor');
+INSERT INTO roles_permissions
+SELECT roles.id, permissions.id
+FROM roles, permissions
+WHERE (roles.name = 'viewer' AND permissions.code = 'movies:read')
+OR (roles.name = 'editor' AND permissions.code IN ('movies:read', 'movies:write'));
@@ -0,0 +1,2 @@
+ALTER TABLE outbox ADD COLUMN IF NOT EXISTS token jsonb;
+UPDATE outbox SET data = '{}' WHERE sent_at IS NOT NULL OR failed_at IS NOT NULL;
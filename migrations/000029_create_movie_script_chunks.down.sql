@@ -0,0 +1,9 @@
+ALTER TABLE movie_scripts ADD COLUMN IF NOT EXISTS script text NOT NULL DEFAULT '';
+UPDATE movie_scripts SET script = chunks.content
+FROM (
+    SELECT movie_id, string_agg(content, '' ORDER BY seq) AS content
+    FROM movie_script_chunks
+    GROUP BY movie_id
+) AS chunks
+WHERE movie_scripts.movie_id = chunks.movie_id;
+DROP TABLE IF EXISTS movie_script_chunks;
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS movie_script_chunks (
+    movie_id bigint NOT NULL REFERENCES movie_scripts ON DELETE CASCADE,
+    seq integer NOT NULL,
+    content text NOT NULL,
+    PRIMARY KEY (movie_id, seq)
+);
+INSERT INTO movie_script_chunks (movie_id, seq, content)
+SELECT movie_id, 0, script FROM movie_scripts WHERE script <> '';
+ALTER TABLE movie_scripts DROP COLUMN IF EXISTS script;
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS movies_lower_title_year_key;
+CREATE UNIQUE INDEX IF NOT EXISTS movies_lower_title_year_key ON movies (lower(title), year);
+DROP INDEX IF EXISTS movies_title_year_key;
+ALTER TABLE movies ADD CONSTRAINT movies_title_year_key UNIQUE (title, year);
@@ -0,0 +1,6 @@
+-- Soft-deleted movies no longer hold their natural key, so a movie can be created again
+-- under the title and year of a deleted one.
+ALTER TABLE movies DROP CONSTRAINT IF EXISTS movies_title_year_key;
+CREATE UNIQUE INDEX IF NOT EXISTS movies_title_year_key ON movies (title, year) WHERE deleted_at IS NULL;
+DROP INDEX IF EXISTS movies_lower_title_year_key;
+CREATE UNIQUE INDEX IF NOT EXISTS movies_lower_title_year_key ON movies (lower(title), year) WHERE deleted_at IS NULL;
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS ratings (
+    movie_id bigint NOT NULL REFERENCES movies ON DELETE CASCADE,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    rating smallint NOT NULL CHECK (rating BETWEEN 1 AND 5),
+    review text NOT NULL DEFAULT '',
+    PRIMARY KEY (movie_id, user_id)
+);
+CREATE INDEX IF NOT EXISTS ratings_user_id_idx ON ratings (user_id);
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS average_rating numeric(3, 2) NOT NULL DEFAULT 0;
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS review_count integer NOT NULL DEFAULT 0;
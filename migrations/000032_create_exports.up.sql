@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS exports (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    completed_at timestamp(0) with time zone,
+    expires_at timestamp(0) with time zone NOT NULL,
+    bundle jsonb
+);
+CREATE INDEX IF NOT EXISTS exports_user_id_idx ON exports (user_id);
+CREATE INDEX IF NOT EXISTS exports_expires_at_idx ON exports (expires_at);